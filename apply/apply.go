@@ -0,0 +1,139 @@
+// Package apply writes the objects this controller generates — a Service's
+// Ingress, Gateway, HTTPRoute and hostname mirror, a Pod's Service and
+// EndpointSlice — with server-side apply, as consts.FieldManager.
+//
+// Get, compare, Update was the old way, and it had two faults no amount of
+// care in the comparison could fix. An Update sends the whole object, so a
+// field another controller had filled in since the Get was written back as it
+// was read, or lost to a 409 and a retry. And the controller could not tell a
+// field it had set from one somebody else had: labels were merged rather than
+// replaced so as not to drop a stranger's, which in turn meant a label this
+// controller stopped writing had to be tracked down and deleted by name.
+//
+// Apply says only what this controller wants. The API server records which
+// fields that is, leaves every other field to whoever set it, and removes a
+// field this controller set last time and does not set now. A field somebody
+// else has changed is a conflict, which is returned for the caller to report
+// and then taken back: a generated object is rebuilt from its parent, so the
+// parent is where an edit belongs.
+//
+// Ownership is still the caller's to check first. Apply creates what is not
+// there and merges into what is, whoever created it, so every caller reads the
+// object beforehand and refuses one it does not control, exactly as before.
+package apply
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/csaupgrade"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// Result is what one Apply did.
+type Result struct {
+	// Object is desired as the API server now has it, status included: the
+	// Service half reads a child's published hostname off it.
+	Object client.Object
+	// Changed is whether anything was written — a create, or a field that
+	// differed. An apply that changes nothing leaves the resourceVersion
+	// alone, and that is what this compares.
+	Changed bool
+	// Conflict is the API server's account of the fields another manager had
+	// changed, or nil. They have been taken back by the time Apply returns;
+	// this is for the caller to say so, on the parent, where the person who
+	// made the edit will look.
+	Conflict error
+}
+
+// Apply writes desired. existing is the object as last read, or nil when there
+// is none; it is only consulted, never written from. Errors are returned as the
+// client gave them, for the caller to say which object they were about.
+//
+// desired is built the way the rest of the controller builds objects, as a
+// typed struct, and converted here. Its status is dropped on the way: status
+// belongs to the reconciler that serves the child, and the main resource
+// ignores it anyway. Every other zero value in desired is applied as written,
+// which for these builders is what is meant — they set only fields they
+// decide.
+func Apply(ctx context.Context, c client.Client, existing, desired client.Object) (Result, error) {
+	before := ""
+	if existing != nil {
+		if err := upgrade(ctx, c, existing); err != nil {
+			return Result{}, err
+		}
+		before = existing.GetResourceVersion()
+	}
+
+	var result Result
+	applied, err := apply(ctx, c, desired)
+	if apierrors.IsConflict(err) {
+		result.Conflict = err
+		applied, err = apply(ctx, c, desired, client.ForceOwnership)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	result.Object = applied
+	result.Changed = applied.GetResourceVersion() != before
+	return result, nil
+}
+
+// apply sends one apply of obj and returns the object it produced, as a fresh
+// object of obj's type.
+func apply(ctx context.Context, c client.Client, obj client.Object, opts ...client.ApplyOption) (client.Object, error) {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return nil, err
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	delete(content, "status")
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(gvk)
+
+	opts = append(opts, client.FieldOwner(consts.FieldManager))
+	if err := c.Apply(ctx, client.ApplyConfigurationFromUnstructured(u), opts...); err != nil {
+		return nil, err
+	}
+
+	out, err := c.Scheme().New(gvk)
+	if err != nil {
+		return nil, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, out); err != nil {
+		return nil, err
+	}
+	return out.(client.Object), nil
+}
+
+// upgrade hands the fields an earlier version of this controller wrote with
+// Create and Update over to its apply manager, once per object.
+//
+// Without it those fields stay the Update manager's, and nothing removes them:
+// apply only drops what its own manager stops setting, so a deadline label
+// written before the upgrade would outlive the deadline being lifted. The
+// patch replaces the managedFields outright and names the resourceVersion they
+// were read at, so a write in between fails rather than being undone. An
+// object that carries no managedFields — an EndpointSlice out of the stripped
+// cache — has nothing to upgrade and is left alone.
+func upgrade(ctx context.Context, c client.Client, existing client.Object) error {
+	patch, err := csaupgrade.UpgradeManagedFieldsPatch(existing, sets.New(consts.FieldManager), consts.FieldManager)
+	if err != nil || patch == nil {
+		return err
+	}
+	if err := c.Patch(ctx, existing, client.RawPatch(types.JSONPatchType, patch)); err != nil {
+		return fmt.Errorf("upgrade managed fields: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package apply
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+func configMap(labels, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-tunnel", Labels: labels},
+		Data:       data,
+	}
+}
+
+func newClient() client.Client {
+	// Managed fields returned, as the cache returns them: upgrade reads them.
+	return fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithReturnManagedFields().Build()
+}
+
+func get(t *testing.T, c client.Client) *corev1.ConfigMap {
+	t.Helper()
+	var cm corev1.ConfigMap
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web-tunnel"}, &cm); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	return &cm
+}
+
+func TestApplyCreates(t *testing.T) {
+	c := newClient()
+	result, err := Apply(context.Background(), c, nil, configMap(map[string]string{"a": "1"}, map[string]string{"k": "v"}))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !result.Changed || result.Conflict != nil {
+		t.Errorf("Apply() = changed %v, conflict %v; want a create and no conflict", result.Changed, result.Conflict)
+	}
+	if got := result.Object.(*corev1.ConfigMap).Data["k"]; got != "v" {
+		t.Errorf("returned data = %q, want the object as created", got)
+	}
+	cm := get(t, c)
+	if len(cm.ManagedFields) != 1 || cm.ManagedFields[0].Manager != consts.FieldManager ||
+		cm.ManagedFields[0].Operation != metav1.ManagedFieldsOperationApply {
+		t.Errorf("managedFields = %+v, want one apply entry for %q", cm.ManagedFields, consts.FieldManager)
+	}
+}
+
+// TestApplyLeavesOtherWritersAlone: what somebody else added is theirs, and a
+// field this controller stops setting goes.
+func TestApplyLeavesOtherWritersAlone(t *testing.T) {
+	ctx := context.Background()
+	c := newClient()
+	if _, err := Apply(ctx, c, nil, configMap(map[string]string{"a": "1", "b": "2"}, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := get(t, c)
+	edited.Labels["mesh"] = "injected"
+	if err := c.Update(ctx, edited, client.FieldOwner("mesh")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Apply(ctx, c, get(t, c), configMap(map[string]string{"a": "1"}, nil))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if result.Conflict != nil {
+		t.Errorf("Conflict = %v, want none: nobody touched a field of ours", result.Conflict)
+	}
+	want := map[string]string{"a": "1", "mesh": "injected"}
+	if got := get(t, c).Labels; len(got) != len(want) || got["a"] != "1" || got["mesh"] != "injected" {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+}
+
+// TestApplySetsBackAnEdit: a field of ours somebody else changed is reported
+// and taken back, rather than failing the pass or being silently kept.
+func TestApplySetsBackAnEdit(t *testing.T) {
+	ctx := context.Background()
+	c := newClient()
+	if _, err := Apply(ctx, c, nil, configMap(nil, map[string]string{"k": "v"})); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := get(t, c)
+	edited.Data["k"] = "by hand"
+	if err := c.Update(ctx, edited, client.FieldOwner("kubectl-edit")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Apply(ctx, c, get(t, c), configMap(nil, map[string]string{"k": "v"}))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if result.Conflict == nil {
+		t.Error("Conflict = nil, want the edit reported")
+	}
+	if got := get(t, c).Data["k"]; got != "v" {
+		t.Errorf("data = %q, want it set back", got)
+	}
+}
+
+// TestApplyUpgradesWhatAnOlderVersionWrote: a child created with Create is the
+// Update manager's, field for field. Upgraded, a label that version wrote is
+// still this one's to drop.
+func TestApplyUpgradesWhatAnOlderVersionWrote(t *testing.T) {
+	ctx := context.Background()
+	c := newClient()
+	old := configMap(map[string]string{"a": "1", "expires-at": "1700000000"}, nil)
+	if err := c.Create(ctx, old, client.FieldOwner(consts.FieldManager)); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Apply(ctx, c, get(t, c), configMap(map[string]string{"a": "1"}, nil))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if result.Conflict != nil {
+		t.Errorf("Conflict = %v, want none: the fields were ours all along", result.Conflict)
+	}
+	cm := get(t, c)
+	if _, ok := cm.Labels["expires-at"]; ok {
+		t.Errorf("labels = %v, want the one the older version wrote dropped", cm.Labels)
+	}
+	for _, m := range cm.ManagedFields {
+		if m.Operation == metav1.ManagedFieldsOperationUpdate {
+			t.Errorf("managedFields still has an update entry: %+v", m)
+		}
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/scaffoldly/tunnel/consts"
 )
 
 // Config is resolved from flags once, in main, and passed to each New.
@@ -33,6 +36,69 @@ type Config struct {
 	// not deploy. A cluster running Istio or Cilium already has them, and
 	// should own them.
 	InstallGatewayAPI bool
+
+	// GatewayAPIChannel is the release channel InstallGatewayAPI installs:
+	// standard unless a cluster needs the experimental kinds. It only decides
+	// what is written where nothing is installed yet — an existing install on
+	// the other channel is left as it is.
+	GatewayAPIChannel string
+
+	// TunnelHealth configures the check every Ready tunnel's hostname gets
+	// from outside: resolved, and requested through the edge. See
+	// tunnels.Health.
+	TunnelHealthInterval time.Duration
+	TunnelHealthPath     string
+	TunnelHealthFailures int
+
+	// NamespaceOptIn restricts every half to namespaces labelled
+	// consts.AllowedLabel=true. See package optin.
+	NamespaceOptIn bool
+
+	// WatchNamespaces scopes the manager's cache, and so every watch, to these
+	// namespaces. Empty watches the whole cluster. See Scoped.
+	WatchNamespaces []string
+
+	// PublicURLWebhook serves the webhook that gives Pods a PUBLIC_URL. See
+	// package publicurl.
+	PublicURLWebhook bool
+
+	// SweepInterval is how often generated objects are checked against what
+	// their owner asks for, and SweepDryRun reports the strays rather than
+	// deleting them. See package sweep.
+	SweepInterval time.Duration
+	SweepDryRun   bool
+}
+
+// Scoped reports whether this controller runs with namespaced RBAC, from
+// --watch-namespaces.
+//
+// A scoped install holds a Role in each watched namespace and nothing
+// cluster-wide, so everything cluster-scoped is off the table: it creates no
+// classes and installs no CRDs, does not own GatewayClass status, and cannot
+// read a Namespace's labels for --namespace-opt-in. Reading an IngressClass
+// or GatewayClass is tried anyway, since a cluster admin may grant it; when
+// refused, the classes named for an installed provider are taken as ours.
+// See (*ingress.Reconciler).class.
+func (c Config) Scoped() bool {
+	return len(c.WatchNamespaces) > 0
+}
+
+// Scope turns off what a scoped install cannot do, and reports the
+// combinations that make no sense rather than ignoring one half of them.
+func (c *Config) Scope() error {
+	if !c.Scoped() {
+		return nil
+	}
+	if c.NamespaceOptIn {
+		// The list is the opt-in. Honouring both would need the cluster-wide
+		// Namespace watch a scoped install exists to avoid.
+		return fmt.Errorf("--%s and --%s cannot be combined: the listed namespaces are the ones served",
+			consts.FlagNamespaceOptIn, consts.FlagWatchNamespaces)
+	}
+	c.InstallIngressClasses = false
+	c.InstallGatewayClasses = false
+	c.InstallGatewayAPI = false
+	return nil
 }
 
 // saPrefix begins the username the API server gives a ServiceAccount:
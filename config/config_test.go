@@ -135,3 +135,26 @@ func TestSelfNamespaceParsesUsernames(t *testing.T) {
 		}
 	}
 }
+
+// TestScope: a scoped install gives up everything cluster-scoped, and refuses
+// --namespace-opt-in rather than quietly running without it.
+func TestScope(t *testing.T) {
+	all := Config{InstallIngressClasses: true, InstallGatewayClasses: true, InstallGatewayAPI: true}
+	if err := all.Scope(); err != nil || !all.InstallIngressClasses || !all.InstallGatewayAPI {
+		t.Errorf("Scope() unscoped = %+v, %v; want it untouched", all, err)
+	}
+
+	scoped := all
+	scoped.WatchNamespaces = []string{"team-a"}
+	if err := scoped.Scope(); err != nil {
+		t.Fatalf("Scope() error = %v", err)
+	}
+	if scoped.InstallIngressClasses || scoped.InstallGatewayClasses || scoped.InstallGatewayAPI {
+		t.Errorf("Scope() = %+v, want every install off", scoped)
+	}
+
+	both := Config{WatchNamespaces: []string{"team-a"}, NamespaceOptIn: true}
+	if err := both.Scope(); err == nil {
+		t.Error("Scope() with --namespace-opt-in = nil, want an error")
+	}
+}
@@ -85,6 +85,18 @@ const (
 	ManagedBy      = "tunnel"
 )
 
+// FieldManager is the server-side apply field manager every generated object
+// is written as. `kubectl get -o yaml --show-managed-fields` then says exactly
+// which of a child's fields are this controller's, and the API server keeps
+// everything else — a label another tool adds, a field a mutating webhook
+// fills in — out of its hands.
+//
+// The same string client-go's default user agent gives the binary, which is
+// what versions that wrote with Update were recorded as. package apply upgrades
+// those entries in place, so labels they set are still this controller's to
+// drop.
+const FieldManager = "tunnel"
+
 // ProtocolLabel is the name half of {provider}/protocol, which declares how the
 // origin behind an object is dialed. Read on a Service or Pod by their
 // controllers and on an Ingress or Gateway by the halves that serve them, and
@@ -93,7 +105,7 @@ const (
 // A label, like the activation key, because this system has one metadata
 // mechanism rather than two. That has a consequence annotations did not:
 // label VALUES are validated — at most 63 characters, alphanumeric at both
-// ends. The values here are a closed set of two, both trivially valid, and
+// ends. The values here are a closed set of three, all trivially valid, and
 // TestWrittenValuesAreValidLabels pins that rather than trusting it.
 //
 // This is not the provider annotation deleted in 1b90a58 and is not a route
@@ -107,8 +119,63 @@ const (
 // it, which is why it exists alongside rather than instead of it.
 const ProtocolLabel = "protocol"
 
+// HostnameLabel is the name half of {provider}/hostname, which asks for the
+// tunnel to be minted on a hostname of the caller's choosing rather than the
+// provider's. Read on an Ingress by the Ingress half; on a Service it is
+// validated and copied onto the child, where the Gateway branch turns it into
+// spec.addresses, the Gateway API's own field for exactly this.
+//
+// A label rather than an annotation for the same reason as ProtocolLabel, and
+// the value limit bites harder here: 63 characters, which is shorter than a
+// hostname may be. A name that does not fit cannot be asked for this way, and
+// a Gateway's spec.addresses has no such limit.
+const HostnameLabel = "hostname"
+
+// PolicyLabel is the name half of {provider}/policy, which names a ConfigMap
+// in the object's own namespace holding the policy for its tunnel — who may
+// reach the origin, and how hard, checked by this process before a request is
+// forwarded. Read on an Ingress or Gateway; on a Service or Pod it is copied
+// onto the child like the other two.
+//
+// A name rather than the policy itself, because a label value could not hold
+// one: a CIDR has a slash in it, and 63 characters is not a list. The class's
+// parameters reference a ConfigMap of the same shape, and both apply.
+const PolicyLabel = "policy"
+
+// PortLabel is the name half of {provider}/port, which names the port a
+// tunnel fronts — by name or by number — where the object has several and the
+// http/https names do not settle it. Read on a Service and on a Pod, whose
+// container ports cannot be renamed once it runs; not copied onto what either
+// generates, since each child fronts the one port already chosen.
+const PortLabel = "port"
+
+// PortsLabel is the name half of {provider}/ports, which on a Service with
+// several TCP ports asks for a tunnel in front of each rather than the one
+// port selection would pick. The only value is "all". Read on a Service only:
+// the children it generates each front one port, and say so with their
+// backend.
+const PortsLabel = "ports"
+
+// TTLLabel and ExpiresAtLabel are the name halves of {provider}/ttl and
+// {provider}/expires-at, which retire a tunnel at a deadline: the hostname
+// comes off status, generated children are pruned, and nothing is served until
+// the label is extended or removed. Read on every object a tunnel can be asked
+// for through — Service, Pod, Ingress, Gateway.
+//
+// ttl is a Go duration ("2h", "90m") counted from the object's creation, so it
+// means the same thing on every pass and survives a controller restart.
+// expires-at is the absolute form, in Unix seconds: a label value cannot hold
+// the colons of an RFC 3339 time. The Service and Pod halves write expires-at
+// onto what they generate rather than copying a ttl, which would count again
+// from the child's own, later creation.
+const (
+	TTLLabel       = "ttl"
+	ExpiresAtLabel = "expires-at"
+)
+
 // TunnelLabel is what asks for a tunnel, on a Service or a Pod, and says which
-// API to serve it through. Values: "true", "ingress", "gateway", "none".
+// API to serve it through. Values: "true", "ingress", "gateway", "none". On a
+// Namespace it is the default for every Service in it without one of its own.
 //
 // A LABEL, not an annotation, and one fixed key rather than {provider}/tunnel.
 // Both follow from the same constraint: the cache has to be able to select on
@@ -125,6 +192,16 @@ const ProtocolLabel = "protocol"
 // provider choice the shortcut never had.
 const TunnelLabel = ProviderTunnelPizza + "/tunnel"
 
+// AllowedLabel is what a Namespace carries, with the value "true", to opt in
+// to tunnels when the controller runs with --namespace-opt-in. Off, the label
+// means nothing and every namespace is served.
+//
+// Fixed to tunnel.pizza like TunnelLabel, and for a similar reason: it is a
+// decision about the cluster, made by whoever administers namespaces, not a
+// choice of provider. Granting it per provider would ask an administrator to
+// know which classes are installed.
+const AllowedLabel = ProviderTunnelPizza + "/allowed"
+
 // Flag names and their defaults.
 const (
 	FlagMetricsAddr = "metrics-bind-address"
@@ -139,10 +216,74 @@ const (
 	FlagInstallGatewayClasses = "install-gateway-classes"
 	FlagInstallGatewayAPI     = "install-gateway-api"
 
+	// FlagGatewayAPIChannel picks which upstream bundle --install-gateway-api
+	// writes. It picks nothing else: the install rules are the same for both.
+	FlagGatewayAPIChannel = "gateway-api-channel"
+
+	// The end-to-end check of Ready hostnames: how often, against which path,
+	// and how many failures in a row replace the tunnel. An interval of 0
+	// turns it off.
+	FlagTunnelHealthInterval = "tunnel-health-interval"
+	FlagTunnelHealthPath     = "tunnel-health-path"
+	FlagTunnelHealthFailures = "tunnel-health-failures"
+
+	// FlagNamespaceOptIn restricts every half to namespaces labelled
+	// AllowedLabel=true. Off by default, which is how a single-tenant
+	// cluster wants it; a multi-tenant one turns it on, since otherwise
+	// anyone who can label a Pod can publish it.
+	FlagNamespaceOptIn = "namespace-opt-in"
+
+	// FlagWatchNamespaces scopes the whole controller to a comma-separated
+	// list of namespaces, for an install granted a Role in each rather than
+	// a ClusterRole. Empty, the default, watches every namespace.
+	FlagWatchNamespaces = "watch-namespaces"
+
+	// FlagPublicURLWebhook serves the mutating webhook that points a Pod's
+	// PUBLIC_URL at its Service's hostname mirror. Off by default: it is only
+	// called if the chart also registers it, which needs a serving
+	// certificate, and a webhook on every Pod creation is not something to
+	// turn on behind anyone's back.
+	FlagPublicURLWebhook = "public-url-webhook"
+
+	// PublicURLWebhookPath is where that webhook is served, and what the
+	// chart's MutatingWebhookConfiguration names.
+	PublicURLWebhookPath = "/mutate-v1-pod-public-url"
+
+	// The sweep that collects generated objects nothing asks for any more:
+	// how often, and whether it only reports them. An interval of 0 turns it
+	// off. See package sweep.
+	FlagSweepInterval = "sweep-interval"
+	FlagSweepDryRun   = "sweep-dry-run"
+
+	// HealthCheckHeader marks the health check's request, so the listener in
+	// front of the origin does not count it: not as traffic, against a
+	// limit, or as activity that would keep a scale-to-zero backend awake
+	// once per interval. Its value is a token new every process, so sending
+	// the header buys nobody else anything; and it is removed before the
+	// request is forwarded. See proxy.(*Front).HealthToken.
+	HealthCheckHeader = "Tunnel-Health-Check"
+
+	DefaultTunnelHealthInterval = time.Minute
+	DefaultTunnelHealthPath     = "/"
+	DefaultTunnelHealthFailures = 3
+
+	// DefaultSweepInterval is long because the sweep is a backstop: prune
+	// collects children the moment their owner stops asking, and the sweep
+	// only finds what a missed reconcile or a renamed child left behind.
+	DefaultSweepInterval = 10 * time.Minute
+
 	DefaultMetricsAddr = ":8080"
 	DefaultProbeAddr   = ":8081"
 )
 
+// Gateway API release channels, spelled the way upstream's
+// gateway.networking.k8s.io/channel annotation spells them so the flag value
+// and what ends up on the CRD are the same string.
+const (
+	GatewayAPIChannelStandard     = "standard"
+	GatewayAPIChannelExperimental = "experimental"
+)
+
 // Event vocabulary. Reason answers "why", Action answers "what was attempted";
 // the events.k8s.io API separates them so events aggregate cleanly.
 const (
@@ -151,7 +292,26 @@ const (
 
 	ReasonTunnelReady  = "TunnelReady"
 	ReasonTunnelFailed = "TunnelFailed"
-	ReasonUnsupported  = "Unsupported"
+	// ReasonTunnelDegraded reports a Ready tunnel whose hostname failed its
+	// end-to-end check. The hostname stays published: it may be the edge
+	// having a bad minute, and it is replaced only if it goes on failing.
+	ReasonTunnelDegraded = "TunnelDegraded"
+	ReasonUnsupported    = "Unsupported"
+	// ReasonBackendUnavailable reports an object whose Service has no ready
+	// endpoints, so its tunnel has nothing to reach.
+	ReasonBackendUnavailable = "BackendUnavailable"
+	// ReasonBackendScaled reports the controller scaling a backend's
+	// workload, up for a request or down after it went idle. See the
+	// scale-to-zero policy key.
+	ReasonBackendScaled = "BackendScaled"
+	// ReasonTunnelExpiry reports when a tunnel with a ttl or expires-at label
+	// will be retired; ReasonTunnelExpired, that it has been.
+	ReasonTunnelExpiry  = "TunnelExpiry"
+	ReasonTunnelExpired = "TunnelExpired"
+	// ReasonNamespaceNotAllowed is the Gateway Programmed reason for a
+	// Gateway in a namespace that has not opted in. The event says
+	// Unsupported, like any other refusal.
+	ReasonNamespaceNotAllowed = "NamespaceNotAllowed"
 	// ReasonProvisioning names the child object a Service's tunnel is being
 	// built through. A Service annotated for a tunnel does not carry the
 	// tunnel itself — a child Ingress does — so a failure surfaces one object
@@ -162,8 +322,24 @@ const (
 	// ReasonProtocol reports what the controller concluded about how an origin
 	// is dialed, and how to override it.
 	ReasonProtocol = "Protocol"
+	// ReasonCustomDomain reports how the hosts an Ingress or Gateway names
+	// were published, if they were. The tunnel serves on its minted hostname
+	// either way; this is about the names the user actually gave out.
+	ReasonCustomDomain = "CustomDomain"
+	// ReasonFieldConflict reports a generated object somebody else had
+	// edited where this controller writes: the edit is set back, because the
+	// object is rebuilt from its parent and a hand edit would otherwise be
+	// silently lost or silently kept depending on which came last. Warning,
+	// so the person who made it can find out why it did not stick.
+	ReasonFieldConflict = "FieldConflict"
+	// ReasonStrayChild reports a generated object the sweep found with no
+	// owner still asking for it. See package sweep.
+	ReasonStrayChild = "StrayChild"
 
 	ActionProvision = "Provision"
+	ActionScale     = "Scale"
+	ActionExpire    = "Expire"
+	ActionSweep     = "Sweep"
 )
 
 // Providers the controller can mint from. Each is a host: the tunnel is
@@ -219,8 +395,31 @@ const (
 	MsgTunnelReadyFmt = "tunnel ready at https://%s/ (minted from https://%s/tunnel)"
 	// MsgTunnelFailedFmt takes the error that ended the tunnel.
 	MsgTunnelFailedFmt = "tunnel failed: %v"
+	// MsgTunnelDegradedFmt takes the hostname, the check's error, and how many
+	// failures in a row replace the tunnel.
+	MsgTunnelDegradedFmt = "tunnel at https://%s/ failed its health check (%v); replaced after %d failures in a row"
+	// MsgBackendHeldFmt and MsgBackendMaintenanceFmt take the Service. The
+	// first when the hostname is withdrawn, the second when a policy's
+	// maintenance-page is served on it instead.
+	MsgBackendHeldFmt        = "service %s has no ready endpoints; the hostname is published once one is"
+	MsgBackendMaintenanceFmt = "service %s has no ready endpoints; serving the maintenance page until one is"
+	// MsgBackendAsleepFmt takes the Service, for a backend a policy scales to
+	// zero: the hostname stays up, and a request wakes it.
+	MsgBackendAsleepFmt = "service %s has no ready endpoints; the next request scales it up"
+	// MsgBackendWokenFmt and MsgBackendSleptFmt take the workload's kind and
+	// name; the second also the idle period.
+	MsgBackendWokenFmt = "scaled %s %s up from zero for a request"
+	MsgBackendSleptFmt = "scaled %s %s to zero after %s without a request"
+	// MsgTunnelExpiresFmt takes the deadline and the time left until it.
+	MsgTunnelExpiresFmt = "tunnel expires at %s, in %s"
+	// MsgTunnelExpiredFmt takes the deadline and the provider, twice: the
+	// labels to edit are the way back.
+	MsgTunnelExpiredFmt = "tunnel expired at %s and was retired; extend or remove %s/ttl or %s/expires-at to serve it again"
 	// MsgUnsupportedFmt takes the reason this object cannot be served.
 	MsgUnsupportedFmt = "cannot serve this object: %v"
+	// MsgTunnelPendingFmt takes the provider host. The Gateway Programmed
+	// condition's message while a tunnel is minting or connecting.
+	MsgTunnelPendingFmt = "tunnel is being minted from https://%s/tunnel"
 
 	// MsgProvisioningFmt takes the child object's kind and name, and the
 	// provider. Emitted on the Service, because that is the object the user
@@ -231,28 +430,86 @@ const (
 	// detection auditable rather than magic.
 	MsgProtocolProbedFmt = "origin at %s speaks %s; set %s/%s to override"
 	// MsgProtocolUnknownFmt takes the address, the reason, and the annotation
-	// to set. Emitted when the origin could not be reached at all, so nothing
-	// can be concluded about it — the tunnel is built plaintext, which is the
-	// old behaviour, and this says how to correct it if that is wrong.
-	MsgProtocolUnknownFmt = "could not determine whether %s speaks TLS (%v); assuming %s. " +
-		"Set %s/%s: \"https\" if it does"
+	// to set. Emitted when the origin could not be reached, or answered in a
+	// way that settles nothing, so nothing can be concluded about it — the
+	// tunnel is built plaintext, which is the old behaviour, and this says how
+	// to correct it if that is wrong.
+	MsgProtocolUnknownFmt = "could not determine how %s speaks (%v); assuming %s. " +
+		"Set %s/%s: \"https\" or \"h2c\" if it is either"
+	// MsgProtocolNotHTTPFmt takes the address and what it answered. Wrapped
+	// in ErrUnsupported and emitted as Unsupported: the origin is up and is
+	// something other than HTTP — Redis, SSH, a database — and a tunnel in
+	// front of it would connect and fail every request.
+	MsgProtocolNotHTTPFmt = "origin at %s does not speak HTTP (it answered %q); " +
+		"a tunnel carries HTTP only, so none is built"
 
-	// MsgPortAssumedFmt takes the port and the Service it was written onto.
+	// MsgPortAssumedFmt takes the port and the {provider}/port label key.
 	// Emitted when a Pod declared no container port, or declared several that
 	// could not be told apart by name — `kubectl run --port` produces an
 	// unnamed one, so that is not a rare shape. The tunnel comes up either way;
 	// this is how someone whose app listens on 3000 finds out why it serves
-	// errors.
+	// errors, and what to label the Pod with. Editing the generated Service
+	// would not stick.
 	MsgPortAssumedFmt = "no container port to choose from; assuming %d. " +
-		"Edit Service %s if that is wrong"
+		"Label the Pod %s=<port> if that is wrong"
 
 	// MsgChildConflictFmt takes the child's kind and name. Emitted when the
 	// name a Service's child would take is already held by an object this
 	// controller does not own — the collision the ownerReference cannot
 	// prevent, only detect.
 	MsgChildConflictFmt = "%s %s already exists and is not owned by this Service; not touching it"
+	// MsgFieldConflictFmt takes the child's kind and name, and the API
+	// server's conflict, which names the fields and who had changed them.
+	// The parent is what to edit instead.
+	MsgFieldConflictFmt = "%s %s was changed where this controller writes it (%v); set back. " +
+		"Edit this object instead: the child is rebuilt from it"
+
+	// The sweep's messages. Each takes the stray's kind and name; the first
+	// two also why it is one, which names its owner. Emitted on the owner
+	// where there is one to emit on, since that is what the user looks at,
+	// and on the stray itself otherwise.
+	MsgStrayDeletedFmt = "%s %s was generated by this controller and %s; deleted"
+	MsgStrayKeptFmt    = "%s %s was generated by this controller and %s; left in place, since --" +
+		FlagSweepDryRun + " is set"
+	// MsgStrayUnownedFmt is for an object carrying the managed-by label with
+	// no Service or Pod controlling it. Never deleted: the label is
+	// copied easily, and the controller reference is what says an object is
+	// this controller's.
+	MsgStrayUnownedFmt = "%s %s is labelled " + LabelManagedBy + "=" + ManagedBy +
+		" but no Service or Pod controls it; left alone"
+
+	// MsgCustomDomainEndpointFmt takes the hosts, the provider, the
+	// DNSEndpoint's name and the tunnel hostname. Normal: this is the path
+	// working, and saying which path was taken is what the event is for.
+	MsgCustomDomainEndpointFmt = "%s: provider %s mints its own hostnames, so DNSEndpoint %s " +
+		"points them at %s by CNAME for external-dns to publish"
+	// MsgCustomDomainUnpublishedFmt takes the hosts, the provider and the
+	// tunnel hostname. A warning: the user named domains and nothing here can
+	// make them resolve, so it says what to do by hand instead.
+	MsgCustomDomainUnpublishedFmt = "%s not published: provider %s mints its own hostnames and " +
+		"this cluster does not serve externaldns.k8s.io DNSEndpoint. CNAME them to %s yourself"
+	// MsgHostnameNotReservableFmt takes the provider and the hostname asked
+	// for. Wrapped in ErrUnsupported and reported like any other refusal: the
+	// object is not served, rather than served on a name nobody asked for.
+	MsgHostnameNotReservableFmt = "provider %s cannot reserve hostname %s: it mints its own names, " +
+		"and a random one is not what was asked for. Name it as a rule host or listener hostname " +
+		"instead to have it CNAMEd to a minted one"
+	// MsgAddressNoIPFmt takes the address. A Gateway may ask for an IP, and
+	// a tunnel has none to give.
+	MsgAddressNoIPFmt = "spec.addresses %s: a tunnel is reached by hostname and has no IP address to assign"
+
+	// MsgDNSEndpointConflictFmt takes the DNSEndpoint's name. The same
+	// collision as MsgChildConflictFmt, on an object whose owner is an Ingress
+	// or Gateway rather than a Service.
+	MsgDNSEndpointConflictFmt = "DNSEndpoint %s already exists and is not owned by this object; not touching it"
 )
 
+// EnvPublicURL is the environment variable a Pod reads its own public URL
+// from, and the key in its Service's hostname mirror that holds it. The name
+// is the one frameworks already read — Create React App, Gatsby and a good
+// many OAuth libraries look for PUBLIC_URL — so an app often needs no change.
+const EnvPublicURL = "PUBLIC_URL"
+
 // Origin is how an Ingress backend is turned into the local URL a tunnel
 // fronts.
 const (
@@ -268,6 +525,16 @@ const (
 	// or is self-signed, and neither is a public chain. The tunnel is the
 	// trust boundary here, not this hop.
 	OriginSchemeTLS = "https"
+	// OriginSchemeH2C dials the backend as HTTP/2 over plaintext, with prior
+	// knowledge: the origin is sent the HTTP/2 preface straight away rather
+	// than asked to upgrade. It is what a gRPC server listening without TLS
+	// speaks, and such a server refuses HTTP/1.1 outright, so "http" is not a
+	// degraded way to reach it but no way at all. Not a URL scheme anyone
+	// registered; it names the transport, and the Front is what dials it.
+	OriginSchemeH2C = "h2c"
+	// AppProtocolH2C is the standard spec.ports[].appProtocol for the same
+	// thing, from KEP-3726. Recognised as a declaration of OriginSchemeH2C.
+	AppProtocolH2C = "kubernetes.io/h2c"
 	// OriginDomain is appended to <service>.<namespace> to reach a Service
 	// from the controller Pod. Deliberately not ".svc.cluster.local": a
 	// cluster may be built with a different cluster domain, and every Pod's
@@ -282,3 +549,14 @@ const (
 // the reconcile is requeued for this long instead of returning an error and
 // riding the workqueue's much faster backoff.
 const TunnelRetryInterval = time.Minute
+
+// PolicyResyncInterval is how often a tunnel behind an access policy re-reads
+// it. The ConfigMap and the Secret it names are read uncached and not watched
+// — an informer over every Secret in the cluster is not a price worth paying
+// for this — so a rotated password takes effect within this long instead.
+const PolicyResyncInterval = time.Minute
+
+// DefaultWakeTimeout is how long a request to a backend scaled to zero is held
+// for it to come up, when the policy does not say. Long enough for an image
+// already on the node; a cold pull is the policy's to allow for.
+const DefaultWakeTimeout = 2 * time.Minute
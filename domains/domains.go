@@ -0,0 +1,297 @@
+// Package domains publishes the hostnames an Ingress or Gateway asks for —
+// spec.rules[].host, spec.listeners[].hostname — on top of the tunnel
+// hostname a provider minted for it.
+//
+// A minted hostname is a random subdomain of the provider's zone. That is fine
+// for a preview and useless for a customer, who was told app.example.com. There
+// are two ways to get from one to the other:
+//
+//  1. Ask the provider for the name. Neither installed provider can:
+//     tunnel.pizza and api.trycloudflare.com both mint their own names, and
+//     libtunnel has no way to request one. When a provider can, this is the
+//     path it should take, because it needs nothing else in the cluster.
+//  2. Point the name at the minted hostname with a CNAME. This controller does
+//     not own any DNS, so it does not write records itself — it writes
+//     external-dns's DNSEndpoint, and whichever external-dns the cluster runs
+//     creates the record in whichever zone it manages.
+//
+// So today it is always 2, or nothing when the DNSEndpoint CRD is not served,
+// and the owning reconciler says which in an event either way. Whether the
+// edge then answers for a name it did not mint is the provider's call; the
+// CNAME is the half this cluster can do.
+package domains
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// errUnsupported marks a domain that cannot be published as written. See
+// consts.ErrUnsupported.
+var errUnsupported = consts.ErrUnsupported
+
+// DNSEndpoint is external-dns's CRD kind.
+//
+// Unstructured rather than imported: external-dns's API module drags in every
+// DNS provider SDK it supports, and three fields of one kind are not worth
+// that. The schema has been v1alpha1 since it was introduced and every
+// external-dns release still serves it.
+var DNSEndpoint = schema.GroupVersionKind{
+	Group:   "externaldns.k8s.io",
+	Version: "v1alpha1",
+	Kind:    "DNSEndpoint",
+}
+
+// recordType is the only record this package writes. The target is a
+// hostname, never an address, so A and AAAA are not options.
+const recordType = "CNAME"
+
+// maxNameLength is the longest name the API server accepts: object names are
+// DNS subdomains. An owner's name can already be that long, and Name adds to
+// it.
+const maxNameLength = 253
+
+// hashLength is how much of the digest goes on the end of a truncated name,
+// as for the Service half's children.
+const hashLength = 8
+
+// Path is how a set of custom domains ended up published.
+type Path int
+
+const (
+	// None means there was nothing to publish: the object asks for no host
+	// of its own.
+	None Path = iota
+	// Endpoint means a DNSEndpoint points every host at the tunnel.
+	Endpoint
+	// Unpublished means the object asks for hosts and nothing in this cluster
+	// can publish them.
+	Unpublished
+)
+
+// Result is what Publish did, for the owning reconciler to report.
+type Result struct {
+	Path Path
+	// Hosts is what was asked for, as Hosts normalized it.
+	Hosts []string
+	// Name is the DNSEndpoint's name when Path is Endpoint.
+	Name string
+	// Changed is whether the DNSEndpoint had to be written, so a reconciler
+	// reports the path once rather than on every pass.
+	Changed bool
+}
+
+// Installed reports whether the cluster serves DNSEndpoint. Same shape as
+// gateway.Installed, for the same reason: the watch on it must not be
+// registered where the API server does not know the kind, or the manager fails
+// to start.
+func Installed(mgr ctrl.Manager) (bool, error) {
+	_, err := mgr.GetRESTMapper().RESTMapping(DNSEndpoint.GroupKind(), DNSEndpoint.Version)
+	if err != nil {
+		if meta.IsNoMatchError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Publisher writes the DNSEndpoint for one object's custom domains.
+type Publisher struct {
+	client.Client
+	// Served is Installed's answer, taken once at startup. When false the
+	// Publisher writes nothing and reports Unpublished, so the reconcilers need
+	// no branch of their own for it.
+	Served bool
+}
+
+// Object is an empty DNSEndpoint, for a watch or a read.
+func Object() *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(DNSEndpoint)
+	return u
+}
+
+// Publish points hosts at target on behalf of owner, whose kind is gvk.
+//
+// One DNSEndpoint per owner, named for it — see Name: the owner is the unit a
+// user adds hosts to and removes them from, and a single object means the
+// update is the whole diff. An owner that stops asking for hosts has its DNSEndpoint
+// withdrawn here too.
+func (p *Publisher) Publish(ctx context.Context, owner client.Object, gvk schema.GroupVersionKind, hosts []string, target string) (Result, error) {
+	if len(hosts) == 0 {
+		return Result{}, p.Withdraw(ctx, owner, gvk)
+	}
+	if !p.Served {
+		return Result{Path: Unpublished, Hosts: hosts}, nil
+	}
+
+	desired := endpoint(owner, gvk, hosts, target)
+	key := client.ObjectKeyFromObject(desired)
+	done := Result{Path: Endpoint, Hosts: hosts, Name: desired.GetName()}
+
+	existing := Object()
+	err := p.Get(ctx, key, existing)
+	switch {
+	case apierrors.IsNotFound(err):
+		if err := p.Create(ctx, desired); err != nil {
+			return Result{}, fmt.Errorf("create dnsendpoint %s: %w", key, err)
+		}
+		done.Changed = true
+		return done, nil
+	case err != nil:
+		return Result{}, fmt.Errorf("get dnsendpoint %s: %w", key, err)
+	}
+
+	// The same rule as every other object this controller generates: a
+	// DNSEndpoint somebody else wrote is theirs, however it is named, and it
+	// may well be publishing records nothing here knows about.
+	if !metav1.IsControlledBy(existing, owner) {
+		return Result{}, fmt.Errorf("%w: %s", errUnsupported,
+			fmt.Sprintf(consts.MsgDNSEndpointConflictFmt, existing.GetName()))
+	}
+
+	if apiequality.Semantic.DeepEqual(existing.Object["spec"], desired.Object["spec"]) &&
+		existing.GetLabels()[consts.LabelManagedBy] == consts.ManagedBy {
+		return done, nil
+	}
+
+	existing.Object["spec"] = desired.Object["spec"]
+	labels := existing.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[consts.LabelManagedBy] = consts.ManagedBy
+	existing.SetLabels(labels)
+	if err := p.Update(ctx, existing); err != nil {
+		return Result{}, fmt.Errorf("update dnsendpoint %s: %w", key, err)
+	}
+	done.Changed = true
+	return done, nil
+}
+
+// Withdraw deletes owner's DNSEndpoint, if it has one. gvk is owner's kind, as
+// for Publish: it is part of the name.
+//
+// Called whenever the tunnel stops serving — failed, refused, reclassed — and
+// not only when the owner goes away, which owner-reference GC already covers.
+// A CNAME to a hostname nothing answers on is the same lie as a stale status
+// address, and it is in public DNS rather than in the cluster.
+func (p *Publisher) Withdraw(ctx context.Context, owner client.Object, gvk schema.GroupVersionKind) error {
+	if !p.Served {
+		return nil
+	}
+	existing := Object()
+	key := client.ObjectKey{Namespace: owner.GetNamespace(), Name: Name(owner.GetName(), gvk)}
+	if err := p.Get(ctx, key, existing); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("get dnsendpoint %s: %w", key, err)
+	}
+	if !metav1.IsControlledBy(existing, owner) {
+		return nil
+	}
+	if err := p.Delete(ctx, existing); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("delete dnsendpoint %s: %w", key, err)
+	}
+	return nil
+}
+
+// Hosts is the set of hostnames to publish, deduplicated and sorted so the
+// DNSEndpoint's spec is stable across reconciles however the owner orders
+// them.
+//
+// The tunnel's own hostname is dropped: a CNAME from a name to itself is a
+// loop, and an Ingress can carry it as a rule host harmlessly.
+func Hosts(target string, hosts ...string) []string {
+	var out []string
+	for _, h := range hosts {
+		if h == "" || h == target {
+			continue
+		}
+		out = append(out, h)
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// Name is the DNSEndpoint's name for an owner called name, of kind gvk: web's
+// is web-ingress, or web-gateway.
+//
+// The kind is in it because an Ingress and a Gateway may share a name in one
+// namespace, and both may ask for hosts. Named for the owner alone, the second
+// would find the first's DNSEndpoint, controlled by another object, and be
+// refused as a conflict. Truncated and re-uniquified past the API server's
+// limit, the way the Service half names its children. Exported for tests that
+// look the object up.
+func Name(name string, gvk schema.GroupVersionKind) string {
+	out := name + "-" + strings.ToLower(gvk.Kind)
+	if len(out) <= maxNameLength {
+		return out
+	}
+	sum := sha256.Sum256([]byte(gvk.Kind + "/" + name))
+	suffix := "-" + hex.EncodeToString(sum[:])[:hashLength]
+	return out[:maxNameLength-len(suffix)] + suffix
+}
+
+// endpoint builds the DNSEndpoint for owner.
+//
+// No recordTTL: external-dns then uses its provider's default, and a TTL is a
+// property of the zone the operator configured external-dns for, not of one
+// Ingress.
+func endpoint(owner client.Object, gvk schema.GroupVersionKind, hosts []string, target string) *unstructured.Unstructured {
+	endpoints := make([]any, 0, len(hosts))
+	for _, h := range hosts {
+		endpoints = append(endpoints, map[string]any{
+			"dnsName":    h,
+			"recordType": recordType,
+			"targets":    []any{target},
+		})
+	}
+
+	u := Object()
+	u.SetNamespace(owner.GetNamespace())
+	u.SetName(Name(owner.GetName(), gvk))
+	u.SetLabels(map[string]string{consts.LabelManagedBy: consts.ManagedBy})
+	// Namespaced owner, namespaced dependent, same namespace. Deleting the
+	// Ingress or Gateway collects the record with it.
+	u.SetOwnerReferences([]metav1.OwnerReference{*metav1.NewControllerRef(owner, gvk)})
+	u.Object["spec"] = map[string]any{"endpoints": endpoints}
+	return u
+}
+
+// Report records which path res took as an event on owner.
+//
+// announce is whether the reconciler is reporting anything else this pass —
+// the tunnel coming up, typically. An Unpublished result writes nothing, so
+// without it there would be no way to tell the first pass from the hundredth,
+// and the warning would repeat on every resync.
+func Report(rec events.EventRecorder, owner runtime.Object, provider, target string, res Result, announce bool) {
+	hosts := strings.Join(res.Hosts, ", ")
+	switch {
+	case res.Path == Endpoint && (res.Changed || announce):
+		rec.Eventf(owner, nil, consts.EventTypeNormal, consts.ReasonCustomDomain,
+			consts.ActionProvision, consts.MsgCustomDomainEndpointFmt, hosts, provider, res.Name, target)
+	case res.Path == Unpublished && announce:
+		rec.Eventf(owner, nil, consts.EventTypeWarning, consts.ReasonCustomDomain,
+			consts.ActionProvision, consts.MsgCustomDomainUnpublishedFmt, hosts, provider, target)
+	}
+}
@@ -0,0 +1,289 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+const target = "brave-tuna.trycloudflare.com"
+
+var ingressKind = networkingv1.SchemeGroupVersion.WithKind("Ingress")
+
+func owner() *networkingv1.Ingress {
+	return &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "web", UID: "ingress-uid",
+	}}
+}
+
+// fakeClient knows DNSEndpoint the way a cluster running external-dns does:
+// registered as unstructured, since there is no Go type for it here.
+func fakeClient(t *testing.T, objs ...client.Object) client.Client {
+	t.Helper()
+	s := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(s))
+	s.AddKnownTypeWithName(DNSEndpoint, &unstructured.Unstructured{})
+	s.AddKnownTypeWithName(DNSEndpoint.GroupVersion().WithKind(DNSEndpoint.Kind+"List"), &unstructured.UnstructuredList{})
+	return fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build()
+}
+
+func get(t *testing.T, c client.Client) *unstructured.Unstructured {
+	t.Helper()
+	u := Object()
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web-ingress"}, u); err != nil {
+		t.Fatalf("get dnsendpoint: %v", err)
+	}
+	return u
+}
+
+// names reads back the dnsName of every endpoint, and fails on any that is not
+// a CNAME to the tunnel.
+func names(t *testing.T, u *unstructured.Unstructured) []string {
+	t.Helper()
+	eps, _, err := unstructured.NestedSlice(u.Object, "spec", "endpoints")
+	if err != nil {
+		t.Fatalf("read endpoints: %v", err)
+	}
+	var out []string
+	for _, raw := range eps {
+		ep := raw.(map[string]any)
+		if ep["recordType"] != recordType {
+			t.Errorf("%v: recordType = %v, want %s", ep["dnsName"], ep["recordType"], recordType)
+		}
+		targets, _ := ep["targets"].([]any)
+		if len(targets) != 1 || targets[0] != target {
+			t.Errorf("%v: targets = %v, want [%s]", ep["dnsName"], targets, target)
+		}
+		out = append(out, ep["dnsName"].(string))
+	}
+	return out
+}
+
+// TestPublishCreatesOwnedEndpoint is the path the package exists for: the
+// hosts become CNAMEs to the tunnel, in an object the owner's deletion
+// collects.
+func TestPublishCreatesOwnedEndpoint(t *testing.T) {
+	c := fakeClient(t)
+	p := &Publisher{Client: c, Served: true}
+
+	res, err := p.Publish(context.Background(), owner(), ingressKind,
+		Hosts(target, "www.example.com", "app.example.com"), target)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if res.Path != Endpoint || !res.Changed || res.Name != "web-ingress" {
+		t.Errorf("Publish() = %+v, want a changed Endpoint named web-ingress", res)
+	}
+
+	got := get(t, c)
+	if !metav1.IsControlledBy(got, owner()) {
+		t.Error("dnsendpoint is not controlled by the ingress; deleting it would leave the record behind")
+	}
+	if got.GetLabels()[consts.LabelManagedBy] != consts.ManagedBy {
+		t.Errorf("labels = %v, want %s=%s", got.GetLabels(), consts.LabelManagedBy, consts.ManagedBy)
+	}
+	if n := strings.Join(names(t, got), ","); n != "app.example.com,www.example.com" {
+		t.Errorf("dnsNames = %s, want app.example.com,www.example.com", n)
+	}
+
+	// Unchanged: no write, and nothing for the reconciler to report.
+	res, err = p.Publish(context.Background(), owner(), ingressKind,
+		Hosts(target, "app.example.com", "www.example.com"), target)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if res.Changed {
+		t.Error("republishing the same hosts rewrote the dnsendpoint")
+	}
+}
+
+// A new tunnel hostname moves every record with it.
+func TestPublishRetargets(t *testing.T) {
+	c := fakeClient(t)
+	p := &Publisher{Client: c, Served: true}
+	if _, err := p.Publish(context.Background(), owner(), ingressKind,
+		[]string{"app.example.com"}, "old-tuna.trycloudflare.com"); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	res, err := p.Publish(context.Background(), owner(), ingressKind, []string{"app.example.com"}, target)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if !res.Changed {
+		t.Error("a new target did not rewrite the dnsendpoint")
+	}
+	names(t, get(t, c))
+}
+
+// Without the CRD nothing is written, and the result says so rather than
+// pretending the hosts were handled.
+func TestPublishUnservedIsUnpublished(t *testing.T) {
+	c := fakeClient(t)
+	p := &Publisher{Client: c}
+
+	res, err := p.Publish(context.Background(), owner(), ingressKind, []string{"app.example.com"}, target)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if res.Path != Unpublished {
+		t.Errorf("Path = %v, want Unpublished", res.Path)
+	}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web-ingress"}, Object()); err == nil {
+		t.Error("wrote a dnsendpoint on a cluster that does not serve them")
+	}
+}
+
+// An owner that stops naming hosts loses its records.
+func TestPublishNoHostsWithdraws(t *testing.T) {
+	c := fakeClient(t)
+	p := &Publisher{Client: c, Served: true}
+	if _, err := p.Publish(context.Background(), owner(), ingressKind, []string{"app.example.com"}, target); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	res, err := p.Publish(context.Background(), owner(), ingressKind, nil, target)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if res.Path != None {
+		t.Errorf("Path = %v, want None", res.Path)
+	}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web-ingress"}, Object()); err == nil {
+		t.Error("dnsendpoint outlived the hosts it published")
+	}
+}
+
+// Somebody else's DNSEndpoint under the same name is neither overwritten nor
+// deleted. It may be publishing records for names this controller never saw.
+func TestForeignEndpointIsLeftAlone(t *testing.T) {
+	foreign := Object()
+	foreign.SetNamespace("default")
+	foreign.SetName("web-ingress")
+	foreign.Object["spec"] = map[string]any{"endpoints": []any{
+		map[string]any{"dnsName": "mail.example.com", "recordType": "MX", "targets": []any{"10 mx.example.com"}},
+	}}
+	c := fakeClient(t, foreign)
+	p := &Publisher{Client: c, Served: true}
+
+	_, err := p.Publish(context.Background(), owner(), ingressKind, []string{"app.example.com"}, target)
+	if !errors.Is(err, consts.ErrUnsupported) {
+		t.Fatalf("Publish() error = %v, want ErrUnsupported", err)
+	}
+	if err := p.Withdraw(context.Background(), owner(), ingressKind); err != nil {
+		t.Fatalf("Withdraw() error = %v", err)
+	}
+
+	got := get(t, c)
+	eps, _, _ := unstructured.NestedSlice(got.Object, "spec", "endpoints")
+	if len(eps) != 1 || eps[0].(map[string]any)["dnsName"] != "mail.example.com" {
+		t.Errorf("foreign dnsendpoint was modified: %v", eps)
+	}
+}
+
+// An Ingress and a Gateway may share a name, and each gets a DNSEndpoint of
+// its own rather than a conflict with the other's.
+func TestPublishKeepsKindsApart(t *testing.T) {
+	c := fakeClient(t)
+	p := &Publisher{Client: c, Served: true}
+	gw := &gatewayv1.Gateway{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "gateway-uid"}}
+	gatewayKind := gatewayv1.SchemeGroupVersion.WithKind("Gateway")
+
+	if _, err := p.Publish(context.Background(), owner(), ingressKind, []string{"app.example.com"}, target); err != nil {
+		t.Fatalf("Publish(ingress) error = %v", err)
+	}
+	res, err := p.Publish(context.Background(), gw, gatewayKind, []string{"api.example.com"}, target)
+	if err != nil {
+		t.Fatalf("Publish(gateway) error = %v", err)
+	}
+	if res.Name != "web-gateway" {
+		t.Errorf("Name = %q, want web-gateway", res.Name)
+	}
+	if n := strings.Join(names(t, get(t, c)), ","); n != "app.example.com" {
+		t.Errorf("ingress dnsNames = %s, want app.example.com", n)
+	}
+
+	// Withdrawing one leaves the other.
+	if err := p.Withdraw(context.Background(), gw, gatewayKind); err != nil {
+		t.Fatalf("Withdraw() error = %v", err)
+	}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web-gateway"}, Object()); err == nil {
+		t.Error("gateway's dnsendpoint outlived its withdrawal")
+	}
+	get(t, c)
+}
+
+// A name at the API server's limit still gets a kind, and stays within it.
+func TestNameTruncates(t *testing.T) {
+	long := strings.Repeat("a", maxNameLength)
+	ing, gw := Name(long, ingressKind), Name(long, gatewayv1.SchemeGroupVersion.WithKind("Gateway"))
+	if len(ing) > maxNameLength || len(gw) > maxNameLength {
+		t.Errorf("lengths = %d, %d, want at most %d", len(ing), len(gw), maxNameLength)
+	}
+	if ing == gw {
+		t.Error("an Ingress and a Gateway of the same long name collide")
+	}
+}
+
+func TestHosts(t *testing.T) {
+	got := Hosts(target, "b.example.com", "", target, "a.example.com", "b.example.com")
+	if want := "a.example.com,b.example.com"; strings.Join(got, ",") != want {
+		t.Errorf("Hosts() = %v, want %s", got, want)
+	}
+	if got := Hosts(target, "", target); len(got) != 0 {
+		t.Errorf("Hosts() = %v, want none", got)
+	}
+}
+
+// Report names the path taken, which is the whole of what the request asked
+// the events to say.
+func TestReport(t *testing.T) {
+	tests := []struct {
+		name      string
+		res       Result
+		announce  bool
+		wantEvent string
+	}{
+		{"endpoint written", Result{Path: Endpoint, Hosts: []string{"app.example.com"}, Name: "web", Changed: true}, false,
+			consts.EventTypeNormal + " " + consts.ReasonCustomDomain},
+		{"endpoint unchanged, tunnel just came up", Result{Path: Endpoint, Hosts: []string{"app.example.com"}, Name: "web"}, true,
+			consts.EventTypeNormal + " " + consts.ReasonCustomDomain},
+		{"endpoint unchanged", Result{Path: Endpoint, Hosts: []string{"app.example.com"}, Name: "web"}, false, ""},
+		{"unpublished, tunnel just came up", Result{Path: Unpublished, Hosts: []string{"app.example.com"}}, true,
+			consts.EventTypeWarning + " " + consts.ReasonCustomDomain},
+		{"unpublished, resync", Result{Path: Unpublished, Hosts: []string{"app.example.com"}}, false, ""},
+		{"nothing asked for", Result{}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := events.NewFakeRecorder(4)
+			Report(rec, owner(), consts.ProviderTunnelPizza, target, tt.res, tt.announce)
+			select {
+			case got := <-rec.Events:
+				if tt.wantEvent == "" {
+					t.Errorf("unexpected event %q", got)
+				} else if !strings.HasPrefix(got, tt.wantEvent+" ") || !strings.Contains(got, "app.example.com") {
+					t.Errorf("event = %q, want %s naming the host", got, tt.wantEvent)
+				}
+			default:
+				if tt.wantEvent != "" {
+					t.Errorf("no event, want %s", tt.wantEvent)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package endpoints
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// Address is the host:port the controller dials to reach port of svc. Every
+// half builds its origin from it, so the probe, the tunnel and the front all
+// ask the same thing of the same place.
+//
+// Most Services are reached by their cluster DNS name, which resolves to the
+// ClusterIP and maps the port to a Pod's. Two kinds are not:
+//
+//   - An ExternalName Service is a CNAME and nothing else. There is no port
+//     mapping, so the port is dialed on the external name as given — from
+//     spec.ports if it lists one, otherwise from whatever named it (see
+//     ExternalPort). The external name is dialed directly rather than through
+//     the CNAME: the answer is the same, and the address in an event or a log
+//     says where the traffic actually goes.
+//
+//   - A headless Service has no ClusterIP, so its DNS name resolves to every
+//     ready Pod at once and the port is not mapped: dialing it reaches
+//     whichever Pod the resolver put first, on a port that Pod may not serve.
+//     Instead one ready endpoint is chosen from its EndpointSlices, on the
+//     target port the slice reports. See headless.
+//
+// r must be uncached, or at least not stripped: the cache Strip feeds keeps no
+// addresses or ports, which is exactly what a headless Service is resolved by.
+//
+// Errors wrap consts.ErrUnsupported only where nothing in the cluster could
+// change the answer short of editing the Service.
+func Address(ctx context.Context, r client.Reader, svc *corev1.Service, port corev1.ServicePort) (string, error) {
+	switch {
+	case svc.Spec.Type == corev1.ServiceTypeExternalName:
+		// The API server accepts a trailing dot on the FQDN; a dialer does not
+		// need it and an SNI name must not have it.
+		host := strings.TrimSuffix(svc.Spec.ExternalName, ".")
+		return net.JoinHostPort(host, strconv.Itoa(int(port.Port))), nil
+	case svc.Spec.ClusterIP == corev1.ClusterIPNone:
+		return headless(ctx, r, svc, port)
+	}
+	return net.JoinHostPort(dnsName(svc.Namespace, svc.Name), strconv.Itoa(int(port.Port))), nil
+}
+
+// ExternalPort is the port to dial on an ExternalName Service that does not
+// list it. spec.ports on an ExternalName is informational — nothing proxies it
+// — so many leave it out, and the port comes from whoever names the Service:
+// an Ingress backend's number, an HTTPRoute's port, a {provider}/port label.
+// A port name cannot be settled that way, since there is nothing to look it up
+// in.
+func ExternalPort(svc *corev1.Service, number int32) (corev1.ServicePort, bool) {
+	if svc.Spec.Type != corev1.ServiceTypeExternalName || number == 0 {
+		return corev1.ServicePort{}, false
+	}
+	return corev1.ServicePort{Port: number, Protocol: corev1.ProtocolTCP}, true
+}
+
+// headless picks the endpoint of a headless Service that port is dialed on.
+//
+// The first ready endpoint with a hostname, by hostname, and otherwise the
+// first ready one by address. A StatefulSet's Pods have hostnames, so its
+// Service is fronted by ordinal zero, which is the Pod a person asking for
+// "the" Pod of a StatefulSet usually means; it is reached by its own DNS name,
+// which survives the Pod being rescheduled. Anything else is reached by
+// address, and the EndpointSlice watch brings the object back to follow it
+// when it moves. Sorted either way, so the choice does not flap between
+// passes.
+//
+// With nothing ready, the Service's own name, on the target port: dialing it
+// fails, which is the truth, and the halves' readiness check already says why
+// and holds the tunnel meanwhile. A headless Service with no selector and no
+// slices is different — nothing will ever write it an endpoint unless someone
+// does by hand, so that is refused.
+func headless(ctx context.Context, r client.Reader, svc *corev1.Service, port corev1.ServicePort) (string, error) {
+	var list discoveryv1.EndpointSliceList
+	if err := r.List(ctx, &list, client.InNamespace(svc.Namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: svc.Name}); err != nil {
+		return "", fmt.Errorf("list endpointslices for service %s/%s: %w", svc.Namespace, svc.Name, err)
+	}
+	if len(list.Items) == 0 && len(svc.Spec.Selector) == 0 {
+		return "", fmt.Errorf("%w: service %s/%s is headless with no selector and no EndpointSlices, "+
+			"so there is no endpoint to dial; give it a selector or a ClusterIP", consts.ErrUnsupported, svc.Namespace, svc.Name)
+	}
+
+	type candidate struct {
+		hostname, address string
+		port              int32
+	}
+	var found []candidate
+	target := targetPort(port)
+	for _, s := range list.Items {
+		// A slice lists ports by the Service port's name, resolved to the
+		// number each of its endpoints serves that port on.
+		number, ok := slicePort(s, port.Name)
+		if !ok {
+			continue
+		}
+		target = number
+		for _, ep := range s.Endpoints {
+			if len(ep.Addresses) == 0 || (ep.Conditions.Ready != nil && !*ep.Conditions.Ready) {
+				continue
+			}
+			found = append(found, candidate{ptr.Deref(ep.Hostname, ""), ep.Addresses[0], number})
+		}
+	}
+	if len(found) == 0 {
+		return net.JoinHostPort(dnsName(svc.Namespace, svc.Name), strconv.Itoa(int(target))), nil
+	}
+
+	best := slices.MinFunc(found, func(a, b candidate) int {
+		// A hostname sorts ahead of none.
+		if (a.hostname == "") != (b.hostname == "") {
+			if a.hostname != "" {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Or(strings.Compare(a.hostname, b.hostname), strings.Compare(a.address, b.address))
+	})
+	host := best.address
+	if best.hostname != "" {
+		host = best.hostname + "." + dnsName(svc.Namespace, svc.Name)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(best.port))), nil
+}
+
+// slicePort is the number a slice serves the Service port called name on.
+// An unnamed Service port is listed with an empty name.
+func slicePort(s discoveryv1.EndpointSlice, name string) (int32, bool) {
+	for _, p := range s.Ports {
+		if ptr.Deref(p.Name, "") == name && p.Port != nil &&
+			ptr.Deref(p.Protocol, corev1.ProtocolTCP) == corev1.ProtocolTCP {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// targetPort is the number port maps to when no slice says, which is only
+// knowable when it is a number; a named target port is resolved per Pod.
+func targetPort(port corev1.ServicePort) int32 {
+	if number := port.TargetPort.IntValue(); number != 0 {
+		return int32(number)
+	}
+	return port.Port
+}
+
+// dnsName is how the controller Pod reaches a Service by name. See
+// consts.OriginDomain.
+func dnsName(namespace, service string) string {
+	return fmt.Sprintf("%s.%s.%s", service, namespace, consts.OriginDomain)
+}
@@ -0,0 +1,184 @@
+package endpoints
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// endpoint is one entry of a served slice: an address, an optional hostname,
+// and whether it is ready.
+type endpoint struct {
+	address, hostname string
+	ready             bool
+}
+
+// served is a slice of web's that serves the port called port on number.
+func served(name, port string, number int32, eps ...endpoint) *discoveryv1.EndpointSlice {
+	s := slice(name, "web")
+	s.Ports = []discoveryv1.EndpointPort{{Name: ptr.To(port), Port: ptr.To(number), Protocol: ptr.To(corev1.ProtocolTCP)}}
+	for _, ep := range eps {
+		e := discoveryv1.Endpoint{
+			Addresses:  []string{ep.address},
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(ep.ready)},
+		}
+		if ep.hostname != "" {
+			e.Hostname = ptr.To(ep.hostname)
+		}
+		s.Endpoints = append(s.Endpoints, e)
+	}
+	return s
+}
+
+func headlessService(selector map[string]string) *corev1.Service {
+	svc := service(selector)
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
+	return svc
+}
+
+func TestAddress(t *testing.T) {
+	selector := map[string]string{"app": "web"}
+	http := corev1.ServicePort{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)}
+
+	for _, tc := range []struct {
+		name            string
+		svc             *corev1.Service
+		port            corev1.ServicePort
+		slices          []client.Object
+		want            string
+		wantUnsupported bool
+	}{
+		{
+			name: "a ClusterIP Service by its DNS name and its own port",
+			svc:  service(selector),
+			port: http,
+			want: "web.default.svc:80",
+		},
+		{
+			name: "an ExternalName on its external name, without the trailing dot",
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: "api.example.com."},
+			},
+			port: corev1.ServicePort{Port: 443},
+			want: "api.example.com:443",
+		},
+		{
+			name:   "a headless Service on a ready endpoint's target port",
+			svc:    headlessService(selector),
+			port:   http,
+			slices: []client.Object{served("web-a", "http", 8080, endpoint{address: "10.0.0.7", ready: true})},
+			want:   "10.0.0.7:8080",
+		},
+		{
+			name: "not-ready endpoints are passed over",
+			svc:  headlessService(selector),
+			port: http,
+			slices: []client.Object{served("web-a", "http", 8080,
+				endpoint{address: "10.0.0.1", ready: false},
+				endpoint{address: "10.0.0.9", ready: true})},
+			want: "10.0.0.9:8080",
+		},
+		{
+			// A StatefulSet's: ordinal zero, by the name that survives its
+			// rescheduling.
+			name: "a hostname wins, and the first of them",
+			svc:  headlessService(selector),
+			port: http,
+			slices: []client.Object{
+				served("web-a", "http", 8080, endpoint{address: "10.0.0.1", ready: true}),
+				served("web-b", "http", 8080,
+					endpoint{address: "10.0.0.3", hostname: "web-1", ready: true},
+					endpoint{address: "10.0.0.2", hostname: "web-0", ready: true}),
+			},
+			want: "web-0.web.default.svc:8080",
+		},
+		{
+			name: "the lowest address, whatever order the slices list them in",
+			svc:  headlessService(selector),
+			port: http,
+			slices: []client.Object{
+				served("web-a", "http", 8080, endpoint{address: "10.0.0.5", ready: true}),
+				served("web-b", "http", 8080, endpoint{address: "10.0.0.4", ready: true}),
+			},
+			want: "10.0.0.4:8080",
+		},
+		{
+			name:   "IPv6 is bracketed",
+			svc:    headlessService(selector),
+			port:   http,
+			slices: []client.Object{served("web-a", "http", 8080, endpoint{address: "fd00::7", ready: true})},
+			want:   "[fd00::7]:8080",
+		},
+		{
+			name:   "a slice serving another port is not this one's",
+			svc:    headlessService(selector),
+			port:   http,
+			slices: []client.Object{served("web-a", "metrics", 9090, endpoint{address: "10.0.0.7", ready: true})},
+			want:   "web.default.svc:8080",
+		},
+		{
+			// Dialing it fails, which is true; the readiness check says why.
+			name: "nothing ready is the Service's name on the target port",
+			svc:  headlessService(selector),
+			port: http,
+			want: "web.default.svc:8080",
+		},
+		{
+			name:            "no selector and no slices has nothing to dial",
+			svc:             headlessService(nil),
+			port:            http,
+			wantUnsupported: true,
+		},
+		{
+			name:   "no selector but hand-written slices",
+			svc:    headlessService(nil),
+			port:   http,
+			slices: []client.Object{served("web-a", "http", 8080, endpoint{address: "10.0.0.7", ready: true})},
+			want:   "10.0.0.7:8080",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(tc.slices...).Build()
+			got, err := Address(context.Background(), c, tc.svc, tc.port)
+			if tc.wantUnsupported {
+				if !errors.Is(err, consts.ErrUnsupported) {
+					t.Fatalf("Address() = %q, %v; want an unsupported error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Address() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Address() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExternalPort(t *testing.T) {
+	external := &corev1.Service{Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: "api.example.com"}}
+	if got, ok := ExternalPort(external, 8443); !ok || got.Port != 8443 {
+		t.Errorf("ExternalPort() = %v, %v; want port 8443", got, ok)
+	}
+	// A name is not a number, and there is nothing to look it up in.
+	if _, ok := ExternalPort(external, 0); ok {
+		t.Error("ExternalPort() = true for no number")
+	}
+	// Anything else maps its ports, and one it does not list is not there.
+	if _, ok := ExternalPort(service(nil), 8443); ok {
+		t.Error("ExternalPort() = true for a ClusterIP Service")
+	}
+}
@@ -0,0 +1,93 @@
+// Package endpoints answers whether a Service has anything behind it to take
+// a request.
+//
+// A Service that exists and exposes the right port can still have no Pod
+// ready behind it: a Deployment scaled to zero, a rollout whose new Pods fail
+// their readiness probes, a selector that matches nothing. A tunnel in front
+// of it comes up healthy and serves 502s, and a published hostname says it is
+// fine. EndpointSlices are where Kubernetes says which backends are ready, so
+// both halves read them before publishing, and watch them to notice when
+// that changes.
+//
+// Watched, unlike Services, which are read uncached. A Service read happens
+// when the object that names it changes; readiness changes with every Pod
+// that starts or stops, and the only way to hear of that is a watch. Strip
+// keeps the cache to what is read here.
+//
+// The same slices say where a Service without a ClusterIP is reached, which
+// is Address's business; that read is uncached, since Strip keeps no
+// addresses.
+package endpoints
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// Ready reports whether svc has at least one endpoint ready to serve.
+//
+// A Service whose endpoints Kubernetes does not manage — an ExternalName, or
+// one without a selector — has nothing to wait for unless someone wrote
+// slices for it by hand, so it is ready when it has no slices at all. One
+// with a selector always gets a slice, empty or not, so having none yet is
+// the EndpointSlice controller not having caught up, and not ready.
+//
+// An endpoint with no ready condition is ready: the API says consumers must
+// read an unknown state that way.
+func Ready(ctx context.Context, r client.Reader, svc *corev1.Service) (bool, error) {
+	var slices discoveryv1.EndpointSliceList
+	if err := r.List(ctx, &slices, client.InNamespace(svc.Namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: svc.Name}); err != nil {
+		return false, fmt.Errorf("list endpointslices for service %s/%s: %w", svc.Namespace, svc.Name, err)
+	}
+	if len(slices.Items) == 0 {
+		return svc.Spec.Type == corev1.ServiceTypeExternalName || len(svc.Spec.Selector) == 0, nil
+	}
+	for _, slice := range slices.Items {
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready == nil || *ep.Conditions.Ready {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Service returns the Service a slice belongs to.
+func Service(slice client.Object) (types.NamespacedName, bool) {
+	name, ok := slice.GetLabels()[discoveryv1.LabelServiceName]
+	if !ok || name == "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: slice.GetNamespace(), Name: name}, true
+}
+
+// Strip is a cache transform that drops everything in an EndpointSlice that
+// Ready does not read: addresses, ports, topology, hints, and every
+// condition but one. The cache is cluster-wide, since any Service may turn
+// out to be a backend, so what it holds per slice is what it costs.
+//
+// Except the slices this controller writes itself. The Pod half reads those
+// back through the same cache and compares addresses and ports against what it
+// wants, so a stripped one would look wrong on every pass and be rewritten on
+// every pass. There is one per tunnelled Pod; keeping them whole costs little.
+func Strip(obj any) (any, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok || slice.Labels[consts.LabelManagedBy] == consts.ManagedBy {
+		return obj, nil
+	}
+	slice.ManagedFields = nil
+	slice.Annotations = nil
+	slice.Ports = nil
+	for i, ep := range slice.Endpoints {
+		slice.Endpoints[i] = discoveryv1.Endpoint{Conditions: discoveryv1.EndpointConditions{Ready: ep.Conditions.Ready}}
+	}
+	return slice, nil
+}
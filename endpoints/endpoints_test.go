@@ -0,0 +1,165 @@
+package endpoints
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+func service(selector map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       corev1.ServiceSpec{Selector: selector},
+	}
+}
+
+// slice belongs to the Service named service, with one endpoint per ready
+// value; a nil one has no ready condition at all.
+func slice(name, service string, ready ...*bool) *discoveryv1.EndpointSlice {
+	s := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: name,
+			Labels: map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for _, r := range ready {
+		s.Endpoints = append(s.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: discoveryv1.EndpointConditions{Ready: r},
+		})
+	}
+	return s
+}
+
+func TestReady(t *testing.T) {
+	selector := map[string]string{"app": "web"}
+	for _, tc := range []struct {
+		name   string
+		svc    *corev1.Service
+		slices []client.Object
+		want   bool
+	}{
+		{
+			name: "a selector with no slice yet",
+			svc:  service(selector),
+		},
+		{
+			name: "no selector and no slice",
+			svc:  service(nil),
+			want: true,
+		},
+		{
+			name: "an ExternalName",
+			svc: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: "example.com", Selector: selector},
+			},
+			want: true,
+		},
+		{
+			name:   "an empty slice",
+			svc:    service(selector),
+			slices: []client.Object{slice("web-a", "web")},
+		},
+		{
+			name:   "nothing ready",
+			svc:    service(selector),
+			slices: []client.Object{slice("web-a", "web", ptr.To(false), ptr.To(false))},
+		},
+		{
+			name:   "one ready in another slice",
+			svc:    service(selector),
+			slices: []client.Object{slice("web-a", "web", ptr.To(false)), slice("web-b", "web", ptr.To(true))},
+			want:   true,
+		},
+		{
+			name:   "no condition reads as ready",
+			svc:    service(selector),
+			slices: []client.Object{slice("web-a", "web", nil)},
+			want:   true,
+		},
+		{
+			name: "a hand-written slice for a Service without a selector",
+			svc:  service(nil),
+			// Someone manages these endpoints, and says none is ready.
+			slices: []client.Object{slice("web-a", "web", ptr.To(false))},
+		},
+		{
+			name:   "another Service's slice",
+			svc:    service(selector),
+			slices: []client.Object{slice("api-a", "api", ptr.To(true))},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(tc.slices...).Build()
+			got, err := Ready(context.Background(), c, tc.svc)
+			if err != nil {
+				t.Fatalf("Ready() error = %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Ready() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestService(t *testing.T) {
+	got, ok := Service(slice("web-a", "web"))
+	if want := (types.NamespacedName{Namespace: "default", Name: "web"}); !ok || got != want {
+		t.Errorf("Service() = %v, %v; want %v, true", got, ok, want)
+	}
+	// A slice somebody wrote without the label belongs to nothing we can name.
+	if _, ok := Service(slice("web-a", "")); ok {
+		t.Error("Service() = true for a slice without a service name")
+	}
+}
+
+func TestStrip(t *testing.T) {
+	s := slice("web-a", "web", ptr.To(true))
+	s.Endpoints[0].Conditions.Serving = ptr.To(true)
+	s.Endpoints[0].NodeName = ptr.To("node-1")
+	s.Ports = []discoveryv1.EndpointPort{{Port: ptr.To[int32](8080)}}
+	s.Annotations = map[string]string{"endpoints.kubernetes.io/last-change-trigger-time": "now"}
+
+	out, err := Strip(s)
+	if err != nil {
+		t.Fatalf("Strip() error = %v", err)
+	}
+	got := out.(*discoveryv1.EndpointSlice)
+	if got.Labels[discoveryv1.LabelServiceName] != "web" {
+		t.Error("Strip() dropped the service label; the watch could no longer map the slice")
+	}
+	if len(got.Ports) != 0 || got.Annotations != nil {
+		t.Errorf("Strip() kept ports %v and annotations %v", got.Ports, got.Annotations)
+	}
+	want := discoveryv1.Endpoint{Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true)}}
+	if len(got.Endpoints) != 1 || got.Endpoints[0].Addresses != nil || got.Endpoints[0].NodeName != nil ||
+		got.Endpoints[0].Conditions.Serving != nil || *got.Endpoints[0].Conditions.Ready != *want.Conditions.Ready {
+		t.Errorf("Strip() endpoints = %+v, want only the ready condition", got.Endpoints)
+	}
+}
+
+// The Pod half reads its own slices back through the cache and compares them
+// whole; stripping those would have it rewrite them on every pass.
+func TestStripKeepsOurOwnSlices(t *testing.T) {
+	s := slice("web-a", "web", ptr.To(true))
+	s.Labels[consts.LabelManagedBy] = consts.ManagedBy
+	s.Ports = []discoveryv1.EndpointPort{{Port: ptr.To[int32](8080)}}
+
+	out, _ := Strip(s)
+	got := out.(*discoveryv1.EndpointSlice)
+	if len(got.Ports) != 1 || len(got.Endpoints[0].Addresses) != 1 {
+		t.Errorf("Strip() = %+v, want the controller's own slice untouched", got)
+	}
+}
@@ -0,0 +1,123 @@
+// Package expiry reads when a tunnel is due to be retired, from the
+// {provider}/ttl and {provider}/expires-at labels. See consts.TTLLabel.
+//
+// Both spellings may sit on one object, and that is not an error: the earlier
+// deadline wins. Nothing here can carry a tunnel past what either label says,
+// so a child stamped with an expires-at and later given a longer ttl by hand
+// still goes when its parent does.
+//
+// Every half checks the deadline on its own object, rather than one half
+// tearing down the others. A Service's child Ingress carries the same instant
+// the Service does, so the two go together whichever reconciles first, and a
+// hand-written Ingress needs nothing else to expire. What they say about it is
+// written here once, so the four halves cannot drift apart in the telling.
+package expiry
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// errUnsupported marks a label that does not parse. See consts.ErrUnsupported.
+var errUnsupported = consts.ErrUnsupported
+
+// At is when obj's tunnel from provider expires, or the zero time if no label
+// says it does.
+func At(obj metav1.Object, provider string) (time.Time, error) {
+	labels := obj.GetLabels()
+	var at time.Time
+	if value, ok := labels[provider+"/"+consts.TTLLabel]; ok {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return time.Time{}, fmt.Errorf("%w: label %s/%s=%q: want a positive duration such as 30m or 48h",
+				errUnsupported, provider, consts.TTLLabel, value)
+		}
+		at = obj.GetCreationTimestamp().Add(ttl)
+	}
+	if value, ok := labels[provider+"/"+consts.ExpiresAtLabel]; ok {
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || secs <= 0 {
+			return time.Time{}, fmt.Errorf("%w: label %s/%s=%q: want a time in Unix seconds, such as %d",
+				errUnsupported, provider, consts.ExpiresAtLabel, value, time.Now().Add(time.Hour).Unix())
+		}
+		if t := time.Unix(secs, 0); at.IsZero() || t.Before(at) {
+			at = t
+		}
+	}
+	return at, nil
+}
+
+// Value is the {provider}/expires-at value that pins a child to at.
+func Value(at time.Time) string {
+	return strconv.FormatInt(at.Unix(), 10)
+}
+
+// Elapsed reports whether at has passed. The zero time never does.
+func Elapsed(at time.Time) bool {
+	return !at.IsZero() && !time.Now().Before(at)
+}
+
+// Sooner is the requeue interval that brings a reconcile back by at as well
+// as after d, which is zero for none. A second at the least, so a deadline a
+// moment away is not a requeue of zero, which means never.
+func Sooner(d time.Duration, at time.Time) time.Duration {
+	if at.IsZero() {
+		return d
+	}
+	left := max(time.Until(at), time.Second)
+	if d == 0 || left < d {
+		return left
+	}
+	return d
+}
+
+// Format renders at and the time left until it, for the expiry messages.
+// Rounded to the second: the deadline is only stored that precisely.
+func Format(at time.Time) (string, time.Duration) {
+	return at.UTC().Format(time.RFC3339), time.Until(at).Round(time.Second)
+}
+
+// Expired says that a tunnel from provider expired at at and was retired, and
+// how to have it back. The event Retired records, and a Gateway's Programmed
+// message while it is over.
+func Expired(provider string, at time.Time) string {
+	deadline, _ := Format(at)
+	return fmt.Sprintf(consts.MsgTunnelExpiredFmt, deadline, provider, provider)
+}
+
+// Retired says on obj that its tunnel from provider has expired, when news is
+// set: the pass that took something down, or the first to tell obj. Every
+// pass after finds it still expired, and saying so each time would bury the
+// one event that matters. What counts as news is read off each half's own
+// object; what is said is the same for all of them.
+func Retired(ctx context.Context, rec events.EventRecorder, obj client.Object, provider string, at time.Time, news bool) {
+	if !news {
+		return
+	}
+	deadline, _ := Format(at)
+	log.FromContext(ctx).Info("tunnel expired", "provider", provider, "expiresAt", deadline)
+	rec.Eventf(obj, nil, consts.EventTypeNormal, consts.ReasonTunnelExpired,
+		consts.ActionExpire, "%s", Expired(provider, at))
+}
+
+// Announce says on obj when its newly published tunnel will be retired, if it
+// will. Beside the ready event rather than in it, so a tunnel without a
+// deadline reads as it always has.
+func Announce(ctx context.Context, rec events.EventRecorder, obj client.Object, at time.Time) {
+	if at.IsZero() {
+		return
+	}
+	deadline, left := Format(at)
+	log.FromContext(ctx).Info("tunnel expires", "expiresAt", deadline, "remaining", left)
+	rec.Eventf(obj, nil, consts.EventTypeNormal, consts.ReasonTunnelExpiry,
+		consts.ActionExpire, consts.MsgTunnelExpiresFmt, deadline, left)
+}
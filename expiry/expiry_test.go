@@ -0,0 +1,155 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/events"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+func object(created time.Time, labels map[string]string) *corev1.Service {
+	return &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default", Name: "web",
+		CreationTimestamp: metav1.NewTime(created),
+		Labels:            labels,
+	}}
+}
+
+func TestAt(t *testing.T) {
+	created := time.Unix(1_700_000_000, 0)
+	ttl := consts.ProviderTunnelPizza + "/" + consts.TTLLabel
+	expiresAt := consts.ProviderTunnelPizza + "/" + consts.ExpiresAtLabel
+	for _, tc := range []struct {
+		name            string
+		labels          map[string]string
+		want            time.Time
+		wantUnsupported bool
+	}{
+		{name: "no label"},
+		{
+			name:   "a ttl counts from creation",
+			labels: map[string]string{ttl: "2h"},
+			want:   created.Add(2 * time.Hour),
+		},
+		{
+			name:   "expires-at is absolute",
+			labels: map[string]string{expiresAt: "1700003600"},
+			want:   created.Add(time.Hour),
+		},
+		{
+			name:   "the earlier of the two wins",
+			labels: map[string]string{ttl: "2h", expiresAt: "1700003600"},
+			want:   created.Add(time.Hour),
+		},
+		{
+			name:   "another provider's label is not ours",
+			labels: map[string]string{consts.ProviderCloudflare + "/" + consts.TTLLabel: "1h"},
+		},
+		{name: "days are not a Go duration", labels: map[string]string{ttl: "2d"}, wantUnsupported: true},
+		{name: "a negative ttl", labels: map[string]string{ttl: "-1h"}, wantUnsupported: true},
+		{name: "a date", labels: map[string]string{expiresAt: "2026-10-18"}, wantUnsupported: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := At(object(created, tc.labels), consts.ProviderTunnelPizza)
+			if tc.wantUnsupported {
+				if !errors.Is(err, consts.ErrUnsupported) {
+					t.Errorf("At() error = %v, want unsupported", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("At() error = %v", err)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("At() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// What the Service and Pod halves stamp on a child reads back as the same
+// instant, so every level of a tunnel expires together.
+func TestValueRoundTrips(t *testing.T) {
+	at := time.Unix(1_700_000_000, 0)
+	child := object(time.Now(), map[string]string{
+		consts.ProviderTunnelPizza + "/" + consts.ExpiresAtLabel: Value(at),
+	})
+	got, err := At(child, consts.ProviderTunnelPizza)
+	if err != nil || !got.Equal(at) {
+		t.Errorf("At(Value(%v)) = %v, %v", at, got, err)
+	}
+}
+
+func TestElapsed(t *testing.T) {
+	if Elapsed(time.Time{}) {
+		t.Error("Elapsed(zero) = true; no deadline never passes")
+	}
+	if !Elapsed(time.Now().Add(-time.Second)) {
+		t.Error("Elapsed(a second ago) = false")
+	}
+	if Elapsed(time.Now().Add(time.Hour)) {
+		t.Error("Elapsed(an hour from now) = true")
+	}
+}
+
+func TestSooner(t *testing.T) {
+	if got := Sooner(time.Minute, time.Time{}); got != time.Minute {
+		t.Errorf("Sooner(1m, none) = %v, want 1m", got)
+	}
+	if got := Sooner(0, time.Now().Add(time.Hour)); got <= 59*time.Minute || got > time.Hour {
+		t.Errorf("Sooner(0, in 1h) = %v, want about an hour", got)
+	}
+	if got := Sooner(time.Minute, time.Now().Add(time.Hour)); got != time.Minute {
+		t.Errorf("Sooner(1m, in 1h) = %v, want 1m", got)
+	}
+	if got := Sooner(time.Minute, time.Now()); got != time.Second {
+		t.Errorf("Sooner(1m, now) = %v, want a second rather than never", got)
+	}
+}
+
+// TestRetired: said only when it is news, and the same words whichever half
+// says it, naming both labels that would bring the tunnel back.
+func TestRetired(t *testing.T) {
+	recorder := events.NewFakeRecorder(10)
+	obj := object(time.Now(), nil)
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	Retired(context.Background(), recorder, obj, "tunnel.pizza", at, false)
+	Retired(context.Background(), recorder, obj, "tunnel.pizza", at, true)
+	if len(recorder.Events) != 1 {
+		t.Fatalf("%d events, want 1: only the pass that was news", len(recorder.Events))
+	}
+	e := <-recorder.Events
+	for _, want := range []string{consts.ReasonTunnelExpired, "2026-01-02T03:04:05Z", "tunnel.pizza/ttl", "tunnel.pizza/expires-at"} {
+		if !strings.Contains(e, want) {
+			t.Errorf("event %q, want it to contain %q", e, want)
+		}
+	}
+}
+
+// TestAnnounce: a tunnel without a deadline hears nothing about one.
+func TestAnnounce(t *testing.T) {
+	recorder := events.NewFakeRecorder(10)
+	obj := object(time.Now(), nil)
+
+	Announce(context.Background(), recorder, obj, time.Time{})
+	if len(recorder.Events) != 0 {
+		t.Fatalf("event %q for a tunnel with no deadline", <-recorder.Events)
+	}
+	Announce(context.Background(), recorder, obj, time.Now().Add(time.Hour))
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, consts.ReasonTunnelExpiry) {
+			t.Errorf("event %q, want %s", e, consts.ReasonTunnelExpiry)
+		}
+	default:
+		t.Error("no event for a tunnel with a deadline")
+	}
+}
@@ -18,6 +18,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 	gatewayconsts "sigs.k8s.io/gateway-api/pkg/consts"
+
+	"github.com/scaffoldly/tunnel/consts"
 )
 
 // Annotations every Gateway API CRD carries, and the two things the upstream
@@ -31,18 +33,44 @@ const (
 	annotationChannel       = gatewayconsts.ChannelAnnotation
 )
 
-// crdYAML is the standard channel bundle, copied from the gateway-api module
-// itself rather than fetched from a release URL — go:embed cannot reach into a
-// dependency, so it has to be vendored, but it can be vendored from the exact
-// version the compiler resolved.
+// The two channel bundles, copied from the gateway-api module itself rather
+// than fetched from a release URL — go:embed cannot reach into a dependency, so
+// they have to be vendored, but they can be vendored from the exact version the
+// compiler resolved.
+//
+// Both are embedded and one is chosen at startup by --gateway-api-channel.
+// Experimental is a superset of standard — TCPRoute, TLSRoute, ListenerSet and
+// the experimental fields on the standard kinds — and a team that needs those
+// cannot get them from a bundle compiled out of the binary.
 //
 // Regenerate with `go generate ./gateway/...` when go.mod moves; a test fails
-// if the two disagree, because installing a schema the controller cannot
-// deserialize is worse than not installing one.
+// if either disagrees with it, because installing a schema the controller
+// cannot deserialize is worse than not installing one.
 //
 //go:generate make -C .. crds
 //go:embed crds/zz_generated.standard-install.yaml
-var crdYAML []byte
+var standardYAML []byte
+
+//go:embed crds/zz_generated.experimental-install.yaml
+var experimentalYAML []byte
+
+// bundle returns the embedded CRDs for a release channel.
+//
+// An unknown channel is an error rather than a fallback to standard: the flag
+// chooses what gets written to cluster-scoped objects every implementation
+// shares, and a typo there should stop the install, not quietly pick the other
+// one.
+func bundle(channel string) ([]byte, error) {
+	switch channel {
+	case consts.GatewayAPIChannelStandard:
+		return standardYAML, nil
+	case consts.GatewayAPIChannelExperimental:
+		return experimentalYAML, nil
+	default:
+		return nil, fmt.Errorf("unknown gateway api channel %q; must be %q or %q",
+			channel, consts.GatewayAPIChannelStandard, consts.GatewayAPIChannelExperimental)
+	}
+}
 
 // bundledVersion is the Gateway API release this controller is built for:
 // the version the module the compiler resolved says it is, not a string
@@ -78,12 +106,21 @@ var supportedVersions = semver.MajorMinor(bundledVersion)
 // Gated on --install, alongside the classes: a cluster that manages its own
 // Gateway API — Istio, Cilium, an admin with Argo — turns the flag off and
 // this never runs.
-func installCRDs(ctx context.Context, c client.Client) error {
+//
+// channel picks the bundle and changes none of the rules. Choosing experimental
+// on a cluster that already has standard CRDs installs only the kinds standard
+// does not carry; the shared kinds stay standard, because crossing channels in
+// either direction is rule 2, and the log line says so per CRD.
+func installCRDs(ctx context.Context, c client.Client, channel string) error {
 	logger := log.FromContext(ctx)
 
-	ours, err := parseCRDs(crdYAML)
+	raw, err := bundle(channel)
+	if err != nil {
+		return err
+	}
+	ours, err := parseCRDs(raw)
 	if err != nil {
-		return fmt.Errorf("parse bundled crds: %w", err)
+		return fmt.Errorf("parse bundled %s crds: %w", channel, err)
 	}
 
 	for _, crd := range ours {
@@ -96,7 +133,8 @@ func installCRDs(ctx context.Context, c client.Client) error {
 				return fmt.Errorf("create crd %s: %w", crd.Name, err)
 			}
 			logger.Info("created gateway api crd", "crd", crd.Name,
-				"version", crd.Annotations[annotationBundleVersion])
+				"version", crd.Annotations[annotationBundleVersion],
+				"channel", crd.Annotations[annotationChannel])
 
 		case err != nil:
 			return fmt.Errorf("get crd %s: %w", crd.Name, err)
@@ -117,7 +155,8 @@ func installCRDs(ctx context.Context, c client.Client) error {
 			}
 			logger.Info("upgraded gateway api crd", "crd", crd.Name, "reason", reason,
 				"from", existing.Annotations[annotationBundleVersion],
-				"to", crd.Annotations[annotationBundleVersion])
+				"to", crd.Annotations[annotationBundleVersion],
+				"channel", crd.Annotations[annotationChannel])
 		}
 	}
 
@@ -134,7 +173,10 @@ func decide(existing, ours *apiextensionsv1.CustomResourceDefinition) (bool, str
 	wantChannel := ours.Annotations[annotationChannel]
 	if haveChannel != wantChannel {
 		// Rule 2. Experimental carries fields standard does not, so
-		// downgrading a channel silently drops data from live objects.
+		// downgrading a channel silently drops data from live objects. The
+		// other direction is refused too: upgrading standard to experimental
+		// under another implementation opts it into fields it never agreed
+		// to serve.
 		return false, fmt.Sprintf("different release channel (%q, bundled is %q)", haveChannel, wantChannel)
 	}
 
@@ -221,6 +263,10 @@ type versionReport struct {
 // installCRDs cares about the channel because writing across channels drops
 // data; reading does not. Reporting an experimental install unsupported would
 // under-report, which is the failure mode this condition is most prone to.
+//
+// It is still named in the message. Which channel a cluster runs is the other
+// half of "what was detected", and with --gateway-api-channel able to install
+// either one, the class is the one place a user can check which they got.
 func checkVersions(ctx context.Context, r client.Reader) (versionReport, error) {
 	// Metadata only. The Gateway API bundle is about 700KB of schema across a
 	// dozen CRDs, all of it irrelevant here, and this runs on every
@@ -234,6 +280,7 @@ func checkVersions(ctx context.Context, r client.Reader) (versionReport, error)
 
 	var (
 		versions    []string
+		channels    []string
 		unannotated []string
 	)
 	for _, crd := range list.Items {
@@ -246,6 +293,9 @@ func checkVersions(ctx context.Context, r client.Reader) (versionReport, error)
 		if !strings.HasSuffix(crd.Name, "."+gatewayv1.GroupName) {
 			continue
 		}
+		if c := crd.Annotations[annotationChannel]; c != "" {
+			channels = append(channels, c)
+		}
 		if v := crd.Annotations[annotationBundleVersion]; v != "" {
 			versions = append(versions, v)
 			continue
@@ -253,14 +303,21 @@ func checkVersions(ctx context.Context, r client.Reader) (versionReport, error)
 		unannotated = append(unannotated, crd.Name)
 	}
 
-	return report(versions, unannotated), nil
+	return report(versions, channels, unannotated), nil
 }
 
 // report turns what was found into the condition's status and message. Split
 // out from the read so the policy can be tested without a cluster.
-func report(versions, unannotated []string) versionReport {
+//
+// channels only ever adds to the message. See checkVersions for why it never
+// moves the status.
+func report(versions, channels, unannotated []string) versionReport {
 	slices.Sort(unannotated)
 	distinct := slices.Compact(slices.Sorted(slices.Values(versions)))
+	onChannels := ""
+	if found := slices.Compact(slices.Sorted(slices.Values(channels))); len(found) > 0 {
+		onChannels = fmt.Sprintf(" on the %s channel", strings.Join(found, " and "))
+	}
 
 	switch {
 	case len(distinct) == 0 && len(unannotated) == 0:
@@ -273,12 +330,12 @@ func report(versions, unannotated []string) versionReport {
 		detail := fmt.Sprintf("are missing the %s annotation on %s", annotationBundleVersion,
 			strings.Join(unannotated, ", "))
 		if len(distinct) > 0 {
-			detail = fmt.Sprintf("are at %s, and %s", strings.Join(distinct, ", "), detail)
+			detail = fmt.Sprintf("are at %s%s, and %s", strings.Join(distinct, ", "), onChannels, detail)
 		}
 		return versionReport{supported: false, detail: detail}
 	}
 
-	detail := fmt.Sprintf("are at %s", strings.Join(distinct, ", "))
+	detail := fmt.Sprintf("are at %s%s", strings.Join(distinct, ", "), onChannels)
 	for _, v := range distinct {
 		// MajorMinor returns "" for anything it cannot parse, which never
 		// equals supportedVersions — so a version string that is not semver at
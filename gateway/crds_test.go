@@ -5,6 +5,8 @@ import (
 
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/scaffoldly/tunnel/consts"
 )
 
 func crd(version, channel string) *apiextensionsv1.CustomResourceDefinition {
@@ -96,45 +98,90 @@ func TestDecide(t *testing.T) {
 	}
 }
 
-// The bundle is embedded, so a truncated or missing file is a build-time
-// problem rather than a runtime one — but the parse still has to yield the
-// kinds the controller watches.
+// The bundles are embedded, so a truncated or missing file is a build-time
+// problem rather than a runtime one — but each parse still has to yield the
+// kinds the controller watches, and the kinds its channel exists for.
 func TestParseCRDsFindsWatchedKinds(t *testing.T) {
-	got, err := parseCRDs(crdYAML)
-	if err != nil {
-		t.Fatalf("parseCRDs: %v", err)
+	tests := []struct {
+		channel string
+		want    []string
+	}{
+		{
+			channel: consts.GatewayAPIChannelStandard,
+			// The two the manager actually watches. Missing either means the
+			// gateway half never registers.
+			want: []string{
+				"gatewayclasses.gateway.networking.k8s.io",
+				"gateways.gateway.networking.k8s.io",
+			},
+		},
+		{
+			channel: consts.GatewayAPIChannelExperimental,
+			// The same two, plus what somebody picks this channel for.
+			want: []string{
+				"gatewayclasses.gateway.networking.k8s.io",
+				"gateways.gateway.networking.k8s.io",
+				"tcproutes.gateway.networking.k8s.io",
+				"tlsroutes.gateway.networking.k8s.io",
+				"listenersets.gateway.networking.k8s.io",
+			},
+		},
 	}
 
-	found := map[string]bool{}
-	for _, c := range got {
-		found[c.Name] = true
-		if c.Annotations[annotationChannel] != "standard" {
-			t.Errorf("%s: channel = %q, want standard", c.Name, c.Annotations[annotationChannel])
-		}
+	for _, tt := range tests {
+		t.Run(tt.channel, func(t *testing.T) {
+			raw, err := bundle(tt.channel)
+			if err != nil {
+				t.Fatalf("bundle(%q): %v", tt.channel, err)
+			}
+			got, err := parseCRDs(raw)
+			if err != nil {
+				t.Fatalf("parseCRDs: %v", err)
+			}
+
+			found := map[string]bool{}
+			for _, c := range got {
+				found[c.Name] = true
+				// decide compares this annotation, so a bundle carrying the
+				// wrong one would cross channels while believing it had not.
+				if c.Annotations[annotationChannel] != tt.channel {
+					t.Errorf("%s: channel = %q, want %q", c.Name, c.Annotations[annotationChannel], tt.channel)
+				}
+			}
+			for _, name := range tt.want {
+				if !found[name] {
+					t.Errorf("%s bundle does not contain %s", tt.channel, name)
+				}
+			}
+		})
 	}
+}
 
-	// The two the manager actually watches. Missing either means the gateway
-	// half never registers.
-	for _, name := range []string{
-		"gatewayclasses.gateway.networking.k8s.io",
-		"gateways.gateway.networking.k8s.io",
-	} {
-		if !found[name] {
-			t.Errorf("bundle does not contain %s", name)
+// A typo in the flag must not quietly install the other channel.
+func TestBundleRejectsUnknownChannel(t *testing.T) {
+	for _, channel := range []string{"", "Standard", "stable"} {
+		if _, err := bundle(channel); err == nil {
+			t.Errorf("bundle(%q) = nil error, want one", channel)
 		}
 	}
 }
 
-// The embedded bundle and the compiled types must be the same release, or the
+// The embedded bundles and the compiled types must be the same release, or the
 // controller installs a schema it cannot deserialize.
 func TestBundleVersionMatchesGoMod(t *testing.T) {
-	got, err := parseCRDs(crdYAML)
-	if err != nil {
-		t.Fatalf("parseCRDs: %v", err)
-	}
-	for _, c := range got {
-		if v := c.Annotations[annotationBundleVersion]; v != bundledVersion {
-			t.Errorf("%s: bundle-version = %q, want %q — run `make crds`", c.Name, v, bundledVersion)
+	for _, channel := range []string{consts.GatewayAPIChannelStandard, consts.GatewayAPIChannelExperimental} {
+		raw, err := bundle(channel)
+		if err != nil {
+			t.Fatalf("bundle(%q): %v", channel, err)
+		}
+		got, err := parseCRDs(raw)
+		if err != nil {
+			t.Fatalf("parseCRDs(%s): %v", channel, err)
+		}
+		for _, c := range got {
+			if v := c.Annotations[annotationBundleVersion]; v != bundledVersion {
+				t.Errorf("%s (%s): bundle-version = %q, want %q — run `make crds`", c.Name, channel, v, bundledVersion)
+			}
 		}
 	}
 }
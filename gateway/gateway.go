@@ -13,10 +13,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"path"
 	"reflect"
+	"slices"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
@@ -35,7 +39,13 @@ import (
 
 	"github.com/scaffoldly/tunnel/config"
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/domains"
+	"github.com/scaffoldly/tunnel/endpoints"
+	"github.com/scaffoldly/tunnel/expiry"
+	"github.com/scaffoldly/tunnel/optin"
+	"github.com/scaffoldly/tunnel/proxy"
 	"github.com/scaffoldly/tunnel/tunnels"
+	"github.com/scaffoldly/tunnel/wake"
 )
 
 // ControllerName is the value a GatewayClass must carry in spec.controllerName
@@ -53,6 +63,10 @@ var Name = path.Base(string(ControllerName))
 // dropping every event. See consts.Reporter.
 var ReporterName = consts.Reporter(string(ControllerName))
 
+// gatewayKind is what a Gateway's DNSEndpoint is owned by, and named for. See
+// domains.Name.
+var gatewayKind = gatewayv1.SchemeGroupVersion.WithKind("Gateway")
+
 // New registers the Gateway API controllers with mgr.
 //
 // Registering nothing is a valid outcome: Gateway API CRDs are not installed
@@ -71,7 +85,7 @@ func New(mgr ctrl.Manager, cfg config.Config) error {
 		if err != nil {
 			return fmt.Errorf("build crd client: %w", err)
 		}
-		if err := installCRDs(context.Background(), c); err != nil {
+		if err := installCRDs(context.Background(), c, cfg.GatewayAPIChannel); err != nil {
 			return fmt.Errorf("install gateway api crds: %w", err)
 		}
 		if err := awaitEstablished(context.Background(), c); err != nil {
@@ -88,21 +102,53 @@ func New(mgr ctrl.Manager, cfg config.Config) error {
 		return nil
 	}
 
-	if err := (&ClassReconciler{Client: mgr.GetClient(), CRDs: mgr.GetAPIReader()}).setup(mgr); err != nil {
-		return fmt.Errorf("setup gatewayclass controller: %w", err)
+	// GatewayClass status is cluster-scoped, and a namespaced install can
+	// neither watch the classes nor write it. Their Gateways are still served;
+	// see (*Reconciler).class.
+	if !cfg.Scoped() {
+		if err := (&ClassReconciler{Client: mgr.GetClient(), CRDs: mgr.GetAPIReader()}).setup(mgr); err != nil {
+			return fmt.Errorf("setup gatewayclass controller: %w", err)
+		}
 	}
 
+	// Made first: the health check carries its token. See
+	// proxy.(*Front).HealthToken.
+	front := proxy.NewFront(mgr.GetLogger().WithName(consts.ControllerGateway), consts.ControllerGateway, "Gateway")
 	store := tunnels.NewStore(mgr.GetLogger().WithName(consts.ControllerGateway), tunnels.Dial, consts.TunnelRetryInterval)
+	store.Health = tunnels.Health{
+		Interval: cfg.TunnelHealthInterval,
+		Path:     cfg.TunnelHealthPath,
+		Failures: cfg.TunnelHealthFailures,
+		Check:    tunnels.Check(front.HealthToken()),
+	}
 	if err := mgr.Add(store); err != nil {
 		return fmt.Errorf("add tunnel store: %w", err)
 	}
 
+	if err := mgr.Add(front); err != nil {
+		return fmt.Errorf("add origin front: %w", err)
+	}
+
+	served, err := domains.Installed(mgr)
+	if err != nil {
+		return fmt.Errorf("detect dnsendpoint: %w", err)
+	}
+
 	r := &Reconciler{
-		Client:   mgr.GetClient(),
-		Services: mgr.GetAPIReader(),
-		Recorder: mgr.GetEventRecorder(ReporterName),
-		Tunnels:  store,
+		Client:     mgr.GetClient(),
+		Services:   mgr.GetAPIReader(),
+		Recorder:   mgr.GetEventRecorder(ReporterName),
+		Tunnels:    store,
+		Domains:    &domains.Publisher{Client: mgr.GetClient(), Served: served},
+		Policies:   mgr.GetAPIReader(),
+		Front:      front,
+		Namespaces: &optin.Gate{Reader: mgr.GetClient(), Required: cfg.NamespaceOptIn},
+		Classes:    mgr.GetClient(),
 	}
+	if cfg.Scoped() {
+		r.Classes = mgr.GetAPIReader()
+	}
+	front.Wake = r.wake
 	if err := r.setup(mgr, store); err != nil {
 		return fmt.Errorf("setup gateway controller: %w", err)
 	}
@@ -206,6 +252,19 @@ func (r *ClassReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 		ObservedGeneration: class.Generation,
 	}
 
+	// A parametersRef this controller cannot read as a policy ConfigMap is
+	// the one thing about the class itself that is wrong, and the spec has a
+	// reason for it. Its shape only: whether the ConfigMap exists is a
+	// question for each Gateway, which re-reads it, and one that is missing
+	// now may not be in a minute.
+	if p := class.Spec.ParametersRef; p != nil {
+		if _, err := classPolicy(class.Name, p); err != nil {
+			accepted.Status = metav1.ConditionFalse
+			accepted.Reason = string(gatewayv1.GatewayClassReasonInvalidParameters)
+			accepted.Message = err.Error()
+		}
+	}
+
 	// A failed read is reported as unsupported rather than swallowed: we
 	// cannot vouch for versions we could not look at, and publishing True
 	// unverified is the same bug as the Accepted=False this package used to
@@ -253,10 +312,27 @@ type Reconciler struct {
 	Recorder events.EventRecorder
 	// Tunnels owns the live tunnels; Reconcile only declares what it wants.
 	Tunnels *tunnels.Store
+	// Domains publishes the Gateway's listener hostnames as CNAMEs to its
+	// tunnel.
+	Domains *domains.Publisher
+	// Policies reads access policy ConfigMaps and the Secrets they name.
+	// Uncached: an informer over every Secret in the cluster would hold every
+	// credential in it in this process's memory.
+	Policies client.Reader
+	// Front enforces those policies between the tunnel and the origin.
+	Front *proxy.Front
+	// Namespaces decides which namespaces may have tunnels at all.
+	Namespaces *optin.Gate
+	// Classes reads GatewayClasses. See ingress.Reconciler.Classes.
+	Classes client.Reader
 }
 
 func (r *Reconciler) setup(mgr ctrl.Manager, store *tunnels.Store) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &gatewayv1.HTTPRoute{},
+		backendIndex, backendServices); err != nil {
+		return fmt.Errorf("index httproute backends: %w", err)
+	}
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&gatewayv1.Gateway{}).
 		// Routes carry the backends, so a Gateway's origin changes when its
 		// routes do without the Gateway itself being touched.
@@ -265,8 +341,56 @@ func (r *Reconciler) setup(mgr ctrl.Manager, store *tunnels.Store) error {
 		// long after that; neither is a change to any object the API server
 		// would report.
 		WatchesRawSource(source.Channel(store.Source(), &handler.EnqueueRequestForObject{})).
-		Named(consts.ControllerGateway).
-		Complete(r)
+		// The origin is resolved from the backend Service, which can appear
+		// after the Gateway or be edited under it, and whether it is up from
+		// its EndpointSlices. Metadata only for the Service: a trigger, read
+		// uncached when it counts.
+		WatchesMetadata(&corev1.Service{}, handler.EnqueueRequestsFromMapFunc(r.backendOf)).
+		Watches(&discoveryv1.EndpointSlice{}, handler.EnqueueRequestsFromMapFunc(r.backendOf))
+	b = r.Namespaces.Watch(b, func() client.ObjectList { return &gatewayv1.GatewayList{} })
+	if r.Domains.Served {
+		b = b.Owns(domains.Object())
+	}
+	return b.Named(consts.ControllerGateway).Complete(r)
+}
+
+// wake scales key's backend up from zero, for the Front when a request finds
+// it down under a scale-to-zero policy. The Gateway is read afresh: the Front
+// knows only the key, and its routes may have changed since it was served.
+func (r *Reconciler) wake(ctx context.Context, key types.NamespacedName) error {
+	var gw gatewayv1.Gateway
+	if err := r.Get(ctx, key, &gw); err != nil {
+		return fmt.Errorf("get gateway %s: %w", key, err)
+	}
+	_, svc, err := r.origin(ctx, &gw)
+	if err != nil {
+		return err
+	}
+	return wake.ScaleFor(ctx, r.Client, r.Services, r.Recorder, &gw, svc, 1, consts.MsgBackendWokenFmt)
+}
+
+// backendOf maps a Service, or one of its EndpointSlices, to the Gateways
+// whose routes send to it: through the backend index to the routes, then
+// through routeParents to the Gateways. Routes only reach Services in their
+// own namespace — see single — so that is the only one to look in.
+func (r *Reconciler) backendOf(ctx context.Context, obj client.Object) []reconcile.Request {
+	svc := client.ObjectKeyFromObject(obj)
+	if _, ok := obj.(*discoveryv1.EndpointSlice); ok {
+		if svc, ok = endpoints.Service(obj); !ok {
+			return nil
+		}
+	}
+	var routes gatewayv1.HTTPRouteList
+	if err := r.List(ctx, &routes, client.InNamespace(svc.Namespace),
+		client.MatchingFields{backendIndex: svc.Name}); err != nil {
+		log.FromContext(ctx).Error(err, "list httproutes for backend", "service", svc)
+		return nil
+	}
+	var out []reconcile.Request
+	for i := range routes.Items {
+		out = append(out, routeParents(ctx, &routes.Items[i])...)
+	}
+	return out
 }
 
 // routeParents maps an HTTPRoute to the Gateways it attaches to, so a route
@@ -300,7 +424,7 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		if apierrors.IsNotFound(err) {
 			// Deleted between the event and this read. The tunnel lives in
 			// this process, so closing it is the whole teardown.
-			r.Tunnels.Forget(req.NamespacedName)
+			r.forget(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
@@ -314,18 +438,70 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		// Someone else's Gateway, or a dangling class. It may have been ours a
 		// moment ago, though, and a reclassed Gateway has to give its tunnel
 		// back and take our stale address with it.
-		if r.Tunnels.Forget(req.NamespacedName) {
-			if _, err := r.publish(ctx, &gw, ""); err != nil {
+		//
+		// Programmed goes with it: it is a claim by whichever controller
+		// serves the Gateway, and the next one makes its own.
+		if r.forget(req.NamespacedName) {
+			if _, err := r.publish(ctx, &gw, "", nil); err != nil {
+				return ctrl.Result{}, err
+			}
+			if err := r.Domains.Withdraw(ctx, &gw, gatewayKind); err != nil {
 				return ctrl.Result{}, err
 			}
 		}
 		return ctrl.Result{}, nil
 	}
 
-	origin, err := r.origin(ctx, &gw)
+	provider := class.Name
+
+	// The namespace, then expiry, before anything else, as in the Ingress
+	// half. Not Invalid: nothing about the Gateway is wrong.
+	reason := gatewayv1.GatewayConditionReason(consts.ReasonNamespaceNotAllowed)
+	err = r.Namespaces.Admit(ctx, gw.Namespace)
+	var expires time.Time
+	if err == nil {
+		reason = gatewayv1.GatewayReasonInvalid
+		expires, err = expiry.At(&gw, provider)
+	}
+	if err == nil && expiry.Elapsed(expires) {
+		return ctrl.Result{}, r.expire(ctx, &gw, provider, expires)
+	}
+	// Addresses next: they need nothing but the object, and the spec gives a
+	// refusal over them its own reason.
+	if err == nil {
+		reason = gatewayv1.GatewayReasonAddressNotAssigned
+		err = addresses(&gw, provider)
+	}
+	var origin *url.URL
+	var svc *corev1.Service
+	if err == nil {
+		reason = gatewayv1.GatewayReasonInvalid
+		origin, svc, err = r.origin(ctx, &gw)
+	}
+	var ready bool
+	if err == nil {
+		ready, err = endpoints.Ready(ctx, r.Client, svc)
+	}
+	// Last, and wrapping the origin rather than beside it: what the tunnel
+	// dials is this process, which counts the traffic and enforces any
+	// policy. A policy that cannot be read fails here with everything else,
+	// so the tunnel goes down rather than up without it.
+	var res ctrl.Result
+	if err == nil {
+		origin, res, err = r.front(ctx, req.NamespacedName, &gw, class, origin)
+	}
 	if err != nil {
-		r.Tunnels.Forget(req.NamespacedName)
-		if _, clearErr := r.publish(ctx, &gw, ""); clearErr != nil {
+		r.forget(req.NamespacedName)
+		cond := programmed(&gw, metav1.ConditionFalse, reason, fmt.Sprintf(consts.MsgUnsupportedFmt, err))
+		if !errors.Is(err, errUnsupported) {
+			// Not the spec's fault — a Service that does not exist yet — so
+			// not Invalid either.
+			cond = programmed(&gw, metav1.ConditionFalse, gatewayv1.GatewayReasonPending, err.Error())
+		}
+		if _, clearErr := r.publish(ctx, &gw, "", &cond); clearErr != nil {
+			return ctrl.Result{}, clearErr
+		}
+		if clearErr := r.Domains.Withdraw(ctx, &gw, gatewayKind); clearErr != nil {
 			return ctrl.Result{}, clearErr
 		}
 		if errors.Is(err, errUnsupported) {
@@ -340,11 +516,58 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		return ctrl.Result{}, err
 	}
 
-	provider := class.Name
+	// Every return from here on is back by the deadline, including the ones
+	// that wait on the store or the EndpointSlice watch.
+	res.RequeueAfter = expiry.Sooner(res.RequeueAfter, expires)
+	publishable, wentDown := r.Front.Backend(req.NamespacedName, ready)
 	status := r.Tunnels.Ensure(req.NamespacedName, class, origin)
+	if !ready && (status.State == tunnels.Ready || status.State == tunnels.Degraded) {
+		// Said when something changed: the backend went down, the tunnel
+		// came up while it was, or the hostname was withdrawn. Not on every
+		// policy resync after, for as long as it stays down or asleep.
+		announce := wentDown || status.Changed
+		msg := fmt.Sprintf(consts.MsgBackendMaintenanceFmt, client.ObjectKeyFromObject(svc))
+		eventType := consts.EventTypeWarning
+		switch {
+		case r.Front.Wakes(req.NamespacedName):
+			msg = fmt.Sprintf(consts.MsgBackendAsleepFmt, client.ObjectKeyFromObject(svc))
+			eventType = consts.EventTypeNormal
+		case !publishable:
+			msg = fmt.Sprintf(consts.MsgBackendHeldFmt, client.ObjectKeyFromObject(svc))
+			cond := programmed(&gw, metav1.ConditionFalse, gatewayv1.GatewayReasonPending, msg)
+			withdrawn, err := r.publish(ctx, &gw, "", &cond)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			announce = announce || withdrawn
+			if err := r.Domains.Withdraw(ctx, &gw, gatewayKind); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		if announce {
+			logger.Info("backend has no ready endpoints", "service", client.ObjectKeyFromObject(svc),
+				"published", publishable)
+			r.Recorder.Eventf(&gw, nil, eventType, consts.ReasonBackendUnavailable,
+				consts.ActionProvision, "%s", msg)
+		}
+		if !publishable {
+			return res, nil
+		}
+	}
+	if idle, ok := r.Front.Idle(req.NamespacedName); ok && ready {
+		if err := wake.ScaleFor(ctx, r.Client, r.Services, r.Recorder, &gw, svc, 0, consts.MsgBackendSleptFmt, idle); err != nil {
+			if !errors.Is(err, errUnsupported) {
+				return ctrl.Result{}, err
+			}
+			r.Recorder.Eventf(&gw, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
+				consts.ActionScale, consts.MsgUnsupportedFmt, err)
+		}
+	}
 	switch status.State {
 	case tunnels.Ready:
-		changed, err := r.publish(ctx, &gw, status.Hostname)
+		cond := programmed(&gw, metav1.ConditionTrue, gatewayv1.GatewayReasonProgrammed,
+			fmt.Sprintf(consts.MsgTunnelReadyFmt, status.Hostname, provider))
+		changed, err := r.publish(ctx, &gw, status.Hostname, &cond)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
@@ -353,11 +576,38 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 				"hostname", status.Hostname)
 			r.Recorder.Eventf(&gw, nil, consts.EventTypeNormal, consts.ReasonTunnelReady,
 				consts.ActionProvision, consts.MsgTunnelReadyFmt, status.Hostname, provider)
+			expiry.Announce(ctx, r.Recorder, &gw, expires)
 		}
-		return ctrl.Result{}, nil
+		return res, r.customDomains(ctx, &gw, provider, status.Hostname, changed)
+
+	case tunnels.Degraded:
+		// Still Programmed, with the hostname kept: the store replaces the
+		// tunnel if this goes on, and withdrawing the address over one
+		// missed check would take down more than it saves. The message is
+		// what says something is wrong.
+		cond := programmed(&gw, metav1.ConditionTrue, gatewayv1.GatewayReasonProgrammed,
+			fmt.Sprintf(consts.MsgTunnelDegradedFmt, status.Hostname, status.Err, r.Tunnels.Health.Threshold()))
+		// The condition follows the latest miss; the warning is said once, on
+		// the way in, as on the Ingress.
+		if _, err := r.publish(ctx, &gw, status.Hostname, &cond); err != nil {
+			return ctrl.Result{}, err
+		}
+		if status.Changed {
+			logger.Info("tunnel degraded", "provider", provider, "hostname", status.Hostname, "error", status.Err)
+			r.Recorder.Eventf(&gw, nil, consts.EventTypeWarning, consts.ReasonTunnelDegraded,
+				consts.ActionProvision, "%s", cond.Message)
+		}
+		return res, nil
 
 	case tunnels.Failed:
-		if _, err := r.publish(ctx, &gw, ""); err != nil {
+		// Pending rather than Invalid: a replacement is minted once the
+		// cooldown passes, and nothing about the Gateway is wrong.
+		cond := programmed(&gw, metav1.ConditionFalse, gatewayv1.GatewayReasonPending,
+			fmt.Sprintf(consts.MsgTunnelFailedFmt, status.Err))
+		if _, err := r.publish(ctx, &gw, "", &cond); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.Domains.Withdraw(ctx, &gw, gatewayKind); err != nil {
 			return ctrl.Result{}, err
 		}
 		logger.Info("tunnel failed", "provider", provider, "error", status.Err,
@@ -367,18 +617,136 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		return ctrl.Result{RequeueAfter: time.Until(status.RetryAt)}, nil
 
 	default:
+		cond := programmed(&gw, metav1.ConditionFalse, gatewayv1.GatewayReasonPending,
+			fmt.Sprintf(consts.MsgTunnelPendingFmt, provider))
+		if _, err := r.publish(ctx, &gw, "", &cond); err != nil {
+			return ctrl.Result{}, err
+		}
 		logger.Info("tunnel pending", "provider", provider, "origin", origin.String())
-		return ctrl.Result{}, nil
+		return res, nil
+	}
+}
+
+// expire retires a Gateway whose {provider}/ttl or expires-at has passed: the
+// tunnel closes, the hostname comes off status and its CNAMEs are withdrawn.
+// Programmed turns False under a reason of its own, since the Gateway is
+// neither pending nor invalid, only over. No requeue — the label is the only
+// thing that brings it back, and editing it is an update.
+func (r *Reconciler) expire(ctx context.Context, gw *gatewayv1.Gateway, provider string, at time.Time) error {
+	// Said once: when a tunnel closes, or when Programmed first says so. A
+	// Gateway that arrives already expired never had a tunnel, and is still
+	// told why it will not get one.
+	prior := meta.FindStatusCondition(gw.Status.Conditions, string(gatewayv1.GatewayConditionProgrammed))
+	news := prior == nil || prior.Reason != consts.ReasonTunnelExpired
+	if r.forget(client.ObjectKeyFromObject(gw)) {
+		news = true
+	}
+	cond := programmed(gw, metav1.ConditionFalse, gatewayv1.GatewayConditionReason(consts.ReasonTunnelExpired),
+		expiry.Expired(provider, at))
+	if _, err := r.publish(ctx, gw, "", &cond); err != nil {
+		return err
+	}
+	if err := r.Domains.Withdraw(ctx, gw, gatewayKind); err != nil {
+		return err
+	}
+	expiry.Retired(ctx, r.Recorder, gw, provider, at, news)
+	return nil
+}
+
+// forget retires key's tunnel and whatever stood in front of its origin, and
+// reports whether there was a tunnel.
+func (r *Reconciler) forget(key types.NamespacedName) bool {
+	r.Front.Release(key)
+	return r.Tunnels.Forget(key)
+}
+
+// front puts the Gateway's policies, if any, in front of origin, and returns
+// the URL the tunnel should dial: always the Front's, so the hostname stays
+// put as policies come and go. The class's spec.parametersRef and the
+// Gateway's own {provider}/policy label both apply, so a Gateway can add to
+// its class's policy and cannot take it away. A fronted Gateway is requeued so
+// the policy is re-read; see consts.PolicyResyncInterval.
+func (r *Reconciler) front(ctx context.Context, key types.NamespacedName, gw *gatewayv1.Gateway,
+	class *gatewayv1.GatewayClass, origin *url.URL) (*url.URL, ctrl.Result, error) {
+	var refs []types.NamespacedName
+	if p := class.Spec.ParametersRef; p != nil {
+		ref, err := classPolicy(class.Name, p)
+		if err != nil {
+			return nil, ctrl.Result{}, err
+		}
+		refs = append(refs, ref)
+	}
+	if ref, ok := proxy.Label(gw, class.Name); ok {
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 {
+		fronted, err := r.Front.Serve(key, class.Name, origin, nil)
+		return fronted, ctrl.Result{}, err
+	}
+
+	policies, err := proxy.Load(ctx, r.Policies, refs...)
+	if err != nil {
+		return nil, ctrl.Result{}, err
+	}
+	fronted, err := r.Front.Serve(key, class.Name, origin, policies)
+	if err != nil {
+		return nil, ctrl.Result{}, err
+	}
+	return fronted, ctrl.Result{RequeueAfter: consts.PolicyResyncInterval}, nil
+}
+
+// classPolicy reads a GatewayClass's parametersRef as the policy ConfigMap it
+// must be.
+func classPolicy(class string, p *gatewayv1.ParametersReference) (types.NamespacedName, error) {
+	return proxy.Parameters(class, string(p.Group), string(p.Kind), p.Name, (*string)(p.Namespace))
+}
+
+// addresses refuses a Gateway whose spec.addresses asks for something a
+// tunnel cannot be.
+//
+// The Gateway API's rule is that an implementation which cannot assign a
+// requested address says so — Programmed=False, AddressNotAssigned — rather
+// than serving on another one. A Hostname address is a request for the tunnel
+// to be minted on that name, which tunnels.Reserve decides; an IPAddress, or a
+// type this controller does not know, is a request it cannot meet at all.
+func addresses(gw *gatewayv1.Gateway, provider string) error {
+	for _, a := range gw.Spec.Addresses {
+		// A nil type is IPAddress, per the API's default.
+		if a.Type != nil && *a.Type == gatewayv1.HostnameAddressType {
+			if err := tunnels.Reserve(provider, a.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		return fmt.Errorf("%w: %s", errUnsupported, fmt.Sprintf(consts.MsgAddressNoIPFmt, a.Value))
 	}
+	return nil
 }
 
-// publish writes the tunnel hostname to the Gateway's status, and reports
-// whether it had to. An empty hostname clears it.
+// programmed builds the Gateway's Programmed condition. Programmed rather than
+// Accepted alone: it is the one that says whether the address in status is
+// live, which is the only thing a tunnel has to say about a Gateway.
+func programmed(gw *gatewayv1.Gateway, status metav1.ConditionStatus, reason gatewayv1.GatewayConditionReason, message string) metav1.Condition {
+	return metav1.Condition{
+		Type:               string(gatewayv1.GatewayConditionProgrammed),
+		Status:             status,
+		Reason:             string(reason),
+		Message:            message,
+		ObservedGeneration: gw.Generation,
+	}
+}
+
+// publish writes the tunnel hostname and the Programmed condition to the
+// Gateway's status, and reports whether the hostname changed. An empty
+// hostname clears it; a nil condition removes ours.
 //
 // status.addresses is the Gateway API's equivalent of the Ingress's
 // status.loadBalancer — where the implementing controller states the address
 // it serves on. Type Hostname because a tunnel has no routable IP.
-func (r *Reconciler) publish(ctx context.Context, gw *gatewayv1.Gateway, hostname string) (bool, error) {
+//
+// One write for both, for the same reason the class writes its two conditions
+// together.
+func (r *Reconciler) publish(ctx context.Context, gw *gatewayv1.Gateway, hostname string, cond *metav1.Condition) (bool, error) {
 	var want []gatewayv1.GatewayStatusAddress
 	if hostname != "" {
 		want = []gatewayv1.GatewayStatusAddress{{
@@ -387,7 +755,14 @@ func (r *Reconciler) publish(ctx context.Context, gw *gatewayv1.Gateway, hostnam
 		}}
 	}
 
-	if apiequality.Semantic.DeepEqual(gw.Status.Addresses, want) {
+	addressChanged := !apiequality.Semantic.DeepEqual(gw.Status.Addresses, want)
+	var condChanged bool
+	if cond != nil {
+		condChanged = upsert(&gw.Status.Conditions, *cond)
+	} else {
+		condChanged = meta.RemoveStatusCondition(&gw.Status.Conditions, string(gatewayv1.GatewayConditionProgrammed))
+	}
+	if !addressChanged && !condChanged {
 		return false, nil
 	}
 
@@ -395,7 +770,40 @@ func (r *Reconciler) publish(ctx context.Context, gw *gatewayv1.Gateway, hostnam
 	if err := r.Status().Update(ctx, gw); err != nil {
 		return false, fmt.Errorf("update gateway status: %w", err)
 	}
-	return true, nil
+	return addressChanged, nil
+}
+
+// customDomains publishes the hostnames the Gateway's listeners name as CNAMEs
+// to its tunnel hostname. A listener's hostname is the user saying which name
+// the Gateway answers to, and publishing it is the only thing it could mean
+// to a controller that fronts one origin per tunnel. A conflicting DNSEndpoint
+// is reported and not retried: the tunnel still serves on its own hostname.
+//
+// A wildcard listener publishes a wildcard record. external-dns and every DNS
+// provider it drives accept one, and it is exactly what the listener asked
+// for.
+func (r *Reconciler) customDomains(ctx context.Context, gw *gatewayv1.Gateway, provider, hostname string, announce bool) error {
+	hosts := make([]string, 0, len(gw.Spec.Listeners))
+	for _, l := range gw.Spec.Listeners {
+		if l.Hostname != nil {
+			hosts = append(hosts, string(*l.Hostname))
+		}
+	}
+
+	res, err := r.Domains.Publish(ctx, gw, gatewayKind,
+		domains.Hosts(hostname, hosts...), hostname)
+	if errors.Is(err, errUnsupported) {
+		if announce {
+			r.Recorder.Eventf(gw, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
+				consts.ActionProvision, consts.MsgUnsupportedFmt, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	domains.Report(r.Recorder, gw, provider, hostname, res, announce)
+	return nil
 }
 
 // class resolves the GatewayClass this Gateway asks for, and reports whether
@@ -405,6 +813,9 @@ func (r *Reconciler) publish(ctx context.Context, gw *gatewayv1.Gateway, hostnam
 // This is what gets handed to libtunnel:
 //
 //	libtunnel.Cloudflare().WithProvider(provider)
+//
+// A read refused to a namespaced install falls back the same way the Ingress
+// half's does: an installed provider's name is ours, anything else is not.
 func (r *Reconciler) class(ctx context.Context, gw *gatewayv1.Gateway) (*gatewayv1.GatewayClass, bool, error) {
 	name := string(gw.Spec.GatewayClassName)
 	if name == "" {
@@ -412,13 +823,23 @@ func (r *Reconciler) class(ctx context.Context, gw *gatewayv1.Gateway) (*gateway
 	}
 
 	var class gatewayv1.GatewayClass
-	if err := r.Get(ctx, client.ObjectKey{Name: name}, &class); err != nil {
-		if apierrors.IsNotFound(err) {
+	if err := r.Classes.Get(ctx, client.ObjectKey{Name: name}, &class); err != nil {
+		switch {
+		case apierrors.IsNotFound(err):
 			// Dangling class reference. The Gateway is inert until the class
 			// exists, and it is not ours to complain about.
 			return nil, false, nil
+		case apierrors.IsForbidden(err):
+			if !slices.Contains(consts.InstalledProviders, name) {
+				return nil, false, nil
+			}
+			class = gatewayv1.GatewayClass{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec:       gatewayv1.GatewayClassSpec{ControllerName: ControllerName},
+			}
+		default:
+			return nil, false, fmt.Errorf("get gatewayclass %q: %w", name, err)
 		}
-		return nil, false, fmt.Errorf("get gatewayclass %q: %w", name, err)
 	}
 
 	if class.Spec.ControllerName != ControllerName {
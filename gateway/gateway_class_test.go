@@ -25,14 +25,16 @@ func gatewayClass(provider string, controller gatewayv1.GatewayController) *gate
 // newFakeClient builds a client carrying the Gateway API types, since they are
 // not in the client-go scheme.
 //
-// The GatewayClass status subresource is enabled so Status().Update behaves as
-// it does against a real API server rather than silently writing the whole
-// object.
+// The GatewayClass and Gateway status subresources are enabled so
+// Status().Update behaves as it does against a real API server rather than
+// silently writing the whole object. The backend index is registered as the
+// manager registers it.
 func newFakeClient(objs ...client.Object) client.WithWatch {
 	return fake.NewClientBuilder().
 		WithScheme(scheme()).
 		WithObjects(objs...).
-		WithStatusSubresource(&gatewayv1.GatewayClass{}).
+		WithStatusSubresource(&gatewayv1.GatewayClass{}, &gatewayv1.Gateway{}).
+		WithIndex(&gatewayv1.HTTPRoute{}, backendIndex, backendServices).
 		Build()
 }
 
@@ -3,13 +3,23 @@ package gateway
 import (
 	"context"
 	"errors"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
@@ -17,6 +27,10 @@ import (
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/domains"
+	"github.com/scaffoldly/tunnel/optin"
+	"github.com/scaffoldly/tunnel/proxy"
+	"github.com/scaffoldly/tunnel/tunnels"
 )
 
 // What the Gateway API spec fixes for the two conditions on a GatewayClass.
@@ -376,6 +390,21 @@ func TestClassReconcilePublishesSupportedVersion(t *testing.T) {
 			want:   metav1.ConditionFalse,
 			wantIn: "main-branch",
 		},
+		{
+			// Experimental is a superset of standard, so it is supported at
+			// the same versions — but which channel was found is part of what
+			// was detected, and --gateway-api-channel can install either.
+			name: "the experimental channel is named",
+			crds: func() []client.Object {
+				objs := gatewayCRDs(versionSupported)
+				for _, o := range objs {
+					o.GetAnnotations()[annotationChannel] = consts.GatewayAPIChannelExperimental
+				}
+				return objs
+			}(),
+			want:   metav1.ConditionTrue,
+			wantIn: "on the experimental channel",
+		},
 		{
 			// Somebody else's CRDs are not ours to have an opinion about.
 			name: "another group's CRDs are ignored",
@@ -480,3 +509,647 @@ func TestClassReconcileReportsUnreadableCRDs(t *testing.T) {
 		t.Errorf("Accepted status = %q, want %q", got.Status, metav1.ConditionTrue)
 	}
 }
+
+// A parametersRef that cannot be a policy ConfigMap is the spec's
+// InvalidParameters.
+func TestClassReconcileRejectsInvalidParameters(t *testing.T) {
+	class := gatewayClass(consts.ProviderTunnelPizza, ControllerName)
+	class.Spec.ParametersRef = &gatewayv1.ParametersReference{Group: "example.com", Kind: "Policy", Name: "strict"}
+	r, c := classReconciler(append(gatewayCRDs(versionSupported), class)...)
+
+	if _, err := r.Reconcile(context.Background(), classRequest(consts.ProviderTunnelPizza)); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	cond := acceptedCondition(t, c, consts.ProviderTunnelPizza)
+	if cond.Status != metav1.ConditionFalse || cond.Reason != string(gatewayv1.GatewayClassReasonInvalidParameters) {
+		t.Errorf("Accepted = %s/%s, want False/InvalidParameters", cond.Status, cond.Reason)
+	}
+
+	// A ConfigMap by namespace and name is what it should say.
+	class = getClass(t, c, consts.ProviderTunnelPizza)
+	class.Spec.ParametersRef = &gatewayv1.ParametersReference{
+		Kind: "ConfigMap", Name: "strict", Namespace: ptr.To(gatewayv1.Namespace("tunnel-system")),
+	}
+	if err := c.Update(context.Background(), class); err != nil {
+		t.Fatalf("update class: %v", err)
+	}
+	if _, err := r.Reconcile(context.Background(), classRequest(consts.ProviderTunnelPizza)); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if cond := acceptedCondition(t, c, consts.ProviderTunnelPizza); cond.Status != metav1.ConditionTrue {
+		t.Errorf("Accepted = %s/%s, want True", cond.Status, cond.Reason)
+	}
+}
+
+// gatewayKey is the Gateway every Gateway reconcile test acts on.
+var gatewayKey = types.NamespacedName{Namespace: "default", Name: "web"}
+
+// servedGateway is the smallest Gateway this controller serves: our class, and
+// one route to one Service port, which come with it.
+func servedGateway() []client.Object {
+	port := gatewayv1.PortNumber(8080)
+	return []client.Object{
+		gatewayClass(consts.ProviderTunnelPizza, ControllerName),
+		&gatewayv1.Gateway{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Generation: 2},
+			Spec:       gatewayv1.GatewaySpec{GatewayClassName: consts.ProviderTunnelPizza},
+		},
+		&gatewayv1.HTTPRoute{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: gatewayv1.HTTPRouteSpec{
+				CommonRouteSpec: gatewayv1.CommonRouteSpec{
+					ParentRefs: []gatewayv1.ParentReference{{Name: "web"}},
+				},
+				Rules: []gatewayv1.HTTPRouteRule{{
+					BackendRefs: []gatewayv1.HTTPBackendRef{{BackendRef: gatewayv1.BackendRef{
+						BackendObjectReference: gatewayv1.BackendObjectReference{Name: "web", Port: &port},
+					}}},
+				}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+		},
+	}
+}
+
+// gatewayReconciler wires a Reconciler over a fake cluster and a store whose
+// dialer hands back tun, counting how often it is asked.
+func gatewayReconciler(t *testing.T, tun tunnels.Tunnel, objs ...client.Object) (
+	*Reconciler, client.Client, *events.FakeRecorder, *tunnels.Store, *int,
+) {
+	t.Helper()
+	c := newFakeClient(objs...)
+	recorder := events.NewFakeRecorder(16)
+	var minted int
+	s := tunnels.NewTestStore(consts.TunnelRetryInterval, func(string, *url.URL) tunnels.Tunnel {
+		minted++
+		return tun
+	})
+	t.Cleanup(s.Close)
+	front := proxy.NewFront(logr.Discard(), consts.ControllerGateway, "Gateway")
+	t.Cleanup(front.Close)
+	return &Reconciler{
+		Client: c, Services: c, Classes: c, Recorder: recorder, Tunnels: s,
+		Domains:  &domains.Publisher{Client: c},
+		Policies: c, Front: front,
+	}, c, recorder, s, &minted
+}
+
+func getGateway(t *testing.T, c client.Client) *gatewayv1.Gateway {
+	t.Helper()
+	var gw gatewayv1.Gateway
+	if err := c.Get(context.Background(), gatewayKey, &gw); err != nil {
+		t.Fatalf("get gateway: %v", err)
+	}
+	return &gw
+}
+
+// TestReconcilePublishesProgrammed follows Programmed through a tunnel's
+// life: Pending while it mints, True with the address once it serves.
+func TestReconcilePublishesProgrammed(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	r, c, _, s, _ := gatewayReconciler(t, tun, servedGateway()...)
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	cond := meta.FindStatusCondition(getGateway(t, c).Status.Conditions, "Programmed")
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != "Pending" {
+		t.Fatalf("Programmed = %+v while minting, want False/Pending", cond)
+	}
+
+	tun.Connect()
+	select {
+	case <-s.Source():
+	case <-time.After(5 * time.Second):
+		t.Fatal("store did not notify the controller")
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	gw := getGateway(t, c)
+	cond = meta.FindStatusCondition(gw.Status.Conditions, "Programmed")
+	if cond == nil || cond.Status != metav1.ConditionTrue || cond.Reason != "Programmed" {
+		t.Fatalf("Programmed = %+v once serving, want True/Programmed", cond)
+	}
+	if cond.ObservedGeneration != 2 {
+		t.Errorf("Programmed observedGeneration = %d, want 2", cond.ObservedGeneration)
+	}
+	if len(gw.Status.Addresses) != 1 || gw.Status.Addresses[0].Value != "brave-tuna.tunneled.pizza" {
+		t.Errorf("status.addresses = %v, want the tunnel hostname", gw.Status.Addresses)
+	}
+}
+
+// TestReconcilePublishesListenerHostnames: once the tunnel serves, the
+// listeners' hostnames become a DNSEndpoint CNAMEing them to it, named for
+// the Gateway's kind so an Ingress of the same name keeps its own; and the
+// record goes when the tunnel fails.
+func TestReconcilePublishesListenerHostnames(t *testing.T) {
+	objs := servedGateway()
+	host := gatewayv1.Hostname("app.example.com")
+	objs[1].(*gatewayv1.Gateway).Spec.Listeners = []gatewayv1.Listener{{
+		Name: "http", Port: 80, Protocol: gatewayv1.HTTPProtocolType, Hostname: &host,
+	}}
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	r, _, recorder, s, _ := gatewayReconciler(t, tun, objs...)
+	// A cluster running external-dns: DNSEndpoint is served, as unstructured,
+	// since there is no Go type for it here.
+	dns := scheme()
+	dns.AddKnownTypeWithName(domains.DNSEndpoint, &unstructured.Unstructured{})
+	dns.AddKnownTypeWithName(domains.DNSEndpoint.GroupVersion().WithKind(domains.DNSEndpoint.Kind+"List"),
+		&unstructured.UnstructuredList{})
+	records := fake.NewClientBuilder().WithScheme(dns).Build()
+	r.Domains = &domains.Publisher{Client: records, Served: true}
+	endpoint := client.ObjectKey{Namespace: gatewayKey.Namespace, Name: gatewayKey.Name + "-gateway"}
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+	}
+	notified := func() {
+		t.Helper()
+		select {
+		case <-s.Source():
+		case <-time.After(5 * time.Second):
+			t.Fatal("store did not notify the controller")
+		}
+	}
+
+	reconcile()
+	if err := records.Get(context.Background(), endpoint, domains.Object()); err == nil {
+		t.Fatal("published a dnsendpoint while pending; there is nothing to CNAME to yet")
+	}
+
+	tun.Connect()
+	notified()
+	reconcile()
+	got := domains.Object()
+	if err := records.Get(context.Background(), endpoint, got); err != nil {
+		t.Fatalf("no dnsendpoint for the listener hostname: %v", err)
+	}
+	eps, _, _ := unstructured.NestedSlice(got.Object, "spec", "endpoints")
+	if len(eps) != 1 {
+		t.Fatalf("endpoints = %v, want one", eps)
+	}
+	ep := eps[0].(map[string]any)
+	if ep["dnsName"] != "app.example.com" || ep["recordType"] != "CNAME" {
+		t.Errorf("endpoint = %v, want a CNAME for app.example.com", ep)
+	}
+	if targets, _ := ep["targets"].([]any); len(targets) != 1 || targets[0] != "brave-tuna.tunneled.pizza" {
+		t.Errorf("targets = %v, want the tunnel hostname", ep["targets"])
+	}
+	said := false
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, consts.ReasonCustomDomain) {
+			said = true
+		}
+	}
+	if !said {
+		t.Errorf("no %s event", consts.ReasonCustomDomain)
+	}
+
+	tun.Fail(errors.New("edge connection lost"))
+	notified()
+	reconcile()
+	if err := records.Get(context.Background(), endpoint, domains.Object()); !apierrors.IsNotFound(err) {
+		t.Errorf("get dnsendpoint = %v once the tunnel failed, want it withdrawn", err)
+	}
+}
+
+// A degraded tunnel keeps Programmed True and its address, with the message
+// saying what is wrong; the warning is said once, not on every resync.
+func TestReconcileKeepsADegradedGateway(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	r, c, recorder, s, _ := gatewayReconciler(t, tun, servedGateway()...)
+	// One miss, then nothing more until shutdown, so it stays Degraded.
+	var checks atomic.Int32
+	s.Health = tunnels.Health{Interval: time.Millisecond, Failures: 3, Check: func(ctx context.Context, _, _ string) error {
+		if checks.Add(1) > 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return errors.New("530 Origin Unreachable")
+	}}
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+	}
+	notified := func() {
+		t.Helper()
+		select {
+		case <-s.Source():
+		case <-time.After(5 * time.Second):
+			t.Fatal("store did not notify the controller")
+		}
+	}
+
+	reconcile()
+	tun.Connect()
+	notified()
+	reconcile()
+	notified()
+	for len(recorder.Events) > 0 {
+		<-recorder.Events
+	}
+	reconcile()
+
+	gw := getGateway(t, c)
+	cond := meta.FindStatusCondition(gw.Status.Conditions, "Programmed")
+	if cond == nil || cond.Status != metav1.ConditionTrue || !strings.Contains(cond.Message, "530") {
+		t.Fatalf("Programmed = %+v while degraded, want True naming the failed check", cond)
+	}
+	if len(gw.Status.Addresses) != 1 {
+		t.Errorf("status.addresses = %v while degraded, want the hostname kept", gw.Status.Addresses)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, consts.ReasonTunnelDegraded) {
+			t.Errorf("event %q, want %s", e, consts.ReasonTunnelDegraded)
+		}
+	default:
+		t.Errorf("no %s event", consts.ReasonTunnelDegraded)
+	}
+
+	reconcile()
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("resync while degraded: unexpected event %q", e)
+	default:
+	}
+}
+
+// TestReconcileWarnsOfADegradedGatewayOnce: each miss carries its own error
+// into Programmed's message, but the tunnel only went Degraded once, so a
+// second miss with a different error is not a second warning.
+func TestReconcileWarnsOfADegradedGatewayOnce(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	r, c, recorder, s, _ := gatewayReconciler(t, tun, servedGateway()...)
+	var checks atomic.Int32
+	s.Health = tunnels.Health{Interval: time.Millisecond, Failures: 3, Check: func(ctx context.Context, _, _ string) error {
+		switch checks.Add(1) {
+		case 1:
+			return errors.New("530 Origin Unreachable")
+		case 2:
+			return errors.New("502 Bad Gateway")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	reconcile := func() {
+		t.Helper()
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+	}
+	notified := func() {
+		t.Helper()
+		select {
+		case <-s.Source():
+		case <-time.After(5 * time.Second):
+			t.Fatal("store did not notify the controller")
+		}
+	}
+
+	reconcile()
+	tun.Connect()
+	notified()
+	reconcile()
+	notified()
+	for len(recorder.Events) > 0 {
+		<-recorder.Events
+	}
+	reconcile()
+	// The third check starts only once the second has been recorded.
+	deadline := time.Now().Add(5 * time.Second)
+	for checks.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("second health check did not run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	reconcile()
+
+	cond := meta.FindStatusCondition(getGateway(t, c).Status.Conditions, "Programmed")
+	if cond == nil || !strings.Contains(cond.Message, "502") {
+		t.Errorf("Programmed = %+v after the second miss, want its error", cond)
+	}
+	var degraded int
+	for len(recorder.Events) > 0 {
+		if e := <-recorder.Events; strings.Contains(e, consts.ReasonTunnelDegraded) {
+			degraded++
+		}
+	}
+	if degraded != 1 {
+		t.Errorf("%d %s events over two misses, want 1", degraded, consts.ReasonTunnelDegraded)
+	}
+}
+
+// A Gateway past its deadline is retired like an Ingress, and Programmed says
+// so under a reason of its own rather than passing for Pending.
+func TestReconcileRetiresAnExpiredGateway(t *testing.T) {
+	objs := servedGateway()
+	objs[1].SetLabels(map[string]string{
+		consts.ProviderTunnelPizza + "/" + consts.TTLLabel: "1h",
+	})
+	objs[1].SetCreationTimestamp(metav1.NewTime(time.Now().Add(-2 * time.Hour)))
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	r, c, recorder, s, minted := gatewayReconciler(t, tun, objs...)
+
+	res, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey})
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if *minted != 0 || s.Tracking(gatewayKey) {
+		t.Errorf("minted %d tunnels for an expired Gateway, want none", *minted)
+	}
+	if res.RequeueAfter != 0 {
+		t.Errorf("RequeueAfter = %v, want none", res.RequeueAfter)
+	}
+	cond := meta.FindStatusCondition(getGateway(t, c).Status.Conditions, "Programmed")
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != consts.ReasonTunnelExpired {
+		t.Fatalf("Programmed = %+v, want False/%s", cond, consts.ReasonTunnelExpired)
+	}
+	if !strings.Contains(cond.Message, "tunnel.pizza/ttl") {
+		t.Errorf("Programmed message %q does not say which label to edit", cond.Message)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, consts.ReasonTunnelExpired) {
+			t.Errorf("event %q, want %s", e, consts.ReasonTunnelExpired)
+		}
+	default:
+		t.Errorf("no %s event", consts.ReasonTunnelExpired)
+	}
+}
+
+// Under --namespace-opt-in a Gateway in a namespace that has not opted in is
+// refused, and Programmed says why under a reason of its own.
+func TestReconcileRefusesANamespaceThatHasNotOptedIn(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	r, c, recorder, s, _ := gatewayReconciler(t, tun, append(servedGateway(), ns)...)
+	r.Namespaces = &optin.Gate{Reader: c, Required: true}
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if s.Tracking(gatewayKey) {
+		t.Error("minted a tunnel in a namespace that has not opted in")
+	}
+	cond := meta.FindStatusCondition(getGateway(t, c).Status.Conditions, "Programmed")
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != consts.ReasonNamespaceNotAllowed {
+		t.Fatalf("Programmed = %+v, want False/%s", cond, consts.ReasonNamespaceNotAllowed)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, consts.ReasonUnsupported) || !strings.Contains(e, consts.AllowedLabel) {
+			t.Errorf("event %q, want %s naming %s", e, consts.ReasonUnsupported, consts.AllowedLabel)
+		}
+	default:
+		t.Errorf("no %s event", consts.ReasonUnsupported)
+	}
+}
+
+// A Gateway's {provider}/policy is served the same way as an Ingress's, and
+// a missing one keeps the tunnel down the same way.
+func TestReconcileFrontsAPolicy(t *testing.T) {
+	objs := servedGateway()
+	objs[1].SetLabels(map[string]string{consts.ProviderTunnelPizza + "/" + consts.PolicyLabel: "web-policy"})
+	r, c, _, _, minted := gatewayReconciler(t, tunnels.NewFake("brave-tuna.tunneled.pizza"), objs...)
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err == nil {
+		t.Fatal("Reconcile() error = nil, want the missing policy retried")
+	}
+	if *minted != 0 {
+		t.Fatalf("minted %d tunnels without the policy they asked for, want 0", *minted)
+	}
+	cond := meta.FindStatusCondition(getGateway(t, c).Status.Conditions, "Programmed")
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != "Pending" {
+		t.Errorf("Programmed = %+v without the policy, want False/Pending", cond)
+	}
+
+	if err := c.Create(context.Background(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-policy"},
+		Data:       map[string]string{"allow-cidrs": "192.0.2.0/24"},
+	}); err != nil {
+		t.Fatalf("create policy: %v", err)
+	}
+	res, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey})
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if *minted != 1 || res.RequeueAfter != consts.PolicyResyncInterval {
+		t.Errorf("minted %d, RequeueAfter %v; want 1 and %v", *minted, res.RequeueAfter, consts.PolicyResyncInterval)
+	}
+	if !r.Front.Release(gatewayKey) {
+		t.Error("no listener held for the gateway")
+	}
+}
+
+// A route whose Service has nothing ready leaves the Gateway unprogrammed,
+// with its tunnel kept, until a slice says an endpoint is.
+func TestReconcileHoldsWithoutAReadyBackend(t *testing.T) {
+	objs := servedGateway()
+	objs[3].(*corev1.Service).Spec.Selector = map[string]string{"app": "web"}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "web-abc12",
+			Labels: map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(false)},
+		}},
+	}
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	r, c, recorder, s, minted := gatewayReconciler(t, tun, append(objs, slice)...)
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	tun.Connect()
+	select {
+	case <-s.Source():
+	case <-time.After(5 * time.Second):
+		t.Fatal("store did not notify the controller")
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	gw := getGateway(t, c)
+	cond := meta.FindStatusCondition(gw.Status.Conditions, "Programmed")
+	if cond == nil || cond.Status != metav1.ConditionFalse || !strings.Contains(cond.Message, "no ready endpoints") {
+		t.Fatalf("Programmed = %+v with nothing ready, want False naming the backend", cond)
+	}
+	if len(gw.Status.Addresses) != 0 {
+		t.Errorf("status.addresses = %v with nothing ready, want none", gw.Status.Addresses)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, consts.ReasonBackendUnavailable) {
+			t.Errorf("event %q, want %s", e, consts.ReasonBackendUnavailable)
+		}
+	default:
+		t.Errorf("no %s event", consts.ReasonBackendUnavailable)
+	}
+	// Still down on the next pass, which is not news.
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("still down: unexpected event %q", e)
+	default:
+	}
+
+	if got := r.backendOf(context.Background(), slice); len(got) != 1 || got[0].NamespacedName != gatewayKey {
+		t.Fatalf("backendOf(EndpointSlice) = %v, want the gateway", got)
+	}
+	// And the Service itself, as the metadata watch delivers it.
+	svc := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	if got := r.backendOf(context.Background(), svc); len(got) != 1 || got[0].NamespacedName != gatewayKey {
+		t.Fatalf("backendOf(Service) = %v, want the gateway", got)
+	}
+	slice.Endpoints[0].Conditions.Ready = ptr.To(true)
+	if err := c.Update(context.Background(), slice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got := getGateway(t, c).Status.Addresses; len(got) != 1 || got[0].Value != "brave-tuna.tunneled.pizza" {
+		t.Errorf("status.addresses = %v once ready, want the tunnel hostname", got)
+	}
+	if *minted != 1 {
+		t.Errorf("minted %d tunnels, want 1", *minted)
+	}
+}
+
+// TestReconcileRefusesRequestedAddresses is the Gateway API's own rule for
+// spec.addresses: an implementation that cannot assign what was asked for
+// says AddressNotAssigned, and does not serve on something else instead.
+func TestReconcileRefusesRequestedAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		address gatewayv1.GatewaySpecAddress
+		wantIn  string
+	}{
+		{
+			name:    "a hostname no provider can reserve",
+			address: gatewayv1.GatewaySpecAddress{Type: ptr.To(gatewayv1.HostnameAddressType), Value: "app.example.com"},
+			wantIn:  "app.example.com",
+		},
+		{
+			name:    "an IP, which a tunnel does not have",
+			address: gatewayv1.GatewaySpecAddress{Type: ptr.To(gatewayv1.IPAddressType), Value: "203.0.113.7"},
+			wantIn:  "203.0.113.7",
+		},
+		{
+			// The API defaults an unset type to IPAddress.
+			name:    "an untyped address",
+			address: gatewayv1.GatewaySpecAddress{Value: "203.0.113.7"},
+			wantIn:  "203.0.113.7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs := servedGateway()
+			objs[1].(*gatewayv1.Gateway).Spec.Addresses = []gatewayv1.GatewaySpecAddress{tt.address}
+			r, c, recorder, _, minted := gatewayReconciler(t, tunnels.NewFake("random-name.tunneled.pizza"), objs...)
+
+			res, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey})
+			if err != nil {
+				t.Fatalf("Reconcile() error = %v, want nil (retrying cannot fix a spec)", err)
+			}
+			if res.RequeueAfter != 0 {
+				t.Errorf("RequeueAfter = %v, want 0", res.RequeueAfter)
+			}
+			if *minted != 0 {
+				t.Errorf("minted %d tunnels in place of the address asked for, want 0", *minted)
+			}
+
+			gw := getGateway(t, c)
+			if len(gw.Status.Addresses) != 0 {
+				t.Errorf("status.addresses = %v, want none", gw.Status.Addresses)
+			}
+			cond := meta.FindStatusCondition(gw.Status.Conditions, "Programmed")
+			if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != "AddressNotAssigned" {
+				t.Fatalf("Programmed = %+v, want False/AddressNotAssigned", cond)
+			}
+			if !strings.Contains(cond.Message, tt.wantIn) {
+				t.Errorf("Programmed message %q does not name %q", cond.Message, tt.wantIn)
+			}
+
+			select {
+			case got := <-recorder.Events:
+				if !strings.HasPrefix(got, consts.EventTypeWarning+" "+consts.ReasonUnsupported+" ") {
+					t.Errorf("event = %q, want Warning Unsupported", got)
+				}
+			default:
+				t.Error("no Unsupported event was recorded")
+			}
+		})
+	}
+}
+
+// A reclassed Gateway keeps no Programmed condition of ours; the next
+// controller states its own.
+func TestReconcileReleasesProgrammed(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	objs := append(servedGateway(), gatewayClass("other", "example.com/other"))
+	r, c, _, _, _ := gatewayReconciler(t, tun, objs...)
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	gw := getGateway(t, c)
+	gw.Spec.GatewayClassName = "other"
+	if err := c.Update(context.Background(), gw); err != nil {
+		t.Fatalf("update gateway: %v", err)
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if cond := meta.FindStatusCondition(getGateway(t, c).Status.Conditions, "Programmed"); cond != nil {
+		t.Errorf("Programmed = %+v after the handover, want none", cond)
+	}
+}
+
+// TestReconcileServesAnInstalledClassItCannotRead: a namespaced install with
+// no grant on gatewayclasses still programs a Gateway on a class named for an
+// installed provider.
+func TestReconcileServesAnInstalledClassItCannotRead(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.tunneled.pizza")
+	r, c, _, s, _ := gatewayReconciler(t, tun, servedGateway()[1:]...)
+	r.Classes = fake.NewClientBuilder().WithScheme(scheme()).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Get: func(_ context.Context, _ client.WithWatch, key client.ObjectKey, _ client.Object, _ ...client.GetOption) error {
+				return apierrors.NewForbidden(gatewayv1.Resource("gatewayclasses"), key.Name, errors.New("no grant"))
+			},
+		}).
+		Build()
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	tun.Connect()
+	select {
+	case <-s.Source():
+	case <-time.After(5 * time.Second):
+		t.Fatal("store did not notify the controller")
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: gatewayKey}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	cond := meta.FindStatusCondition(getGateway(t, c).Status.Conditions, "Programmed")
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Errorf("Programmed = %+v, want True", cond)
+	}
+}
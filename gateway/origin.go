@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"slices"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
@@ -12,6 +13,7 @@ import (
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/endpoints"
 )
 
 // errUnsupported marks a Gateway this controller cannot serve as written, as
@@ -38,26 +40,27 @@ type backend struct {
 // libtunnel fronts exactly one origin, so routes fanning out across several
 // Services cannot be served faithfully. Rather than pick one and silently
 // misroute the rest, that is refused.
-func (r *Reconciler) origin(ctx context.Context, gw *gatewayv1.Gateway) (*url.URL, error) {
+func (r *Reconciler) origin(ctx context.Context, gw *gatewayv1.Gateway) (*url.URL, *corev1.Service, error) {
 	var routes gatewayv1.HTTPRouteList
 	if err := r.List(ctx, &routes, client.InNamespace(gw.Namespace)); err != nil {
-		return nil, fmt.Errorf("list httproutes: %w", err)
+		return nil, nil, fmt.Errorf("list httproutes: %w", err)
 	}
 
 	b, err := single(gw, routes.Items)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	port, err := r.port(ctx, b)
+	svc, port, err := r.port(ctx, b)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &url.URL{
-		Scheme: originScheme(gw, port),
-		Host:   fmt.Sprintf("%s.%s.%s:%d", b.service, b.namespace, consts.OriginDomain, port.Port),
-	}, nil
+	host, err := endpoints.Address(ctx, r.Services, svc, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &url.URL{Scheme: originScheme(gw, port), Host: host}, svc, nil
 }
 
 // scheme decides how the backend is dialed, exactly as the Ingress half does:
@@ -79,12 +82,45 @@ func originScheme(gw *gatewayv1.Gateway, port corev1.ServicePort) string {
 }
 
 func normalizeScheme(declared string) string {
-	if strings.EqualFold(declared, consts.OriginSchemeTLS) {
+	switch {
+	case strings.EqualFold(declared, consts.OriginSchemeTLS):
 		return consts.OriginSchemeTLS
+	case strings.EqualFold(declared, consts.OriginSchemeH2C), strings.EqualFold(declared, consts.AppProtocolH2C):
+		return consts.OriginSchemeH2C
 	}
 	return consts.OriginScheme
 }
 
+// backendIndex is the field index of HTTPRoutes by the Services they send to.
+// Not a real field path: a route names its backends in a list of lists, and
+// the index flattens that. See backendServices.
+const backendIndex = "spec.rules.backendRefs.service"
+
+// backendServices is the backendIndex extractor: the Services a route sends
+// to in its own namespace. A cross-namespace ref is left out, since single
+// refuses it and the Service it names is never read.
+func backendServices(obj client.Object) []string {
+	route, ok := obj.(*gatewayv1.HTTPRoute)
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, rule := range route.Spec.Rules {
+		for _, ref := range rule.BackendRefs {
+			if (ref.Kind != nil && *ref.Kind != "Service") || (ref.Group != nil && *ref.Group != "") {
+				continue
+			}
+			if ref.Namespace != nil && string(*ref.Namespace) != route.Namespace {
+				continue
+			}
+			if name := string(ref.Name); !slices.Contains(out, name) {
+				out = append(out, name)
+			}
+		}
+	}
+	return out
+}
+
 // single reduces the routes attached to gw to the one Service they name.
 func single(gw *gatewayv1.Gateway, routes []gatewayv1.HTTPRoute) (backend, error) {
 	var found []backend
@@ -172,22 +208,28 @@ func slicesContains(bs []backend, want backend) bool {
 // does: a cached Get would start an informer over every Service in the cluster.
 // Returns the whole ServicePort rather than its number: appProtocol rides on
 // it, and re-reading the Service for that would be a second round trip for
-// something already in hand.
-func (r *Reconciler) port(ctx context.Context, b backend) (corev1.ServicePort, error) {
+// something already in hand. The Service too, for endpoints.Ready.
+//
+// An ExternalName Service need not list the port at all; see
+// endpoints.ExternalPort.
+func (r *Reconciler) port(ctx context.Context, b backend) (*corev1.Service, corev1.ServicePort, error) {
 	var svc corev1.Service
 	key := client.ObjectKey{Namespace: b.namespace, Name: b.service}
 	if err := r.Services.Get(ctx, key, &svc); err != nil {
 		if apierrors.IsNotFound(err) {
 			// Transient by assumption: the Service may simply not exist yet.
-			return corev1.ServicePort{}, fmt.Errorf("service %s not found", key)
+			return nil, corev1.ServicePort{}, fmt.Errorf("service %s not found", key)
 		}
-		return corev1.ServicePort{}, fmt.Errorf("get service %s: %w", key, err)
+		return nil, corev1.ServicePort{}, fmt.Errorf("get service %s: %w", key, err)
 	}
 
 	for _, p := range svc.Spec.Ports {
 		if p.Port == b.port {
-			return p, nil
+			return &svc, p, nil
 		}
 	}
-	return corev1.ServicePort{}, fmt.Errorf("%w: service %s exposes no port %d", errUnsupported, key, b.port)
+	if port, ok := endpoints.ExternalPort(&svc, b.port); ok {
+		return &svc, port, nil
+	}
+	return nil, corev1.ServicePort{}, fmt.Errorf("%w: service %s exposes no port %d", errUnsupported, key, b.port)
 }
@@ -1,13 +1,41 @@
 package gateway
 
 import (
+	"context"
+	"slices"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 )
 
+// The index holds the Services a route sends to in its own namespace: the
+// ones single would read.
+func TestBackendServices(t *testing.T) {
+	port := gatewayv1.PortNumber(8080)
+	ref := func(name string, kind *gatewayv1.Kind, ns *gatewayv1.Namespace) gatewayv1.HTTPBackendRef {
+		return gatewayv1.HTTPBackendRef{BackendRef: gatewayv1.BackendRef{
+			BackendObjectReference: gatewayv1.BackendObjectReference{Name: gatewayv1.ObjectName(name), Kind: kind, Namespace: ns, Port: &port},
+		}}
+	}
+	route := &gatewayv1.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: gatewayv1.HTTPRouteSpec{Rules: []gatewayv1.HTTPRouteRule{
+			{BackendRefs: []gatewayv1.HTTPBackendRef{ref("web", nil, nil), ref("api", ptr.To[gatewayv1.Kind]("Service"), nil)}},
+			{BackendRefs: []gatewayv1.HTTPBackendRef{
+				ref("web", nil, ptr.To[gatewayv1.Namespace]("default")),
+				ref("bucket", ptr.To[gatewayv1.Kind]("Bucket"), nil),
+				ref("elsewhere", nil, ptr.To[gatewayv1.Namespace]("other")),
+			}},
+		}},
+	}
+	if got, want := backendServices(route), []string{"web", "api"}; !slices.Equal(got, want) {
+		t.Errorf("backendServices() = %v, want %v", got, want)
+	}
+}
+
 // TestOriginScheme covers how the backend is dialed on this half. It has to
 // agree with the Ingress half's TestScheme: a Service that reaches the Gateway
 // branch instead of the Ingress one has said nothing about its origin, so
@@ -63,6 +91,18 @@ func TestOriginScheme(t *testing.T) {
 			annotations: map[string]string{"tunnel.pizza/protocol": "HTTPS"},
 			want:        "https",
 		},
+		{
+			name:        "the label can ask for cleartext HTTP/2",
+			class:       "tunnel.pizza",
+			annotations: map[string]string{"tunnel.pizza/protocol": "h2c"},
+			want:        "h2c",
+		},
+		{
+			name:        "so can the standard appProtocol for it",
+			class:       "tunnel.pizza",
+			appProtocol: "kubernetes.io/h2c",
+			want:        "h2c",
+		},
 	}
 
 	for _, tc := range tests {
@@ -81,3 +121,26 @@ func TestOriginScheme(t *testing.T) {
 		})
 	}
 }
+
+// TestOriginExternalName: the route's port is dialed on the external name,
+// whether or not the Service lists it — spec.ports on an ExternalName is
+// informational, and often left out.
+func TestOriginExternalName(t *testing.T) {
+	for _, ports := range [][]corev1.ServicePort{nil, {{Name: "http", Port: 8080}}} {
+		objs := servedGateway()
+		svc := objs[len(objs)-1].(*corev1.Service)
+		svc.Spec.Type = corev1.ServiceTypeExternalName
+		svc.Spec.ExternalName = "api.example.com"
+		svc.Spec.Ports = ports
+		c := newFakeClient(objs...)
+		r := &Reconciler{Client: c, Services: c}
+
+		got, _, err := r.origin(context.Background(), objs[1].(*gatewayv1.Gateway))
+		if err != nil {
+			t.Fatalf("origin() with ports %v error = %v", ports, err)
+		}
+		if want := "http://api.example.com:8080"; got.String() != want {
+			t.Errorf("origin() with ports %v = %q, want %q", ports, got, want)
+		}
+	}
+}
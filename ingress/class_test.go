@@ -2,9 +2,11 @@ package ingress
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -25,6 +27,7 @@ func TestClass(t *testing.T) {
 		name         string
 		classes      []client.Object
 		ing          *networkingv1.Ingress
+		forbidden    bool
 		wantProvider string
 		wantOurs     bool
 	}{
@@ -80,11 +83,30 @@ func TestClass(t *testing.T) {
 				map[string]string{"tunnel.pizza/provider": "ingress.example"}),
 			wantOurs: false,
 		},
+		{
+			// A namespaced install with no grant on ingressclasses still
+			// serves the classes the install flags would have created.
+			name:         "an installed provider is ours when classes cannot be read",
+			ing:          ingress("web", ptr.To(consts.ProviderCloudflare), nil),
+			forbidden:    true,
+			wantProvider: consts.ProviderCloudflare,
+			wantOurs:     true,
+		},
+		{
+			name:      "any other class is not ours when classes cannot be read",
+			ing:       ingress("web", ptr.To(theirClass), nil),
+			forbidden: true,
+			wantOurs:  false,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := &Reconciler{Client: fakeClient(t, tt.classes...)}
+			c := fakeClient(t, tt.classes...)
+			r := &Reconciler{Client: c, Classes: c}
+			if tt.forbidden {
+				r.Classes = forbidden{c}
+			}
 
 			got, ours, err := r.class(context.Background(), tt.ing)
 			if err != nil {
@@ -126,3 +148,11 @@ func ingress(name string, className *string, annotations map[string]string) *net
 		Spec: networkingv1.IngressSpec{IngressClassName: className},
 	}
 }
+
+// forbidden refuses every Get, as the API server does a Role-only install
+// reading a cluster-scoped kind.
+type forbidden struct{ client.Reader }
+
+func (forbidden) Get(_ context.Context, key client.ObjectKey, _ client.Object, _ ...client.GetOption) error {
+	return apierrors.NewForbidden(networkingv1.Resource("ingressclasses"), key.Name, errors.New("no grant"))
+}
@@ -5,8 +5,10 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -14,6 +16,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
+	"github.com/scaffoldly/tunnel/domains"
 	"github.com/scaffoldly/tunnel/tunnels"
 )
 
@@ -29,13 +32,19 @@ func fakeClient(t *testing.T, objs ...client.Object) client.WithWatch {
 		WithScheme(testScheme(t)).
 		WithObjects(objs...).
 		WithStatusSubresource(&networkingv1.Ingress{}).
+		WithIndex(&networkingv1.Ingress{}, backendIndex, backendServices).
 		Build()
 }
 
+// testScheme includes DNSEndpoint, as unstructured, so a test can stand in for
+// a cluster running external-dns by setting Domains.Served.
 func testScheme(t *testing.T) *runtime.Scheme {
 	t.Helper()
 	s := runtime.NewScheme()
 	utilruntime.Must(clientgoscheme.AddToScheme(s))
+	s.AddKnownTypeWithName(domains.DNSEndpoint, &unstructured.Unstructured{})
+	s.AddKnownTypeWithName(domains.DNSEndpoint.GroupVersion().WithKind(domains.DNSEndpoint.Kind+"List"),
+		&unstructured.UnstructuredList{})
 	return s
 }
 
@@ -47,6 +56,37 @@ func service(namespace, name string, ports ...corev1.ServicePort) *corev1.Servic
 	}
 }
 
+// external is an ExternalName Service pointing at host.
+func external(namespace, name, host string, ports ...corev1.ServicePort) *corev1.Service {
+	svc := service(namespace, name, ports...)
+	svc.Spec.Type = corev1.ServiceTypeExternalName
+	svc.Spec.ExternalName = host
+	return svc
+}
+
+// headless takes svc's ClusterIP away.
+func headless(svc *corev1.Service) *corev1.Service {
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
+	return svc
+}
+
+// endpointSlice belongs to service and serves its port called port on
+// number, at each of addresses, all ready.
+func endpointSlice(namespace, name, service, port string, number int32, addresses ...string) *discoveryv1.EndpointSlice {
+	s := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace, Name: name,
+			Labels: map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: &port, Port: &number}},
+	}
+	for _, a := range addresses {
+		s.Endpoints = append(s.Endpoints, discoveryv1.Endpoint{Addresses: []string{a}})
+	}
+	return s
+}
+
 // drainStore waits for the store to wake the controller, and fails if it does
 // not. The channel is how a pending tunnel becomes a second reconcile, so a
 // missing notification is a hang in production, not a slow test.
@@ -21,24 +21,37 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"path"
 	"reflect"
+	"slices"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/events"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/scaffoldly/tunnel/config"
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/domains"
+	"github.com/scaffoldly/tunnel/endpoints"
+	"github.com/scaffoldly/tunnel/expiry"
+	"github.com/scaffoldly/tunnel/optin"
+	"github.com/scaffoldly/tunnel/proxy"
 	"github.com/scaffoldly/tunnel/tunnels"
+	"github.com/scaffoldly/tunnel/wake"
 )
 
 // ControllerName is the value an IngressClass must carry in spec.controller to
@@ -56,6 +69,10 @@ var Name = path.Base(ControllerName)
 // dropping every event. See consts.Reporter.
 var ReporterName = consts.Reporter(ControllerName)
 
+// ingressKind is what an Ingress's DNSEndpoint is owned by, and named for. See
+// domains.Name.
+var ingressKind = networkingv1.SchemeGroupVersion.WithKind("Ingress")
+
 // Reconciler wires Ingresses claimed by one of our IngressClasses to a tunnel.
 type Reconciler struct {
 	client.Client
@@ -65,26 +82,74 @@ type Reconciler struct {
 	Recorder events.EventRecorder
 	// Tunnels owns the live tunnels; Reconcile only declares what it wants.
 	Tunnels *tunnels.Store
+	// Domains publishes the Ingress's rule hosts as CNAMEs to its tunnel.
+	Domains *domains.Publisher
+	// Policies reads access policy ConfigMaps and the Secrets they name.
+	// Uncached, like Services: an informer over every Secret in the cluster
+	// would hold every credential in it in this process's memory.
+	Policies client.Reader
+	// Front enforces those policies between the tunnel and the origin.
+	Front *proxy.Front
+	// Namespaces decides which namespaces may have tunnels at all.
+	Namespaces *optin.Gate
+	// Classes reads IngressClasses: the cached client, or under
+	// --watch-namespaces the uncached reader, since a Role cannot list a
+	// cluster-scoped kind and an informer over one would never sync. See
+	// (*Reconciler).class.
+	Classes client.Reader
 }
 
 // New registers the Ingress controller with mgr.
 //
 // Ingress is served by every cluster, so unlike the Gateway API half there is
-// no capability to probe for first.
+// no capability to probe for first. DNSEndpoint is probed, but only decides
+// whether rule hosts can be published — see customDomains.
 func New(mgr ctrl.Manager, cfg config.Config) error {
+	// Made first: the health check carries its token. See
+	// proxy.(*Front).HealthToken.
+	front := proxy.NewFront(mgr.GetLogger().WithName(consts.ControllerIngress), consts.ControllerIngress, "Ingress")
 	store := tunnels.NewStore(mgr.GetLogger().WithName(consts.ControllerIngress), tunnels.Dial, consts.TunnelRetryInterval)
+	store.Health = tunnels.Health{
+		Interval: cfg.TunnelHealthInterval,
+		Path:     cfg.TunnelHealthPath,
+		Failures: cfg.TunnelHealthFailures,
+		Check:    tunnels.Check(front.HealthToken()),
+	}
 	if err := mgr.Add(store); err != nil {
 		return fmt.Errorf("add tunnel store: %w", err)
 	}
 
+	if err := mgr.Add(front); err != nil {
+		return fmt.Errorf("add origin front: %w", err)
+	}
+
+	served, err := domains.Installed(mgr)
+	if err != nil {
+		return fmt.Errorf("detect dnsendpoint: %w", err)
+	}
+
 	r := &Reconciler{
-		Client:   mgr.GetClient(),
-		Services: mgr.GetAPIReader(),
-		Recorder: mgr.GetEventRecorder(ReporterName),
-		Tunnels:  store,
+		Client:     mgr.GetClient(),
+		Services:   mgr.GetAPIReader(),
+		Recorder:   mgr.GetEventRecorder(ReporterName),
+		Tunnels:    store,
+		Domains:    &domains.Publisher{Client: mgr.GetClient(), Served: served},
+		Policies:   mgr.GetAPIReader(),
+		Front:      front,
+		Namespaces: &optin.Gate{Reader: mgr.GetClient(), Required: cfg.NamespaceOptIn},
+		Classes:    mgr.GetClient(),
+	}
+	if cfg.Scoped() {
+		r.Classes = mgr.GetAPIReader()
+	}
+	front.Wake = r.wake
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &networkingv1.Ingress{},
+		backendIndex, backendServices); err != nil {
+		return fmt.Errorf("index ingress backends: %w", err)
 	}
 
-	if err := ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&networkingv1.Ingress{}).
 		// A tunnel becomes ready seconds after it is asked for, and can drop
 		// long after that. Both are changes the Ingress's status has to
@@ -92,8 +157,22 @@ func New(mgr ctrl.Manager, cfg config.Config) error {
 		// tell us about — so the store wakes us directly instead of the
 		// controller polling every pending Ingress on a timer.
 		WatchesRawSource(source.Channel(store.Source(), &handler.EnqueueRequestForObject{})).
-		Named(consts.ControllerIngress).
-		Complete(r); err != nil {
+		// The origin is resolved from the backend Service, which can be
+		// created after the Ingress or have its port or appProtocol edited
+		// under it. Metadata only: this is a trigger, and the Service itself
+		// is still read uncached. The informer is the one the Service half
+		// already runs.
+		WatchesMetadata(&corev1.Service{}, handler.EnqueueRequestsFromMapFunc(r.backendOf)).
+		// A backend's readiness changes with its Pods, which nothing about
+		// the Ingress says. See package endpoints.
+		Watches(&discoveryv1.EndpointSlice{}, handler.EnqueueRequestsFromMapFunc(r.backendOf))
+	b = r.Namespaces.Watch(b, func() client.ObjectList { return &networkingv1.IngressList{} })
+	if served {
+		// Somebody deleting or hand-editing the DNSEndpoint changes what
+		// public DNS says about this Ingress; put it back.
+		b = b.Owns(domains.Object())
+	}
+	if err := b.Named(consts.ControllerIngress).Complete(r); err != nil {
 		return fmt.Errorf("setup ingress controller: %w", err)
 	}
 
@@ -116,7 +195,7 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 			// Deleted between the event and this read. The tunnel lives in
 			// this process, so closing it is the whole teardown — nothing
 			// survives in the cluster to need a finalizer.
-			r.Tunnels.Forget(req.NamespacedName)
+			r.forget(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
@@ -135,20 +214,58 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		// Only if we were actually serving it: an Ingress that was never ours
 		// owns its own status, and writing to it would fight whichever
 		// controller does.
-		if r.Tunnels.Forget(req.NamespacedName) {
+		if r.forget(req.NamespacedName) {
 			if _, err := r.publish(ctx, &ing, ""); err != nil {
 				return ctrl.Result{}, err
 			}
+			if err := r.Domains.Withdraw(ctx, &ing, ingressKind); err != nil {
+				return ctrl.Result{}, err
+			}
 		}
 		return ctrl.Result{}, nil
 	}
 
-	origin, err := r.origin(ctx, &ing)
+	// The namespace first: one that has not opted in gets nothing, and is
+	// refused below like any other Ingress that cannot be served. Then
+	// expiry, then the hostname check: both need nothing but the object, and
+	// an Ingress past its deadline is retired whatever else it says, without
+	// its Service being read.
+	err = r.Namespaces.Admit(ctx, ing.Namespace)
+	var expires time.Time
+	if err == nil {
+		expires, err = expiry.At(&ing, class.Name)
+	}
+	if err == nil && expiry.Elapsed(expires) {
+		return ctrl.Result{}, r.expire(ctx, &ing, class.Name, expires)
+	}
+	if err == nil {
+		err = reserve(&ing, class.Name)
+	}
+	var origin *url.URL
+	var svc *corev1.Service
+	if err == nil {
+		origin, svc, err = r.origin(ctx, &ing)
+	}
+	var ready bool
+	if err == nil {
+		ready, err = endpoints.Ready(ctx, r.Client, svc)
+	}
+	// Last, and wrapping the origin rather than beside it: what the tunnel
+	// dials is this process, which counts the traffic and enforces any
+	// policy. A policy that cannot be read lands in the branch below with
+	// everything else, so the tunnel goes down rather than up without it.
+	var res ctrl.Result
+	if err == nil {
+		origin, res, err = r.front(ctx, req.NamespacedName, &ing, class, origin)
+	}
 	if err != nil {
-		r.Tunnels.Forget(req.NamespacedName)
+		r.forget(req.NamespacedName)
 		if _, clearErr := r.publish(ctx, &ing, ""); clearErr != nil {
 			return ctrl.Result{}, clearErr
 		}
+		if clearErr := r.Domains.Withdraw(ctx, &ing, ingressKind); clearErr != nil {
+			return ctrl.Result{}, clearErr
+		}
 		if errors.Is(err, errUnsupported) {
 			// Nothing to retry: this is the spec, not the weather. Editing the
 			// Ingress brings us straight back here.
@@ -161,7 +278,60 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 	}
 
 	provider := class.Name
+	// Every return from here on is back by the deadline, including the ones
+	// that wait on the store or the EndpointSlice watch.
+	res.RequeueAfter = expiry.Sooner(res.RequeueAfter, expires)
+	// After the front is served, which is what it records this against.
+	publishable, wentDown := r.Front.Backend(req.NamespacedName, ready)
 	status := r.Tunnels.Ensure(req.NamespacedName, class, origin)
+	if !ready && (status.State == tunnels.Ready || status.State == tunnels.Degraded) {
+		// The tunnel stays up either way, so the hostname comes back the
+		// moment an endpoint does rather than after a fresh mint. Only
+		// whether it is advertised meanwhile depends on the policy.
+		//
+		// Said when something changed: the backend went down, the tunnel
+		// came up while it was, or the hostname was withdrawn. Not on every
+		// pass after, which for an object with a policy is one a minute for
+		// as long as the backend is down — or asleep, which is indefinitely.
+		announce := wentDown || status.Changed
+		msg, eventType := consts.MsgBackendMaintenanceFmt, consts.EventTypeWarning
+		switch {
+		case r.Front.Wakes(req.NamespacedName):
+			// Asleep by the policy's own choice, which is not a warning.
+			msg, eventType = consts.MsgBackendAsleepFmt, consts.EventTypeNormal
+		case !publishable:
+			msg = consts.MsgBackendHeldFmt
+			withdrawn, err := r.publish(ctx, &ing, "")
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			announce = announce || withdrawn
+			if err := r.Domains.Withdraw(ctx, &ing, ingressKind); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		if announce {
+			logger.Info("backend has no ready endpoints", "service", client.ObjectKeyFromObject(svc),
+				"published", publishable)
+			r.Recorder.Eventf(&ing, nil, eventType, consts.ReasonBackendUnavailable,
+				consts.ActionProvision, msg, client.ObjectKeyFromObject(svc))
+		}
+		if !publishable {
+			// The EndpointSlice watch brings us back.
+			return res, nil
+		}
+	}
+	if idle, ok := r.Front.Idle(req.NamespacedName); ok && ready {
+		// Checked on the policy resync, so an idle period is honoured to
+		// within PolicyResyncInterval. The next request wakes it; see wake.
+		if err := wake.ScaleFor(ctx, r.Client, r.Services, r.Recorder, &ing, svc, 0, consts.MsgBackendSleptFmt, idle); err != nil {
+			if !errors.Is(err, errUnsupported) {
+				return ctrl.Result{}, err
+			}
+			r.Recorder.Eventf(&ing, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
+				consts.ActionScale, consts.MsgUnsupportedFmt, err)
+		}
+	}
 	switch status.State {
 	case tunnels.Ready:
 		changed, err := r.publish(ctx, &ing, status.Hostname)
@@ -176,8 +346,24 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 			// ingress` shows it.
 			r.Recorder.Eventf(&ing, nil, consts.EventTypeNormal, consts.ReasonTunnelReady,
 				consts.ActionProvision, consts.MsgTunnelReadyFmt, status.Hostname, provider)
+			expiry.Announce(ctx, r.Recorder, &ing, expires)
 		}
-		return ctrl.Result{}, nil
+		return res, r.customDomains(ctx, &ing, provider, status.Hostname, changed)
+
+	case tunnels.Degraded:
+		// Still published: the store replaces the tunnel if this goes on,
+		// and withdrawing a hostname over one missed check would take down
+		// more than it saves. The store wakes us on the next transition.
+		//
+		// Said once, on the way in. Every resync and backend change lands
+		// here too while it lasts, and the message carries the check's
+		// error, so the recorder would not fold the repeats into one.
+		if status.Changed {
+			logger.Info("tunnel degraded", "provider", provider, "hostname", status.Hostname, "error", status.Err)
+			r.Recorder.Eventf(&ing, nil, consts.EventTypeWarning, consts.ReasonTunnelDegraded,
+				consts.ActionProvision, consts.MsgTunnelDegradedFmt, status.Hostname, status.Err, r.Tunnels.Health.Threshold())
+		}
+		return res, nil
 
 	case tunnels.Failed:
 		// Stop advertising a hostname that no longer serves, and wait out the
@@ -185,6 +371,11 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		if _, err := r.publish(ctx, &ing, ""); err != nil {
 			return ctrl.Result{}, err
 		}
+		// The replacement will have a different hostname, so the CNAME goes
+		// too rather than pointing at this one in the meantime.
+		if err := r.Domains.Withdraw(ctx, &ing, ingressKind); err != nil {
+			return ctrl.Result{}, err
+		}
 		logger.Info("tunnel failed", "provider", provider, "error", status.Err,
 			"retryAt", status.RetryAt)
 		r.Recorder.Eventf(&ing, nil, consts.EventTypeWarning, consts.ReasonTunnelFailed,
@@ -196,8 +387,114 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		// hostname is real. Publishing one before it resolves would advertise
 		// an address that does not answer.
 		logger.Info("tunnel pending", "provider", provider, "origin", origin.String())
-		return ctrl.Result{}, nil
+		return res, nil
+	}
+}
+
+// wake scales key's backend up from zero, for the Front when a request finds
+// it down under a scale-to-zero policy. The Ingress is read afresh: the Front
+// knows only the key, and the backend may have changed since it was served.
+func (r *Reconciler) wake(ctx context.Context, key types.NamespacedName) error {
+	var ing networkingv1.Ingress
+	if err := r.Get(ctx, key, &ing); err != nil {
+		return fmt.Errorf("get ingress %s: %w", key, err)
 	}
+	_, svc, err := r.origin(ctx, &ing)
+	if err != nil {
+		return err
+	}
+	return wake.ScaleFor(ctx, r.Client, r.Services, r.Recorder, &ing, svc, 1, consts.MsgBackendWokenFmt)
+}
+
+// backendOf maps a Service, or one of its EndpointSlices, to the Ingresses in
+// its namespace that name it as a backend, through the backend index. Whether
+// they are ours is Reconcile's to decide.
+func (r *Reconciler) backendOf(ctx context.Context, obj client.Object) []reconcile.Request {
+	svc := client.ObjectKeyFromObject(obj)
+	if _, ok := obj.(*discoveryv1.EndpointSlice); ok {
+		if svc, ok = endpoints.Service(obj); !ok {
+			return nil
+		}
+	}
+	var list networkingv1.IngressList
+	if err := r.List(ctx, &list, client.InNamespace(svc.Namespace),
+		client.MatchingFields{backendIndex: svc.Name}); err != nil {
+		log.FromContext(ctx).Error(err, "list ingresses for backend", "service", svc)
+		return nil
+	}
+	out := make([]reconcile.Request, 0, len(list.Items))
+	for i := range list.Items {
+		out = append(out, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&list.Items[i])})
+	}
+	return out
+}
+
+// expire retires an Ingress whose {provider}/ttl or expires-at has passed:
+// the tunnel closes, the hostname comes off status and its CNAMEs are
+// withdrawn. No requeue — the label is the only thing that brings it back, and
+// editing it is an update.
+//
+// Said once, when there was something to retire, rather than on every pass
+// that finds it still expired.
+func (r *Reconciler) expire(ctx context.Context, ing *networkingv1.Ingress, provider string, at time.Time) error {
+	retired := r.forget(client.ObjectKeyFromObject(ing))
+	changed, err := r.publish(ctx, ing, "")
+	if err != nil {
+		return err
+	}
+	if err := r.Domains.Withdraw(ctx, ing, ingressKind); err != nil {
+		return err
+	}
+	expiry.Retired(ctx, r.Recorder, ing, provider, at, retired || changed)
+	return nil
+}
+
+// forget retires key's tunnel and whatever stood in front of its origin, and
+// reports whether there was a tunnel.
+func (r *Reconciler) forget(key types.NamespacedName) bool {
+	r.Front.Release(key)
+	return r.Tunnels.Forget(key)
+}
+
+// front puts the Ingress's policies, if any, in front of origin, and returns
+// the URL the tunnel should dial. Always the Front's, policy or not: it is
+// where the tunnel's traffic is counted, and a URL that stays put as policies
+// come and go is a hostname that does too.
+//
+// Two places can name a policy: the class's spec.parameters, which covers
+// every Ingress on it, and the Ingress's own {provider}/policy label. Both
+// apply. An Ingress can add to its class's policy and cannot take it away,
+// which is the only way round a shared class can be trusted with one.
+//
+// The result requeues a fronted Ingress so the policy is re-read; see
+// consts.PolicyResyncInterval.
+func (r *Reconciler) front(ctx context.Context, key types.NamespacedName, ing *networkingv1.Ingress,
+	class *networkingv1.IngressClass, origin *url.URL) (*url.URL, ctrl.Result, error) {
+	var refs []types.NamespacedName
+	if p := class.Spec.Parameters; p != nil {
+		ref, err := proxy.Parameters(class.Name, ptr.Deref(p.APIGroup, ""), p.Kind, p.Name, p.Namespace)
+		if err != nil {
+			return nil, ctrl.Result{}, err
+		}
+		refs = append(refs, ref)
+	}
+	if ref, ok := proxy.Label(ing, class.Name); ok {
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 {
+		fronted, err := r.Front.Serve(key, class.Name, origin, nil)
+		return fronted, ctrl.Result{}, err
+	}
+
+	policies, err := proxy.Load(ctx, r.Policies, refs...)
+	if err != nil {
+		return nil, ctrl.Result{}, err
+	}
+	fronted, err := r.Front.Serve(key, class.Name, origin, policies)
+	if err != nil {
+		return nil, ctrl.Result{}, err
+	}
+	return fronted, ctrl.Result{RequeueAfter: consts.PolicyResyncInterval}, nil
 }
 
 // publish writes the tunnel hostname to the Ingress's status, and reports
@@ -245,6 +542,54 @@ func (r *Reconciler) publish(ctx context.Context, ing *networkingv1.Ingress, hos
 	return true, nil
 }
 
+// reserve refuses an Ingress whose {provider}/hostname label asks for a name
+// the provider cannot mint on. Keyed by the class the Ingress names, as
+// {provider}/protocol is; a label for another provider is not addressed to
+// this tunnel.
+//
+// Not the same thing as a rule host, which customDomains publishes: a rule
+// host is a name pointed at the tunnel, while this asks for the tunnel to be
+// that name.
+func reserve(ing *networkingv1.Ingress, provider string) error {
+	want, ok := ing.Labels[provider+"/"+consts.HostnameLabel]
+	if !ok {
+		return nil
+	}
+	return tunnels.Reserve(provider, want)
+}
+
+// customDomains publishes the hosts the Ingress's rules name as CNAMEs to its
+// tunnel hostname.
+//
+// A rule's host is the user saying which name the Ingress answers to. This
+// controller does not route by host — one tunnel fronts one origin — so it
+// was ignored until now; publishing it is the only thing it could mean here.
+//
+// A conflicting DNSEndpoint is reported and not retried. The tunnel itself is
+// serving on its own hostname, and refusing that over a DNS record somebody
+// else owns would take down the part that works.
+func (r *Reconciler) customDomains(ctx context.Context, ing *networkingv1.Ingress, provider, hostname string, announce bool) error {
+	hosts := make([]string, 0, len(ing.Spec.Rules))
+	for _, rule := range ing.Spec.Rules {
+		hosts = append(hosts, rule.Host)
+	}
+
+	res, err := r.Domains.Publish(ctx, ing, ingressKind,
+		domains.Hosts(hostname, hosts...), hostname)
+	if errors.Is(err, errUnsupported) {
+		if announce {
+			r.Recorder.Eventf(ing, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
+				consts.ActionProvision, consts.MsgUnsupportedFmt, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	domains.Report(r.Recorder, ing, provider, hostname, res, announce)
+	return nil
+}
+
 // class resolves the IngressClass this Ingress asks for, and reports whether
 // it is ours.
 //
@@ -256,6 +601,13 @@ func (r *Reconciler) publish(ctx context.Context, ing *networkingv1.Ingress, hos
 // This is what ends up handed to libtunnel:
 //
 //	libtunnel.Cloudflare().WithProvider(class.Name)
+//
+// A namespaced install may not be allowed to read classes at all. Then the
+// ones the install flags would have created, named for InstalledProviders,
+// are taken as ours on their name alone, without parameters: nothing else
+// claims those names, and it is the difference between such an install
+// serving the documented classes and serving nothing. Any other name stays
+// unclaimed, since it may well be another controller's.
 func (r *Reconciler) class(ctx context.Context, ing *networkingv1.Ingress) (*networkingv1.IngressClass, bool, error) {
 	name := ing.Spec.IngressClassName
 	if name == nil || *name == "" {
@@ -263,13 +615,23 @@ func (r *Reconciler) class(ctx context.Context, ing *networkingv1.Ingress) (*net
 	}
 
 	var class networkingv1.IngressClass
-	if err := r.Get(ctx, client.ObjectKey{Name: *name}, &class); err != nil {
-		if apierrors.IsNotFound(err) {
+	if err := r.Classes.Get(ctx, client.ObjectKey{Name: *name}, &class); err != nil {
+		switch {
+		case apierrors.IsNotFound(err):
 			// Dangling class reference. The Ingress is inert until the class
 			// exists, and it is not ours to complain about.
 			return nil, false, nil
+		case apierrors.IsForbidden(err):
+			if !slices.Contains(consts.InstalledProviders, *name) {
+				return nil, false, nil
+			}
+			class = networkingv1.IngressClass{
+				ObjectMeta: metav1.ObjectMeta{Name: *name},
+				Spec:       networkingv1.IngressClassSpec{Controller: ControllerName},
+			}
+		default:
+			return nil, false, fmt.Errorf("get ingressclass %q: %w", *name, err)
 		}
-		return nil, false, fmt.Errorf("get ingressclass %q: %w", *name, err)
 	}
 
 	if class.Spec.Controller != ControllerName {
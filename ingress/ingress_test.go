@@ -3,11 +3,18 @@ package ingress
 import (
 	"context"
 	"errors"
+	"io"
+	"net/http"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/events"
@@ -16,6 +23,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/domains"
+	"github.com/scaffoldly/tunnel/optin"
+	"github.com/scaffoldly/tunnel/proxy"
 	"github.com/scaffoldly/tunnel/tunnels"
 )
 
@@ -114,6 +124,128 @@ func TestReconcileClearsHostnameOnFailure(t *testing.T) {
 	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonTunnelFailed)
 }
 
+// A hostname that fails its health check stays published, with a warning: one
+// miss is not worth an outage, and the store replaces the tunnel if it goes on.
+func TestReconcileKeepsADegradedHostname(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.trycloudflare.com")
+	r, c, recorder, s := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel { return tun },
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		claimedIngress(),
+	)
+	// One miss, then nothing more until shutdown, so it stays Degraded.
+	var checks atomic.Int32
+	s.Health = tunnels.Health{Interval: time.Millisecond, Failures: 3, Check: func(ctx context.Context, _, _ string) error {
+		if checks.Add(1) > 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return errors.New("530 Origin Unreachable")
+	}}
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	tun.Connect()
+	drainStore(t, s)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertEvent(t, recorder, consts.EventTypeNormal, consts.ReasonTunnelReady)
+
+	drainStore(t, s)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got := address(t, c); got != "brave-tuna.trycloudflare.com" {
+		t.Errorf("published %q while degraded, want the hostname kept", got)
+	}
+	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonTunnelDegraded)
+
+	// A resync while it lasts is not news.
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder)
+}
+
+// TestReconcilePublishesCustomDomains covers rule hosts: once the tunnel is up
+// they become a DNSEndpoint CNAMEing them to it, the event says that is the
+// path taken, and the record goes when the tunnel does.
+func TestReconcilePublishesCustomDomains(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.trycloudflare.com")
+	ing := claimedIngress()
+	ing.Spec.Rules[0].Host = "app.example.com"
+	r, c, recorder, s := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel { return tun },
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		ing,
+	)
+	r.Domains.Served = true
+	endpoint := client.ObjectKey{Namespace: testKey.Namespace, Name: domains.Name(testKey.Name, ingressKind)}
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if err := c.Get(context.Background(), endpoint, domains.Object()); err == nil {
+		t.Fatal("published a dnsendpoint while pending; there is nothing to CNAME to yet")
+	}
+
+	tun.Connect()
+	drainStore(t, s)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	// Status still carries the minted hostname: that is what the CNAME
+	// targets, and what answers before DNS has propagated.
+	if got := address(t, c); got != "brave-tuna.trycloudflare.com" {
+		t.Errorf("published %q, want the tunnel hostname", got)
+	}
+	if err := c.Get(context.Background(), endpoint, domains.Object()); err != nil {
+		t.Fatalf("no dnsendpoint for the rule host: %v", err)
+	}
+	assertEvent(t, recorder, consts.EventTypeNormal, consts.ReasonTunnelReady)
+	assertEvent(t, recorder, consts.EventTypeNormal, consts.ReasonCustomDomain)
+
+	tun.Fail(errors.New("edge connection lost"))
+	drainStore(t, s)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if err := c.Get(context.Background(), endpoint, domains.Object()); err == nil {
+		t.Error("dnsendpoint still points at a tunnel that failed")
+	}
+}
+
+// Without external-dns the hosts cannot be published, and the warning says
+// so once — when the tunnel comes up — rather than on every resync.
+func TestReconcileReportsUnpublishedCustomDomains(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.trycloudflare.com")
+	ing := claimedIngress()
+	ing.Spec.Rules[0].Host = "app.example.com"
+	r, _, recorder, s := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel { return tun },
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		ing,
+	)
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	tun.Connect()
+	drainStore(t, s)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertEvent(t, recorder, consts.EventTypeNormal, consts.ReasonTunnelReady)
+	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonCustomDomain)
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder)
+}
+
 // TestReconcileRefusesUnserviceableIngress proves an Ingress we cannot serve
 // faithfully gets an event and no tunnel, rather than a hostname that answers
 // for one of its backends.
@@ -149,6 +281,403 @@ func TestReconcileRefusesUnserviceableIngress(t *testing.T) {
 	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonUnsupported)
 }
 
+// TestReconcileRefusesRequestedHostname covers {provider}/hostname. No
+// provider can mint on a chosen name, and the request is that the Ingress says
+// so rather than coming up on a random one.
+func TestReconcileRefusesRequestedHostname(t *testing.T) {
+	var minted int
+	ing := claimedIngress()
+	ing.Labels = map[string]string{consts.ProviderTunnelPizza + "/" + consts.HostnameLabel: "app.example.com"}
+
+	r, c, recorder, _ := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel {
+		minted++
+		return tunnels.NewFake("random-name.tunneled.pizza")
+	},
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		ing,
+	)
+
+	res, err := r.Reconcile(context.Background(), request())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v, want nil (retrying cannot fix a spec)", err)
+	}
+	if res.RequeueAfter != 0 {
+		t.Errorf("RequeueAfter = %v, want 0", res.RequeueAfter)
+	}
+	if minted != 0 {
+		t.Errorf("minted %d tunnels on a name nobody asked for, want 0", minted)
+	}
+	if got := address(t, c); got != "" {
+		t.Errorf("published %q, want nothing", got)
+	}
+	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonUnsupported)
+}
+
+// A hostname label addressed to another provider is not this tunnel's.
+func TestReconcileIgnoresOtherProvidersHostname(t *testing.T) {
+	var minted int
+	ing := claimedIngress()
+	ing.Labels = map[string]string{consts.ProviderCloudflare + "/" + consts.HostnameLabel: "app.example.com"}
+
+	r, _, _, _ := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel {
+		minted++
+		return tunnels.NewFake("brave-tuna.trycloudflare.com")
+	},
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		ing,
+	)
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if minted != 1 {
+		t.Errorf("minted %d tunnels, want 1", minted)
+	}
+}
+
+// Every tunnel dials this process, policy or not: it is where the traffic
+// is counted. Without a policy there is nothing to re-read.
+func TestReconcileFrontsTheOriginWithoutAPolicy(t *testing.T) {
+	var dialed *url.URL
+	r, _, _, _ := reconciler(t, func(_ string, origin *url.URL) tunnels.Tunnel {
+		dialed = origin
+		return tunnels.NewFake("brave-tuna.tunneled.pizza")
+	},
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		claimedIngress(),
+	)
+
+	res, err := r.Reconcile(context.Background(), request())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if dialed == nil || dialed.Hostname() != "127.0.0.1" {
+		t.Fatalf("tunnel dials %v, want the front listener on loopback", dialed)
+	}
+	if res.RequeueAfter != 0 {
+		t.Errorf("RequeueAfter = %v with no policy to re-read", res.RequeueAfter)
+	}
+}
+
+// TestReconcileFrontsTheOriginWithAPolicy covers {provider}/policy: the
+// tunnel dials this process rather than the Service, and the reconcile comes
+// back to re-read the policy.
+func TestReconcileFrontsTheOriginWithAPolicy(t *testing.T) {
+	var dialed *url.URL
+	ing := claimedIngress()
+	ing.Labels = map[string]string{consts.ProviderTunnelPizza + "/" + consts.PolicyLabel: "web-policy"}
+
+	r, _, _, _ := reconciler(t, func(_ string, origin *url.URL) tunnels.Tunnel {
+		dialed = origin
+		return tunnels.NewFake("brave-tuna.tunneled.pizza")
+	},
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-policy"},
+			Data:       map[string]string{"allow-cidrs": "192.0.2.0/24"},
+		},
+		ing,
+	)
+
+	res, err := r.Reconcile(context.Background(), request())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if dialed == nil || dialed.Hostname() != "127.0.0.1" {
+		t.Fatalf("tunnel dials %v, want the policy listener on loopback", dialed)
+	}
+	if res.RequeueAfter != consts.PolicyResyncInterval {
+		t.Errorf("RequeueAfter = %v, want %v so the policy is re-read", res.RequeueAfter, consts.PolicyResyncInterval)
+	}
+	if !r.Front.Release(testKey) {
+		t.Error("no listener held for the ingress")
+	}
+}
+
+// selected is the backing Service with a selector, so it is ready only with
+// an EndpointSlice that says so; ready is that slice.
+func selected() *corev1.Service {
+	svc := service("default", "web", corev1.ServicePort{Name: "http", Port: 8080})
+	svc.Spec.Selector = map[string]string{"app": "web"}
+	return svc
+}
+
+func readySlice(ready bool) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "web-abc12",
+			Labels: map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(ready)},
+		}},
+	}
+}
+
+// A Service with nothing ready keeps its tunnel but not its hostname, and
+// gets it back when an endpoint turns ready, with no new tunnel minted.
+func TestReconcileHoldsTheHostnameWithoutAReadyBackend(t *testing.T) {
+	var minted int
+	tun := tunnels.NewFake("brave-tuna.trycloudflare.com")
+	r, c, recorder, s := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel {
+		minted++
+		return tun
+	},
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		selected(), readySlice(false), claimedIngress(),
+	)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	tun.Connect()
+	drainStore(t, s)
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got := address(t, c); got != "" {
+		t.Errorf("published %q with no ready endpoint, want nothing", got)
+	}
+	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonBackendUnavailable)
+
+	slice := readySlice(true)
+	var existing discoveryv1.EndpointSlice
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(slice), &existing); err != nil {
+		t.Fatal(err)
+	}
+	existing.Endpoints = slice.Endpoints
+	if err := c.Update(context.Background(), &existing); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.backendOf(context.Background(), &existing); len(got) != 1 || got[0] != request() {
+		t.Fatalf("backendOf() = %v, want the ingress", got)
+	}
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got := address(t, c); got != "brave-tuna.trycloudflare.com" {
+		t.Errorf("published %q once ready, want the tunnel's hostname", got)
+	}
+	if minted != 1 {
+		t.Errorf("minted %d tunnels, want 1: readiness is not a reason to replace one", minted)
+	}
+}
+
+// With a maintenance page, the hostname stays published and the page is
+// what it serves.
+func TestReconcileServesTheMaintenancePage(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.trycloudflare.com")
+	var dialed *url.URL
+	ing := claimedIngress()
+	ing.Labels = map[string]string{consts.ProviderTunnelPizza + "/" + consts.PolicyLabel: "web-policy"}
+	r, c, recorder, s := reconciler(t, func(_ string, origin *url.URL) tunnels.Tunnel {
+		dialed = origin
+		return tun
+	},
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		selected(), readySlice(false), ing,
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-policy"},
+			Data:       map[string]string{"maintenance-page": "Back soon."},
+		},
+	)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	tun.Connect()
+	drainStore(t, s)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	if got := address(t, c); got != "brave-tuna.trycloudflare.com" {
+		t.Errorf("published %q, want the hostname kept for the maintenance page", got)
+	}
+	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonBackendUnavailable)
+	assertEvent(t, recorder, consts.EventTypeNormal, consts.ReasonTunnelReady)
+	// Still down on the next resync, which is not news.
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder)
+
+	resp, err := http.Get(dialed.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "Back soon." {
+		t.Errorf("tunnel origin answered %d %q, want 503 with the page", resp.StatusCode, body)
+	}
+}
+
+// A backend Service created after its Ingress is noticed when it appears,
+// through the Service watch, not when the retry backoff next comes round.
+func TestReconcileFollowsALateService(t *testing.T) {
+	r, c, _, _ := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel {
+		return tunnels.NewFake("brave-tuna.trycloudflare.com")
+	},
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		claimedIngress(),
+	)
+	if _, err := r.Reconcile(context.Background(), request()); err == nil {
+		t.Fatal("Reconcile() error = nil without the Service, want it retried")
+	}
+
+	svc := service("default", "web", corev1.ServicePort{Name: "http", Port: 8080})
+	if err := c.Create(context.Background(), svc); err != nil {
+		t.Fatal(err)
+	}
+	// What the metadata watch delivers.
+	meta := &metav1.PartialObjectMetadata{ObjectMeta: svc.ObjectMeta}
+	if got := r.backendOf(context.Background(), meta); len(got) != 1 || got[0] != request() {
+		t.Fatalf("backendOf(Service) = %v, want the ingress", got)
+	}
+	other := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api"}}
+	if got := r.backendOf(context.Background(), other); len(got) != 0 {
+		t.Errorf("backendOf(unrelated Service) = %v, want nothing", got)
+	}
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v once the Service exists", err)
+	}
+}
+
+// Under scale-to-zero an idle backend's Deployment is scaled to zero on a
+// resync, the hostname stays published while it sleeps, and the Front's
+// wake scales it back to one.
+func TestReconcileScalesAnIdleBackendToZero(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.trycloudflare.com")
+	ing := claimedIngress()
+	ing.Labels = map[string]string{consts.ProviderTunnelPizza + "/" + consts.PolicyLabel: "web-policy"}
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To[int32](1),
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}}},
+		},
+	}
+	r, c, recorder, s := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel { return tun },
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		selected(), readySlice(true), ing, deploy,
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-policy"},
+			Data:       map[string]string{"scale-to-zero": "1ms"},
+		},
+	)
+	replicas := func() int32 {
+		t.Helper()
+		var got appsv1.Deployment
+		if err := c.Get(context.Background(), client.ObjectKeyFromObject(deploy), &got); err != nil {
+			t.Fatal(err)
+		}
+		return ptr.Deref(got.Spec.Replicas, -1)
+	}
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	tun.Connect()
+	drainStore(t, s)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got := replicas(); got != 0 {
+		t.Fatalf("replicas = %d after the idle period, want 0", got)
+	}
+
+	// Its Pods gone, the backend has nothing ready; the hostname stays.
+	var slice discoveryv1.EndpointSlice
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(readySlice(false)), &slice); err != nil {
+		t.Fatal(err)
+	}
+	slice.Endpoints[0].Conditions.Ready = ptr.To(false)
+	if err := c.Update(context.Background(), &slice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got := address(t, c); got != "brave-tuna.trycloudflare.com" {
+		t.Errorf("published %q while asleep, want the hostname kept", got)
+	}
+	// Asleep is said once, not on every policy resync while it lasts.
+	for len(recorder.Events) > 0 {
+		<-recorder.Events
+	}
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder)
+
+	if err := r.wake(context.Background(), testKey); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	if got := replicas(); got != 1 {
+		t.Errorf("replicas = %d after wake, want 1", got)
+	}
+}
+
+// A policy that cannot be read keeps the tunnel down. Coming up without it is
+// the one thing that must not happen, and the ConfigMap may be on its way, so
+// it is an error to retry rather than a refusal.
+func TestReconcileHoldsTheTunnelWithoutItsPolicy(t *testing.T) {
+	var minted int
+	ing := claimedIngress()
+	ing.Labels = map[string]string{consts.ProviderTunnelPizza + "/" + consts.PolicyLabel: "web-policy"}
+
+	r, _, _, s := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel {
+		minted++
+		return tunnels.NewFake("brave-tuna.tunneled.pizza")
+	},
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		ing,
+	)
+
+	if _, err := r.Reconcile(context.Background(), request()); err == nil {
+		t.Fatal("Reconcile() error = nil, want the missing policy retried")
+	}
+	if minted != 0 || s.Tracking(testKey) {
+		t.Errorf("minted %d tunnels without the policy they asked for, want 0", minted)
+	}
+}
+
+// A class whose parameters cannot be a policy refuses every Ingress on it
+// rather than serving them all unprotected.
+func TestReconcileRefusesUnreadableClassParameters(t *testing.T) {
+	var minted int
+	cls := class(consts.ProviderTunnelPizza, ControllerName, nil).(*networkingv1.IngressClass)
+	cls.Spec.Parameters = &networkingv1.IngressClassParametersReference{
+		APIGroup: ptr.To("example.com"), Kind: "Policy", Name: "strict",
+	}
+
+	r, _, recorder, _ := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel {
+		minted++
+		return tunnels.NewFake("brave-tuna.tunneled.pizza")
+	},
+		cls,
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		claimedIngress(),
+	)
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v, want nil (retrying cannot fix a spec)", err)
+	}
+	if minted != 0 {
+		t.Errorf("minted %d tunnels, want 0", minted)
+	}
+	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonUnsupported)
+}
+
 // TestReconcileIgnoresOtherControllers proves an Ingress claimed by someone
 // else is never touched: no tunnel, and no status write onto another
 // controller's object.
@@ -251,6 +780,100 @@ func TestReconcileForgetsDeletedIngress(t *testing.T) {
 	}
 }
 
+// An Ingress with a deadline says when, comes back by it, and is retired once
+// it passes: tunnel closed, hostname withdrawn, and said once rather than on
+// every pass that finds it still expired.
+func TestReconcileRetiresAnExpiredIngress(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.trycloudflare.com")
+	ing := claimedIngress()
+	ing.Labels = map[string]string{
+		"tunnel.pizza/expires-at": strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+	}
+	r, c, recorder, s := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel { return tun },
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		ing,
+	)
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	tun.Connect()
+	drainStore(t, s)
+	res, err := r.Reconcile(context.Background(), request())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got := address(t, c); got == "" {
+		t.Fatal("expected a published hostname before the deadline")
+	}
+	if res.RequeueAfter <= 58*time.Minute || res.RequeueAfter > time.Hour {
+		t.Errorf("RequeueAfter = %v, want the time left until the deadline", res.RequeueAfter)
+	}
+	assertEvent(t, recorder, consts.EventTypeNormal, consts.ReasonTunnelReady)
+	assertEvent(t, recorder, consts.EventTypeNormal, consts.ReasonTunnelExpiry)
+
+	var live networkingv1.Ingress
+	if err := c.Get(context.Background(), testKey, &live); err != nil {
+		t.Fatal(err)
+	}
+	live.Labels["tunnel.pizza/expires-at"] = strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+	if err := c.Update(context.Background(), &live); err != nil {
+		t.Fatal(err)
+	}
+	res, err = r.Reconcile(context.Background(), request())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got := address(t, c); got != "" {
+		t.Errorf("still publishing %q after the deadline, want nothing", got)
+	}
+	if s.Tracking(testKey) {
+		t.Error("tunnel outlived its deadline")
+	}
+	if res.RequeueAfter != 0 {
+		t.Errorf("RequeueAfter = %v, want none: only the label brings it back", res.RequeueAfter)
+	}
+	assertEvent(t, recorder, consts.EventTypeNormal, consts.ReasonTunnelExpired)
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder)
+}
+
+// Under --namespace-opt-in an Ingress in a namespace that has not opted in is
+// refused out loud, and is served once the namespace opts in.
+func TestReconcileRefusesANamespaceThatHasNotOptedIn(t *testing.T) {
+	tun := tunnels.NewFake("brave-tuna.trycloudflare.com")
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	r, c, recorder, s := reconciler(t, func(_ string, _ *url.URL) tunnels.Tunnel { return tun },
+		class(consts.ProviderTunnelPizza, ControllerName, nil),
+		service("default", "web", corev1.ServicePort{Name: "http", Port: 8080}),
+		claimedIngress(), ns,
+	)
+	r.Namespaces = &optin.Gate{Reader: c, Required: true}
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if s.Tracking(testKey) {
+		t.Error("minted a tunnel in a namespace that has not opted in")
+	}
+	assertEvent(t, recorder, consts.EventTypeWarning, consts.ReasonUnsupported)
+
+	ns.Labels = map[string]string{consts.AllowedLabel: "true"}
+	if err := c.Update(context.Background(), ns); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if !s.Tracking(testKey) {
+		t.Error("no tunnel once the namespace opted in")
+	}
+}
+
 // reconciler wires a Reconciler over a fake cluster and a store whose dialer
 // is under the test's control.
 func reconciler(t *testing.T, mint func(string, *url.URL) tunnels.Tunnel, objs ...client.Object) (
@@ -261,7 +884,13 @@ func reconciler(t *testing.T, mint func(string, *url.URL) tunnels.Tunnel, objs .
 	recorder := events.NewFakeRecorder(16)
 	s := tunnels.NewTestStore(consts.TunnelRetryInterval, mint)
 	t.Cleanup(s.Close)
-	return &Reconciler{Client: c, Services: c, Recorder: recorder, Tunnels: s}, c, recorder, s
+	front := proxy.NewFront(logr.Discard(), consts.ControllerIngress, "Ingress")
+	t.Cleanup(front.Close)
+	return &Reconciler{
+		Client: c, Services: c, Classes: c, Recorder: recorder, Tunnels: s,
+		Domains:  &domains.Publisher{Client: c},
+		Policies: c, Front: front,
+	}, c, recorder, s
 }
 
 func request() ctrl.Request {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"slices"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
@@ -12,6 +13,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/endpoints"
 )
 
 // errUnsupported marks an Ingress this controller cannot serve as written, as
@@ -30,27 +32,29 @@ type backend struct {
 	portName string
 }
 
-// origin resolves the Ingress to the local URL its tunnel fronts.
+// origin resolves the Ingress to the local URL its tunnel fronts, and the
+// Service behind it.
 //
 // libtunnel fronts exactly one origin, so an Ingress that fans out across
 // several Services cannot be served faithfully. Rather than pick one and
 // silently misroute the rest, that is refused: publishing a hostname that
 // serves some paths and 502s the others is worse than publishing nothing.
-func (r *Reconciler) origin(ctx context.Context, ing *networkingv1.Ingress) (*url.URL, error) {
+func (r *Reconciler) origin(ctx context.Context, ing *networkingv1.Ingress) (*url.URL, *corev1.Service, error) {
 	b, err := single(ing)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	port, err := r.port(ctx, ing.Namespace, b)
+	svc, port, err := r.port(ctx, ing.Namespace, b)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &url.URL{
-		Scheme: scheme(ing, port),
-		Host:   fmt.Sprintf("%s.%s.%s:%d", b.service, ing.Namespace, consts.OriginDomain, port.Port),
-	}, nil
+	host, err := endpoints.Address(ctx, r.Services, svc, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &url.URL{Scheme: scheme(ing, port), Host: host}, svc, nil
 }
 
 // scheme decides how the backend is dialed.
@@ -81,12 +85,47 @@ func scheme(ing *networkingv1.Ingress, port corev1.ServicePort) string {
 }
 
 func normalizeScheme(declared string) string {
-	if strings.EqualFold(declared, consts.OriginSchemeTLS) {
+	switch {
+	case strings.EqualFold(declared, consts.OriginSchemeTLS):
 		return consts.OriginSchemeTLS
+	case strings.EqualFold(declared, consts.OriginSchemeH2C), strings.EqualFold(declared, consts.AppProtocolH2C):
+		return consts.OriginSchemeH2C
 	}
 	return consts.OriginScheme
 }
 
+// backendIndex is the field index of Ingresses by the Services they name as
+// backends. Not a real field path: the names are spread over the default
+// backend and every rule's paths, and the index gathers them. See
+// backendServices.
+const backendIndex = "spec.backend.service"
+
+// backendServices is the backendIndex extractor. Every Service named, not
+// only the one single settles on: an Ingress refused for naming two is one a
+// change to either may be relevant to, and it is Reconcile that says so.
+func backendServices(obj client.Object) []string {
+	ing, ok := obj.(*networkingv1.Ingress)
+	if !ok {
+		return nil
+	}
+	var out []string
+	add := func(b *networkingv1.IngressBackend) {
+		if b != nil && b.Service != nil && !slices.Contains(out, b.Service.Name) {
+			out = append(out, b.Service.Name)
+		}
+	}
+	add(ing.Spec.DefaultBackend)
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for i := range rule.HTTP.Paths {
+			add(&rule.HTTP.Paths[i].Backend)
+		}
+	}
+	return out
+}
+
 // single reduces an Ingress to the one Service backend it names, or explains
 // why it cannot.
 func single(ing *networkingv1.Ingress) (backend, error) {
@@ -150,29 +189,39 @@ func single(ing *networkingv1.Ingress) (backend, error) {
 // per Ingress change, and would need cluster-wide list/watch to do it.
 // Returns the whole ServicePort rather than its number: appProtocol rides on
 // it, and re-reading the Service to find that out would be a second round trip
-// for something already in hand.
-func (r *Reconciler) port(ctx context.Context, namespace string, b backend) (corev1.ServicePort, error) {
+// for something already in hand. The Service too, for endpoints.Ready.
+//
+// An ExternalName Service need not list the port at all; see
+// endpoints.ExternalPort.
+func (r *Reconciler) port(ctx context.Context, namespace string, b backend) (*corev1.Service, corev1.ServicePort, error) {
 	var svc corev1.Service
 	key := client.ObjectKey{Namespace: namespace, Name: b.service}
 	if err := r.Services.Get(ctx, key, &svc); err != nil {
 		if apierrors.IsNotFound(err) {
 			// Transient by assumption: the Service may simply not exist yet.
-			return corev1.ServicePort{}, fmt.Errorf("service %s not found", key)
+			return nil, corev1.ServicePort{}, fmt.Errorf("service %s not found", key)
 		}
-		return corev1.ServicePort{}, fmt.Errorf("get service %s: %w", key, err)
+		return nil, corev1.ServicePort{}, fmt.Errorf("get service %s: %w", key, err)
 	}
 
 	for _, p := range svc.Spec.Ports {
 		switch {
 		case b.portName != "" && p.Name == b.portName:
-			return p, nil
+			return &svc, p, nil
 		case b.portName == "" && p.Port == b.port:
-			return p, nil
+			return &svc, p, nil
 		}
 	}
 
+	if port, ok := endpoints.ExternalPort(&svc, b.port); ok {
+		return &svc, port, nil
+	}
 	if b.portName != "" {
-		return corev1.ServicePort{}, fmt.Errorf("%w: service %s exposes no port named %q", errUnsupported, key, b.portName)
+		if svc.Spec.Type == corev1.ServiceTypeExternalName {
+			return nil, corev1.ServicePort{}, fmt.Errorf("%w: service %s is an ExternalName listing no port named %q; "+
+				"name the port by number instead", errUnsupported, key, b.portName)
+		}
+		return nil, corev1.ServicePort{}, fmt.Errorf("%w: service %s exposes no port named %q", errUnsupported, key, b.portName)
 	}
-	return corev1.ServicePort{}, fmt.Errorf("%w: service %s exposes no port %d", errUnsupported, key, b.port)
+	return nil, corev1.ServicePort{}, fmt.Errorf("%w: service %s exposes no port %d", errUnsupported, key, b.port)
 }
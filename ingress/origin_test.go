@@ -3,6 +3,7 @@ package ingress
 import (
 	"context"
 	"errors"
+	"slices"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -97,6 +98,43 @@ func TestOrigin(t *testing.T) {
 			wantErr:         true,
 			wantUnsupported: true,
 		},
+		{
+			name: "an ExternalName is dialed on its external name",
+			objs: []client.Object{external("default", "web", "api.example.com.", corev1.ServicePort{Name: "https", Port: 443})},
+			ing:  withBackends(rule(named("web", "https"))),
+			want: "http://api.example.com:443",
+		},
+		{
+			// spec.ports on an ExternalName is informational, and often left
+			// out; the backend's number is the port.
+			name: "an ExternalName need not list the port",
+			objs: []client.Object{external("default", "web", "api.example.com")},
+			ing:  withBackends(rule(numeric("web", 8443))),
+			want: "http://api.example.com:8443",
+		},
+		{
+			name:            "an ExternalName port name with nothing to look it up in is unsupported",
+			objs:            []client.Object{external("default", "web", "api.example.com")},
+			ing:             withBackends(rule(named("web", "https"))),
+			wantErr:         true,
+			wantUnsupported: true,
+		},
+		{
+			name: "a headless service is dialed on a ready endpoint's target port",
+			objs: []client.Object{
+				headless(service("default", "web", corev1.ServicePort{Name: "http", Port: 80})),
+				endpointSlice("default", "web-a", "web", "http", 8080, "10.0.0.7"),
+			},
+			ing:  withBackends(rule(numeric("web", 80))),
+			want: "http://10.0.0.7:8080",
+		},
+		{
+			name:            "a headless service with no selector and no endpoints is unsupported",
+			objs:            []client.Object{headless(service("default", "web", corev1.ServicePort{Name: "http", Port: 80}))},
+			ing:             withBackends(rule(numeric("web", 80))),
+			wantErr:         true,
+			wantUnsupported: true,
+		},
 		{
 			// Retryable, not unsupported: the Service may just not exist yet.
 			name:            "a missing service is a retryable error",
@@ -112,7 +150,7 @@ func TestOrigin(t *testing.T) {
 			c := fakeClient(t, tt.objs...)
 			r := &Reconciler{Client: c, Services: c}
 
-			got, err := r.origin(context.Background(), tt.ing)
+			got, _, err := r.origin(context.Background(), tt.ing)
 			if tt.wantErr {
 				if err == nil {
 					t.Fatalf("origin() = %v, want error", got)
@@ -187,6 +225,23 @@ func named(service, port string) networkingv1.IngressBackend {
 	}
 }
 
+// The index holds every Service an Ingress names, once, whether or not single
+// would accept the Ingress.
+func TestBackendServices(t *testing.T) {
+	ing := withBackends(
+		defaultBackend(numeric("web", 8080)),
+		rule(named("web", "http"), numeric("api", 9090)),
+		resourceRule(),
+	)
+	got := backendServices(ing)
+	if want := []string{"web", "api"}; !slices.Equal(got, want) {
+		t.Errorf("backendServices() = %v, want %v", got, want)
+	}
+	if got := backendServices(&corev1.Service{}); got != nil {
+		t.Errorf("backendServices(Service) = %v, want nil", got)
+	}
+}
+
 // TestScheme covers how the backend is dialed, which has no field on an
 // Ingress and therefore has to come from somewhere less obvious.
 func TestScheme(t *testing.T) {
@@ -244,6 +299,18 @@ func TestScheme(t *testing.T) {
 			annotations: map[string]string{"tunnel.pizza/protocol": "HTTPS"},
 			want:        "https",
 		},
+		{
+			name:        "the label can ask for cleartext HTTP/2",
+			class:       "tunnel.pizza",
+			annotations: map[string]string{"tunnel.pizza/protocol": "h2c"},
+			want:        "h2c",
+		},
+		{
+			name:        "so can the standard appProtocol for it",
+			class:       "tunnel.pizza",
+			appProtocol: "kubernetes.io/h2c",
+			want:        "h2c",
+		},
 	}
 
 	for _, tc := range tests {
@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/selection"
@@ -32,13 +33,16 @@ import (
 
 	"github.com/scaffoldly/tunnel/config"
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/endpoints"
 	"github.com/scaffoldly/tunnel/gateway"
 	"github.com/scaffoldly/tunnel/healthz"
 	"github.com/scaffoldly/tunnel/ingress"
 	"github.com/scaffoldly/tunnel/metrics"
 	"github.com/scaffoldly/tunnel/pod"
+	"github.com/scaffoldly/tunnel/publicurl"
 	"github.com/scaffoldly/tunnel/readyz"
 	"github.com/scaffoldly/tunnel/service"
+	"github.com/scaffoldly/tunnel/sweep"
 )
 
 var scheme = runtime.NewScheme()
@@ -64,6 +68,31 @@ func main() {
 		"create default GatewayClasses on startup")
 	flag.BoolVar(&cfg.InstallGatewayAPI, consts.FlagInstallGatewayAPI, true,
 		"install the Gateway API CRDs when the cluster has none")
+	flag.StringVar(&cfg.GatewayAPIChannel, consts.FlagGatewayAPIChannel, consts.GatewayAPIChannelStandard,
+		"Gateway API release channel to install: standard or experimental")
+	flag.DurationVar(&cfg.TunnelHealthInterval, consts.FlagTunnelHealthInterval, consts.DefaultTunnelHealthInterval,
+		"how often each Ready tunnel's hostname is checked through the edge; 0 disables")
+	flag.StringVar(&cfg.TunnelHealthPath, consts.FlagTunnelHealthPath, consts.DefaultTunnelHealthPath,
+		"path requested by the tunnel health check")
+	flag.IntVar(&cfg.TunnelHealthFailures, consts.FlagTunnelHealthFailures, consts.DefaultTunnelHealthFailures,
+		"consecutive health check failures that replace a tunnel")
+	flag.BoolVar(&cfg.NamespaceOptIn, consts.FlagNamespaceOptIn, false,
+		"serve only namespaces labelled "+consts.AllowedLabel+"=true")
+	flag.BoolVar(&cfg.PublicURLWebhook, consts.FlagPublicURLWebhook, false,
+		"serve the webhook that sets "+consts.EnvPublicURL+" on Pods behind a tunnelled Service")
+	flag.DurationVar(&cfg.SweepInterval, consts.FlagSweepInterval, consts.DefaultSweepInterval,
+		"how often generated objects are checked against what their owner still asks for; 0 disables")
+	flag.BoolVar(&cfg.SweepDryRun, consts.FlagSweepDryRun, false,
+		"report generated objects nothing asks for instead of deleting them")
+	flag.Func(consts.FlagWatchNamespaces, "comma-separated namespaces to watch, for an install with a Role in each; "+
+		"empty watches all", func(value string) error {
+		for _, ns := range strings.Split(value, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				cfg.WatchNamespaces = append(cfg.WatchNamespaces, ns)
+			}
+		}
+		return nil
+	})
 
 	opts := zap.Options{Development: true}
 	opts.BindFlags(flag.CommandLine)
@@ -72,9 +101,17 @@ func main() {
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 	log := ctrl.Log.WithName("setup")
 
+	if err := cfg.Scope(); err != nil {
+		log.Error(err, "invalid flags")
+		os.Exit(1)
+	}
+	if cfg.Scoped() {
+		log.Info("watching only the listed namespaces; class and CRD installation is off", "namespaces", cfg.WatchNamespaces)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
-		Cache:                  cacheOptions(),
+		Cache:                  cacheOptions(cfg.WatchNamespaces),
 		Metrics:                metrics.New(metricsAddr),
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         leaderElect,
@@ -99,6 +136,8 @@ func main() {
 		{gateway.Name, func(m ctrl.Manager) error { return gateway.New(m, cfg) }},
 		{service.Name, func(m ctrl.Manager) error { return service.New(m, cfg) }},
 		{pod.Name, func(m ctrl.Manager) error { return pod.New(m, cfg) }},
+		{publicurl.Name, func(m ctrl.Manager) error { return publicurl.New(m, cfg) }},
+		{sweep.Name, func(m ctrl.Manager) error { return sweep.New(m, cfg) }},
 	} {
 		if err := c.register(mgr); err != nil {
 			log.Error(err, "registration failed", "component", c.name)
@@ -144,7 +183,17 @@ func leaderElectionID() string {
 // nothing to show for it — no error, no event, no reconcile. Services are
 // low-churn enough that watching all of them costs little, and their watch is
 // metadata-only anyway.
-func cacheOptions() cache.Options {
+//
+// EndpointSlices are not restricted either — any Service may turn out to be a
+// backend — but are stripped to their ready conditions on the way in, which is
+// all package endpoints reads. See endpoints.Strip.
+//
+// namespaces, from --watch-namespaces, scopes every namespaced informer to
+// those namespaces, which is what lets the install run on a Role in each.
+// Nothing cluster-scoped is cached then: the halves read classes uncached, so
+// a refused read is an error they can handle rather than an informer that
+// never syncs.
+func cacheOptions(namespaces []string) cache.Options {
 	// Exists, not equality: the label's value chooses a branch and may be any
 	// of several, so what is being selected on is the key.
 	requirement, err := labels.NewRequirement(consts.TunnelLabel, selection.Exists, nil)
@@ -155,9 +204,21 @@ func cacheOptions() cache.Options {
 		panic(fmt.Sprintf("build pod cache selector: %v", err))
 	}
 
-	return cache.Options{
+	opts := cache.Options{
 		ByObject: map[client.Object]cache.ByObject{
 			&corev1.Pod{}: {Label: labels.NewSelector().Add(*requirement)},
+			// Only the Service half's hostname mirrors. Every other ConfigMap
+			// read — an access policy — goes through the uncached reader, and
+			// the cluster's ConfigMaps have no business in this heap.
+			&corev1.ConfigMap{}:          {Label: labels.SelectorFromSet(labels.Set{consts.LabelManagedBy: consts.ManagedBy})},
+			&discoveryv1.EndpointSlice{}: {Transform: endpoints.Strip},
 		},
 	}
+	if len(namespaces) > 0 {
+		opts.DefaultNamespaces = make(map[string]cache.Config, len(namespaces))
+		for _, ns := range namespaces {
+			opts.DefaultNamespaces[ns] = cache.Config{}
+		}
+	}
+	return opts
 }
@@ -9,7 +9,7 @@ import (
 	"github.com/scaffoldly/tunnel/consts"
 )
 
-// TestCacheOptionsRestrictPodsOnly pins an asymmetry that looks like an
+// TestCacheOptionsRestrictPodsNotServices pins an asymmetry that looks like an
 // oversight and will otherwise be "fixed".
 //
 // Pods are restricted because they are the most numerous and highest-churn
@@ -17,8 +17,8 @@ import (
 // a tunnel through spec.loadBalancerClass, which lives in the spec where no
 // label selector can see it, so restricting that cache would silently stop
 // delivering those Services and that trigger would just quietly stop working.
-func TestCacheOptionsRestrictPodsOnly(t *testing.T) {
-	opts := cacheOptions()
+func TestCacheOptionsRestrictPodsNotServices(t *testing.T) {
+	opts := cacheOptions(nil)
 
 	var podSelector labels.Selector
 	for obj, byObject := range opts.ByObject {
@@ -44,3 +44,53 @@ func TestCacheOptionsRestrictPodsOnly(t *testing.T) {
 		t.Error("an unlabelled pod matches, so the restriction buys nothing")
 	}
 }
+
+// TestCacheOptionsRestrictConfigMapsToMirrors: the Service half's hostname
+// mirrors are the only ConfigMaps read through the cache, and an informer over
+// every ConfigMap in the cluster would hold all of them in this process.
+func TestCacheOptionsRestrictConfigMapsToMirrors(t *testing.T) {
+	var selector labels.Selector
+	for obj, byObject := range cacheOptions(nil).ByObject {
+		if _, ok := obj.(*corev1.ConfigMap); ok {
+			selector = byObject.Label
+		}
+	}
+	if selector == nil {
+		t.Fatal("the ConfigMaps cache is unrestricted")
+	}
+	if !selector.Matches(labels.Set{consts.LabelManagedBy: consts.ManagedBy}) {
+		t.Error("a mirror is filtered out; the Service half could not find the ones it made")
+	}
+	if selector.Matches(labels.Set{"app": "web"}) {
+		t.Error("any ConfigMap matches, so the restriction buys nothing")
+	}
+}
+
+// TestCacheOptionsScopeToWatchedNamespaces: with --watch-namespaces every
+// informer lists only those namespaces, which is all a Role in each can
+// answer. Without it nothing is scoped.
+func TestCacheOptionsScopeToWatchedNamespaces(t *testing.T) {
+	if opts := cacheOptions(nil); opts.DefaultNamespaces != nil {
+		t.Errorf("DefaultNamespaces = %v without the flag, want the whole cluster", opts.DefaultNamespaces)
+	}
+
+	opts := cacheOptions([]string{"team-a", "team-b"})
+	if len(opts.DefaultNamespaces) != 2 {
+		t.Fatalf("DefaultNamespaces = %v, want team-a and team-b", opts.DefaultNamespaces)
+	}
+	for _, ns := range []string{"team-a", "team-b"} {
+		if _, ok := opts.DefaultNamespaces[ns]; !ok {
+			t.Errorf("DefaultNamespaces = %v, missing %s", opts.DefaultNamespaces, ns)
+		}
+	}
+	// The Pod restriction still holds inside the scope.
+	restricted := false
+	for obj, byObject := range opts.ByObject {
+		if _, ok := obj.(*corev1.Pod); ok && byObject.Label != nil {
+			restricted = true
+		}
+	}
+	if !restricted {
+		t.Error("the Pods cache lost its label restriction once scoped")
+	}
+}
@@ -1,4 +1,5 @@
-// Package metrics configures the manager's Prometheus endpoint.
+// Package metrics configures the manager's Prometheus endpoint, and holds the
+// collectors this controller adds to it.
 //
 // Unlike the probes and controllers, metrics cannot be registered after the
 // fact — the manager builds its metrics server during construction — so New
@@ -13,6 +14,8 @@
 package metrics
 
 import (
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	"github.com/scaffoldly/tunnel/consts"
@@ -25,3 +28,65 @@ const Name = consts.Metrics
 func New(addr string) metricsserver.Options {
 	return metricsserver.Options{BindAddress: addr}
 }
+
+// ProxyDenied counts requests an access policy turned away before they reached
+// the origin, by the controller that serves the object, the object, and which
+// check refused them.
+//
+// Every request, allowed or not, is in TunnelRequests already; a denial there
+// is one more 4xx. This says which check it was, which is what someone tuning
+// an allowlist needs to know and a status class cannot tell them. Dropped with
+// the traffic series when the object's tunnel goes.
+var ProxyDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tunnel_proxy_denied_total",
+	Help: "Requests refused by a tunnel's access policy before reaching the origin.",
+}, []string{"controller", "namespace", "name", "reason"})
+
+// ProxyRejected counts requests a policy's limits turned away, labelled like
+// ProxyDenied. Kept apart from it because the two answer different questions:
+// a denial is someone who should not be there, a rejection is someone who
+// came too often or sent too much.
+var ProxyRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tunnel_proxy_rejected_total",
+	Help: "Requests refused by a tunnel's rate, concurrency or body size limits before reaching the origin.",
+}, []string{"controller", "namespace", "name", "reason"})
+
+// The traffic collectors count every request through a live tunnel, by the
+// object it serves and the provider carrying it. The object's series are
+// dropped when its tunnel goes, so a dashboard lists the tunnels there are
+// rather than every one there has been.
+var (
+	// TunnelRequests counts responses by status class: 2xx, 4xx and so on.
+	// Refusals by a policy are among them, as the 4xx they are.
+	TunnelRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_requests_total",
+		Help: "Requests through a tunnel, by status class.",
+	}, append(tunnelLabels, "code"))
+	// TunnelRequestDuration is the time from a request arriving to its
+	// response finishing, which for a streamed response is its whole life.
+	TunnelRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tunnel_request_duration_seconds",
+		Help:    "Time from a request arriving through a tunnel to its response finishing.",
+		Buckets: prometheus.DefBuckets,
+	}, tunnelLabels)
+	// TunnelRequestBytes and TunnelResponseBytes count bodies, not headers.
+	TunnelRequestBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_request_bytes_total",
+		Help: "Request body bytes received through a tunnel.",
+	}, tunnelLabels)
+	TunnelResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_response_bytes_total",
+		Help: "Response body bytes sent back through a tunnel.",
+	}, tunnelLabels)
+)
+
+// tunnelLabels name a tunnel: the object it serves, by kind, and its provider.
+var tunnelLabels = []string{"namespace", "kind", "name", "provider"}
+
+// Registered on controller-runtime's registry rather than a private one, so
+// they are served from the endpoint New configures alongside the manager's
+// own.
+func init() {
+	ctrlmetrics.Registry.MustRegister(ProxyDenied, ProxyRejected,
+		TunnelRequests, TunnelRequestDuration, TunnelRequestBytes, TunnelResponseBytes)
+}
@@ -0,0 +1,136 @@
+// Package optin decides which namespaces may have tunnels, for a controller run
+// with --namespace-opt-in.
+//
+// Without it, anyone who can label a Pod in any namespace can publish it to the
+// internet, which is fine on a laptop and not in a cluster shared between
+// teams. With it, a namespace has to carry consts.AllowedLabel=true, and
+// setting a label on a Namespace is a cluster-scoped write most tenants do not
+// have. That is the whole of the control: RBAC on namespaces already says who
+// may grant it, so nothing here needs its own list of who may.
+//
+// Every half asks the same Gate, and refuses the same way it refuses anything
+// else it cannot serve: whatever it had published is withdrawn, and an
+// Unsupported event on the object says why. Silence would look like the
+// controller being down.
+package optin
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// errUnsupported marks an object in a namespace that has not opted in. See
+// consts.ErrUnsupported: nothing about it changes on a retry, and labelling
+// the namespace is an event the watch below delivers.
+var errUnsupported = consts.ErrUnsupported
+
+// Gate admits the namespaces that have opted in. A nil Gate, or one not
+// Required, admits every namespace, which is what a controller run without the
+// flag does.
+type Gate struct {
+	// Reader reads Namespaces. The manager's cached client: Namespaces are few
+	// and cluster-scoped, and only their metadata is cached, so every
+	// reconcile can ask without a round trip.
+	Reader   client.Reader
+	Required bool
+}
+
+// Admit returns nil for a namespace that may have tunnels, and an error
+// wrapping consts.ErrUnsupported that says how to grant it for one that may
+// not. Any other error is a failed read and worth a retry.
+func (g *Gate) Admit(ctx context.Context, namespace string) error {
+	if g == nil || !g.Required {
+		return nil
+	}
+	ns := &metav1.PartialObjectMetadata{}
+	ns.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Namespace"))
+	if err := g.Reader.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return fmt.Errorf("get namespace %s: %w", namespace, err)
+		}
+		// Going, or a cache a moment behind. Refused either way.
+	}
+	if ns.Labels[consts.AllowedLabel] == "true" {
+		return nil
+	}
+	return fmt.Errorf("%w: namespace %s has not opted in to tunnels; this controller runs with --%s "+
+		"and serves only namespaces labelled %s=true", errUnsupported, namespace, consts.FlagNamespaceOptIn, consts.AllowedLabel)
+}
+
+// Watch adds to b a watch on Namespaces that re-reconciles every object of
+// list's kind in one whose opt-in changes, so granting or revoking it takes
+// effect without anyone touching the objects. A no-op unless g is Required:
+// without the flag nothing depends on a Namespace, and there is no reason to
+// hold them in the cache.
+//
+// list returns a fresh, empty list each call. A PartialObjectMetadataList must
+// carry its kind.
+func (g *Gate) Watch(b *builder.Builder, list func() client.ObjectList) *builder.Builder {
+	if g == nil || !g.Required {
+		return b
+	}
+	return Follow(b, g.Reader, consts.AllowedLabel, list)
+}
+
+// Follow adds to b a watch on Namespaces that re-reconciles every object of
+// list's kind, read through r, in one whose label changes. What Watch does for
+// the opt-in; exported for the Service half, whose namespace-wide tunnel label
+// has to reach every Service in the same way.
+func Follow(b *builder.Builder, r client.Reader, label string, list func() client.ObjectList) *builder.Builder {
+	return b.WatchesMetadata(&corev1.Namespace{},
+		handler.EnqueueRequestsFromMapFunc(objects(r, list)),
+		builder.WithPredicates(flipped(label)))
+}
+
+// objects maps a Namespace to every object of list's kind in it. Whether each
+// is this controller's to serve is Reconcile's to decide, as it is for every
+// other mapped watch.
+func objects(r client.Reader, list func() client.ObjectList) handler.MapFunc {
+	return func(ctx context.Context, ns client.Object) []reconcile.Request {
+		l := list()
+		if err := r.List(ctx, l, client.InNamespace(ns.GetName())); err != nil {
+			log.FromContext(ctx).Error(err, "list objects for namespace", "namespace", ns.GetName())
+			return nil
+		}
+		items, err := meta.ExtractList(l)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "extract objects for namespace", "namespace", ns.GetName())
+			return nil
+		}
+		out := make([]reconcile.Request, 0, len(items))
+		for _, item := range items {
+			if obj, ok := item.(client.Object); ok {
+				out = append(out, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(obj)})
+			}
+		}
+		return out
+	}
+}
+
+// flipped passes only a Namespace whose label changed. Creation is not one: a
+// new namespace has nothing in it yet, and at startup every object is
+// reconciled anyway. Deletion takes the objects with it.
+func flipped(label string) predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return false },
+		DeleteFunc:  func(event.DeleteEvent) bool { return false },
+		GenericFunc: func(event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return e.ObjectOld.GetLabels()[label] != e.ObjectNew.GetLabels()[label]
+		},
+	}
+}
@@ -0,0 +1,111 @@
+package optin
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+func namespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func TestAdmit(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+		namespace("team-a", map[string]string{consts.AllowedLabel: "true"}),
+		namespace("team-b", nil),
+		namespace("team-c", map[string]string{consts.AllowedLabel: "yes"}),
+	).Build()
+	required := &Gate{Reader: c, Required: true}
+
+	for _, tc := range []struct {
+		name      string
+		gate      *Gate
+		namespace string
+		want      bool
+	}{
+		{name: "opted in", gate: required, namespace: "team-a", want: true},
+		{name: "not labelled", gate: required, namespace: "team-b"},
+		{name: "only true opts in", gate: required, namespace: "team-c"},
+		{name: "a namespace that is gone", gate: required, namespace: "team-d"},
+		{name: "not required", gate: &Gate{Reader: c}, namespace: "team-b", want: true},
+		{name: "no gate", namespace: "team-b", want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.gate.Admit(context.Background(), tc.namespace)
+			if tc.want {
+				if err != nil {
+					t.Errorf("Admit(%s) = %v, want admitted", tc.namespace, err)
+				}
+				return
+			}
+			if !errors.Is(err, consts.ErrUnsupported) {
+				t.Fatalf("Admit(%s) = %v, want unsupported", tc.namespace, err)
+			}
+			// The refusal is the only place a tenant learns the policy, so it
+			// has to name the label that lifts it.
+			if !strings.Contains(err.Error(), consts.AllowedLabel+"=true") {
+				t.Errorf("Admit(%s) = %q, want it to name %s=true", tc.namespace, err, consts.AllowedLabel)
+			}
+		})
+	}
+}
+
+func TestObjects(t *testing.T) {
+	ing := func(ns, name string) *networkingv1.Ingress {
+		return &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+		ing("team-a", "web"), ing("team-a", "api"), ing("team-b", "web"),
+	).Build()
+
+	got := objects(c, func() client.ObjectList { return &networkingv1.IngressList{} })(
+		context.Background(), namespace("team-a", nil))
+	if len(got) != 2 {
+		t.Fatalf("objects(team-a) = %v, want its two Ingresses", got)
+	}
+	for _, req := range got {
+		if req.Namespace != "team-a" {
+			t.Errorf("objects(team-a) enqueued %s", req.NamespacedName)
+		}
+	}
+}
+
+func TestFlipped(t *testing.T) {
+	p := flipped(consts.AllowedLabel)
+	on := namespace("team-a", map[string]string{consts.AllowedLabel: "true"})
+	off := namespace("team-a", map[string]string{"team": "a"})
+	if !p.Update(event.UpdateEvent{ObjectOld: off, ObjectNew: on}) {
+		t.Error("opting in did not pass")
+	}
+	if !p.Update(event.UpdateEvent{ObjectOld: on, ObjectNew: off}) {
+		t.Error("opting out did not pass")
+	}
+	// Any other edit to a namespace is not this watch's business.
+	if p.Update(event.UpdateEvent{ObjectOld: off, ObjectNew: namespace("team-a", map[string]string{"team": "b"})}) {
+		t.Error("an unrelated label change passed")
+	}
+	if p.Create(event.CreateEvent{Object: on}) {
+		t.Error("a new namespace passed; it has nothing in it to reconcile")
+	}
+
+	// Each watch follows its own label, and only it.
+	tunnel := flipped(consts.TunnelLabel)
+	if tunnel.Update(event.UpdateEvent{ObjectOld: off, ObjectNew: on}) {
+		t.Error("the tunnel label's watch passed an opt-in change")
+	}
+	if !tunnel.Update(event.UpdateEvent{ObjectOld: off, ObjectNew: namespace("team-a", map[string]string{consts.TunnelLabel: "true"})}) {
+		t.Error("the tunnel label's watch missed the tunnel label")
+	}
+}
@@ -3,18 +3,24 @@ package pod
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
+	"github.com/scaffoldly/tunnel/apply"
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/expiry"
 	"github.com/scaffoldly/tunnel/service"
+	"github.com/scaffoldly/tunnel/tunnels"
 )
 
 // defaultPort is what a Pod that declares no container port is assumed to
@@ -34,10 +40,13 @@ var portNames = []string{"http", "https"}
 // frontedPort picks the port the generated Service targets, and reports whether
 // it had to be assumed.
 //
-// A declared port always wins. 80 is the fallback for a Pod that declares
-// nothing, not an override of one that does: a Pod declaring only
-// containerPort 8080 gets 8080.
-func frontedPort(pod *corev1.Pod) (int32, bool) {
+// {provider}/port wins over everything: it is the one way to settle a Pod
+// whose ports cannot be renamed. A number is taken as given, declared or not,
+// since most Pods declare nothing; a name has to match a declared TCP port, and
+// is refused when none does. Otherwise a declared port always wins. 80 is the
+// fallback for a Pod that declares nothing, not an override of one that does:
+// a Pod declaring only containerPort 8080 gets 8080.
+func frontedPort(pod *corev1.Pod) (int32, bool, error) {
 	var declared []corev1.ContainerPort
 	for _, c := range pod.Spec.Containers {
 		for _, p := range c.Ports {
@@ -50,17 +59,39 @@ func frontedPort(pod *corev1.Pod) (int32, bool) {
 		}
 	}
 
+	key := consts.ProviderTunnelPizza + "/" + consts.PortLabel
+	if value, ok := pod.Labels[key]; ok {
+		name, number, err := service.ParsePort(value)
+		if err != nil {
+			return 0, false, fmt.Errorf("%w: label %s=%q: %v", consts.ErrUnsupported, key, value, err)
+		}
+		if name == "" {
+			return number, false, nil
+		}
+		found := []string{}
+		for _, p := range declared {
+			if p.Name == name {
+				return p.ContainerPort, false, nil
+			}
+			if p.Name != "" {
+				found = append(found, p.Name)
+			}
+		}
+		return 0, false, fmt.Errorf("%w: label %s=%q matches no named TCP container port (declared: %v); "+
+			"give the port's number instead", consts.ErrUnsupported, key, value, found)
+	}
+
 	switch len(declared) {
 	case 0:
-		return defaultPort, true
+		return defaultPort, true, nil
 	case 1:
-		return declared[0].ContainerPort, false
+		return declared[0].ContainerPort, false, nil
 	}
 
 	for _, want := range portNames {
 		for _, p := range declared {
 			if p.Name == want {
-				return p.ContainerPort, false
+				return p.ContainerPort, false, nil
 			}
 		}
 	}
@@ -70,8 +101,8 @@ func frontedPort(pod *corev1.Pod) (int32, bool) {
 	// name — which makes refusing here a dead end rather than a correction,
 	// since container ports cannot be edited on a running Pod. The first
 	// declared port is taken instead, and it is reported as assumed so the
-	// choice is visible.
-	return declared[0].ContainerPort, true
+	// choice is visible, along with the label that would settle it.
+	return declared[0].ContainerPort, true, nil
 }
 
 // childName is the name of the Service and EndpointSlice generated for a Pod.
@@ -91,15 +122,48 @@ func childName(pod string) string {
 // subdomains too, so this is only reachable by a Pod already near the limit.
 const maxNameLength = 253
 
+// Children is what pod asks for: the Service and EndpointSlice in front of it,
+// or nothing when its labels ask for no tunnel, cannot be served, or have
+// expired. Exported for package sweep, which collects children their owner no
+// longer asks for when no reconcile has. The objects carry only their names.
+func Children(pod *corev1.Pod) []client.Object {
+	wanted, err := service.Requested(pod.Labels)
+	if err != nil || len(wanted) == 0 {
+		return nil
+	}
+	expires, err := expiry.At(pod, consts.ProviderTunnelPizza)
+	if err != nil || expiry.Elapsed(expires) {
+		return nil
+	}
+	if _, _, err := frontedPort(pod); err != nil {
+		return nil
+	}
+	meta := metav1.ObjectMeta{Namespace: pod.Namespace, Name: childName(pod.Name)}
+	return []client.Object{
+		&corev1.Service{ObjectMeta: meta},
+		&discoveryv1.EndpointSlice{ObjectMeta: meta},
+	}
+}
+
 // ensure creates or updates the Service and EndpointSlice fronting one Pod.
-func (r *Reconciler) ensure(ctx context.Context, pod *corev1.Pod, port int32) error {
-	if err := r.ensureObject(ctx, pod, serviceChild(pod, port)); err != nil {
-		return err
+// expires is the Pod's deadline, or the zero time. It reports whether the
+// Service now carries a deadline it did not before: made just now, or its
+// deadline moved.
+func (r *Reconciler) ensure(ctx context.Context, pod *corev1.Pod, port int32, expires time.Time) (bool, error) {
+	desired := serviceChild(pod, port, expires)
+	prior, err := r.ensureObject(ctx, pod, desired)
+	if err != nil {
+		return false, err
 	}
-	return r.ensureObject(ctx, pod, sliceChild(pod, port))
+	label := consts.ProviderTunnelPizza + "/" + consts.ExpiresAtLabel
+	moved := prior == nil || prior.GetLabels()[label] != desired.Labels[label]
+	_, err = r.ensureObject(ctx, pod, sliceChild(pod, port))
+	return moved, err
 }
 
-func (r *Reconciler) ensureObject(ctx context.Context, pod *corev1.Pod, desired client.Object) error {
+// ensureObject applies one of them, and returns it as it was before, or nil
+// where it is new. See package apply.
+func (r *Reconciler) ensureObject(ctx context.Context, pod *corev1.Pod, desired client.Object) (client.Object, error) {
 	logger := log.FromContext(ctx)
 	kind := kindOf(desired)
 
@@ -107,49 +171,68 @@ func (r *Reconciler) ensureObject(ctx context.Context, pod *corev1.Pod, desired
 	err := r.Get(ctx, client.ObjectKeyFromObject(desired), existing)
 	switch {
 	case apierrors.IsNotFound(err):
-		if err := r.Create(ctx, desired); err != nil {
-			return fmt.Errorf("create %s %s: %w", kind, client.ObjectKeyFromObject(desired), err)
-		}
-		logger.Info("created child", "kind", kind, "name", desired.GetName(), "pod", pod.Name)
-		r.Recorder.Eventf(pod, nil, consts.EventTypeNormal, consts.ReasonProvisioning,
-			consts.ActionProvision, consts.MsgProvisioningFmt, kind, desired.GetName(), "the Pod's annotations")
-		return nil
+		existing = nil
 	case err != nil:
-		return fmt.Errorf("get %s %s: %w", kind, client.ObjectKeyFromObject(desired), err)
+		return nil, fmt.Errorf("get %s %s: %w", kind, client.ObjectKeyFromObject(desired), err)
+	case !metav1.IsControlledBy(existing, pod):
+		// Ownership is the whole of the authorisation to write here. The RBAC
+		// grants these verbs cluster-wide because it must, so the scoping
+		// happens in code: a Service this controller did not create is
+		// somebody else's, whatever its name says — and on this path that is
+		// very likely to be the one `kubectl run --expose` made.
+		return nil, fmt.Errorf("%w: %s", consts.ErrUnsupported,
+			fmt.Sprintf(consts.MsgChildConflictFmt, kind, existing.GetName()))
 	}
 
-	// Ownership is the whole of the authorisation to write here. The RBAC
-	// grants these verbs cluster-wide because it must, so the scoping happens
-	// in code: a Service this controller did not create is somebody else's,
-	// whatever its name says — and on this path that is very likely to be the
-	// one `kubectl run --expose` made.
-	if !metav1.IsControlledBy(existing, pod) {
-		return fmt.Errorf("%w: %s", consts.ErrUnsupported,
-			fmt.Sprintf(consts.MsgChildConflictFmt, kind, existing.GetName()))
+	result, err := apply.Apply(ctx, r.Client, existing, desired)
+	if err != nil {
+		return nil, fmt.Errorf("apply %s %s: %w", kind, client.ObjectKeyFromObject(desired), err)
+	}
+	if result.Conflict != nil {
+		r.Recorder.Eventf(pod, nil, consts.EventTypeWarning, consts.ReasonFieldConflict,
+			consts.ActionProvision, consts.MsgFieldConflictFmt, kind, desired.GetName(), result.Conflict)
+	}
+	if err := r.deselect(ctx, result.Object); err != nil {
+		return nil, err
 	}
+	switch {
+	case existing == nil:
+		logger.Info("created child", "kind", kind, "name", desired.GetName(), "pod", pod.Name)
+		r.Recorder.Eventf(pod, nil, consts.EventTypeNormal, consts.ReasonProvisioning,
+			consts.ActionProvision, consts.MsgProvisioningFmt, kind, desired.GetName(), "the Pod's annotations")
+	case result.Changed:
+		logger.Info("updated child", "kind", kind, "name", desired.GetName(), "pod", pod.Name)
+	}
+	return existing, nil
+}
 
-	if equal(existing, desired) {
+// deselect removes a selector from the generated Service. A selector on it is
+// the failure this design exists to avoid — see the package doc — and the
+// apply cannot take one away: it never sets one, so one somebody else added is
+// theirs as far as the API server is concerned. Removed outright instead,
+// which is the one field this controller writes without owning.
+func (r *Reconciler) deselect(ctx context.Context, obj client.Object) error {
+	svc, ok := obj.(*corev1.Service)
+	if !ok || svc.Spec.Selector == nil {
 		return nil
 	}
-
-	updated := existing.DeepCopyObject().(client.Object)
-	copyInto(updated, desired)
-	if err := r.Update(ctx, updated); err != nil {
-		return fmt.Errorf("update %s %s: %w", kind, client.ObjectKeyFromObject(updated), err)
+	patch := client.RawPatch(types.MergePatchType, []byte(`{"spec":{"selector":null}}`))
+	if err := r.Patch(ctx, svc, patch, client.FieldOwner(consts.FieldManager)); err != nil {
+		return fmt.Errorf("clear selector of %s %s: %w", kindService, client.ObjectKeyFromObject(svc), err)
 	}
-	logger.Info("updated child", "kind", kind, "name", updated.GetName(), "pod", pod.Name)
 	return nil
 }
 
-// prune removes the generated objects. keep is false in every current caller
-// and exists so the signature says what it does rather than what it is used
-// for.
-func (r *Reconciler) prune(ctx context.Context, pod *corev1.Pod, keep bool) error {
+// prune removes the generated objects, and reports whether there were any to
+// remove. keep is false in every current caller and exists so the signature
+// says what it does rather than what it is used for.
+func (r *Reconciler) prune(ctx context.Context, pod *corev1.Pod, keep bool) (bool, error) {
 	if keep {
-		return nil
+		return false, nil
 	}
 	logger := log.FromContext(ctx)
 	name := childName(pod.Name)
+	pruned := false
 
 	for _, obj := range []client.Object{
 		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: name}},
@@ -160,7 +243,7 @@ func (r *Reconciler) prune(ctx context.Context, pod *corev1.Pod, keep bool) erro
 			if apierrors.IsNotFound(err) {
 				continue
 			}
-			return fmt.Errorf("get %s %s: %w", kindOf(obj), client.ObjectKeyFromObject(obj), err)
+			return false, fmt.Errorf("get %s %s: %w", kindOf(obj), client.ObjectKeyFromObject(obj), err)
 		}
 		// Never delete what we did not create, even at a name we would have
 		// used. `kubectl run --expose` puts a Service right here.
@@ -168,11 +251,12 @@ func (r *Reconciler) prune(ctx context.Context, pod *corev1.Pod, keep bool) erro
 			continue
 		}
 		if err := r.Delete(ctx, existing); err != nil && !apierrors.IsNotFound(err) {
-			return fmt.Errorf("delete %s %s: %w", kindOf(obj), client.ObjectKeyFromObject(existing), err)
+			return false, fmt.Errorf("delete %s %s: %w", kindOf(obj), client.ObjectKeyFromObject(existing), err)
 		}
 		logger.Info("deleted child no longer asked for", "kind", kindOf(obj), "name", existing.GetName())
+		pruned = true
 	}
-	return nil
+	return pruned, nil
 }
 
 // serviceChild is the Service that stands in front of the Pod.
@@ -181,9 +265,17 @@ func (r *Reconciler) prune(ctx context.Context, pod *corev1.Pod, keep bool) erro
 // copied across verbatim, which is what makes the Service controller do all the
 // remaining work and what makes `tunnel: gateway` on a Pod produce a Gateway
 // pair without this package knowing anything about the Gateway API.
-func serviceChild(pod *corev1.Pod, port int32) *corev1.Service {
+//
+// A deadline is the exception to verbatim: it is written as the instant the
+// Pod's own labels resolve to, since a ttl copied across would count again
+// from the Service's later creation.
+func serviceChild(pod *corev1.Pod, port int32, expires time.Time) *corev1.Service {
+	meta := objectMeta(pod)
+	if !expires.IsZero() {
+		meta.Labels[consts.ProviderTunnelPizza+"/"+consts.ExpiresAtLabel] = expiry.Value(expires)
+	}
 	return &corev1.Service{
-		ObjectMeta: objectMeta(pod),
+		ObjectMeta: meta,
 		Spec: corev1.ServiceSpec{
 			Type: corev1.ServiceTypeClusterIP,
 			Ports: []corev1.ServicePort{{
@@ -244,6 +336,26 @@ func podReady(pod *corev1.Pod) bool {
 	return false
 }
 
+// reserve refuses a Pod whose {provider}/hostname asks one of the providers it
+// wants for a name that provider cannot mint on. Here rather than on the
+// Service it would be copied to: the Pod is what the user labelled, and a
+// Service generated only to be refused is one more object to explain. See
+// tunnels.Reserve.
+func reserve(pod *corev1.Pod, wanted []string) error {
+	for _, provider := range wanted {
+		if hostname, ok := pod.Labels[provider+"/"+consts.HostnameLabel]; ok {
+			if err := tunnels.Reserve(provider, hostname); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// carried are the name halves of the {provider}/... labels a Pod's Service
+// inherits: the ones that mean something to the objects downstream of it.
+var carried = []string{consts.ProtocolLabel, consts.HostnameLabel, consts.PolicyLabel}
+
 // objectMeta is the metadata both generated objects carry.
 func objectMeta(pod *corev1.Pod) metav1.ObjectMeta {
 	labels := map[string]string{
@@ -257,7 +369,7 @@ func objectMeta(pod *corev1.Pod) metav1.ObjectMeta {
 		// Only ours, and only what means something downstream. Copying the
 		// Pod's whole label set would drag `run: nginx` and every selector
 		// somebody else relies on onto an object they were not written for.
-		if _, name, ok := strings.Cut(key, "/"); ok && name == consts.ProtocolLabel {
+		if _, name, ok := strings.Cut(key, "/"); ok && slices.Contains(carried, name) {
 			labels[key] = value
 		}
 	}
@@ -46,9 +46,11 @@ import (
 	"fmt"
 	"path"
 	"reflect"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/events"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
@@ -60,6 +62,8 @@ import (
 
 	"github.com/scaffoldly/tunnel/config"
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/expiry"
+	"github.com/scaffoldly/tunnel/optin"
 	"github.com/scaffoldly/tunnel/service"
 )
 
@@ -85,18 +89,21 @@ type Reconciler struct {
 	Recorder events.EventRecorder
 	// Providers is the vocabulary a trigger may name.
 	Providers []string
+	// Namespaces decides which namespaces may have tunnels at all.
+	Namespaces *optin.Gate
 }
 
 // New registers the Pod controller with mgr.
-func New(mgr ctrl.Manager, _ config.Config) error {
+func New(mgr ctrl.Manager, cfg config.Config) error {
 	r := &Reconciler{
-		Client:    mgr.GetClient(),
-		Pods:      mgr.GetAPIReader(),
-		Recorder:  mgr.GetEventRecorder(ReporterName),
-		Providers: consts.InstalledProviders,
+		Client:     mgr.GetClient(),
+		Pods:       mgr.GetAPIReader(),
+		Recorder:   mgr.GetEventRecorder(ReporterName),
+		Providers:  consts.InstalledProviders,
+		Namespaces: &optin.Gate{Reader: mgr.GetClient(), Required: cfg.NamespaceOptIn},
 	}
 
-	if err := ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		// Metadata only, and filtered. Unlike Services, the only trigger here
 		// is an annotation — there is no spec.loadBalancerClass equivalent to
 		// go looking for — so the predicate can answer from metadata alone and
@@ -104,9 +111,14 @@ func New(mgr ctrl.Manager, _ config.Config) error {
 		// never read. Only their metadata is cached, which is the price of
 		// annotation discovery and is why this is not a full informer.
 		WatchesMetadata(&corev1.Pod{}, &handler.EnqueueRequestForObject{},
-			builder.WithPredicates(triggered())).
-		Named(consts.ControllerPod).
-		Complete(r); err != nil {
+			builder.WithPredicates(triggered()))
+	// Listed from the same metadata cache, which holds only labelled Pods.
+	b = r.Namespaces.Watch(b, func() client.ObjectList {
+		list := &metav1.PartialObjectMetadataList{}
+		list.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("PodList"))
+		return list
+	})
+	if err := b.Named(consts.ControllerPod).Complete(r); err != nil {
 		return fmt.Errorf("setup pod controller: %w", err)
 	}
 
@@ -162,11 +174,32 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 	}
 
 	wanted, err := service.Requested(pod.Labels)
+	var expires time.Time
+	if err == nil {
+		// Only tunnel.pizza's: it is the one provider this path mints from.
+		// See consts.TunnelLabel.
+		expires, err = expiry.At(&pod, consts.ProviderTunnelPizza)
+	}
+	if err == nil {
+		err = reserve(&pod, wanted)
+	}
+	var port int32
+	var guessed bool
+	if err == nil && len(wanted) > 0 {
+		port, guessed, err = frontedPort(&pod)
+	}
+	if err == nil && len(wanted) > 0 {
+		err = r.Namespaces.Admit(ctx, pod.Namespace)
+	}
 	if err != nil {
-		// Unsupported by construction: this reads one object's annotations and
-		// reaches nothing else, so no retry changes the answer.
+		// Unsupported by construction, a failed namespace read aside: this
+		// reads one object's annotations and reaches nothing else, so no
+		// retry changes the answer.
+		if !errors.Is(err, consts.ErrUnsupported) {
+			return ctrl.Result{}, err
+		}
 		logger.Info("pod not serviceable", "reason", err)
-		if err := r.prune(ctx, &pod, false); err != nil {
+		if _, err := r.prune(ctx, &pod, false); err != nil {
 			return ctrl.Result{}, err
 		}
 		r.Recorder.Eventf(&pod, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
@@ -178,7 +211,22 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		// Either the annotation was removed or it says none. Both mean the
 		// generated objects should go; owner-reference GC does not cover it,
 		// because the Pod is still here.
-		return ctrl.Result{}, r.prune(ctx, &pod, false)
+		_, err := r.prune(ctx, &pod, false)
+		return ctrl.Result{}, err
+	}
+
+	if expiry.Elapsed(expires) {
+		// Pruned here rather than left to the Service half's own deadline:
+		// the generated Service is this half's, and one left behind would be
+		// a selector-less Service with nothing asking for it.
+		// Said when there was something to take back: the Pod outlives its
+		// deadline, and every later pass finds nothing left.
+		pruned, err := r.prune(ctx, &pod, false)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		expiry.Retired(ctx, r.Recorder, &pod, consts.ProviderTunnelPizza, expires, pruned)
+		return ctrl.Result{}, nil
 	}
 
 	// A Pod with no address yet has nothing to point an EndpointSlice at. It
@@ -189,8 +237,8 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		return ctrl.Result{}, nil
 	}
 
-	port, guessed := frontedPort(&pod)
-	if err := r.ensure(ctx, &pod, port); err != nil {
+	moved, err := r.ensure(ctx, &pod, port, expires)
+	if err != nil {
 		if errors.Is(err, consts.ErrUnsupported) {
 			r.Recorder.Eventf(&pod, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
 				consts.ActionProvision, consts.MsgUnsupportedFmt, err)
@@ -206,7 +254,14 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 	// serves errors without reading this source.
 	if guessed {
 		r.Recorder.Eventf(&pod, nil, consts.EventTypeNormal, consts.ReasonProvisioning,
-			consts.ActionProvision, consts.MsgPortAssumedFmt, port, childName(pod.Name))
+			consts.ActionProvision, consts.MsgPortAssumedFmt, port, consts.ProviderTunnelPizza+"/"+consts.PortLabel)
+	}
+	// Once, when the Service that carries the deadline is made or its
+	// deadline moves: a resync restating it says nothing new.
+	if moved {
+		expiry.Announce(ctx, r.Recorder, &pod, expires)
 	}
-	return ctrl.Result{}, nil
+	// Back at the deadline to prune, and not before: nothing else here
+	// changes without an update on the Pod.
+	return ctrl.Result{RequeueAfter: expiry.Sooner(0, expires)}, nil
 }
@@ -2,11 +2,14 @@ package pod
 
 import (
 	"context"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -19,6 +22,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/event"
 
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/optin"
 )
 
 var testKey = types.NamespacedName{Namespace: "default", Name: "nginx"}
@@ -100,6 +104,20 @@ func assertEvent(t *testing.T, recorder *events.FakeRecorder, substr string) {
 	}
 }
 
+func assertNoEvent(t *testing.T, recorder *events.FakeRecorder, substr string) {
+	t.Helper()
+	for {
+		select {
+		case e := <-recorder.Events:
+			if strings.Contains(e, substr) {
+				t.Fatalf("unexpected event containing %q: %s", substr, e)
+			}
+		default:
+			return
+		}
+	}
+}
+
 // TestReconcileFrontsThePod is the hero: one annotation on a Pod `kubectl run`
 // made, and the objects that give it a hostname appear.
 func TestReconcileFrontsThePod(t *testing.T) {
@@ -295,13 +313,13 @@ func TestReconcileFollowsReadiness(t *testing.T) {
 // TestReconcileIsIdempotent: a rewritten Service would churn its child Ingress
 // and, through it, re-mint the tunnel.
 func TestReconcileIsIdempotent(t *testing.T) {
-	r, c, _ := reconciler(t, runPod(map[string]string{"tunnel.pizza/tunnel": "true"}))
+	r, c, recorder := reconciler(t, runPod(map[string]string{"tunnel.pizza/tunnel": "true"}))
 
 	if _, err := r.Reconcile(context.Background(), request()); err != nil {
 		t.Fatalf("Reconcile() error = %v", err)
 	}
-	svcVersion := getService(t, c, "nginx-tunnel").ResourceVersion
-	sliceVersion := getSlice(t, c, "nginx-tunnel").ResourceVersion
+	svc := settled(getService(t, c, "nginx-tunnel"))
+	slice := settled(getSlice(t, c, "nginx-tunnel"))
 
 	for range 3 {
 		if _, err := r.Reconcile(context.Background(), request()); err != nil {
@@ -309,14 +327,29 @@ func TestReconcileIsIdempotent(t *testing.T) {
 		}
 	}
 
-	if got := getService(t, c, "nginx-tunnel").ResourceVersion; got != svcVersion {
-		t.Errorf("service was rewritten: %s -> %s", svcVersion, got)
+	if got := settled(getService(t, c, "nginx-tunnel")); !apiequality.Semantic.DeepEqual(got, svc) {
+		t.Errorf("service was rewritten:\n%+v\nthen\n%+v", svc, got)
 	}
-	if got := getSlice(t, c, "nginx-tunnel").ResourceVersion; got != sliceVersion {
-		t.Errorf("slice was rewritten: %s -> %s", sliceVersion, got)
+	if got := settled(getSlice(t, c, "nginx-tunnel")); !apiequality.Semantic.DeepEqual(got, slice) {
+		t.Errorf("slice was rewritten:\n%+v\nthen\n%+v", slice, got)
+	}
+	for len(recorder.Events) > 0 {
+		if e := <-recorder.Events; strings.Contains(e, consts.ReasonFieldConflict) {
+			t.Errorf("unexpected event %q: the controller fought itself", e)
+		}
 	}
 }
 
+// settled is obj without what every write stamps on it. The fake client bumps
+// resourceVersion on every apply, one that changes nothing included, where an
+// API server leaves a no-op apply alone.
+func settled[T client.Object](obj T) T {
+	out := obj.DeepCopyObject().(T)
+	out.SetResourceVersion("")
+	out.SetManagedFields(nil)
+	return out
+}
+
 // TestReconcileCarriesTheGatewayValue: `tunnel: gateway` on a Pod reaches the
 // Service half unchanged, which is what makes the Gateway branch work here
 // without this package knowing the Gateway API exists.
@@ -324,6 +357,7 @@ func TestReconcileCarriesTheGatewayValue(t *testing.T) {
 	r, c, _ := reconciler(t, runPod(map[string]string{
 		"tunnel.pizza/tunnel":   "gateway",
 		"tunnel.pizza/protocol": "https",
+		"tunnel.pizza/policy":   "nginx-policy",
 		"example.com/unrelated": "keep-out",
 	}))
 
@@ -338,6 +372,9 @@ func TestReconcileCarriesTheGatewayValue(t *testing.T) {
 	if got := svc.Labels["tunnel.pizza/protocol"]; got != "https" {
 		t.Errorf("protocol annotation = %q, want https", got)
 	}
+	if got := svc.Labels["tunnel.pizza/policy"]; got != "nginx-policy" {
+		t.Errorf("policy label = %q, want nginx-policy", got)
+	}
 	if _, ok := svc.Labels["example.com/unrelated"]; ok {
 		t.Error("an unrelated label was copied onto the generated service")
 	}
@@ -422,7 +459,7 @@ func TestEnsureClearsASelectorItFinds(t *testing.T) {
 
 	// Ours, but with a selector — the shape a partial edit or an older version
 	// of this controller would leave behind.
-	stale := serviceChild(pod, 80)
+	stale := serviceChild(pod, 80, time.Time{})
 	stale.Spec.Selector = map[string]string{"run": "nginx"}
 
 	r, c, _ := reconciler(t, pod, stale)
@@ -446,3 +483,115 @@ func merge(a, b map[string]string) map[string]string {
 	}
 	return out
 }
+
+// TestReconcileExpires: the generated Service carries the Pod's deadline as an
+// instant, and once it passes the Pod half takes its objects back.
+func TestReconcileExpires(t *testing.T) {
+	pod := runPod(map[string]string{"tunnel.pizza/tunnel": "true", "tunnel.pizza/ttl": "1h"})
+	pod.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	r, c, recorder := reconciler(t, pod)
+
+	res, err := r.Reconcile(context.Background(), request())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	deadline := pod.CreationTimestamp.Add(time.Hour)
+	svc := getService(t, c, "nginx-tunnel")
+	if got := svc.Labels["tunnel.pizza/expires-at"]; got != strconv.FormatInt(deadline.Unix(), 10) {
+		t.Errorf("service expires-at = %q, want %d", got, deadline.Unix())
+	}
+	if _, ok := svc.Labels["tunnel.pizza/ttl"]; ok {
+		t.Error("service carries the ttl; it would count again from the Service's creation")
+	}
+	if res.RequeueAfter <= 58*time.Minute || res.RequeueAfter > time.Hour {
+		t.Errorf("RequeueAfter = %v, want the time left until the deadline", res.RequeueAfter)
+	}
+	assertEvent(t, recorder, consts.ReasonTunnelExpiry)
+	// Said once. A resync finds the same Service with the same deadline.
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder, consts.ReasonTunnelExpiry)
+
+	live := &corev1.Pod{}
+	if err := c.Get(context.Background(), testKey, live); err != nil {
+		t.Fatal(err)
+	}
+	live.Labels["tunnel.pizza/ttl"] = "30s"
+	if err := c.Update(context.Background(), live); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := serviceNames(t, c); len(names) != 0 {
+		t.Errorf("services = %v, want none once the deadline passed", names)
+	}
+	assertEvent(t, recorder, consts.ReasonTunnelExpired)
+	// The Pod is still there past its deadline, and there is nothing left
+	// to retire.
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder, consts.ReasonTunnelExpired)
+}
+
+// TestReconcileRefusesARequestedHostname: the Pod is what was labelled, so the
+// refusal lands there, and no Service is generated only to be refused.
+func TestReconcileRefusesARequestedHostname(t *testing.T) {
+	r, c, recorder := reconciler(t, runPod(map[string]string{
+		"tunnel.pizza/tunnel":   "true",
+		"tunnel.pizza/hostname": "nginx.tunneled.pizza",
+	}))
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := serviceNames(t, c); len(names) != 0 {
+		t.Errorf("services = %v, want none for a hostname that cannot be minted on", names)
+	}
+	assertEvent(t, recorder, "cannot reserve hostname nginx.tunneled.pizza")
+}
+
+// TestReconcileRefusesANamespaceThatHasNotOptedIn: under --namespace-opt-in
+// the Pod gets no Service, and an event naming the label that would change
+// that.
+func TestReconcileRefusesANamespaceThatHasNotOptedIn(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	r, c, recorder := reconciler(t, runPod(map[string]string{"tunnel.pizza/tunnel": "true"}), ns)
+	r.Namespaces = &optin.Gate{Reader: c, Required: true}
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := serviceNames(t, c); len(names) != 0 {
+		t.Errorf("services = %v, want none in a namespace that has not opted in", names)
+	}
+	assertEvent(t, recorder, consts.AllowedLabel)
+
+	ns.Labels = map[string]string{consts.AllowedLabel: "true"}
+	if err := c.Update(context.Background(), ns); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := serviceNames(t, c); len(names) != 1 {
+		t.Errorf("services = %v, want the Pod's once the namespace opted in", names)
+	}
+}
+
+// TestReconcileRefusesAPortLabelThatMatchesNothing: a named port the Pod does
+// not declare gets no Service and an event naming the label.
+func TestReconcileRefusesAPortLabelThatMatchesNothing(t *testing.T) {
+	key := consts.ProviderTunnelPizza + "/" + consts.PortLabel
+	r, c, recorder := reconciler(t, runPod(map[string]string{"tunnel.pizza/tunnel": "true", key: "grpc"}))
+
+	if _, err := r.Reconcile(context.Background(), request()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := serviceNames(t, c); len(names) != 0 {
+		t.Errorf("services = %v, want none for a port that matches nothing", names)
+	}
+	assertEvent(t, recorder, key)
+}
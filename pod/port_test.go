@@ -1,9 +1,13 @@
 package pod
 
 import (
+	"errors"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/scaffoldly/tunnel/consts"
 )
 
 // TestFrontedPort is where the port decision lives, and the one place a silent
@@ -84,7 +88,10 @@ func TestFrontedPort(t *testing.T) {
 			pod := &corev1.Pod{Spec: corev1.PodSpec{
 				Containers: []corev1.Container{{Name: "app", Ports: tc.ports}},
 			}}
-			got, assumed := frontedPort(pod)
+			got, assumed, err := frontedPort(pod)
+			if err != nil {
+				t.Fatalf("frontedPort() error = %v", err)
+			}
 			if got != tc.want {
 				t.Errorf("frontedPort() = %d, want %d", got, tc.want)
 			}
@@ -104,7 +111,10 @@ func TestFrontedPortAcrossContainers(t *testing.T) {
 		{Name: "sidecar", Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: 9090}}},
 	}}}
 
-	got, assumed := frontedPort(pod)
+	got, assumed, err := frontedPort(pod)
+	if err != nil {
+		t.Fatalf("frontedPort() error = %v", err)
+	}
 	if got != 3000 {
 		t.Errorf("frontedPort() = %d, want the container port named http", got)
 	}
@@ -112,3 +122,47 @@ func TestFrontedPortAcrossContainers(t *testing.T) {
 		t.Error("assumed = true, but http was declared")
 	}
 }
+
+// TestFrontedPortLabel: {provider}/port settles what names cannot, and a value
+// that settles nothing is refused rather than ignored.
+func TestFrontedPortLabel(t *testing.T) {
+	unnamed := []corev1.ContainerPort{{ContainerPort: 8080}, {ContainerPort: 9090}}
+	named := []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}, {Name: "admin", ContainerPort: 9090}}
+	tests := []struct {
+		name            string
+		value           string
+		ports           []corev1.ContainerPort
+		want            int32
+		wantUnsupported bool
+	}{
+		{name: "a number picks between unnamed ports", value: "9090", ports: unnamed, want: 9090},
+		{name: "a number need not be declared", value: "3000", want: 3000},
+		{name: "a name beats the http preference", value: "admin", ports: named, want: 9090},
+		{name: "a name nothing declares", value: "grpc", ports: named, wantUnsupported: true},
+		{name: "a name on a pod that declares none", value: "http", wantUnsupported: true},
+		{name: "not a port", value: "0", ports: named, wantUnsupported: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+					consts.ProviderTunnelPizza + "/" + consts.PortLabel: tc.value,
+				}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Ports: tc.ports}}},
+			}
+			got, assumed, err := frontedPort(pod)
+			if tc.wantUnsupported {
+				if !errors.Is(err, consts.ErrUnsupported) {
+					t.Errorf("frontedPort() error = %v, want unsupported", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("frontedPort() error = %v", err)
+			}
+			if got != tc.want || assumed {
+				t.Errorf("frontedPort() = %d, assumed %v; want %d, not assumed", got, assumed, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,833 @@
+package proxy
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/metrics"
+)
+
+// Why a request was refused. These are the reason label on
+// metrics.ProxyDenied, so they are a closed set.
+const (
+	deniedSource = "source"
+	deniedBasic  = "basic-auth"
+	deniedJWT    = "jwt"
+)
+
+// Why a request was turned away by a limit. The reason label on
+// metrics.ProxyRejected.
+const (
+	rejectedRate        = "rate"
+	rejectedConnections = "connections"
+	rejectedBody        = "body"
+)
+
+// clientHeader is where the edge puts the address a request came from. The
+// tunnel's own connection is a loopback one from the engine, so the socket
+// says nothing; the edge sets this and overwrites any copy a client sends.
+const clientHeader = "Cf-Connecting-Ip"
+
+// discoveryTimeout bounds one OIDC discovery or key fetch, which happens on a
+// request's path.
+const discoveryTimeout = 10 * time.Second
+
+// Front owns the listeners standing in for origins, one per object, keyed by
+// namespace/name the way the tunnel Store is.
+//
+// Every tunnel dials one, whether or not a policy applies: this is the only
+// place a request through a tunnel can be seen, so it is where the traffic
+// metrics are counted. A tunnel with no policy is forwarded unchecked.
+//
+// One per controller, for the same reason there is one Store per controller:
+// an Ingress and a Gateway may share a name, and the key alone has to say
+// which tunnel it is.
+//
+// A manager Runnable, so shutdown closes every listener.
+type Front struct {
+	controller string
+	// kind is the kind of object served, for the traffic metrics.
+	kind string
+	log  logr.Logger
+	// access is where access logs go: the controller's own log, under its
+	// own name so a collector can route them apart.
+	access logr.Logger
+	// health is the value of consts.HealthCheckHeader that marks this
+	// process's own health check. See HealthToken.
+	health string
+
+	// base is the parent of every OIDC key fetch, which outlives the request
+	// that first needed it.
+	base context.Context
+	stop context.CancelFunc
+
+	mu      sync.Mutex
+	entries map[types.NamespacedName]*entry
+
+	vmu       sync.Mutex
+	verifiers map[string]*oidc.IDTokenVerifier
+
+	// Wake scales key's backend up from zero. Called at most once per time
+	// the backend goes down, from the first request held for it under a
+	// scale-to-zero policy; nil holds requests without waking anything.
+	// Set by whoever owns the object, which is who can find its workload.
+	Wake func(ctx context.Context, key types.NamespacedName) error
+}
+
+// entry is one object's listener. The listener, and so the URL the tunnel
+// dials, stays put for as long as the object has a policy; what it enforces
+// and where it forwards are swapped underneath it. That is what lets a policy
+// be edited without re-minting the tunnel and losing its hostname.
+type entry struct {
+	srv    *http.Server
+	url    *url.URL
+	target atomic.Pointer[target]
+	// down is set while the backend has no ready endpoints. See Backend.
+	down atomic.Bool
+	// last is when the last request arrived, in Unix nanoseconds, or when
+	// the entry was made. See Idle.
+	last atomic.Int64
+
+	// mu guards up and waking, and every write to down. up is closed while
+	// the backend is up, and replaced when it goes down, so a held request
+	// waits on the one it read. waking is set once a request has called Wake
+	// for this time down.
+	mu     sync.Mutex
+	up     chan struct{}
+	waking bool
+}
+
+// setDown records whether the backend is down, releasing held requests when
+// it comes up, and reports whether that was a change.
+func (e *entry) setDown(down bool) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case down && !e.down.Load():
+		e.up = make(chan struct{})
+	case !down && e.down.Load():
+		close(e.up)
+		e.waking = false
+	default:
+		return false
+	}
+	e.down.Store(down)
+	return true
+}
+
+// target is what an entry currently enforces and forwards to. limiters is
+// parallel to policies.
+type target struct {
+	provider string
+	origin   string
+	policies []Policy
+	limiters []*limiter
+	log      *AccessLog
+	// maintenance is served while the entry is down. Empty for a default.
+	maintenance string
+	// errorPage is served when the origin cannot be reached. Empty for the
+	// status alone.
+	errorPage string
+	// wake is the scale-to-zero in force, or nil.
+	wake  *Wake
+	proxy *httputil.ReverseProxy
+}
+
+// limiter is one policy's limits and the state enforcing them. It outlives a
+// reconcile, which rebuilds every Policy: a bucket refilled on every resync
+// is not a rate limit.
+type limiter struct {
+	limits Limits
+	rate   *rate.Limiter // nil when the policy sets no rate
+	slots  chan struct{} // nil when it sets no connection cap
+}
+
+func newLimiter(l Limits) *limiter {
+	lim := &limiter{limits: l}
+	if l.RPS > 0 {
+		lim.rate = rate.NewLimiter(rate.Limit(l.RPS), l.Burst)
+	}
+	if l.MaxConnections > 0 {
+		lim.slots = make(chan struct{}, l.MaxConnections)
+	}
+	return lim
+}
+
+// admit takes a slot and a token for req, or returns why it cannot. release
+// gives the slot back, and is set whenever reason is empty.
+func (l *limiter) admit(req *http.Request) (release func(), reason string) {
+	if l.limits.MaxBodyBytes > 0 && req.ContentLength > l.limits.MaxBodyBytes {
+		// Known up front, so refused before it costs a token. A body without
+		// a length is capped as it is read; see Front.handler.
+		return nil, rejectedBody
+	}
+	release = func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() { <-l.slots }
+		default:
+			return nil, rejectedConnections
+		}
+	}
+	if l.rate != nil && !l.rate.Allow() {
+		release()
+		return nil, rejectedRate
+	}
+	return release, ""
+}
+
+// NewFront builds an empty Front for controller, which labels its policy
+// metrics, serving objects of kind, which labels its traffic metrics.
+func NewFront(log logr.Logger, controller, kind string) *Front {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Front{
+		controller: controller,
+		kind:       kind,
+		log:        log,
+		access:     log.WithName("access"),
+		base:       ctx,
+		stop:       cancel,
+		health:     crand.Text(),
+		entries:    make(map[types.NamespacedName]*entry),
+		verifiers:  make(map[string]*oidc.IDTokenVerifier),
+	}
+}
+
+// HealthToken is what the tunnel health check sends in
+// consts.HealthCheckHeader for its requests to be known here. See
+// tunnels.Check.
+//
+// Random, and new every process. The check is forwarded to the origin like
+// any request and through every access check, but it is not counted, not
+// limited, and not the activity that keeps a backend awake — and a request
+// that could claim that by naming a well-known header would be a way round a
+// rate limit for anyone.
+func (f *Front) HealthToken() string { return f.health }
+
+// Start implements manager.Runnable. It holds until the manager shuts down,
+// then closes every listener.
+func (f *Front) Start(ctx context.Context) error {
+	<-ctx.Done()
+	f.Close()
+	return nil
+}
+
+// Serve puts policies, which may be none, in front of origin for key's tunnel
+// through provider, and returns the URL the tunnel should dial instead. The
+// same URL for as long as key is served, so adding or editing a policy does
+// not change what the tunnel dials.
+//
+// A policy whose limits are unchanged keeps its limiter, so a resync does not
+// hand every client a fresh burst.
+func (f *Front) Serve(key types.NamespacedName, provider string, origin *url.URL, policies []Policy) (*url.URL, error) {
+	t := &target{
+		provider: provider,
+		origin:   origin.String(),
+		policies: policies,
+		log:      accessLog(policies),
+	}
+	// The last that sets one, which is the object's over its class's: the
+	// page is the object's to word, not a check the class can insist on.
+	for _, p := range policies {
+		if p.Maintenance != "" {
+			t.maintenance = p.Maintenance
+		}
+		if p.ErrorPage != "" {
+			t.errorPage = p.ErrorPage
+		}
+		if p.Wake != nil {
+			t.wake = p.Wake
+		}
+	}
+	if t.maintenance == "" {
+		// A page for "cannot reach the origin" says as much while there is
+		// no origin to reach yet; a preview link opened before its Pods
+		// are up should not look broken.
+		t.maintenance = t.errorPage
+	}
+	t.proxy = f.reverseProxy(key, origin, t.errorPage)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[key]
+	var prev *target
+	if ok {
+		prev = e.target.Load()
+	}
+	for _, p := range policies {
+		t.limiters = append(t.limiters, prev.limiter(p))
+	}
+	if ok {
+		e.target.Store(t)
+		return e.url, nil
+	}
+
+	// Loopback only. The engine dials it from this process, and nothing else
+	// should be able to reach the origin around a policy.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listen for %s: %w", key, err)
+	}
+	e = &entry{url: &url.URL{Scheme: consts.OriginScheme, Host: ln.Addr().String()}, up: make(chan struct{})}
+	close(e.up)
+	e.last.Store(time.Now().UnixNano())
+	e.target.Store(t)
+	e.srv = &http.Server{Handler: f.handler(key, e), ReadHeaderTimeout: discoveryTimeout}
+	// HTTP/2 with prior knowledge as well, so an engine that dials it can
+	// carry what an h2c origin needs end to end — gRPC's trailers do not
+	// survive an HTTP/1.1 hop.
+	e.srv.Protocols = new(http.Protocols)
+	e.srv.Protocols.SetHTTP1(true)
+	e.srv.Protocols.SetUnencryptedHTTP2(true)
+	go func() {
+		if err := e.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			f.log.Error(err, "front listener stopped", "object", key)
+		}
+	}()
+	f.entries[key] = e
+	f.log.Info("fronting origin", "object", key, "listener", e.url.Host)
+	return e.url, nil
+}
+
+// Backend records whether key's backend has a ready endpoint, and reports
+// whether key should be published: it has, or a policy gave a page to serve
+// while it has not, or scales it to zero and will wake it. False for a key
+// that is not served.
+//
+// changed is whether the backend went up or down with this call. Every
+// reconcile records it, and a backend asleep under scale-to-zero is down on
+// every policy resync, so what is said about it is said when this is set.
+//
+// While down, every request is answered here with a 503 rather than
+// forwarded to a Service with nothing behind it. Published or not, the
+// tunnel's hostname still answers, and a 503 with Retry-After says what a
+// 502 from the edge does not. Under scale-to-zero a request is held for the
+// backend instead, and forwarded when this reports it ready.
+func (f *Front) Backend(key types.NamespacedName, ready bool) (publish, changed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[key]
+	if !ok {
+		return false, false
+	}
+	changed = e.setDown(!ready)
+	t := e.target.Load()
+	return ready || t.maintenance != "" || t.wake != nil, changed
+}
+
+// Wakes reports whether key's policy scales its backend to zero.
+func (f *Front) Wakes(key types.NamespacedName) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[key]
+	return ok && e.target.Load().wake != nil
+}
+
+// Idle reports whether key's backend is up and has gone its policy's
+// scale-to-zero period without a request, and what that period is. The
+// caller scales it down; the next request wakes it.
+func (f *Front) Idle(key types.NamespacedName) (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[key]
+	if !ok {
+		return 0, false
+	}
+	w := e.target.Load().wake
+	if w == nil || e.down.Load() {
+		return 0, false
+	}
+	return w.Idle, time.Since(time.Unix(0, e.last.Load())) >= w.Idle
+}
+
+// hold waits up to timeout for e's backend to come up, waking it if nothing
+// has yet, and reports whether it did.
+func (f *Front) hold(ctx context.Context, key types.NamespacedName, e *entry, timeout time.Duration) bool {
+	e.mu.Lock()
+	up := e.up
+	if !e.waking && f.Wake != nil {
+		e.waking = true
+		go f.wake(key, e, timeout)
+	}
+	e.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-up:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// wake calls Wake for key. A failure lets the next request try again, rather
+// than leaving every request to wait out the timeout for nothing.
+func (f *Front) wake(key types.NamespacedName, e *entry, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(f.base, timeout)
+	defer cancel()
+	if err := f.Wake(ctx, key); err != nil {
+		f.log.Error(err, "wake backend", "object", key)
+		e.mu.Lock()
+		e.waking = false
+		e.mu.Unlock()
+	}
+}
+
+// limiter returns the limiter t already has for p, if its limits are the same,
+// or a new one.
+func (t *target) limiter(p Policy) *limiter {
+	if t != nil {
+		for i, q := range t.policies {
+			if q.Source == p.Source && q.Limits == p.Limits {
+				return t.limiters[i]
+			}
+		}
+	}
+	return newLimiter(p.Limits)
+}
+
+// Release closes key's listener, if it has one, and reports whether it did.
+// Its traffic series go with it.
+func (f *Front) Release(key types.NamespacedName) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[key]
+	if !ok {
+		return false
+	}
+	_ = e.srv.Close()
+	delete(f.entries, key)
+
+	series := prometheus.Labels{"namespace": key.Namespace, "kind": f.kind, "name": key.Name}
+	metrics.TunnelRequests.DeletePartialMatch(series)
+	metrics.TunnelRequestDuration.DeletePartialMatch(series)
+	metrics.TunnelRequestBytes.DeletePartialMatch(series)
+	metrics.TunnelResponseBytes.DeletePartialMatch(series)
+	refused := prometheus.Labels{"controller": f.controller, "namespace": key.Namespace, "name": key.Name}
+	metrics.ProxyDenied.DeletePartialMatch(refused)
+	metrics.ProxyRejected.DeletePartialMatch(refused)
+	return true
+}
+
+// Close releases everything. Idempotent.
+func (f *Front) Close() {
+	f.mu.Lock()
+	for key, e := range f.entries {
+		_ = e.srv.Close()
+		delete(f.entries, key)
+	}
+	f.mu.Unlock()
+	f.stop()
+}
+
+// handler hands the request to forward, and counts and logs what came of it.
+//
+// The health check is forwarded too, checked against every policy, and logged,
+// but is none of the rest: not counted, not limited, and not activity. Once a minute
+// against every hostname, it would otherwise keep every scale-to-zero backend
+// awake, and wake every sleeping one. A backend that is down gets the answer
+// any request would without a wake, which is the front answering, and that is
+// what the check needs to see. See HealthToken.
+func (f *Front) handler(key types.NamespacedName, e *entry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		check := subtle.ConstantTimeCompare([]byte(req.Header.Get(consts.HealthCheckHeader)), []byte(f.health)) == 1
+		// Never past here, whoever sent it: the token is this process's,
+		// and nothing behind the tunnel has a use for it.
+		req.Header.Del(consts.HealthCheckHeader)
+		t := e.target.Load()
+		start := time.Now()
+		rec := &recorder{ResponseWriter: w}
+		body := &counter{ReadCloser: req.Body}
+		req.Body = body
+		// Read before forwarding, which deletes the Authorization header
+		// after a basic-auth pass; logged redacted, it is still worth
+		// knowing one was sent.
+		var headers map[string]string
+		logged := t.log != nil && rand.Float64() < t.log.Sample
+		if logged {
+			headers = t.log.headers(req.Header)
+		}
+		if !check {
+			e.last.Store(start.UnixNano())
+		}
+		switch {
+		case !e.down.Load():
+			f.forward(rec, req, key, t, !check)
+		case !check && t.wake != nil && f.hold(req.Context(), key, e, t.wake.Timeout):
+			// Re-read: the reconcile that saw the backend come up may
+			// have served a new target with it.
+			f.forward(rec, req, key, e.target.Load(), true)
+		default:
+			maintenance(rec, t.maintenance)
+		}
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		latency := time.Since(start)
+		if !check {
+			labels := []string{key.Namespace, f.kind, key.Name, t.provider}
+			metrics.TunnelRequests.WithLabelValues(append(labels, fmt.Sprintf("%dxx", rec.status/100))...).Inc()
+			metrics.TunnelRequestDuration.WithLabelValues(labels...).Observe(latency.Seconds())
+			metrics.TunnelRequestBytes.WithLabelValues(labels...).Add(float64(body.n))
+			metrics.TunnelResponseBytes.WithLabelValues(labels...).Add(float64(rec.n))
+		}
+
+		if !logged {
+			return
+		}
+		// The path, never the query: a query string is where a token ends
+		// up when a client has nowhere else to put it.
+		f.access.Info("request", "object", key.String(),
+			"method", req.Method, "host", req.Host, "path", req.URL.Path,
+			"status", rec.status, "latency", latency,
+			"bytesIn", body.n, "bytesOut", rec.n,
+			"client", req.Header.Get(clientHeader), "headers", headers)
+	})
+}
+
+// forward checks every policy in turn and forwards what passes all of them.
+// Every policy's limits come first, then every policy's access checks.
+// counted is false for the health check alone, which takes nothing from a
+// limit and is no denial in the metrics, but is refused like any request.
+func (f *Front) forward(w http.ResponseWriter, req *http.Request, key types.NamespacedName, t *target, counted bool) {
+	var body int64
+	limiters := t.limiters
+	if !counted {
+		limiters = nil
+	}
+	for _, l := range limiters {
+		release, reason := l.admit(req)
+		if reason != "" {
+			f.reject(w, key, reason)
+			return
+		}
+		defer release()
+		if n := l.limits.MaxBodyBytes; n > 0 && (body == 0 || n < body) {
+			body = n
+		}
+	}
+	if body > 0 {
+		// A chunked body has no length to check up front. It is cut off
+		// at the limit as it is read, and reverseProxy's ErrorHandler
+		// turns that into a 413.
+		req.Body = http.MaxBytesReader(w, req.Body, body)
+	}
+
+	for _, p := range t.policies {
+		if reason := f.check(req, p); reason != "" {
+			if counted {
+				metrics.ProxyDenied.WithLabelValues(f.controller, key.Namespace, key.Name, reason).Inc()
+			}
+			deny(w, reason)
+			return
+		}
+		if p.Basic != nil {
+			// The password was for this hop. The origin did not ask for
+			// it and has no business seeing it.
+			req.Header.Del("Authorization")
+		}
+	}
+	t.proxy.ServeHTTP(w, req)
+}
+
+// accessLog merges the policies' access logging into one. Any policy asking
+// for a log gets one, at the highest rate any asks for, with every header any
+// names and every redaction any asks for: one policy cannot turn off what
+// another turned on.
+func accessLog(policies []Policy) *AccessLog {
+	var out *AccessLog
+	for _, p := range policies {
+		if p.Log == nil {
+			continue
+		}
+		if out == nil {
+			out = &AccessLog{}
+		}
+		out.Sample = max(out.Sample, p.Log.Sample)
+		for _, h := range p.Log.Headers {
+			if !slices.Contains(out.Headers, h) {
+				out.Headers = append(out.Headers, h)
+			}
+		}
+		for _, h := range p.Log.Redact {
+			if !slices.Contains(out.Redact, h) {
+				out.Redact = append(out.Redact, h)
+			}
+		}
+	}
+	return out
+}
+
+// redacted stands in for the value of a header logged as present only.
+const redacted = "[redacted]"
+
+// headers returns the request headers l logs, by canonical name. A header
+// sent more than once is logged comma-joined, as it would be folded.
+func (l *AccessLog) headers(h http.Header) map[string]string {
+	out := make(map[string]string, len(l.Headers))
+	for _, name := range l.Headers {
+		v, ok := h[name]
+		if !ok {
+			continue
+		}
+		if slices.Contains(l.Redact, name) {
+			out[name] = redacted
+			continue
+		}
+		out[name] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+// recorder notes the status and size of a response.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (r *recorder) WriteHeader(code int) {
+	// An informational response is not the response.
+	if r.status == 0 && code >= http.StatusOK {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController, which the proxy flushes a streamed
+// response through, reach the connection underneath.
+func (r *recorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// counter counts the request body as the proxy reads it.
+type counter struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *counter) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// check returns why p refuses req, or empty when it allows it. Every check p
+// configures must pass.
+func (f *Front) check(req *http.Request, p Policy) string {
+	if p.Allow != nil {
+		// Fail closed: a request the edge did not stamp is one nothing can
+		// vouch for.
+		addr, err := netip.ParseAddr(strings.TrimSpace(req.Header.Get(clientHeader)))
+		if err != nil || !slices.ContainsFunc(p.Allow, func(pfx netip.Prefix) bool { return pfx.Contains(addr.Unmap()) }) {
+			return deniedSource
+		}
+	}
+	if p.Basic != nil {
+		user, pass, ok := req.BasicAuth()
+		// Both compared in full whatever the first says, so the time taken
+		// does not tell a caller which half was wrong.
+		u := subtle.ConstantTimeCompare([]byte(user), []byte(p.Basic.Username))
+		w := subtle.ConstantTimeCompare([]byte(pass), []byte(p.Basic.Password))
+		if !ok || u&w != 1 {
+			return deniedBasic
+		}
+	}
+	if p.Issuer != "" {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			return deniedJWT
+		}
+		v, err := f.verifier(p.Issuer, p.Audience)
+		if err != nil {
+			f.log.Error(err, "oidc discovery failed; refusing bearer tokens until it succeeds", "issuer", p.Issuer)
+			return deniedJWT
+		}
+		if _, err := v.Verify(req.Context(), token); err != nil {
+			return deniedJWT
+		}
+	}
+	return ""
+}
+
+// verifier returns the token verifier for an issuer and audience, running
+// discovery the first time it is asked for.
+//
+// Cached across reconciles, which rebuild every Policy each time: discovery is
+// a network round trip, and the key set it yields refreshes itself when a
+// token names a key it has not seen. A failed discovery is not cached, so the
+// next request tries again.
+func (f *Front) verifier(issuer, audience string) (*oidc.IDTokenVerifier, error) {
+	id := issuer + " " + audience
+	f.vmu.Lock()
+	defer f.vmu.Unlock()
+	if v, ok := f.verifiers[id]; ok {
+		return v, nil
+	}
+
+	ctx := oidc.ClientContext(f.base, &http.Client{Timeout: discoveryTimeout})
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	// An audience is how a token minted for some other service at the same
+	// issuer is told apart, so only an explicit none skips the check.
+	v := provider.Verifier(&oidc.Config{ClientID: audience, SkipClientIDCheck: audience == ""})
+	f.verifiers[id] = v
+	return v, nil
+}
+
+// unavailable is served while a backend is down and no policy gave a page.
+const unavailable = "No backend is ready to serve this request. Try again shortly.\n"
+
+// maintenance answers for a backend with no ready endpoints. Before any
+// policy check: there is nothing behind them to protect, and a page that
+// asked for a password first would say the wrong thing.
+func maintenance(w http.ResponseWriter, page string) {
+	if page == "" {
+		page = unavailable
+	}
+	w.Header().Set("Retry-After", "30")
+	errorPage(w, http.StatusServiceUnavailable, page)
+}
+
+// errorPage writes status with page as its body, or with none when page is
+// empty. Never cached: the condition it reports is meant to pass, and an
+// edge or browser holding on to it would outlast it.
+func errorPage(w http.ResponseWriter, status int, page string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if page == "" {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType([]byte(page)))
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, page)
+}
+
+// reject counts and writes a refusal by one of a policy's limits.
+func (f *Front) reject(w http.ResponseWriter, key types.NamespacedName, reason string) {
+	metrics.ProxyRejected.WithLabelValues(f.controller, key.Namespace, key.Name, reason).Inc()
+	status := http.StatusTooManyRequests
+	if reason == rejectedBody {
+		status = http.StatusRequestEntityTooLarge
+	} else {
+		// A second is as good a guess as any, and better than a client
+		// retrying at once.
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// deny writes the refusal. A challenge for the two that a client can answer,
+// so a browser prompts for basic auth rather than showing a bare 401.
+func deny(w http.ResponseWriter, reason string) {
+	switch reason {
+	case deniedBasic:
+		w.Header().Set("WWW-Authenticate", `Basic realm="tunnel"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	case deniedJWT:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	default:
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+// forwarded are the headers the engine sets on the way in. ReverseProxy drops
+// them from the outbound request before Rewrite runs, and the origin should
+// see what it would have seen without this hop.
+var forwarded = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// reverseProxy forwards to origin as the engine would have: the public Host
+// header kept, TLS unverified for the reason consts.OriginSchemeTLS gives, and
+// an h2c origin spoken to in HTTP/2 as consts.OriginSchemeH2C describes.
+// A body cut off at a policy's max-body-size is reported as the 413 it is,
+// rather than the 502 any other failure to forward is — or 504, when what
+// failed was waiting for the origin. Either of those carries page.
+//
+// Only failures here. An origin that answers 502 itself is answering, and its
+// body is its own to word.
+func (f *Front) reverseProxy(key types.NamespacedName, origin *url.URL, page string) *httputil.ReverseProxy {
+	var transport *http.Transport
+	switch origin.Scheme {
+	case consts.OriginSchemeTLS:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec // see consts.OriginSchemeTLS
+		}
+	case consts.OriginSchemeH2C:
+		// HTTP/2 from the first byte, and nothing else: an origin that
+		// speaks only this refuses HTTP/1.1, so falling back would fail
+		// every request anyway. The URL is http to the transport, which is
+		// all h2c is on the wire.
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		plain := *origin
+		plain.Scheme = consts.OriginScheme
+		origin = &plain
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(origin)
+			pr.Out.Host = pr.In.Host
+			for _, h := range forwarded {
+				if v, ok := pr.In.Header[h]; ok {
+					pr.Out.Header[h] = v
+				}
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+				f.reject(w, key, rejectedBody)
+				return
+			}
+			f.log.V(1).Info("forwarding to origin failed", "object", key, "error", err.Error())
+			status := http.StatusBadGateway
+			if netErr := net.Error(nil); errors.Is(err, context.DeadlineExceeded) ||
+				(errors.As(err, &netErr) && netErr.Timeout()) {
+				status = http.StatusGatewayTimeout
+			}
+			errorPage(w, status, page)
+		},
+	}
+	if transport != nil {
+		rp.Transport = transport
+	}
+	return rp
+}
@@ -0,0 +1,761 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/metrics"
+)
+
+var frontKey = types.NamespacedName{Namespace: "default", Name: "web"}
+
+// origin stands in for the Service, and answers with what it was sent.
+func origin(t *testing.T) *url.URL {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Seen-Host", r.Host)
+		_, _ = io.WriteString(w, "origin")
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return u
+}
+
+func front(t *testing.T) *Front {
+	t.Helper()
+	f := NewFront(logr.Discard(), consts.ControllerIngress, "Ingress")
+	t.Cleanup(f.Close)
+	return f
+}
+
+func serve(t *testing.T, f *Front, policies ...Policy) *url.URL {
+	t.Helper()
+	u, err := f.Serve(frontKey, consts.ProviderTunnelPizza, origin(t), policies)
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	return u
+}
+
+func get(t *testing.T, u *url.URL, header http.Header) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, u.String(), nil)
+	req.Host = "brave-tuna.trycloudflare.com"
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", u, err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func denied(reason string) float64 {
+	return testutil.ToFloat64(metrics.ProxyDenied.WithLabelValues(consts.ControllerIngress, frontKey.Namespace, frontKey.Name, reason))
+}
+
+func rejected(reason string) float64 {
+	return testutil.ToFloat64(metrics.ProxyRejected.WithLabelValues(consts.ControllerIngress, frontKey.Namespace, frontKey.Name, reason))
+}
+
+func post(t *testing.T, u *url.URL, body io.Reader) *http.Response {
+	t.Helper()
+	resp, err := http.Post(u.String(), "application/octet-stream", body)
+	if err != nil {
+		t.Fatalf("POST %s: %v", u, err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+// TestFrontSpeaksH2C: an origin that speaks only cleartext HTTP/2 refuses
+// HTTP/1.1 outright, so the Front has to speak HTTP/2 to it from the first
+// byte. And a client that arrives with HTTP/2 is carried through in it.
+func TestFrontSpeaksH2C(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	h2c, _ := url.Parse(srv.URL)
+	h2c.Scheme = consts.OriginSchemeH2C
+
+	f := front(t)
+	u, err := f.Serve(frontKey, consts.ProviderTunnelPizza, h2c, nil)
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+
+	resp := get(t, u, nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "HTTP/2.0" {
+		t.Errorf("status = %d, origin saw %q; want 200 over HTTP/2.0", resp.StatusCode, body)
+	}
+
+	client := &http.Client{Transport: &http.Transport{Protocols: new(http.Protocols)}}
+	client.Transport.(*http.Transport).Protocols.SetUnencryptedHTTP2(true)
+	resp, err = client.Get(u.String())
+	if err != nil {
+		t.Fatalf("GET over h2c: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	if resp.Proto != "HTTP/2.0" {
+		t.Errorf("front answered in %s, want HTTP/2.0 to a client that spoke it", resp.Proto)
+	}
+}
+
+func TestFrontAllowList(t *testing.T) {
+	f := front(t)
+	u := serve(t, f, Policy{Allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	before := denied(deniedSource)
+
+	if resp := get(t, u, http.Header{clientHeader: {"192.0.2.7"}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("allowed address: status = %d, want 200", resp.StatusCode)
+	} else if got := resp.Header.Get("X-Seen-Host"); got != "brave-tuna.trycloudflare.com" {
+		t.Errorf("origin saw Host %q; the public hostname should reach it unchanged", got)
+	}
+	if resp := get(t, u, http.Header{clientHeader: {"198.51.100.1"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other address: status = %d, want 403", resp.StatusCode)
+	}
+	// Nothing to vouch for the caller, so nothing gets through.
+	if resp := get(t, u, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unstamped request: status = %d, want 403", resp.StatusCode)
+	}
+	if got := denied(deniedSource) - before; got != 2 {
+		t.Errorf("denied{reason=%s} rose by %v, want 2", deniedSource, got)
+	}
+}
+
+func TestFrontBasicAuth(t *testing.T) {
+	f := front(t)
+	u := serve(t, f, Policy{Basic: &Credentials{Username: "ada", Password: "hunter2"}})
+	before := denied(deniedBasic)
+
+	req := func(user, pass string) http.Header {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth(user, pass)
+		return r.Header
+	}
+
+	resp := get(t, u, req("ada", "hunter2"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("right password: status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-Seen-Authorization"); got != "" {
+		t.Errorf("origin was sent the edge's credentials: %q", got)
+	}
+
+	resp = get(t, u, req("ada", "hunter3"))
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("wrong password: status = %d, challenge %q; want 401 with a challenge",
+			resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	if got := denied(deniedBasic) - before; got != 1 {
+		t.Errorf("denied{reason=%s} rose by %v, want 1", deniedBasic, got)
+	}
+}
+
+// Every policy must pass: the class's and the object's both apply.
+func TestFrontEveryPolicyApplies(t *testing.T) {
+	f := front(t)
+	u := serve(t, f,
+		Policy{Allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}},
+		Policy{Allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.128/25")}},
+	)
+	if resp := get(t, u, http.Header{clientHeader: {"192.0.2.7"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("allowed by one policy only: status = %d, want 403", resp.StatusCode)
+	}
+	if resp := get(t, u, http.Header{clientHeader: {"192.0.2.200"}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("allowed by both: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// Editing the policy must not move the listener: the tunnel dials its URL, and
+// a new one would mean a new tunnel and a new hostname.
+func TestFrontKeepsItsAddressAcrossEdits(t *testing.T) {
+	f := front(t)
+	first := serve(t, f, Policy{Allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	second := serve(t, f, Policy{Allow: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}})
+	if first.String() != second.String() {
+		t.Fatalf("listener moved from %s to %s", first, second)
+	}
+	if resp := get(t, second, http.Header{clientHeader: {"198.51.100.1"}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("new policy not in force: status = %d, want 200", resp.StatusCode)
+	}
+
+	if !f.Release(frontKey) {
+		t.Fatal("Release() = false for a served key")
+	}
+	if f.Release(frontKey) {
+		t.Error("Release() = true twice")
+	}
+	if _, err := http.Get(second.String()); err == nil {
+		t.Error("listener still answering after Release")
+	}
+}
+
+func TestFrontJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issuer string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"issuer":                                issuer,
+				"jwks_uri":                              issuer + "/keys",
+				"id_token_signing_alg_values_supported": []string{"RS256"},
+			})
+		case "/keys":
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "k1", Algorithm: string(jose.RS256), Use: "sig"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(idp.Close)
+	issuer = idp.URL
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "k1"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(aud string, exp time.Time) string {
+		claims, _ := json.Marshal(map[string]any{"iss": issuer, "sub": "ada", "aud": aud, "exp": exp.Unix()})
+		jws, err := signer.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := jws.CompactSerialize()
+		return s
+	}
+
+	f := front(t)
+	u := serve(t, f, Policy{Issuer: issuer, Audience: "web"})
+	before := denied(deniedJWT)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"a valid token", http.Header{"Authorization": {"Bearer " + token("web", time.Now().Add(time.Hour))}}, http.StatusOK},
+		{"no token", nil, http.StatusUnauthorized},
+		{"another audience", http.Header{"Authorization": {"Bearer " + token("api", time.Now().Add(time.Hour))}}, http.StatusUnauthorized},
+		{"expired", http.Header{"Authorization": {"Bearer " + token("web", time.Now().Add(-time.Hour))}}, http.StatusUnauthorized},
+		{"not a token", http.Header{"Authorization": {"Bearer nonsense"}}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, u, tt.header)
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			// The origin may want to know who called; the token is forwarded.
+			if tt.want == http.StatusOK && resp.Header.Get("X-Seen-Authorization") == "" {
+				t.Error("bearer token was not forwarded to the origin")
+			}
+		})
+	}
+	if got := denied(deniedJWT) - before; got != 4 {
+		t.Errorf("denied{reason=%s} rose by %v, want 4", deniedJWT, got)
+	}
+}
+
+func TestFrontRateLimit(t *testing.T) {
+	f := front(t)
+	// A rate slow enough that the bucket cannot refill during the test.
+	limits := Limits{RPS: 0.001, Burst: 2}
+	u := serve(t, f, Policy{Source: "ConfigMap default/limits", Limits: limits})
+	before := rejected(rejectedRate)
+
+	for i := range 2 {
+		if resp := get(t, u, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d within the burst: status = %d, want 200", i, resp.StatusCode)
+		}
+	}
+	resp := get(t, u, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("over the burst: status = %d, Retry-After %q; want 429 with a Retry-After",
+			resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if got := rejected(rejectedRate) - before; got != 1 {
+		t.Errorf("rejected{reason=%s} rose by %v, want 1", rejectedRate, got)
+	}
+
+	// A resync rebuilds the policy; it must not refill the bucket.
+	serve(t, f, Policy{Source: "ConfigMap default/limits", Limits: limits})
+	if resp := get(t, u, nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("after a resync: status = %d, want 429", resp.StatusCode)
+	}
+	// Changing the limits is a new bucket.
+	serve(t, f, Policy{Source: "ConfigMap default/limits", Limits: Limits{RPS: 0.001, Burst: 3}})
+	if resp := get(t, u, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("after an edit: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestFrontMaxConnections(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	backend, _ := url.Parse(srv.URL)
+
+	f := front(t)
+	u, err := f.Serve(frontKey, consts.ProviderTunnelPizza, backend, []Policy{{Limits: Limits{MaxConnections: 1}}})
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	before := rejected(rejectedConnections)
+
+	go func() {
+		if resp, err := http.Get(u.String()); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-arrived
+
+	if resp := get(t, u, nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second request in flight: status = %d, want 429", resp.StatusCode)
+	}
+	if got := rejected(rejectedConnections) - before; got != 1 {
+		t.Errorf("rejected{reason=%s} rose by %v, want 1", rejectedConnections, got)
+	}
+}
+
+func TestFrontMaxBodySize(t *testing.T) {
+	f := front(t)
+	u := serve(t, f, Policy{Limits: Limits{MaxBodyBytes: 8}})
+	before := rejected(rejectedBody)
+
+	if resp := post(t, u, strings.NewReader("small")); resp.StatusCode != http.StatusOK {
+		t.Errorf("body under the limit: status = %d, want 200", resp.StatusCode)
+	}
+	if resp := post(t, u, strings.NewReader("far too large")); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("body over the limit: status = %d, want 413", resp.StatusCode)
+	}
+	// No Content-Length to refuse up front; cut off as it is read.
+	if resp := post(t, u, io.MultiReader(strings.NewReader("far too "), strings.NewReader("large"))); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked body over the limit: status = %d, want 413", resp.StatusCode)
+	}
+	if got := rejected(rejectedBody) - before; got != 2 {
+		t.Errorf("rejected{reason=%s} rose by %v, want 2", rejectedBody, got)
+	}
+}
+
+func TestFrontAccessLog(t *testing.T) {
+	// Logged once the response is written, so after the client may have
+	// read it.
+	logged := make(chan string, 4)
+	f := NewFront(funcr.New(func(prefix, args string) {
+		if prefix == "access" {
+			logged <- args
+		}
+	}, funcr.Options{}), consts.ControllerIngress, "Ingress")
+	t.Cleanup(f.Close)
+	u := serve(t, f,
+		Policy{Basic: &Credentials{Username: "ada", Password: "hunter2"}},
+		Policy{Log: &AccessLog{Sample: 1, Headers: []string{"Authorization", "X-Request-Id"}, Redact: alwaysRedacted}},
+	)
+
+	next := func() string {
+		t.Helper()
+		select {
+		case line := <-logged:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("request not logged")
+			return ""
+		}
+	}
+
+	withQuery := *u
+	withQuery.Path, withQuery.RawQuery = "/hooks/payment", "token=s3cret"
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("ada", "hunter2")
+	r.Header.Set("X-Request-Id", "req-1")
+	r.Header.Set(clientHeader, "192.0.2.7")
+	if resp := get(t, &withQuery, r.Header); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	line := next()
+	// Refused requests are the ones most worth finding afterwards.
+	if resp := get(t, u, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("no credentials: status = %d, want 401", resp.StatusCode)
+	}
+
+	for _, want := range []string{
+		`"path"="/hooks/payment"`, `"status"=200`, `"bytesOut"=6`, `"client"="192.0.2.7"`,
+		`"X-Request-Id"="req-1"`, `"Authorization"="[redacted]"`, `"object"="default/web"`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log line %s lacks %s", line, want)
+		}
+	}
+	for _, leak := range []string{"s3cret", "hunter2", "YWRhOmh1bnRlcjI"} {
+		if strings.Contains(line, leak) {
+			t.Errorf("log line %s leaks %q", line, leak)
+		}
+	}
+	if line := next(); !strings.Contains(line, `"status"=401`) {
+		t.Errorf("refusal logged as %s, want status 401", line)
+	}
+}
+
+func TestFrontCountsTraffic(t *testing.T) {
+	f := front(t)
+	u := serve(t, f, Policy{Allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	labels := []string{frontKey.Namespace, "Ingress", frontKey.Name, consts.ProviderTunnelPizza}
+	count := func(class string) float64 {
+		return testutil.ToFloat64(metrics.TunnelRequests.WithLabelValues(append(labels, class)...))
+	}
+	ok, refused, sent := count("2xx"), count("4xx"), testutil.ToFloat64(metrics.TunnelResponseBytes.WithLabelValues(labels...))
+
+	get(t, u, http.Header{clientHeader: {"192.0.2.7"}})
+	get(t, u, http.Header{clientHeader: {"198.51.100.1"}})
+
+	// Counted once the response is written, so after the client may have
+	// read it.
+	deadline := time.Now().Add(5 * time.Second)
+	for count("2xx")-ok < 1 || count("4xx")-refused < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests{2xx} rose by %v and {4xx} by %v, want 1 each", count("2xx")-ok, count("4xx")-refused)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// "origin", then the refusal's "Forbidden\n".
+	if got := testutil.ToFloat64(metrics.TunnelResponseBytes.WithLabelValues(labels...)) - sent; got != 16 {
+		t.Errorf("response bytes rose by %v, want 16", got)
+	}
+	if got := testutil.CollectAndCount(metrics.TunnelRequestDuration); got == 0 {
+		t.Error("no latency observed")
+	}
+
+	// A tunnel that is gone is not on the dashboard.
+	f.Release(frontKey)
+	series := prometheus.Labels{"namespace": frontKey.Namespace, "kind": "Ingress", "name": frontKey.Name}
+	if n := metrics.TunnelRequests.DeletePartialMatch(series); n != 0 {
+		t.Errorf("%d request series outlived Release", n)
+	}
+	// The refusal was a denial too, and goes with the rest.
+	denials := prometheus.Labels{"controller": consts.ControllerIngress, "namespace": frontKey.Namespace, "name": frontKey.Name}
+	if n := metrics.ProxyDenied.DeletePartialMatch(denials); n != 0 {
+		t.Errorf("%d denial series outlived Release", n)
+	}
+}
+
+// A backend with nothing ready is answered at the front, with the policy's
+// page if there is one, and forwarded to again the moment it recovers.
+func TestFrontBackendDown(t *testing.T) {
+	f := front(t)
+	if publish, _ := f.Backend(frontKey, false); publish {
+		t.Error("Backend() = true for a key that is not served")
+	}
+
+	u := serve(t, f)
+	if publish, changed := f.Backend(frontKey, false); publish || !changed {
+		t.Errorf("Backend() = %v, %v with nothing ready and no page; want the hostname held, and a change", publish, changed)
+	}
+	// Still down is not news.
+	if _, changed := f.Backend(frontKey, false); changed {
+		t.Error("Backend() reported a change for a backend that was already down")
+	}
+	resp := get(t, u, nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != unavailable {
+		t.Errorf("down: status = %d, body %q; want 503 with the default text", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Retry-After") == "" || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("down: headers = %v, want Retry-After and no-store", resp.Header)
+	}
+
+	// The object's page overrides the class's.
+	page := "<!doctype html><p>Back soon.</p>"
+	u = serve(t, f, Policy{Maintenance: "<p>class</p>"}, Policy{Maintenance: page})
+	if publish, _ := f.Backend(frontKey, false); !publish {
+		t.Error("Backend() = false with a maintenance page; the hostname should stay published")
+	}
+	resp = get(t, u, nil)
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != page {
+		t.Errorf("down with a page: status = %d, body %q; want 503 with %q", resp.StatusCode, body, page)
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("down with a page: Content-Type = %q, want text/html", got)
+	}
+
+	if publish, changed := f.Backend(frontKey, true); !publish || !changed {
+		t.Errorf("Backend() = %v, %v with a ready endpoint; want published, and a change", publish, changed)
+	}
+	if resp := get(t, u, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("recovered: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// An origin that cannot be reached gets the policy's error page with the
+// status that says so, and the same page stands in for a maintenance page.
+// What the origin itself answers is left alone.
+func TestFrontErrorPage(t *testing.T) {
+	page := "<!doctype html><p>Starting up.</p>"
+	f := front(t)
+
+	gone := httptest.NewServer(http.NotFoundHandler())
+	dead, _ := url.Parse(gone.URL)
+	gone.Close()
+	u, err := f.Serve(frontKey, consts.ProviderTunnelPizza, dead, []Policy{{ErrorPage: page}})
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	resp := get(t, u, nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || string(body) != page {
+		t.Errorf("unreachable origin: status = %d, body %q; want 502 with the page", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("unreachable origin: Content-Type = %q, want text/html", got)
+	}
+
+	if publish, _ := f.Backend(frontKey, false); !publish {
+		t.Error("Backend() = false with an error page; the hostname should stay published")
+	}
+	resp = get(t, u, nil)
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != page {
+		t.Errorf("down: status = %d, body %q; want 503 with the error page", resp.StatusCode, body)
+	}
+	f.Backend(frontKey, true)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = io.WriteString(w, "upstream of the origin")
+	}))
+	t.Cleanup(srv.Close)
+	answering, _ := url.Parse(srv.URL)
+	if _, err := f.Serve(frontKey, consts.ProviderTunnelPizza, answering, []Policy{{ErrorPage: page}}); err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	resp = get(t, u, nil)
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || string(body) != "upstream of the origin" {
+		t.Errorf("origin's own 502: status = %d, body %q; want it passed through", resp.StatusCode, body)
+	}
+}
+
+// Waiting out the origin is a 504, not a 502.
+func TestFrontErrorPageTimeout(t *testing.T) {
+	rp := front(t).reverseProxy(frontKey, origin(t), "late")
+	rec := httptest.NewRecorder()
+	rp.ErrorHandler(rec, httptest.NewRequest(http.MethodGet, "/", nil), fmt.Errorf("dial: %w", context.DeadlineExceeded))
+	if rec.Code != http.StatusGatewayTimeout || rec.Body.String() != "late" {
+		t.Errorf("timeout: status = %d, body %q; want 504 with the page", rec.Code, rec.Body.String())
+	}
+}
+
+// A request that finds a scale-to-zero backend down is held, wakes it once,
+// and is forwarded when it comes up.
+func TestFrontWakes(t *testing.T) {
+	f := front(t)
+	woken := make(chan types.NamespacedName, 4)
+	f.Wake = func(_ context.Context, key types.NamespacedName) error {
+		woken <- key
+		go f.Backend(key, true)
+		return nil
+	}
+	u := serve(t, f, Policy{Wake: &Wake{Idle: time.Hour, Timeout: 5 * time.Second}})
+	if publish, _ := f.Backend(frontKey, false); !publish {
+		t.Error("Backend() = false under scale-to-zero; the hostname should stay published")
+	}
+	if !f.Wakes(frontKey) {
+		t.Error("Wakes() = false under scale-to-zero")
+	}
+
+	if resp := get(t, u, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("held request: status = %d, want 200 once woken", resp.StatusCode)
+	}
+	if got := <-woken; got != frontKey {
+		t.Errorf("woke %v, want %v", got, frontKey)
+	}
+	if resp := get(t, u, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("after waking: status = %d, want 200", resp.StatusCode)
+	}
+	select {
+	case <-woken:
+		t.Error("woken again while up")
+	default:
+	}
+}
+
+// A backend that does not come up in time gets the maintenance answer, and
+// a failed wake is tried again by the next request.
+func TestFrontWakeTimesOut(t *testing.T) {
+	f := front(t)
+	var calls atomic.Int32
+	f.Wake = func(context.Context, types.NamespacedName) error {
+		calls.Add(1)
+		return errors.New("forbidden")
+	}
+	u := serve(t, f, Policy{Wake: &Wake{Idle: time.Hour, Timeout: 20 * time.Millisecond}})
+	f.Backend(frontKey, false)
+
+	for range 2 {
+		if resp := get(t, u, nil); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("timed out: status = %d, want 503", resp.StatusCode)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Wake called %d times, want 2: a failure is retried", got)
+	}
+}
+
+// Idle is true once the period passes without a request, and a request
+// resets it.
+func TestFrontIdle(t *testing.T) {
+	f := front(t)
+	u := serve(t, f, Policy{Wake: &Wake{Idle: 50 * time.Millisecond, Timeout: time.Second}})
+	if _, idle := f.Idle(frontKey); idle {
+		t.Error("Idle() = true for a key just served")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if period, idle := f.Idle(frontKey); !idle || period != 50*time.Millisecond {
+		t.Errorf("Idle() = %v, %v after the period; want 50ms, true", period, idle)
+	}
+	get(t, u, nil)
+	if _, idle := f.Idle(frontKey); idle {
+		t.Error("Idle() = true straight after a request")
+	}
+
+	serve(t, f)
+	time.Sleep(60 * time.Millisecond)
+	if _, idle := f.Idle(frontKey); idle {
+		t.Error("Idle() = true without scale-to-zero")
+	}
+}
+
+// The health check runs against every Ready hostname once a minute. It goes
+// to the origin and through every access check like any request, but it
+// neither wakes a backend that is asleep, nor counts as the request that keeps
+// one awake, nor takes from a limit; and it is not traffic. Only this
+// process's token makes it one, and the origin never sees it.
+func TestFrontForwardsTheHealthCheck(t *testing.T) {
+	f := front(t)
+	var woken atomic.Int32
+	f.Wake = func(context.Context, types.NamespacedName) error {
+		woken.Add(1)
+		return nil
+	}
+	var reached atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		w.Header().Set("X-Seen-Check", r.Header.Get(consts.HealthCheckHeader))
+		_, _ = io.WriteString(w, "origin")
+	}))
+	t.Cleanup(backend.Close)
+	dial, _ := url.Parse(backend.URL)
+	u, err := f.Serve(frontKey, consts.ProviderTunnelPizza, dial, []Policy{{
+		Wake:   &Wake{Idle: time.Hour, Timeout: 50 * time.Millisecond},
+		Limits: Limits{RPS: 0.001, Burst: 1},
+	}})
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	check := http.Header{consts.HealthCheckHeader: {f.HealthToken()}}
+	last := f.entries[frontKey].last.Load()
+	labels := []string{frontKey.Namespace, "Ingress", frontKey.Name, consts.ProviderTunnelPizza, "2xx"}
+	before := testutil.ToFloat64(metrics.TunnelRequests.WithLabelValues(labels...))
+
+	// More than the burst allows: none of them is taken from it.
+	for range 3 {
+		resp := get(t, u, check)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("health check: status = %d, want the origin's 200", resp.StatusCode)
+		}
+		if seen := resp.Header.Get("X-Seen-Check"); seen != "" {
+			t.Errorf("origin saw %s: %q, want it removed", consts.HealthCheckHeader, seen)
+		}
+	}
+	if n := reached.Load(); n != 3 {
+		t.Errorf("origin reached %d times, want 3", n)
+	}
+	if got := f.entries[frontKey].last.Load(); got != last {
+		t.Error("a health check counted as activity")
+	}
+	if got := testutil.ToFloat64(metrics.TunnelRequests.WithLabelValues(labels...)); got != before {
+		t.Errorf("requests{2xx} rose by %v for a health check, want 0", got-before)
+	}
+
+	// Asleep: answered at the front, and nothing is woken for it.
+	f.Backend(frontKey, false)
+	if resp := get(t, u, check); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("health check while asleep: status = %d, want 503 from the front", resp.StatusCode)
+	}
+	if n := woken.Load(); n != 0 {
+		t.Errorf("Wake called %d times by a health check, want none", n)
+	}
+
+	// The header with any other value is just a request, and the first
+	// ordinary one since the burst was left untouched.
+	f.Backend(frontKey, true)
+	resp := get(t, u, http.Header{consts.HealthCheckHeader: {"1"}})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("forged check: status = %d, want 200 within the burst", resp.StatusCode)
+	}
+	if seen := resp.Header.Get("X-Seen-Check"); seen != "" {
+		t.Errorf("origin saw %s: %q, want it removed", consts.HealthCheckHeader, seen)
+	}
+	if resp := get(t, u, http.Header{consts.HealthCheckHeader: {"1"}}); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("forged check past the burst: status = %d, want 429", resp.StatusCode)
+	}
+	if got := f.entries[frontKey].last.Load(); got == last {
+		t.Error("a forged check did not count as activity")
+	}
+}
+
+// The check is refused by an access policy like anything else, and is not a
+// denial to count.
+func TestFrontChecksTheHealthCheck(t *testing.T) {
+	f := front(t)
+	u := serve(t, f, Policy{Allow: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	before := denied(deniedSource)
+
+	resp := get(t, u, http.Header{consts.HealthCheckHeader: {f.HealthToken()}, clientHeader: {"198.51.100.1"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("health check from outside the allowlist: status = %d, want 403", resp.StatusCode)
+	}
+	if got := denied(deniedSource) - before; got != 0 {
+		t.Errorf("denied{source} rose by %v for a health check, want 0", got)
+	}
+}
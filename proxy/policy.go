@@ -0,0 +1,465 @@
+// Package proxy puts a policy in front of a tunnel's origin: who may reach it,
+// and how hard.
+//
+// A tunnel is world-readable the moment it is Ready: the provider hands out a
+// public hostname and the edge forwards whatever arrives on it. Nothing in the
+// path can tell one caller from another except this process, because this is
+// where the tunnel ends — libtunnel runs the engine in-process, and the origin
+// it dials is whatever URL it was given. So the URL it is given becomes a
+// listener here, which checks each request against the policy and forwards
+// what passes to the real origin.
+//
+// A policy is a ConfigMap, named by the class's parameters, by a
+// {provider}/policy label on the object, or both. Every one that applies must
+// pass. Any combination of these keys:
+//
+//	allow-cidrs        client addresses allowed, comma or newline separated
+//	basic-auth-secret  a kubernetes.io/basic-auth Secret beside the ConfigMap
+//	jwt-issuer         an OIDC issuer whose bearer tokens are accepted
+//	jwt-audience       the audience those tokens must carry; optional
+//	rate-limit-rps     requests per second, sustained
+//	rate-limit-burst   requests allowed at once above that; defaults to the rate
+//	max-connections    requests in flight at once
+//	max-body-size      largest request body, as a quantity: 10Mi
+//	access-log         "true" to log every request, refused or not
+//	access-log-sample  the fraction of requests logged, 0 to 1; defaults to 1
+//	access-log-headers request headers to log, comma or newline separated
+//	access-log-redact  headers to log as present but not by value
+//	maintenance-page   served with a 503 while the Service has no ready
+//	                   endpoints, in place of withdrawing the hostname
+//	error-page         served in place of a bare 502 or 504 when the origin
+//	                   cannot be reached, and as the maintenance page when
+//	                   there is none
+//	scale-to-zero      how long without a request before the Service's
+//	                   Deployment or StatefulSet is scaled to zero, as a
+//	                   duration: 30m. The next request scales it back to one
+//	wake-timeout       how long that request is held for it; defaults to 2m
+//
+// Limits are checked before access, so a scanner guessing passwords is slowed
+// down by the same limit as everything else.
+//
+// Unknown keys are refused rather than ignored. A misspelled key that is
+// skipped is an access policy that is not enforced, and nothing would say so.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// errUnsupported marks a policy that cannot be enforced as written. See
+// consts.ErrUnsupported.
+var errUnsupported = consts.ErrUnsupported
+
+// The keys a policy ConfigMap may carry.
+const (
+	keyAllowCIDRs      = "allow-cidrs"
+	keyBasicAuthSecret = "basic-auth-secret"
+	keyJWTIssuer       = "jwt-issuer"
+	keyJWTAudience     = "jwt-audience"
+	keyRateLimitRPS    = "rate-limit-rps"
+	keyRateLimitBurst  = "rate-limit-burst"
+	keyMaxConnections  = "max-connections"
+	keyMaxBodySize     = "max-body-size"
+	keyAccessLog       = "access-log"
+	keyAccessLogSample = "access-log-sample"
+	keyAccessLogHeader = "access-log-headers"
+	keyAccessLogRedact = "access-log-redact"
+	keyMaintenancePage = "maintenance-page"
+	keyErrorPage       = "error-page"
+	keyScaleToZero     = "scale-to-zero"
+	keyWakeTimeout     = "wake-timeout"
+)
+
+var keys = []string{
+	keyAccessLog, keyAccessLogHeader, keyAccessLogRedact, keyAccessLogSample,
+	keyAllowCIDRs, keyBasicAuthSecret, keyErrorPage, keyJWTAudience, keyJWTIssuer,
+	keyMaintenancePage, keyMaxBodySize, keyMaxConnections, keyRateLimitBurst, keyRateLimitRPS,
+	keyScaleToZero, keyWakeTimeout,
+}
+
+// alwaysRedacted are the request headers never logged by value, whatever a
+// policy asks for. Each is a credential, and a log is read by more people
+// than the origin is.
+var alwaysRedacted = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// Policy is one ConfigMap's worth of checks. Its zero value allows everything,
+// and never comes out of Load.
+type Policy struct {
+	// Source names where the policy came from, for messages.
+	Source string
+	// Allow is the client addresses allowed through, or nil for any.
+	Allow []netip.Prefix
+	// Basic is the one username and password accepted, or nil.
+	Basic *Credentials
+	// Issuer is the OIDC issuer whose tokens are accepted, or empty. Audience
+	// is checked only when set.
+	Issuer   string
+	Audience string
+	// Limits caps how hard the tunnel may be driven.
+	Limits Limits
+	// Log asks for requests to be logged, or is nil.
+	Log *AccessLog
+	// Maintenance is the page served while the backend has no ready
+	// endpoints, or empty to withdraw the hostname instead.
+	Maintenance string
+	// ErrorPage is the page served when the origin cannot be reached, with
+	// the status that says why, or empty for the status alone.
+	ErrorPage string
+	// Wake scales the backend to zero while idle, or is nil.
+	Wake *Wake
+}
+
+// Wake is a policy's scale-to-zero.
+type Wake struct {
+	// Idle is how long without a request before the workload is scaled to
+	// zero.
+	Idle time.Duration
+	// Timeout is how long a request that finds it at zero is held for it to
+	// come up.
+	Timeout time.Duration
+}
+
+// AccessLog is a policy's access logging.
+type AccessLog struct {
+	// Sample is the fraction of requests logged, in (0, 1].
+	Sample float64
+	// Headers are the request headers logged, canonicalized. Redact are
+	// those logged as present but not by value, alwaysRedacted among them.
+	Headers []string
+	Redact  []string
+}
+
+// Limits is a policy's caps. A zero field is no cap.
+type Limits struct {
+	// RPS and Burst are a token bucket: Burst requests at once, refilled at
+	// RPS a second.
+	RPS   float64
+	Burst int
+	// MaxConnections is how many requests may be in flight at once. The edge
+	// multiplexes every client over a few connections to this process, so a
+	// request is the only thing here that corresponds to one of theirs.
+	MaxConnections int
+	// MaxBodyBytes is the largest request body forwarded.
+	MaxBodyBytes int64
+}
+
+// Credentials is a kubernetes.io/basic-auth Secret's two keys.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Label reports the policy ConfigMap obj names through {provider}/policy.
+// Keyed by provider, like every other label on these objects: a policy meant
+// for another provider's tunnel is not addressed to this one.
+func Label(obj metav1.Object, provider string) (types.NamespacedName, bool) {
+	name, ok := obj.GetLabels()[provider+"/"+consts.PolicyLabel]
+	if !ok {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}, true
+}
+
+// Parameters checks a class's parameters reference and returns the ConfigMap
+// it names. group, kind and namespace are as the class spells them; neither
+// API defaults them usefully, so all three must say core, ConfigMap, and
+// where.
+//
+// A class is cluster-scoped and its policy is not the property of any one
+// namespace, so the namespace is required rather than guessed.
+func Parameters(class, group, kind, name string, namespace *string) (types.NamespacedName, error) {
+	if group != "" || kind != "ConfigMap" || namespace == nil || *namespace == "" {
+		return types.NamespacedName{}, fmt.Errorf("%w: class %s parameters must name a core ConfigMap "+
+			"by namespace and name to be read as an access policy", errUnsupported, class)
+	}
+	return types.NamespacedName{Namespace: *namespace, Name: name}, nil
+}
+
+// Load reads the policies refs name.
+//
+// A ConfigMap or Secret that does not exist is an error, and not an
+// unsupported one: it may be created a moment from now, and until it is, the
+// tunnel stays down. Serving without the policy that was asked for is the one
+// outcome this package must not have.
+//
+// r should be uncached. See consts.PolicyResyncInterval.
+func Load(ctx context.Context, r client.Reader, refs ...types.NamespacedName) ([]Policy, error) {
+	out := make([]Policy, 0, len(refs))
+	for _, ref := range refs {
+		p, err := load(ctx, r, ref)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+
+	// Both read the Authorization header, so a request could satisfy one or
+	// the other and never both. Refusing the combination beats a tunnel
+	// nobody can reach.
+	basic := slices.IndexFunc(out, func(p Policy) bool { return p.Basic != nil })
+	bearer := slices.IndexFunc(out, func(p Policy) bool { return p.Issuer != "" })
+	if basic >= 0 && bearer >= 0 {
+		return nil, fmt.Errorf("%w: %s sets %s and %s sets %s; both read the Authorization header, "+
+			"so no request could pass both", errUnsupported,
+			out[basic].Source, keyBasicAuthSecret, out[bearer].Source, keyJWTIssuer)
+	}
+	return out, nil
+}
+
+func load(ctx context.Context, r client.Reader, ref types.NamespacedName) (Policy, error) {
+	p := Policy{Source: "ConfigMap " + ref.String()}
+
+	var cm corev1.ConfigMap
+	if err := r.Get(ctx, ref, &cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return Policy{}, fmt.Errorf("access policy %s not found", p.Source)
+		}
+		return Policy{}, fmt.Errorf("get access policy %s: %w", p.Source, err)
+	}
+
+	for key := range cm.Data {
+		if !slices.Contains(keys, key) {
+			return Policy{}, fmt.Errorf("%w: %s: unknown key %q; known keys are %s",
+				errUnsupported, p.Source, key, strings.Join(keys, ", "))
+		}
+	}
+
+	for _, field := range list(cm.Data[keyAllowCIDRs]) {
+		prefix, err := parsePrefix(field)
+		if err != nil {
+			return Policy{}, fmt.Errorf("%w: %s: %s: %v", errUnsupported, p.Source, keyAllowCIDRs, err)
+		}
+		p.Allow = append(p.Allow, prefix)
+	}
+
+	if name := cm.Data[keyBasicAuthSecret]; name != "" {
+		creds, err := basicAuth(ctx, r, types.NamespacedName{Namespace: ref.Namespace, Name: name})
+		if err != nil {
+			return Policy{}, fmt.Errorf("%s: %w", p.Source, err)
+		}
+		p.Basic = creds
+	}
+
+	p.Issuer = cm.Data[keyJWTIssuer]
+	p.Audience = cm.Data[keyJWTAudience]
+	if p.Issuer != "" {
+		u, err := url.Parse(p.Issuer)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return Policy{}, fmt.Errorf("%w: %s: %s %q must be an https URL", errUnsupported, p.Source, keyJWTIssuer, p.Issuer)
+		}
+	} else if p.Audience != "" {
+		return Policy{}, fmt.Errorf("%w: %s: %s without %s checks nothing", errUnsupported, p.Source, keyJWTAudience, keyJWTIssuer)
+	}
+
+	limits, err := parseLimits(cm.Data)
+	if err != nil {
+		return Policy{}, fmt.Errorf("%w: %s: %v", errUnsupported, p.Source, err)
+	}
+	p.Limits = limits
+
+	log, err := parseAccessLog(cm.Data)
+	if err != nil {
+		return Policy{}, fmt.Errorf("%w: %s: %v", errUnsupported, p.Source, err)
+	}
+	p.Log = log
+	p.Maintenance = cm.Data[keyMaintenancePage]
+	p.ErrorPage = cm.Data[keyErrorPage]
+
+	wake, err := parseWake(cm.Data)
+	if err != nil {
+		return Policy{}, fmt.Errorf("%w: %s: %v", errUnsupported, p.Source, err)
+	}
+	p.Wake = wake
+
+	if p.Allow == nil && p.Basic == nil && p.Issuer == "" && p.Limits == (Limits{}) && p.Log == nil &&
+		p.Maintenance == "" && p.ErrorPage == "" && p.Wake == nil {
+		// Naming a policy that does nothing is a mistake, not a choice: the
+		// way to allow everything is to name no policy.
+		return Policy{}, fmt.Errorf("%w: %s sets none of %s", errUnsupported, p.Source, strings.Join(keys, ", "))
+	}
+	return p, nil
+}
+
+// parseLimits reads the four limit keys. Each must be positive when present:
+// a zero would read as "no limit" here and as "nothing allowed" to whoever
+// wrote it.
+func parseLimits(data map[string]string) (Limits, error) {
+	var l Limits
+	if v, ok := data[keyRateLimitRPS]; ok {
+		rps, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || rps <= 0 || math.IsInf(rps, 0) || math.IsNaN(rps) {
+			return Limits{}, fmt.Errorf("%s %q must be a positive number", keyRateLimitRPS, v)
+		}
+		l.RPS = rps
+		// A burst of the rate lets a second's worth through at once, which
+		// is what "n per second" reads as to most people.
+		l.Burst = int(math.Ceil(rps))
+	}
+	if v, ok := data[keyRateLimitBurst]; ok {
+		if l.RPS == 0 {
+			return Limits{}, fmt.Errorf("%s without %s limits nothing", keyRateLimitBurst, keyRateLimitRPS)
+		}
+		burst, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || burst <= 0 {
+			return Limits{}, fmt.Errorf("%s %q must be a positive integer", keyRateLimitBurst, v)
+		}
+		l.Burst = burst
+	}
+	if v, ok := data[keyMaxConnections]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n <= 0 {
+			return Limits{}, fmt.Errorf("%s %q must be a positive integer", keyMaxConnections, v)
+		}
+		l.MaxConnections = n
+	}
+	if v, ok := data[keyMaxBodySize]; ok {
+		// A quantity, as every other size in Kubernetes is, so 10Mi means
+		// what it means in a resource limit.
+		q, err := resource.ParseQuantity(strings.TrimSpace(v))
+		if err != nil || q.Sign() <= 0 {
+			return Limits{}, fmt.Errorf("%s %q must be a positive quantity, such as 10Mi", keyMaxBodySize, v)
+		}
+		l.MaxBodyBytes = q.Value()
+	}
+	return l, nil
+}
+
+// parseAccessLog reads the access log keys. The other three are refused
+// without access-log itself, for the reason a jwt-audience without an issuer
+// is: they read as though something were logged, and nothing would be.
+func parseAccessLog(data map[string]string) (*AccessLog, error) {
+	on := false
+	if v, ok := data[keyAccessLog]; ok {
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s %q must be true or false", keyAccessLog, v)
+		}
+		on = b
+	}
+	if !on {
+		for _, key := range []string{keyAccessLogSample, keyAccessLogHeader, keyAccessLogRedact} {
+			if _, ok := data[key]; ok {
+				return nil, fmt.Errorf("%s without %s: \"true\" logs nothing", key, keyAccessLog)
+			}
+		}
+		return nil, nil
+	}
+
+	l := &AccessLog{Sample: 1, Redact: slices.Clone(alwaysRedacted)}
+	if v, ok := data[keyAccessLogSample]; ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || f <= 0 || f > 1 {
+			return nil, fmt.Errorf("%s %q must be a fraction above 0 and at most 1", keyAccessLogSample, v)
+		}
+		l.Sample = f
+	}
+	for _, h := range list(data[keyAccessLogHeader]) {
+		l.Headers = append(l.Headers, http.CanonicalHeaderKey(h))
+	}
+	for _, h := range list(data[keyAccessLogRedact]) {
+		if h = http.CanonicalHeaderKey(h); !slices.Contains(l.Redact, h) {
+			l.Redact = append(l.Redact, h)
+		}
+	}
+	return l, nil
+}
+
+// parseWake reads scale-to-zero and wake-timeout. A timeout alone is refused:
+// it reads as though something woke the backend, and nothing would.
+func parseWake(data map[string]string) (*Wake, error) {
+	v, ok := data[keyScaleToZero]
+	if !ok {
+		if _, ok := data[keyWakeTimeout]; ok {
+			return nil, fmt.Errorf("%s without %s: nothing scales to zero to be woken", keyWakeTimeout, keyScaleToZero)
+		}
+		return nil, nil
+	}
+	w := &Wake{Timeout: consts.DefaultWakeTimeout}
+	var err error
+	if w.Idle, err = duration(keyScaleToZero, v); err != nil {
+		return nil, err
+	}
+	if v, ok := data[keyWakeTimeout]; ok {
+		if w.Timeout, err = duration(keyWakeTimeout, v); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// duration parses a positive duration for key.
+func duration(key, v string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s %q must be a positive duration, such as 30m", key, v)
+	}
+	return d, nil
+}
+
+// list splits a comma, newline or space separated value.
+func list(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n' || r == ' ' || r == '\t'
+	})
+}
+
+// parsePrefix reads a CIDR, or a bare address as the prefix holding only it.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// basicAuth reads the Secret a policy names. Beside the ConfigMap, never
+// elsewhere: a policy that could name a Secret in any namespace would let
+// whoever writes it read credentials out of namespaces they cannot.
+func basicAuth(ctx context.Context, r client.Reader, ref types.NamespacedName) (*Credentials, error) {
+	var secret corev1.Secret
+	if err := r.Get(ctx, ref, &secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%s Secret %s not found", keyBasicAuthSecret, ref)
+		}
+		return nil, fmt.Errorf("get %s Secret %s: %w", keyBasicAuthSecret, ref, err)
+	}
+	// The type is what promises the two keys, and asking for it keeps a
+	// generic Secret from being read as credentials by accident.
+	if secret.Type != corev1.SecretTypeBasicAuth {
+		return nil, fmt.Errorf("%w: Secret %s is %s, want %s", errUnsupported, ref, secret.Type, corev1.SecretTypeBasicAuth)
+	}
+	creds := &Credentials{
+		Username: string(secret.Data[corev1.BasicAuthUsernameKey]),
+		Password: string(secret.Data[corev1.BasicAuthPasswordKey]),
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return nil, fmt.Errorf("%w: Secret %s must set both %s and %s", errUnsupported, ref,
+			corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)
+	}
+	return creds, nil
+}
@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+var policyKey = types.NamespacedName{Namespace: "default", Name: "web-policy"}
+
+func configMap(data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: policyKey.Namespace, Name: policyKey.Name},
+		Data:       data,
+	}
+}
+
+func basicSecret(name string, typ corev1.SecretType, user, pass string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Type:       typ,
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte(user),
+			corev1.BasicAuthPasswordKey: []byte(pass),
+		},
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		objs []client.Object
+		want Policy
+		// wantErr is a substring of the expected error; wantUnsupported says
+		// whether it should wrap ErrUnsupported. An absent ConfigMap should
+		// not: it may be created next, and that is a retry.
+		wantErr         string
+		wantUnsupported bool
+	}{
+		{
+			name: "cidrs, comma and newline separated, a bare address among them",
+			objs: []client.Object{configMap(map[string]string{keyAllowCIDRs: "10.0.0.0/8, 192.0.2.7\n2001:db8::/32"})},
+			want: Policy{Allow: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("192.0.2.7/32"),
+				netip.MustParsePrefix("2001:db8::/32"),
+			}},
+		},
+		{
+			name:            "a cidr that does not parse",
+			objs:            []client.Object{configMap(map[string]string{keyAllowCIDRs: "10.0.0.0/33"})},
+			wantErr:         keyAllowCIDRs,
+			wantUnsupported: true,
+		},
+		{
+			name: "basic auth from the Secret beside it",
+			objs: []client.Object{
+				configMap(map[string]string{keyBasicAuthSecret: "creds"}),
+				basicSecret("creds", corev1.SecretTypeBasicAuth, "ada", "hunter2"),
+			},
+			want: Policy{Basic: &Credentials{Username: "ada", Password: "hunter2"}},
+		},
+		{
+			name:    "basic auth naming a Secret that is not there yet",
+			objs:    []client.Object{configMap(map[string]string{keyBasicAuthSecret: "creds"})},
+			wantErr: "not found",
+		},
+		{
+			name: "a Secret of any other type is not read as credentials",
+			objs: []client.Object{
+				configMap(map[string]string{keyBasicAuthSecret: "creds"}),
+				basicSecret("creds", corev1.SecretTypeOpaque, "ada", "hunter2"),
+			},
+			wantErr:         string(corev1.SecretTypeBasicAuth),
+			wantUnsupported: true,
+		},
+		{
+			name: "a basic-auth Secret without a password",
+			objs: []client.Object{
+				configMap(map[string]string{keyBasicAuthSecret: "creds"}),
+				basicSecret("creds", corev1.SecretTypeBasicAuth, "ada", ""),
+			},
+			wantErr:         corev1.BasicAuthPasswordKey,
+			wantUnsupported: true,
+		},
+		{
+			name: "an issuer and an audience",
+			objs: []client.Object{configMap(map[string]string{
+				keyJWTIssuer: "https://issuer.example.com", keyJWTAudience: "web",
+			})},
+			want: Policy{Issuer: "https://issuer.example.com", Audience: "web"},
+		},
+		{
+			name:            "an issuer that is not https",
+			objs:            []client.Object{configMap(map[string]string{keyJWTIssuer: "http://issuer.example.com"})},
+			wantErr:         keyJWTIssuer,
+			wantUnsupported: true,
+		},
+		{
+			name:            "an audience with no issuer checks nothing",
+			objs:            []client.Object{configMap(map[string]string{keyJWTAudience: "web"})},
+			wantErr:         keyJWTAudience,
+			wantUnsupported: true,
+		},
+		{
+			name: "limits alone are a policy",
+			objs: []client.Object{configMap(map[string]string{
+				keyRateLimitRPS: "2.5", keyMaxConnections: "10", keyMaxBodySize: "1Mi",
+			})},
+			// The burst defaults to a second's worth of the rate.
+			want: Policy{Limits: Limits{RPS: 2.5, Burst: 3, MaxConnections: 10, MaxBodyBytes: 1 << 20}},
+		},
+		{
+			name: "a maintenance page alone is a policy",
+			objs: []client.Object{configMap(map[string]string{keyMaintenancePage: "<p>Back soon.</p>"})},
+			want: Policy{Maintenance: "<p>Back soon.</p>"},
+		},
+		{
+			name: "an error page alone is a policy",
+			objs: []client.Object{configMap(map[string]string{keyErrorPage: "<p>Starting up.</p>"})},
+			want: Policy{ErrorPage: "<p>Starting up.</p>"},
+		},
+		{
+			name: "scale-to-zero with the default wake timeout",
+			objs: []client.Object{configMap(map[string]string{keyScaleToZero: "30m"})},
+			want: Policy{Wake: &Wake{Idle: 30 * time.Minute, Timeout: consts.DefaultWakeTimeout}},
+		},
+		{
+			name: "scale-to-zero with a wake timeout",
+			objs: []client.Object{configMap(map[string]string{keyScaleToZero: "1h", keyWakeTimeout: "5m"})},
+			want: Policy{Wake: &Wake{Idle: time.Hour, Timeout: 5 * time.Minute}},
+		},
+		{
+			name:            "a wake timeout alone",
+			objs:            []client.Object{configMap(map[string]string{keyWakeTimeout: "5m"})},
+			wantErr:         keyWakeTimeout,
+			wantUnsupported: true,
+		},
+		{
+			name:            "an idle period that is not a duration",
+			objs:            []client.Object{configMap(map[string]string{keyScaleToZero: "30"})},
+			wantErr:         keyScaleToZero,
+			wantUnsupported: true,
+		},
+		{
+			name: "a burst beside the rate",
+			objs: []client.Object{configMap(map[string]string{keyRateLimitRPS: "5", keyRateLimitBurst: "50"})},
+			want: Policy{Limits: Limits{RPS: 5, Burst: 50}},
+		},
+		{
+			name:            "a burst with no rate",
+			objs:            []client.Object{configMap(map[string]string{keyRateLimitBurst: "50"})},
+			wantErr:         keyRateLimitBurst,
+			wantUnsupported: true,
+		},
+		{
+			name:            "a rate of zero",
+			objs:            []client.Object{configMap(map[string]string{keyRateLimitRPS: "0"})},
+			wantErr:         keyRateLimitRPS,
+			wantUnsupported: true,
+		},
+		{
+			name:            "a connection cap that is not a number",
+			objs:            []client.Object{configMap(map[string]string{keyMaxConnections: "lots"})},
+			wantErr:         keyMaxConnections,
+			wantUnsupported: true,
+		},
+		{
+			name:            "a body size that is not a quantity",
+			objs:            []client.Object{configMap(map[string]string{keyMaxBodySize: "ten megs"})},
+			wantErr:         keyMaxBodySize,
+			wantUnsupported: true,
+		},
+		{
+			name: "an access log alone is a policy, credentials redacted whatever it asks",
+			objs: []client.Object{configMap(map[string]string{
+				keyAccessLog: "true", keyAccessLogSample: "0.25",
+				keyAccessLogHeader: "x-request-id, authorization\nStripe-Signature",
+				keyAccessLogRedact: "stripe-signature",
+			})},
+			want: Policy{Log: &AccessLog{
+				Sample:  0.25,
+				Headers: []string{"X-Request-Id", "Authorization", "Stripe-Signature"},
+				Redact:  append(slices.Clone(alwaysRedacted), "Stripe-Signature"),
+			}},
+		},
+		{
+			name:            "a sample rate above one",
+			objs:            []client.Object{configMap(map[string]string{keyAccessLog: "true", keyAccessLogSample: "2"})},
+			wantErr:         keyAccessLogSample,
+			wantUnsupported: true,
+		},
+		{
+			name:            "log headers with the log turned off",
+			objs:            []client.Object{configMap(map[string]string{keyAccessLog: "false", keyAccessLogHeader: "X-Request-Id"})},
+			wantErr:         keyAccessLogHeader,
+			wantUnsupported: true,
+		},
+		{
+			name:            "a policy that logs nothing and checks nothing",
+			objs:            []client.Object{configMap(map[string]string{keyAccessLog: "false"})},
+			wantErr:         "sets none of",
+			wantUnsupported: true,
+		},
+		{
+			name:            "a misspelled key is refused, not skipped",
+			objs:            []client.Object{configMap(map[string]string{"allow-cidr": "10.0.0.0/8"})},
+			wantErr:         `unknown key "allow-cidr"`,
+			wantUnsupported: true,
+		},
+		{
+			name:            "a policy that checks nothing",
+			objs:            []client.Object{configMap(nil)},
+			wantErr:         "sets none of",
+			wantUnsupported: true,
+		},
+		{
+			name:    "no ConfigMap yet",
+			wantErr: "not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithObjects(tt.objs...).Build()
+			got, err := Load(context.Background(), c, policyKey)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				if errors.Is(err, consts.ErrUnsupported) != tt.wantUnsupported {
+					t.Errorf("Load() error = %v; ErrUnsupported = %v, want %v", err, !tt.wantUnsupported, tt.wantUnsupported)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			tt.want.Source = "ConfigMap " + policyKey.String()
+			if len(got) != 1 {
+				t.Fatalf("Load() = %d policies, want 1", len(got))
+			}
+			p := got[0]
+			if p.Source != tt.want.Source || p.Issuer != tt.want.Issuer || p.Audience != tt.want.Audience || p.Limits != tt.want.Limits ||
+				!slices.Equal(p.Allow, tt.want.Allow) || (p.Basic == nil) != (tt.want.Basic == nil) ||
+				(p.Basic != nil && *p.Basic != *tt.want.Basic) || (p.Log == nil) != (tt.want.Log == nil) ||
+				(p.Log != nil && (p.Log.Sample != tt.want.Log.Sample || !slices.Equal(p.Log.Headers, tt.want.Log.Headers) ||
+					!slices.Equal(p.Log.Redact, tt.want.Log.Redact))) {
+				t.Errorf("Load() = %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+// Basic auth and a bearer token both want the Authorization header, so two
+// policies asking for one each could never both pass.
+func TestLoadRefusesBasicAuthBesideJWT(t *testing.T) {
+	class := types.NamespacedName{Namespace: "tunnel-system", Name: "class-policy"}
+	c := fake.NewClientBuilder().WithObjects(
+		configMap(map[string]string{keyBasicAuthSecret: "creds"}),
+		basicSecret("creds", corev1.SecretTypeBasicAuth, "ada", "hunter2"),
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: class.Namespace, Name: class.Name},
+			Data:       map[string]string{keyJWTIssuer: "https://issuer.example.com"},
+		},
+	).Build()
+
+	_, err := Load(context.Background(), c, class, policyKey)
+	if !errors.Is(err, consts.ErrUnsupported) || !strings.Contains(err.Error(), "Authorization") {
+		t.Fatalf("Load() error = %v, want ErrUnsupported naming the Authorization header", err)
+	}
+}
+
+func TestParameters(t *testing.T) {
+	tests := []struct {
+		name      string
+		group     string
+		kind      string
+		namespace *string
+		wantErr   bool
+	}{
+		{"a core ConfigMap with a namespace", "", "ConfigMap", ptr.To("tunnel-system"), false},
+		{"no namespace to find it in", "", "ConfigMap", nil, true},
+		{"another kind", "", "Secret", ptr.To("tunnel-system"), true},
+		{"another group", "example.com", "ConfigMap", ptr.To("tunnel-system"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parameters("tunnel.pizza", tt.group, tt.kind, "policy", tt.namespace)
+			if tt.wantErr {
+				if !errors.Is(err, consts.ErrUnsupported) {
+					t.Errorf("Parameters() error = %v, want ErrUnsupported", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parameters() error = %v", err)
+			}
+			if want := (types.NamespacedName{Namespace: "tunnel-system", Name: "policy"}); got != want {
+				t.Errorf("Parameters() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// Keyed by provider, like every other label on these objects.
+func TestLabel(t *testing.T) {
+	obj := &metav1.ObjectMeta{Namespace: "default", Labels: map[string]string{
+		"tunnel.pizza/policy": "web-policy",
+	}}
+	if got, ok := Label(obj, consts.ProviderTunnelPizza); !ok || got != policyKey {
+		t.Errorf("Label() = %v, %v, want %v", got, ok, policyKey)
+	}
+	if _, ok := Label(obj, consts.ProviderCloudflare); ok {
+		t.Error("a policy for tunnel.pizza was read for api.trycloudflare.com")
+	}
+}
@@ -0,0 +1,185 @@
+// Package publicurl serves a mutating admission webhook that tells a Pod its
+// own public URL, for a controller run with --public-url-webhook.
+//
+// An app often needs to know where the internet reaches it: an OAuth callback,
+// a webhook it registers with somebody else, a link in an email. The Service
+// half already keeps that in the Service's hostname mirror (see
+// service.MirrorName), so all a Pod needs is to be pointed at it. This adds a
+// PUBLIC_URL variable to every container of a Pod that a tunnelled Service
+// selects, read from the mirror's consts.EnvPublicURL key.
+//
+// A reference, not the value. A Pod is usually created before its tunnel is
+// up — a Deployment and its Service arrive together — and a value copied at
+// admission would be missing or, after the tunnel is replaced, wrong. The
+// reference is optional, so a Pod starting before the mirror exists starts
+// without the variable rather than not at all, and picks it up when its
+// container next starts. A Pod that needs it to follow a replacement without
+// a restart mounts the mirror as a volume instead; the kubelet refreshes those.
+//
+// Never in the way of a Pod. Anything that goes wrong here admits the Pod
+// unchanged, and the chart registers the webhook with failurePolicy: Ignore
+// for the case where this process is not answering at all.
+package publicurl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/scaffoldly/tunnel/config"
+	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/service"
+)
+
+// Name identifies the webhook in logs and registration.
+const Name = "publicurl"
+
+// Injector is the webhook's handler.
+type Injector struct {
+	// Services is read uncached, for the same reason the Service half reads
+	// them that way: the selectors are in spec, and the cache holds Service
+	// metadata only.
+	Services client.Reader
+	// Providers is the vocabulary a trigger may name; see
+	// service.Reconciler.Providers.
+	Providers []string
+	Decoder   admission.Decoder
+}
+
+// New registers the webhook with mgr's webhook server, when cfg asks for it.
+// Not asking leaves the server unstarted: the manager only runs one that
+// something has been registered on.
+func New(mgr ctrl.Manager, cfg config.Config) error {
+	if !cfg.PublicURLWebhook {
+		return nil
+	}
+	mgr.GetWebhookServer().Register(consts.PublicURLWebhookPath, &webhook.Admission{Handler: &Injector{
+		Services:  mgr.GetAPIReader(),
+		Providers: consts.InstalledProviders,
+		Decoder:   admission.NewDecoder(mgr.GetScheme()),
+	}})
+	mgr.GetLogger().Info("public url webhook registered", "path", consts.PublicURLWebhookPath)
+	return nil
+}
+
+// Handle implements admission.Handler.
+func (i *Injector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	logger := log.FromContext(ctx)
+
+	var pod corev1.Pod
+	if err := i.Decoder.Decode(req, &pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if len(pod.Labels) == 0 {
+		// Nothing can select it.
+		return admission.Allowed("")
+	}
+
+	svc, err := i.selecting(ctx, req.Namespace, pod.Labels)
+	if err != nil {
+		logger.Info("admitting pod without a public url", "error", err)
+		return admission.Allowed("")
+	}
+	if svc == "" {
+		return admission.Allowed("")
+	}
+	if !inject(&pod, service.MirrorName(svc)) {
+		return admission.Allowed("")
+	}
+
+	patched, err := json.Marshal(&pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, patched)
+}
+
+// selecting returns the name of the tunnelled Service in namespace whose
+// selector matches podLabels, or empty when none does. Where several do, the
+// first by name: a Pod behind two tunnelled Services has two public URLs and
+// no way to say which it meant, and the same answer every time is the most
+// that can be offered.
+func (i *Injector) selecting(ctx context.Context, namespace string, podLabels map[string]string) (string, error) {
+	var list corev1.ServiceList
+	if err := i.Services.List(ctx, &list, client.InNamespace(namespace)); err != nil {
+		return "", fmt.Errorf("list services in %s: %w", namespace, err)
+	}
+	labels, err := i.namespace(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for idx := range list.Items {
+		svc := &list.Items[idx]
+		// An empty selector selects nothing here, not everything: such a
+		// Service has its endpoints managed by hand, which is how the Pod
+		// half's generated Services are built.
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if !k8slabels.SelectorFromSet(svc.Spec.Selector).Matches(k8slabels.Set(podLabels)) {
+			continue
+		}
+		if service.Wants(svc, labels, i.Providers) {
+			names = append(names, svc.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	return slices.Min(names), nil
+}
+
+// namespace returns the labels of the Namespace, for the Service half's
+// namespace-wide tunnel label. A scoped install may not read Namespaces, and
+// has no such default either, so a refusal is no labels rather than an error.
+func (i *Injector) namespace(ctx context.Context, name string) (map[string]string, error) {
+	ns := &metav1.PartialObjectMetadata{}
+	ns.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Namespace"))
+	if err := i.Services.Get(ctx, client.ObjectKey{Name: name}, ns); err != nil {
+		if apierrors.IsForbidden(err) || apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get namespace %s: %w", name, err)
+	}
+	return ns.Labels, nil
+}
+
+// inject adds PUBLIC_URL, read from mirror, to every container of pod that
+// does not already set it, and reports whether it changed anything. A
+// PUBLIC_URL the Pod sets itself is the author's statement, and wins.
+func inject(pod *corev1.Pod, mirror string) bool {
+	env := corev1.EnvVar{
+		Name: consts.EnvPublicURL,
+		ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: mirror},
+			Key:                  consts.EnvPublicURL,
+			Optional:             ptr.To(true),
+		}},
+	}
+	changed := false
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for idx := range containers {
+			c := &containers[idx]
+			if slices.ContainsFunc(c.Env, func(e corev1.EnvVar) bool { return e.Name == consts.EnvPublicURL }) {
+				continue
+			}
+			c.Env = append(c.Env, env)
+			changed = true
+		}
+	}
+	return changed
+}
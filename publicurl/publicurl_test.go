@@ -0,0 +1,205 @@
+package publicurl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+var known = []string{consts.ProviderTunnelPizza, consts.ProviderCloudflare}
+
+func svc(name string, labels, selector map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: labels},
+		Spec: corev1.ServiceSpec{
+			Selector: selector,
+			Ports:    []corev1.ServicePort{{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+}
+
+func pod(labels map[string]string, env ...corev1.EnvVar) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1", Labels: labels},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "migrate", Image: "web"}},
+			Containers:     []corev1.Container{{Name: "web", Image: "web", Env: env}},
+		},
+	}
+}
+
+func injector(t *testing.T, objs ...client.Object) *Injector {
+	t.Helper()
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objs...).Build()
+	return &Injector{Services: c, Providers: known, Decoder: admission.NewDecoder(clientgoscheme.Scheme)}
+}
+
+func request(t *testing.T, p *corev1.Pod) admission.Request {
+	t.Helper()
+	raw, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("marshal pod: %v", err)
+	}
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+var tunnelled = map[string]string{"tunnel.pizza/tunnel": "true"}
+
+func TestHandle(t *testing.T) {
+	web := map[string]string{"app": "web"}
+
+	for _, tc := range []struct {
+		name     string
+		services []client.Object
+		pod      *corev1.Pod
+		// want is the mirror the Pod is pointed at, or empty for none.
+		want string
+	}{
+		{
+			name:     "a Pod behind a tunnelled Service",
+			services: []client.Object{svc("web", tunnelled, web)},
+			pod:      pod(map[string]string{"app": "web", "pod-template-hash": "abc"}),
+			want:     "web-tunnel",
+		},
+		{
+			name:     "the loadBalancerClass trigger counts too",
+			services: []client.Object{classed(svc("web", nil, web))},
+			pod:      pod(web),
+			want:     "web-tunnel",
+		},
+		{
+			name: "a Service whose Namespace asks for it",
+			services: []client.Object{
+				svc("web", nil, web),
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: tunnelled}},
+			},
+			pod:  pod(web),
+			want: "web-tunnel",
+		},
+		{
+			name:     "a Service that asks for no tunnel",
+			services: []client.Object{svc("web", nil, web)},
+			pod:      pod(web),
+		},
+		{
+			name:     "a Service selecting other Pods",
+			services: []client.Object{svc("api", tunnelled, map[string]string{"app": "api"})},
+			pod:      pod(web),
+		},
+		{
+			// The Pod half's generated Services are built this way, and an
+			// empty selector matching everything would point every Pod in
+			// the namespace at one of them.
+			name:     "a Service with no selector selects nothing",
+			services: []client.Object{svc("manual", tunnelled, nil)},
+			pod:      pod(web),
+		},
+		{
+			name: "of two, the first by name",
+			services: []client.Object{
+				svc("web-public", tunnelled, web),
+				svc("web-admin", tunnelled, web),
+			},
+			pod:  pod(web),
+			want: "web-admin-tunnel",
+		},
+		{
+			name:     "a Pod with no labels",
+			services: []client.Object{svc("web", tunnelled, web)},
+			pod:      pod(nil),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := injector(t, tc.services...).Handle(context.Background(), request(t, tc.pod))
+			if !resp.Allowed {
+				t.Fatalf("Handle() refused the Pod: %v", resp.Result)
+			}
+			if tc.want == "" {
+				if len(resp.Patches) != 0 {
+					t.Errorf("patches = %+v, want the Pod unchanged", resp.Patches)
+				}
+				return
+			}
+			if len(resp.Patches) == 0 {
+				t.Fatal("no patch; the Pod gets no PUBLIC_URL")
+			}
+			got := tc.pod.DeepCopy()
+			inject(got, tc.want)
+			if ref := got.Spec.Containers[0].Env[0].ValueFrom.ConfigMapKeyRef; ref.Name != tc.want {
+				t.Errorf("mirror = %q, want %q", ref.Name, tc.want)
+			}
+		})
+	}
+}
+
+func classed(s *corev1.Service) *corev1.Service {
+	class := consts.ProviderTunnelPizza
+	s.Spec.Type = corev1.ServiceTypeLoadBalancer
+	s.Spec.LoadBalancerClass = &class
+	return s
+}
+
+// TestInject: every container, init containers included, gets an optional
+// reference to the mirror's key — optional, because the Pod usually starts
+// before the tunnel is up — and a PUBLIC_URL the Pod sets itself stands.
+func TestInject(t *testing.T) {
+	p := pod(nil)
+	if !inject(p, "web-tunnel") {
+		t.Fatal("inject() = false, want a change")
+	}
+	for _, c := range append(p.Spec.InitContainers, p.Spec.Containers...) {
+		if len(c.Env) != 1 || c.Env[0].Name != consts.EnvPublicURL {
+			t.Fatalf("container %s env = %+v, want %s", c.Name, c.Env, consts.EnvPublicURL)
+		}
+		ref := c.Env[0].ValueFrom.ConfigMapKeyRef
+		if ref.Name != "web-tunnel" || ref.Key != consts.EnvPublicURL {
+			t.Errorf("container %s reads %s/%s, want web-tunnel/%s", c.Name, ref.Name, ref.Key, consts.EnvPublicURL)
+		}
+		if ref.Optional == nil || !*ref.Optional {
+			t.Errorf("container %s: reference is required; the Pod would not start before its tunnel", c.Name)
+		}
+	}
+
+	own := pod(nil, corev1.EnvVar{Name: consts.EnvPublicURL, Value: "https://example.com"})
+	own.Spec.InitContainers = nil
+	if inject(own, "web-tunnel") {
+		t.Error("inject() = true; the Pod's own PUBLIC_URL was overridden")
+	}
+	if got := own.Spec.Containers[0].Env; len(got) != 1 || got[0].Value != "https://example.com" {
+		t.Errorf("env = %+v, want the Pod's own value alone", got)
+	}
+}
+
+// TestHandleAdmitsWhenServicesCannotBeRead: a webhook on every Pod creation
+// must never be why a Pod was not created.
+func TestHandleAdmitsWhenServicesCannotBeRead(t *testing.T) {
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).
+		WithInterceptorFuncs(interceptor.Funcs{
+			List: func(context.Context, client.WithWatch, client.ObjectList, ...client.ListOption) error {
+				return errors.New("apiserver unavailable")
+			},
+		}).Build()
+	i := &Injector{Services: c, Providers: known, Decoder: admission.NewDecoder(clientgoscheme.Scheme)}
+
+	resp := i.Handle(context.Background(), request(t, pod(map[string]string{"app": "web"})))
+	if !resp.Allowed || len(resp.Patches) != 0 {
+		t.Errorf("Handle() = allowed %v with %d patches, want the Pod admitted unchanged", resp.Allowed, len(resp.Patches))
+	}
+}
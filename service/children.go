@@ -5,18 +5,21 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
-	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 
+	"github.com/scaffoldly/tunnel/apply"
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/expiry"
 )
 
 // maxNameLength is the longest name the API server accepts: object names are
@@ -39,7 +42,17 @@ const hashLength = 8
 //
 // The first object returned is the one that will carry the public address.
 func children(svc *corev1.Service, want resolved) []client.Object {
-	name := childName(svc.Name, want.provider)
+	base := svc.Name
+	if want.each {
+		// A Service with several ports must name every one, so the name is
+		// always there; the number is for completeness.
+		port := want.port.name
+		if port == "" {
+			port = strconv.Itoa(int(want.port.number))
+		}
+		base += "-" + port
+	}
+	name := childName(base, want.provider)
 
 	switch want.api {
 	case apiGateway:
@@ -52,7 +65,7 @@ func children(svc *corev1.Service, want resolved) []client.Object {
 	}
 }
 
-// ensure creates or updates one child and returns it as it now exists.
+// ensure applies one child and returns it as it now exists. See package apply.
 func (r *Reconciler) ensure(ctx context.Context, svc *corev1.Service, want resolved, desired client.Object) (client.Object, error) {
 	logger := log.FromContext(ctx)
 	kind := kindOf(desired)
@@ -61,50 +74,99 @@ func (r *Reconciler) ensure(ctx context.Context, svc *corev1.Service, want resol
 	err := r.Get(ctx, client.ObjectKeyFromObject(desired), existing)
 	switch {
 	case apierrors.IsNotFound(err):
-		if err := r.Create(ctx, desired); err != nil {
-			return nil, fmt.Errorf("create %s %s: %w", kind, client.ObjectKeyFromObject(desired), err)
-		}
-		logger.Info("created child", "kind", kind, "name", desired.GetName(), "provider", want.provider)
-		r.Recorder.Eventf(svc, nil, consts.EventTypeNormal, consts.ReasonProvisioning,
-			consts.ActionProvision, consts.MsgProvisioningFmt, kind, desired.GetName(), want.provider)
-		return desired, nil
+		existing = nil
 	case err != nil:
 		return nil, fmt.Errorf("get %s %s: %w", kind, client.ObjectKeyFromObject(desired), err)
-	}
-
-	// Ownership is the whole of the authorisation to write here. The RBAC
-	// grants delete on these kinds cluster-wide because it must, so the scoping
-	// has to happen in code: anything this controller did not create is
-	// somebody else's object, whatever its name says.
-	if !metav1.IsControlledBy(existing, svc) {
+	case !metav1.IsControlledBy(existing, svc):
+		// Ownership is the whole of the authorisation to write here. The RBAC
+		// grants delete on these kinds cluster-wide because it must, so the
+		// scoping has to happen in code: anything this controller did not
+		// create is somebody else's object, whatever its name says.
 		return nil, fmt.Errorf("%w: %s", consts.ErrUnsupported,
 			fmt.Sprintf(consts.MsgChildConflictFmt, kind, existing.GetName()))
 	}
 
-	if apiequality.Semantic.DeepEqual(specOf(existing), specOf(desired)) &&
-		matches(existing.GetLabels(), desired.GetLabels()) {
-		return existing, nil
+	result, err := apply.Apply(ctx, r.Client, existing, desired)
+	if err != nil {
+		return nil, fmt.Errorf("apply %s %s: %w", kind, client.ObjectKeyFromObject(desired), err)
 	}
+	r.overwritten(svc, desired, result.Conflict)
+	switch {
+	case existing == nil:
+		logger.Info("created child", "kind", kind, "name", desired.GetName(), "provider", want.provider)
+		r.Recorder.Eventf(svc, nil, consts.EventTypeNormal, consts.ReasonProvisioning,
+			consts.ActionProvision, consts.MsgProvisioningFmt, kind, desired.GetName(), want.provider)
+	case result.Changed:
+		logger.Info("updated child", "kind", kind, "name", desired.GetName(), "provider", want.provider)
+	}
+	return result.Object, nil
+}
 
-	updated := existing.DeepCopyObject().(client.Object)
-	copySpec(updated, desired)
-
-	// Merged, not replaced: a label somebody else put on the child is not ours
-	// to drop.
-	labels := updated.GetLabels()
-	if labels == nil {
-		labels = map[string]string{}
+// Children is every object svc's triggers ask for: the children of each
+// provider it resolves to, and its hostname mirror. Only what its labels and
+// class say, and nothing a probe or a deadline later makes of it — the
+// reconcile decides those and prunes after itself. Exported for package sweep,
+// which collects children their owner no longer asks for when no reconcile
+// has.
+//
+// namespace is the labels of svc's Namespace, as for Wants. A trigger that
+// does not resolve asks for nothing, which is what the reconcile makes of it
+// too.
+func Children(svc *corev1.Service, namespace map[string]string, known []string) []client.Object {
+	wanted, err := providers(svc, namespace, known)
+	if err != nil {
+		return nil
+	}
+	var out []client.Object
+	for _, want := range wanted {
+		if expiry.Elapsed(want.expires) {
+			continue
+		}
+		out = append(out, children(svc, want)...)
 	}
-	for k, v := range desired.GetLabels() {
-		labels[k] = v
+	if len(out) > 0 {
+		out = append(out, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Namespace: svc.Namespace,
+			Name:      MirrorName(svc.Name),
+		}})
 	}
-	updated.SetLabels(labels)
+	return out
+}
 
-	if err := r.Update(ctx, updated); err != nil {
-		return nil, fmt.Errorf("update %s %s: %w", kind, client.ObjectKeyFromObject(updated), err)
+// overwritten reports a child whose fields somebody else had changed, which
+// the apply has just set back. On the Service, like every other word about a
+// child: it is what the user edits, and the edit that did not stick belongs
+// there instead. Nothing to report when conflict is nil.
+func (r *Reconciler) overwritten(svc *corev1.Service, child client.Object, conflict error) {
+	if conflict == nil {
+		return
 	}
-	logger.Info("updated child", "kind", kind, "name", updated.GetName(), "provider", want.provider)
-	return updated, nil
+	r.Recorder.Eventf(svc, nil, consts.EventTypeWarning, consts.ReasonFieldConflict,
+		consts.ActionProvision, consts.MsgFieldConflictFmt, kindOf(child), child.GetName(), conflict)
+}
+
+// hold returns the existing children of svc among desired, changing nothing.
+// It is what a pass does while the origin's protocol is still being probed:
+// building the children now would mean guessing the scheme, and a wrong guess
+// is a tunnel that connects and fails every request. What is already there
+// stays, so the prune does not take a serving tunnel down for the length of a
+// probe.
+func (r *Reconciler) hold(ctx context.Context, svc *corev1.Service, desired []client.Object) ([]client.Object, error) {
+	var held []client.Object
+	for _, d := range desired {
+		existing := emptyLike(d)
+		err := r.Get(ctx, client.ObjectKeyFromObject(d), existing)
+		switch {
+		case apierrors.IsNotFound(err):
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("get %s %s: %w", kindOf(d), client.ObjectKeyFromObject(d), err)
+		}
+		if metav1.IsControlledBy(existing, svc) {
+			held = append(held, existing)
+		}
+	}
+	return held, nil
 }
 
 // prune deletes the children of svc that keep does not name.
@@ -115,14 +177,15 @@ func (r *Reconciler) ensure(ctx context.Context, svc *corev1.Service, want resol
 // a Service switching from one API to the other, which would otherwise leave
 // the previous branch's children behind, still serving, with the Service no
 // longer asking for them. Nothing else in the system notices either, so both
-// are done here.
+// are done here. The mirror ConfigMap is swept with the rest: a hostname left
+// in it outlives the tunnel that served it.
 func (r *Reconciler) prune(ctx context.Context, svc *corev1.Service, keep map[childKey]struct{}) error {
 	logger := log.FromContext(ctx)
 
 	// Every kind, every time, regardless of what the Service currently asks
 	// for: the whole point is to collect children of a branch it has stopped
 	// asking for.
-	lists := []client.ObjectList{&networkingv1.IngressList{}}
+	lists := []client.ObjectList{&networkingv1.IngressList{}, &corev1.ConfigMapList{}}
 	if r.GatewayAPI {
 		// Only where the API server serves them. Listing a kind it does not
 		// know is an error, and on an Ingress-only cluster there is nothing of
@@ -190,11 +253,25 @@ func ingressChild(svc *corev1.Service, want resolved, name string) *networkingv1
 // one below it, in this Service's namespace. The Gateway half refuses
 // cross-namespace backendRefs outright rather than honouring one without a
 // ReferenceGrant, so a wider setting would advertise something it will not do.
+//
+// A requested hostname becomes spec.addresses rather than a label: the Gateway
+// API has a field for asking for an address, and the Gateway half reads it
+// there whoever wrote the Gateway.
 func gatewayChild(svc *corev1.Service, want resolved, name string) *gatewayv1.Gateway {
 	from := gatewayv1.NamespacesFromSame
+	var addresses []gatewayv1.GatewaySpecAddress
+	if want.hostname != "" {
+		addresses = []gatewayv1.GatewaySpecAddress{{
+			Type:  ptr.To(gatewayv1.HostnameAddressType),
+			Value: want.hostname,
+		}}
+	}
+	meta := objectMeta(svc, want, name)
+	delete(meta.Labels, want.provider+"/"+consts.HostnameLabel)
 	return &gatewayv1.Gateway{
-		ObjectMeta: objectMeta(svc, want, name),
+		ObjectMeta: meta,
 		Spec: gatewayv1.GatewaySpec{
+			Addresses:        addresses,
 			GatewayClassName: gatewayv1.ObjectName(want.provider),
 			Listeners: []gatewayv1.Listener{{
 				Name:     "http",
@@ -241,18 +318,32 @@ func routeChild(svc *corev1.Service, want resolved, name string) *gatewayv1.HTTP
 
 // objectMeta is the metadata every child carries, whatever its kind.
 func objectMeta(svc *corev1.Service, want resolved, name string) metav1.ObjectMeta {
+	// The child restates how its origin is dialed, rather than the serving
+	// reconciler reaching back to the Service for it. That keeps the
+	// generated object self-describing — the whole argument for generating a
+	// real object instead of hiding the tunnel — and it means a hand-written
+	// object can say the same thing the same way. A requested hostname and an
+	// access policy ride along for the same reason.
+	labels := map[string]string{
+		consts.LabelManagedBy:                      consts.ManagedBy,
+		want.provider + "/" + consts.ProtocolLabel: want.protocol,
+	}
+	if want.hostname != "" {
+		labels[want.provider+"/"+consts.HostnameLabel] = want.hostname
+	}
+	if want.policy != "" {
+		labels[want.provider+"/"+consts.PolicyLabel] = want.policy
+	}
+	// The deadline as an instant, whichever label the Service spelled it
+	// with: a ttl copied as written would count again from the child's own
+	// creation, and the two would expire apart.
+	if !want.expires.IsZero() {
+		labels[want.provider+"/"+consts.ExpiresAtLabel] = expiry.Value(want.expires)
+	}
 	return metav1.ObjectMeta{
 		Name:      name,
 		Namespace: svc.Namespace,
-		// The child restates how its origin is dialed, rather than the serving
-		// reconciler reaching back to the Service for it. That keeps the
-		// generated object self-describing — the whole argument for generating
-		// a real object instead of hiding the tunnel — and it means a
-		// hand-written object can say the same thing the same way.
-		Labels: map[string]string{
-			consts.LabelManagedBy:                      consts.ManagedBy,
-			want.provider + "/" + consts.ProtocolLabel: want.protocol,
-		},
+		Labels:    labels,
 		// Namespaced owner, namespaced dependent, same namespace: legal, unlike
 		// the cluster-scoped classes the installer creates, which have to be
 		// owned by a Namespace.
@@ -262,7 +353,9 @@ func objectMeta(svc *corev1.Service, want resolved, name string) metav1.ObjectMe
 	}
 }
 
-// childName is the name of the children for one Service and provider.
+// childName is the name of the children for one Service and provider. Under
+// {provider}/ports: all, service carries the port's name as well, giving each
+// port its own.
 //
 // Deterministic, because it is the only handle on them: an unstable name
 // orphans the previous child on every reconcile, and prune would then delete
@@ -288,16 +381,3 @@ func childName(service, provider string) string {
 	suffix := "-" + hex.EncodeToString(sum[:])[:hashLength]
 	return name[:maxNameLength-len(suffix)] + suffix
 }
-
-// matches reports whether want is a subset of got. A child may carry
-// annotations this controller did not write — kubectl's last-applied, a mesh's
-// injection marker — and rewriting it on every pass because of them would churn
-// the object and re-mint its tunnel.
-func matches(got, want map[string]string) bool {
-	for k, v := range want {
-		if got[k] != v {
-			return false
-		}
-	}
-	return true
-}
@@ -8,6 +8,7 @@ import (
 	networkingv1 "k8s.io/api/networking/v1"
 	apivalidation "k8s.io/apimachinery/pkg/api/validation"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 )
 
 // TestChildName pins the naming, which is the only handle the controller has
@@ -183,6 +184,54 @@ func TestChildDeclaresTheProtocol(t *testing.T) {
 	}
 }
 
+// TestChildCarriesTheRequestedHostname: each branch asks for the name the way
+// its own half reads it — a label on the Ingress, spec.addresses on the
+// Gateway — so the refusal lands on the object the user can see.
+func TestChildCarriesTheRequestedHostname(t *testing.T) {
+	want := resolved{
+		provider: "tunnel.pizza", api: apiIngress,
+		port: servicePort{number: 80}, protocol: "http", hostname: "app.tunneled.pizza",
+	}
+	ing := ingressChildFor(annotated(nil), want)
+	if got := ing.Labels["tunnel.pizza/hostname"]; got != "app.tunneled.pizza" {
+		t.Errorf("ingress child label = %q, want app.tunneled.pizza", got)
+	}
+
+	want.api = apiGateway
+	gw := gatewayChild(annotated(nil), want, childName("web", want.provider))
+	if len(gw.Spec.Addresses) != 1 ||
+		gw.Spec.Addresses[0].Type == nil || *gw.Spec.Addresses[0].Type != gatewayv1.HostnameAddressType ||
+		gw.Spec.Addresses[0].Value != "app.tunneled.pizza" {
+		t.Errorf("gateway child addresses = %+v, want one Hostname app.tunneled.pizza", gw.Spec.Addresses)
+	}
+	if _, ok := gw.Labels["tunnel.pizza/hostname"]; ok {
+		t.Error("gateway child carries the hostname twice; spec.addresses is the one its half reads")
+	}
+
+	want.hostname = ""
+	if gw := gatewayChild(annotated(nil), want, childName("web", want.provider)); gw.Spec.Addresses != nil {
+		t.Errorf("gateway child addresses = %+v, want none when nothing was asked for", gw.Spec.Addresses)
+	}
+}
+
+// The policy is enforced by whichever half serves the child, so the child has
+// to say which one.
+func TestChildCarriesTheAccessPolicy(t *testing.T) {
+	for _, api := range []childAPI{apiIngress, apiGateway} {
+		want := resolved{
+			provider: "tunnel.pizza", api: api,
+			port: servicePort{number: 80}, protocol: "http", policy: "web-policy",
+		}
+		meta := objectMeta(annotated(nil), want, childName("web", want.provider))
+		if api == apiGateway {
+			meta = gatewayChild(annotated(nil), want, childName("web", want.provider)).ObjectMeta
+		}
+		if got := meta.Labels["tunnel.pizza/policy"]; got != "web-policy" {
+			t.Errorf("%s child policy label = %q, want web-policy", api, got)
+		}
+	}
+}
+
 // ingressChildFor builds the Ingress branch's child the way children() does,
 // so a test never has to know the naming rule it is asserting against.
 func ingressChildFor(svc *corev1.Service, want resolved) *networkingv1.Ingress {
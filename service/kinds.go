@@ -1,18 +1,21 @@
 package service
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 )
 
-// The three kinds this controller creates on a Service's behalf. Named as
+// The four kinds this controller creates on a Service's behalf. Named as
 // strings for events and log lines; the type switches below are what actually
 // dispatch.
 const (
 	kindIngress   = "Ingress"
 	kindGateway   = "Gateway"
 	kindHTTPRoute = "HTTPRoute"
+	// kindConfigMap is the mirror, not a tunnel: see mirror.
+	kindConfigMap = "ConfigMap"
 )
 
 // childKey identifies one child object. Kind is part of it because the Ingress
@@ -25,7 +28,7 @@ type childKey struct {
 }
 
 // A small type switch in each of these, rather than unstructured objects or
-// reflection. Three kinds is few enough that being explicit is shorter than
+// reflection. Four kinds is few enough that being explicit is shorter than
 // being generic, and the compiler catches a fourth being added without the
 // rest of this file being taught about it.
 
@@ -37,6 +40,8 @@ func kindOf(o client.Object) string {
 		return kindGateway
 	case *gatewayv1.HTTPRoute:
 		return kindHTTPRoute
+	case *corev1.ConfigMap:
+		return kindConfigMap
 	}
 	return ""
 }
@@ -54,37 +59,12 @@ func emptyLike(o client.Object) client.Object {
 		return &gatewayv1.Gateway{}
 	case *gatewayv1.HTTPRoute:
 		return &gatewayv1.HTTPRoute{}
+	case *corev1.ConfigMap:
+		return &corev1.ConfigMap{}
 	}
 	return nil
 }
 
-// specOf returns the part of an object this controller owns. Status is
-// deliberately not in it: the child's status belongs to the reconciler that
-// serves it, and writing it from here would be two controllers on one field.
-func specOf(o client.Object) any {
-	switch t := o.(type) {
-	case *networkingv1.Ingress:
-		return t.Spec
-	case *gatewayv1.Gateway:
-		return t.Spec
-	case *gatewayv1.HTTPRoute:
-		return t.Spec
-	}
-	return nil
-}
-
-// copySpec overwrites dst's spec with src's. Both must be the same kind.
-func copySpec(dst, src client.Object) {
-	switch d := dst.(type) {
-	case *networkingv1.Ingress:
-		d.Spec = src.(*networkingv1.Ingress).Spec
-	case *gatewayv1.Gateway:
-		d.Spec = src.(*gatewayv1.Gateway).Spec
-	case *gatewayv1.HTTPRoute:
-		d.Spec = src.(*gatewayv1.HTTPRoute).Spec
-	}
-}
-
 // hostnameOf reads the public address a child currently publishes, from
 // wherever its own API puts it.
 //
@@ -133,6 +113,10 @@ func itemsOf(list client.ObjectList) []client.Object {
 		for i := range l.Items {
 			out = append(out, &l.Items[i])
 		}
+	case *corev1.ConfigMapList:
+		for i := range l.Items {
+			out = append(out, &l.Items[i])
+		}
 	}
 	return out
 }
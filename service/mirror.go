@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/scaffoldly/tunnel/apply"
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// mirrorSuffix names the mirror after its Service: web's is web-tunnel.
+const mirrorSuffix = "-tunnel"
+
+// MirrorName is the ConfigMap a Service's hostnames are mirrored into.
+// Exported for the public-URL webhook, which points Pods at it.
+func MirrorName(service string) string {
+	return service + mirrorSuffix
+}
+
+// mirror keeps a ConfigMap named <service>-tunnel holding the hostnames svc's
+// tunnels publish, and returns it for the prune to keep. Nil, and so pruned,
+// when there is nothing to hold.
+//
+// A label-triggered Service has nowhere of its own to say this. Its status is
+// off limits — the API server rejects status.loadBalancer on a Service that is
+// not type LoadBalancer — and its metadata is the user's: an annotated Service
+// is left exactly as it was written, and that is not going to be given up for
+// a convenience. Without this the hostname lives only on the child, and
+// finding it means knowing how children are named. A ConfigMap beside the
+// Service, named after it, is found by the name the user already knows, and a
+// Pod can mount it or read it with envFrom.
+//
+// The loadBalancerClass path's hostnames are in it too, although its status
+// already carries them: an app reads its own URL the same way whichever
+// trigger its Service used.
+//
+// One key per provider, and multiple hostnames for one provider, under
+// {provider}/ports: all, are one per line in port order — the order status
+// lists them in. consts.EnvPublicURL is the first of them as an https URL,
+// taking providers in the order known lists them: the one value an app that
+// wants "my address" can read without choosing.
+func (r *Reconciler) mirror(ctx context.Context, svc *corev1.Service, hostnames map[string][]string) (client.Object, error) {
+	data := map[string]string{}
+	for _, provider := range r.Providers {
+		names := slices.DeleteFunc(slices.Clone(hostnames[provider]), func(h string) bool { return h == "" })
+		if len(names) == 0 {
+			continue
+		}
+		data[provider] = strings.Join(names, "\n")
+		if _, ok := data[consts.EnvPublicURL]; !ok {
+			data[consts.EnvPublicURL] = "https://" + names[0]
+		}
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	desired := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      MirrorName(svc.Name),
+			Namespace: svc.Namespace,
+			// What the cache selects ConfigMaps on. Without it this one would
+			// be invisible to the next pass, which would try to create it
+			// again.
+			Labels: map[string]string{consts.LabelManagedBy: consts.ManagedBy},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(svc, corev1.SchemeGroupVersion.WithKind("Service")),
+			},
+		},
+		Data: data,
+	}
+	key := client.ObjectKeyFromObject(desired)
+
+	var existing corev1.ConfigMap
+	err := r.Get(ctx, key, &existing)
+	if apierrors.IsNotFound(err) {
+		// The cache only holds ConfigMaps labelled as ours, so a miss there
+		// says nothing about one somebody else made under this name — and an
+		// apply would merge into it rather than fail the way a create did.
+		// Asked again of the API server before anything is written.
+		err = r.Services.Get(ctx, key, &existing)
+	}
+	switch {
+	case apierrors.IsNotFound(err):
+		result, err := apply.Apply(ctx, r.Client, nil, desired)
+		if err != nil {
+			return nil, fmt.Errorf("apply configmap %s: %w", key, err)
+		}
+		log.FromContext(ctx).Info("created hostname mirror", "name", desired.Name)
+		return result.Object, nil
+	case err != nil:
+		return nil, fmt.Errorf("get configmap %s: %w", key, err)
+	}
+
+	if !metav1.IsControlledBy(&existing, svc) {
+		// Somebody else's. Not touched, any more than a child of another name
+		// is.
+		r.conflict(svc, desired)
+		return nil, nil
+	}
+	result, err := apply.Apply(ctx, r.Client, &existing, desired)
+	if err != nil {
+		return nil, fmt.Errorf("apply configmap %s: %w", key, err)
+	}
+	r.overwritten(svc, desired, result.Conflict)
+	return result.Object, nil
+}
+
+// published returns the hostnames svc's mirror already holds, by provider:
+// what an earlier pass found and said. A hostname in it has been announced,
+// and a pass that finds it again has nothing new to tell. Nil where there is
+// no mirror, or one this controller does not own.
+func (r *Reconciler) published(ctx context.Context, svc *corev1.Service) (map[string][]string, error) {
+	var existing corev1.ConfigMap
+	err := r.Get(ctx, client.ObjectKey{Namespace: svc.Namespace, Name: MirrorName(svc.Name)}, &existing)
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("get configmap %s/%s: %w", svc.Namespace, MirrorName(svc.Name), err)
+	case !metav1.IsControlledBy(&existing, svc):
+		return nil, nil
+	}
+	out := make(map[string][]string, len(existing.Data))
+	for _, provider := range r.Providers {
+		if names, ok := existing.Data[provider]; ok {
+			out[provider] = strings.Split(names, "\n")
+		}
+	}
+	return out, nil
+}
+
+// conflict reports a mirror name held by an object this controller did not
+// create. The tunnels are unaffected; only the mirror is missing.
+func (r *Reconciler) conflict(svc *corev1.Service, desired client.Object) {
+	r.Recorder.Eventf(svc, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
+		consts.ActionProvision, consts.MsgUnsupportedFmt,
+		fmt.Errorf("%w: %s", consts.ErrUnsupported,
+			fmt.Sprintf(consts.MsgChildConflictFmt, kindOf(desired), desired.GetName())))
+}
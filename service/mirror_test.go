@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+var mirrorKey = types.NamespacedName{Namespace: "default", Name: "web-tunnel"}
+
+func getMirror(t *testing.T, c client.Client) (*corev1.ConfigMap, bool) {
+	t.Helper()
+	var cm corev1.ConfigMap
+	err := c.Get(context.Background(), mirrorKey, &cm)
+	if apierrors.IsNotFound(err) {
+		return nil, false
+	}
+	if err != nil {
+		t.Fatalf("get configmap: %v", err)
+	}
+	return &cm, true
+}
+
+// TestReconcileMirrorsTheHostname: the hostname of a label-triggered Service
+// lands in <service>-tunnel once the child has one, and leaves with the
+// trigger.
+func TestReconcileMirrorsTheHostname(t *testing.T) {
+	r, c, _ := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"}))
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	// Nothing to say before the tunnel is up.
+	if cm, ok := getMirror(t, c); ok {
+		t.Fatalf("mirror = %v before the child had a hostname", cm.Data)
+	}
+
+	withHostname(t, c, "web-tunnel-pizza", "lonely-ostrich.tunneled.pizza")
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	cm, ok := getMirror(t, c)
+	if !ok {
+		t.Fatal("no mirror once the child published a hostname")
+	}
+	if got := cm.Data["tunnel.pizza"]; got != "lonely-ostrich.tunneled.pizza" {
+		t.Errorf("data[tunnel.pizza] = %q, want the child's hostname", got)
+	}
+	if got := cm.Data[consts.EnvPublicURL]; got != "https://lonely-ostrich.tunneled.pizza" {
+		t.Errorf("data[%s] = %q, want the hostname as an https URL", consts.EnvPublicURL, got)
+	}
+	if !metav1.IsControlledBy(cm, getService(t, c)) {
+		t.Error("mirror is not controlled by the Service; GC would leave it behind")
+	}
+	// The cache only sees ConfigMaps carrying this; without it the next pass
+	// could not find the mirror it made.
+	if got := cm.Labels[consts.LabelManagedBy]; got != consts.ManagedBy {
+		t.Errorf("%s = %q, want %q", consts.LabelManagedBy, got, consts.ManagedBy)
+	}
+
+	svc := getService(t, c)
+	svc.Labels = nil
+	if err := c.Update(context.Background(), svc); err != nil {
+		t.Fatalf("remove trigger: %v", err)
+	}
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if cm, ok := getMirror(t, c); ok {
+		t.Errorf("mirror = %v after the trigger was removed; it names a tunnel that is gone", cm.Data)
+	}
+}
+
+// TestReconcileMirrorsEveryPort: under ports: all, one line per port, in the
+// order status would list them.
+func TestReconcileMirrorsEveryPort(t *testing.T) {
+	r, c, _ := reconciler(t, annotated(
+		map[string]string{"tunnel.pizza/tunnel": "ingress", "tunnel.pizza/ports": "all"},
+		corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "admin", Port: 9090, Protocol: corev1.ProtocolTCP},
+	))
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	withHostname(t, c, "web-http-tunnel-pizza", "one.tunneled.pizza")
+	withHostname(t, c, "web-admin-tunnel-pizza", "two.tunneled.pizza")
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	cm, ok := getMirror(t, c)
+	if !ok {
+		t.Fatal("no mirror")
+	}
+	if got, want := cm.Data["tunnel.pizza"], "one.tunneled.pizza\ntwo.tunneled.pizza"; got != want {
+		t.Errorf("data[tunnel.pizza] = %q, want %q", got, want)
+	}
+	// One URL, the first port's: the app asked for "its" address, and the
+	// order is the Service's own.
+	if got := cm.Data[consts.EnvPublicURL]; got != "https://one.tunneled.pizza" {
+		t.Errorf("data[%s] = %q, want the first port's", consts.EnvPublicURL, got)
+	}
+}
+
+// TestReconcileMirrorsTheClassPathToo: a loadBalancerClass Service carries
+// its hostname in status as well, but an app reads its own URL from the same
+// place whichever trigger its Service used.
+func TestReconcileMirrorsTheClassPathToo(t *testing.T) {
+	r, c, _ := reconciler(t, classed("tunnel.pizza"))
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	withHostname(t, c, "web-tunnel-pizza", "lonely-ostrich.tunneled.pizza")
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	cm, ok := getMirror(t, c)
+	if !ok {
+		t.Fatal("no mirror on the class path")
+	}
+	if got := cm.Data[consts.EnvPublicURL]; got != "https://lonely-ostrich.tunneled.pizza" {
+		t.Errorf("data[%s] = %q, want the status hostname as a URL", consts.EnvPublicURL, got)
+	}
+}
+
+// TestReconcileLeavesSomebodyElsesConfigMap: the name is taken by a ConfigMap
+// this controller did not make. It is not written, the tunnel is unaffected,
+// and the Service says why there is no mirror.
+func TestReconcileLeavesSomebodyElsesConfigMap(t *testing.T) {
+	theirs := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-tunnel"},
+		Data:       map[string]string{"mine": "yes"},
+	}
+	r, c, recorder := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"}), theirs)
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	withHostname(t, c, "web-tunnel-pizza", "lonely-ostrich.tunneled.pizza")
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	cm, _ := getMirror(t, c)
+	if len(cm.Data) != 1 || cm.Data["mine"] != "yes" {
+		t.Errorf("data = %v, want it as its owner left it", cm.Data)
+	}
+	if names := ingressNames(t, c); len(names) != 1 {
+		t.Errorf("ingresses = %v, want the tunnel regardless", names)
+	}
+	assertEvent(t, recorder, "ConfigMap web-tunnel already exists")
+}
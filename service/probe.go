@@ -1,49 +1,94 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/endpoints"
 )
 
-// probeTimeout bounds one probe. Reconcile is single-threaded per controller,
-// so a hung dial to one Service would stall every other Service in the cluster.
-// Short enough that a black-holed address costs a few seconds, long enough for
-// a TLS handshake across a slow node.
+// probeTimeout bounds one probe. Probes run off the reconcile path now, but a
+// worker held by a black-holed address is one fewer for every other Service.
+// Short enough that one costs a few seconds, long enough for a TLS handshake
+// across a slow node.
 const probeTimeout = 3 * time.Second
 
-// Prober reports how the origin at address speaks: consts.OriginScheme or
-// consts.OriginSchemeTLS.
+// probeWorkers is how many origins are probed at once. Each probe is at most
+// two dials, so this bounds the sockets the controller has open for probing
+// rather than anything about throughput.
+const probeWorkers = 8
+
+// probeTTL is how long an answer stands before the origin is asked again. How
+// a backend speaks changes with a deploy, not from minute to minute, and the
+// stale answer is served while the fresh one is fetched, so this only bounds
+// how long a changed backend goes unnoticed.
+//
+// A probe that settled nothing stands for consts.TunnelRetryInterval instead,
+// which is when the reconcile that saw it comes back. One that found something
+// other than HTTP did settle it, and stands the full time.
+const probeTTL = 10 * time.Minute
+
+// Prober reports how the origin at address speaks: consts.OriginScheme,
+// consts.OriginSchemeTLS or consts.OriginSchemeH2C.
 //
 // An error means undetermined, not plaintext. The difference matters: guessing
 // plaintext at a TLS origin produces a tunnel that connects and then fails
 // every request, which looks like a broken tunnel rather than a misconfigured
-// one.
+// one. An error wrapping consts.ErrUnsupported is the one exception: it is a
+// determination, that the origin speaks something other than HTTP.
 //
 // A field on the Reconciler rather than a package function so tests can answer
 // without a network, and so this stays the one place that opens a socket.
 type Prober func(ctx context.Context, address string) (string, error)
 
-// Probe is the production Prober: try to speak TLS to the origin, and fall
-// back to a plain connection.
+// Probe is the production Prober. It asks three questions in turn, each on a
+// fresh connection: does the origin complete a TLS handshake, does it answer
+// an HTTP/1.1 request, and does it answer the HTTP/2 preface.
+//
+// Fresh connections rather than one upgraded in place, because a server that
+// rejects one attempt has usually closed the connection, so reusing it would
+// confirm nothing. Each question gets its own timeout, so one that stalls
+// cannot starve the next of the budget it needs to answer.
 //
-// Two dials rather than one connection upgraded in place, because they answer
-// two different questions and conflating them loses the third answer. A
-// completed TLS handshake is strong evidence of TLS — a plaintext server
-// cannot produce one. A plain connection that opens where TLS failed is good
-// evidence of plaintext: an HTTP server answers a ClientHello with a 400 or
-// closes, neither of which parses as a ServerHello. And neither succeeding
-// says nothing at all about the origin, which is reported as undetermined
-// rather than guessed at — the backend may simply not be listening yet.
+// TLS first, and offering h2 and http/1.1 through ALPN. A completed handshake
+// is strong evidence of TLS — a plaintext server cannot produce one — and
+// either protocol negotiated settles that it is HTTP; the Front's transport
+// speaks whichever the origin picks. A handshake with no protocol negotiated
+// is followed by a request over the same connection, which is what catches a
+// TLS-wrapped origin that is not HTTP at all.
 //
-// The fallback is a fresh dial on purpose. A server that rejects a handshake
-// has usually closed the connection, so reusing it would confirm nothing; a
-// second dial confirms the origin is actually reachable before concluding
-// anything about how it speaks.
+// Then a plain HTTP/1.1 request, which is most origins, and answers for
+// WebSocket servers too: a WebSocket is an HTTP/1.1 request that asks to
+// upgrade, and the Front proxies the upgrade. Anything that parses as a status
+// line is HTTP; how the request was answered is the origin's business.
+//
+// Only when that got no status line, the HTTP/2 preface. A cleartext gRPC
+// server is the usual case: it drops or garbles an HTTP/1.1 request, and
+// answers the preface with its SETTINGS frame. Asked second because a server
+// that speaks both is served best as plain http, which the engine handles
+// without the Front's help.
+//
+// What is left answered with bytes that are neither, and is reported as
+// unsupported with the first of them quoted — `SSH-2.0-OpenSSH`, or Redis's
+// `-ERR unknown command` — so the event says what is actually listening. An
+// origin that says nothing at all, or is not listening, is undetermined: the
+// backend may simply not be ready yet.
 //
 // InsecureSkipVerify because verification is not the question being asked, and
 // answering it would answer "no" for every legitimate in-cluster origin: a
@@ -51,39 +96,292 @@ type Prober func(ctx context.Context, address string) (string, error)
 // chains to a public root. The tunnel engine does not verify this hop either —
 // it cannot, for the same reason — so requiring a valid chain here would refuse
 // exactly the origins that do work.
-//
-// Each dial gets its own timeout, so a TLS attempt that stalls cannot starve
-// the fallback of the budget it needs to answer. Worst case is therefore twice
-// probeTimeout.
 func Probe(ctx context.Context, address string) (string, error) {
-	tlsCtx, cancelTLS := context.WithTimeout(ctx, probeTimeout)
-	defer cancelTLS()
+	if scheme, err := probeTLS(ctx, address); scheme != "" || err != nil {
+		return scheme, err
+	}
+
+	answer, stalled, err := probeExchange(ctx, address, httpRequest(address))
+	if err != nil {
+		return "", err
+	}
+	if isHTTP(answer) {
+		return consts.OriginScheme, nil
+	}
+	if stalled && len(answer) == 0 {
+		// Accepted and said nothing. An HTTP/2 server would at least have
+		// closed on a request it cannot parse, and asking it would only spend
+		// another timeout on a backend that is likely still starting.
+		return "", fmt.Errorf("%s accepted the connection and did not answer", address)
+	}
+
+	// A dial failing here, after one succeeded a moment ago, settles nothing
+	// about how the origin speaks; what the HTTP/1.1 attempt got still does.
+	if preface, _, err := probeExchange(ctx, address, h2cPreface); err == nil && isSettings(preface) {
+		return consts.OriginSchemeH2C, nil
+	}
+	if len(answer) == 0 {
+		return "", fmt.Errorf("%s closed the connection without answering", address)
+	}
+	return "", fmt.Errorf("%w: %s", consts.ErrUnsupported,
+		fmt.Sprintf(consts.MsgProtocolNotHTTPFmt, address, excerpt(answer)))
+}
+
+// probeTLS reports consts.OriginSchemeTLS for an origin that completes a TLS
+// handshake and is HTTP, an unsupported error for one that completes it and is
+// not, and neither for one that does not complete it at all.
+func probeTLS(ctx context.Context, address string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
 
 	dialer := tls.Dialer{
 		Config: &tls.Config{
 			InsecureSkipVerify: true, //nolint:gosec // detection, not authentication
+			NextProtos:         []string{"h2", "http/1.1"},
 		},
 	}
-	if conn, err := dialer.DialContext(tlsCtx, "tcp", address); err == nil {
-		_ = conn.Close()
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return "", nil
+	}
+	defer func() { _ = conn.Close() }()
+	if conn.(*tls.Conn).ConnectionState().NegotiatedProtocol != "" {
 		return consts.OriginSchemeTLS, nil
 	}
 
-	plainCtx, cancelPlain := context.WithTimeout(ctx, probeTimeout)
-	defer cancelPlain()
+	// Most TLS servers do not speak ALPN at all, so its absence is not
+	// evidence of anything; the request is. One that does not answer it is
+	// still TLS, and still most likely HTTP.
+	answer, _ := exchange(ctx, conn, httpRequest(address))
+	if len(answer) > 0 && !isHTTP(answer) {
+		return "", fmt.Errorf("%w: %s", consts.ErrUnsupported,
+			fmt.Sprintf(consts.MsgProtocolNotHTTPFmt, address, excerpt(answer)))
+	}
+	return consts.OriginSchemeTLS, nil
+}
 
-	var plain net.Dialer
-	conn, err := plain.DialContext(plainCtx, "tcp", address)
+// probeExchange dials address in plaintext, sends req, and returns the start
+// of whatever came back, which may be nothing, and whether the read ran out of
+// time rather than being closed. Only a failure to connect is an error: an
+// origin that accepted and then closed or stalled has answered, with silence.
+func probeExchange(ctx context.Context, address string, req []byte) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
-		return "", fmt.Errorf("dial %s: %w", address, err)
+		return nil, false, fmt.Errorf("dial %s: %w", address, err)
+	}
+	defer func() { _ = conn.Close() }()
+	answer, err := exchange(ctx, conn, req)
+	return answer, errors.Is(err, os.ErrDeadlineExceeded), nil
+}
+
+// probeAnswerBytes is as much of an answer as is read: enough for a status
+// line or a frame header, and for a readable excerpt of anything else.
+const probeAnswerBytes = 64
+
+// exchange writes req to conn and reads the start of the answer, until ctx's
+// deadline.
+func exchange(ctx context.Context, conn net.Conn, req []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
 	}
-	_ = conn.Close()
-	return consts.OriginScheme, nil
+	buf := make([]byte, probeAnswerBytes)
+	n, err := io.ReadAtLeast(conn, buf, len(h2cSettingsHeader))
+	return buf[:n], err
+}
+
+// httpRequest is the HTTP/1.1 question. HEAD, so an origin that answers with
+// a large page does not send it.
+func httpRequest(address string) []byte {
+	return []byte("HEAD / HTTP/1.1\r\nHost: " + address + "\r\nUser-Agent: " +
+		consts.ControllerService + "\r\nConnection: close\r\n\r\n")
+}
+
+// isHTTP reports whether answer starts with an HTTP/1.x status line.
+func isHTTP(answer []byte) bool {
+	return bytes.HasPrefix(answer, []byte("HTTP/1."))
+}
+
+// h2cPreface is the client connection preface of RFC 9113 section 3.4, with
+// the empty SETTINGS frame that must follow it.
+var h2cPreface = append([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), h2cSettingsHeader...)
+
+// h2cSettingsHeader is the nine-byte header of an empty SETTINGS frame: zero
+// length, type 0x4, no flags, stream 0.
+var h2cSettingsHeader = []byte{0, 0, 0, 0x4, 0, 0, 0, 0, 0}
+
+// isSettings reports whether answer starts with a SETTINGS frame, which is
+// how a server's preface must begin.
+func isSettings(answer []byte) bool {
+	return len(answer) >= len(h2cSettingsHeader) && answer[3] == h2cSettingsHeader[3] &&
+		bytes.Equal(answer[5:9], h2cSettingsHeader[5:9])
+}
+
+// excerpt is the first line of answer, for an event a person reads.
+func excerpt(answer []byte) string {
+	line, _, _ := bytes.Cut(answer, []byte("\n"))
+	return strings.TrimSpace(strings.ToValidUTF8(string(line), "?"))
 }
 
 // originAddress is where the controller dials a Service to probe it: the same
 // host:port the tunnel will front, so the probe answers the question actually
-// being asked rather than one about a different endpoint.
-func originAddress(namespace, service string, port int32) string {
-	return fmt.Sprintf("%s.%s.%s:%d", service, namespace, consts.OriginDomain, port)
+// being asked rather than one about a different endpoint. See
+// endpoints.Address.
+func (r *Reconciler) originAddress(ctx context.Context, svc *corev1.Service, port servicePort) (string, error) {
+	for _, p := range svc.Spec.Ports {
+		if p.Name == port.name && p.Port == port.number {
+			return endpoints.Address(ctx, r.Services, svc, p)
+		}
+	}
+	// Not listed: an ExternalName's port from {provider}/port.
+	return endpoints.Address(ctx, r.Services, svc, corev1.ServicePort{Name: port.name, Port: port.number})
+}
+
+// Origin is what is known about how one origin speaks: a scheme, or the error
+// that kept the probe from finding one. See Prober.
+type Origin struct {
+	Scheme string
+	Err    error
+}
+
+// Origins answers how an origin speaks from what has already been probed,
+// without blocking. ok is false when nothing is known yet; the answer is then
+// on its way, and key is reconciled again when it lands.
+//
+// An interface so the reconcile tests can answer on the spot. Production is
+// *Probes.
+type Origins interface {
+	Lookup(address string, key types.NamespacedName) (origin Origin, ok bool)
+}
+
+// Probes runs Probe off the reconcile path: a pool of workers, fed by Lookup,
+// with the answers cached per address.
+//
+// Every Service in the cluster flows through one reconciler, one at a time,
+// and an inline probe cost it up to two dials of probeTimeout each, so one slow
+// backend delayed every Service behind it. Here a reconcile only ever reads
+// the cache. A miss queues the address — once, however many Services ask —
+// and the Services that asked are woken through Source when the answer
+// arrives, the way the tunnel store wakes the Ingress half.
+//
+// An expired answer is still returned while the fresh one is fetched. A
+// backend that has not changed then costs no reconcile at all, and one that
+// has is picked up when the new answer differs.
+type Probes struct {
+	// Probe is the dial. Probe in production.
+	Probe Prober
+
+	queue  workqueue.TypedInterface[string]
+	events chan event.GenericEvent
+
+	mu      sync.Mutex
+	results map[string]probed
+	// waiting is who asked about an address since it was last answered.
+	waiting map[string]map[types.NamespacedName]struct{}
+}
+
+// probed is one cached answer, and when it stops being fresh.
+type probed struct {
+	Origin
+	expires time.Time
+}
+
+func NewProbes(probe Prober) *Probes {
+	return &Probes{
+		Probe:   probe,
+		queue:   workqueue.NewTyped[string](),
+		events:  make(chan event.GenericEvent, 64),
+		results: make(map[string]probed),
+		waiting: make(map[string]map[types.NamespacedName]struct{}),
+	}
+}
+
+// Start implements manager.Runnable: the workers run until the manager stops.
+func (p *Probes) Start(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for range probeWorkers {
+		wg.Go(func() {
+			for {
+				address, shutdown := p.queue.Get()
+				if shutdown {
+					return
+				}
+				p.run(ctx, address)
+				p.queue.Done(address)
+			}
+		})
+	}
+	<-ctx.Done()
+	p.queue.ShutDown()
+	wg.Wait()
+	return nil
+}
+
+// Source is the channel the controller watches for answers.
+func (p *Probes) Source() <-chan event.GenericEvent { return p.events }
+
+// Lookup implements Origins.
+func (p *Probes) Lookup(address string, key types.NamespacedName) (Origin, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res, ok := p.results[address]
+	if ok && time.Now().Before(res.expires) {
+		return res.Origin, true
+	}
+	// Somebody already waiting means the probe is queued or running, so a
+	// hundred Services behind one address are one probe. Adding again would
+	// not queue a duplicate, but would dial a second time once the first
+	// finished.
+	if p.waiting[address] == nil {
+		p.waiting[address] = map[types.NamespacedName]struct{}{}
+		p.queue.Add(address)
+	}
+	p.waiting[address][key] = struct{}{}
+	return res.Origin, ok
+}
+
+// run probes one address, stores the answer, and wakes whoever asked if it is
+// news to them: a first answer, or one that differs from the last.
+func (p *Probes) run(ctx context.Context, address string) {
+	scheme, err := p.Probe(ctx, address)
+	now := time.Now()
+	ttl := probeTTL
+	if err != nil && !errors.Is(err, consts.ErrUnsupported) {
+		// Not an answer, so asked again as soon as anybody would look.
+		ttl = consts.TunnelRetryInterval
+	}
+
+	p.mu.Lock()
+	prev, had := p.results[address]
+	p.results[address] = probed{Origin: Origin{Scheme: scheme, Err: err}, expires: now.Add(ttl)}
+	waiters := p.waiting[address]
+	delete(p.waiting, address)
+	// Forget addresses nobody has asked about for a while, so a deleted
+	// Service does not hold its entry forever.
+	for a, res := range p.results {
+		if now.Sub(res.expires) > probeTTL {
+			delete(p.results, a)
+		}
+	}
+	p.mu.Unlock()
+
+	if had && prev.Scheme == scheme && (prev.Err == nil) == (err == nil) {
+		return
+	}
+	for key := range waiters {
+		ev := event.GenericEvent{Object: &metav1.PartialObjectMetadata{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		}}
+		select {
+		case p.events <- ev:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
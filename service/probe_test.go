@@ -2,12 +2,18 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"k8s.io/apimachinery/pkg/types"
+
 	"github.com/scaffoldly/tunnel/consts"
 )
 
@@ -42,11 +48,32 @@ func TestProbe(t *testing.T) {
 		}
 	}()
 
+	// Speaks HTTP/2 with prior knowledge and nothing else, as a cleartext
+	// gRPC server does.
+	h2c := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	h2c.Config.Protocols = new(http.Protocols)
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	t.Cleanup(h2c.Close)
+
+	// Negotiates h2 through ALPN.
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	t.Cleanup(h2.Close)
+
 	tests := []struct {
 		name    string
 		address string
 		want    string
 		wantErr bool
+		// unsupported is whether the error is a determination that the origin
+		// is not HTTP, rather than a failure to find out.
+		unsupported bool
 	}{
 		{
 			name:    "a TLS server completes the handshake",
@@ -58,6 +85,38 @@ func TestProbe(t *testing.T) {
 			address: plaintext.Listener.Addr().String(),
 			want:    consts.OriginScheme,
 		},
+		{
+			name:    "a TLS server negotiating h2 is https",
+			address: h2.Listener.Addr().String(),
+			want:    consts.OriginSchemeTLS,
+		},
+		{
+			name:    "a server that only answers the HTTP/2 preface is h2c",
+			address: h2c.Listener.Addr().String(),
+			want:    consts.OriginSchemeH2C,
+		},
+		{
+			name: "an SSH server is not HTTP",
+			address: raw(t, func(conn net.Conn) {
+				_, _ = io.WriteString(conn, "SSH-2.0-OpenSSH_9.6\r\n")
+			}),
+			wantErr:     true,
+			unsupported: true,
+		},
+		{
+			name: "nor is Redis",
+			address: raw(t, func(conn net.Conn) {
+				_, _ = conn.Read(make([]byte, 512))
+				_, _ = io.WriteString(conn, "-ERR unknown command 'HEAD'\r\n")
+			}),
+			wantErr:     true,
+			unsupported: true,
+		},
+		{
+			name:    "a server that hangs up on everything is undetermined",
+			address: raw(t, func(net.Conn) {}),
+			wantErr: true,
+		},
 		{
 			name: "nothing listening is undetermined, not plaintext",
 			// Port 1 on loopback: reliably refused, never in use.
@@ -73,6 +132,9 @@ func TestProbe(t *testing.T) {
 				if err == nil {
 					t.Fatalf("Probe() = %q, want an error: an unreachable origin proves nothing", got)
 				}
+				if unsupported := errors.Is(err, consts.ErrUnsupported); unsupported != tc.unsupported {
+					t.Errorf("Probe() error = %v; unsupported = %v, want %v", err, unsupported, tc.unsupported)
+				}
 				return
 			}
 			if err != nil {
@@ -99,3 +161,202 @@ func TestProbe(t *testing.T) {
 		}
 	})
 }
+
+// raw listens on loopback and hands each connection to serve, closing it
+// after. It stands in for whatever is not an HTTP server.
+func raw(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// started runs p until the test ends.
+func started(t *testing.T, p *Probes) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = p.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// woken waits for the next event from p and returns whom it names.
+func woken(t *testing.T, p *Probes) types.NamespacedName {
+	t.Helper()
+	select {
+	case ev := <-p.Source():
+		return types.NamespacedName{Namespace: ev.Object.GetNamespace(), Name: ev.Object.GetName()}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no wake-up; the Service would wait for a resync to see the answer")
+		return types.NamespacedName{}
+	}
+}
+
+// quiet asserts p sends nothing for a moment.
+func quiet(t *testing.T, p *Probes) {
+	t.Helper()
+	select {
+	case ev := <-p.Source():
+		t.Fatalf("woke %s/%s, want nothing: the answer had not changed",
+			ev.Object.GetNamespace(), ev.Object.GetName())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestProbesAnswersFromTheCache: the first lookup has no answer and wakes the
+// asker when one arrives; later lookups are answered without a dial.
+func TestProbesAnswersFromTheCache(t *testing.T) {
+	var dials atomic.Int32
+	p := NewProbes(func(context.Context, string) (string, error) {
+		dials.Add(1)
+		return consts.OriginSchemeTLS, nil
+	})
+	started(t, p)
+
+	if _, ok := p.Lookup("web.default.svc:8080", testKey); ok {
+		t.Fatal("Lookup() answered before anything was probed")
+	}
+	if got := woken(t, p); got != testKey {
+		t.Errorf("woke %v, want %v", got, testKey)
+	}
+
+	origin, ok := p.Lookup("web.default.svc:8080", testKey)
+	if !ok || origin.Scheme != consts.OriginSchemeTLS || origin.Err != nil {
+		t.Errorf("Lookup() = %+v, %v, want %q from the cache", origin, ok, consts.OriginSchemeTLS)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("dialled %d times, want 1", n)
+	}
+}
+
+// TestProbesDialsOnceForManyAskers: Services sharing an origin, asking before
+// it is answered, cost one dial and are all woken.
+func TestProbesDialsOnceForManyAskers(t *testing.T) {
+	var dials atomic.Int32
+	release := make(chan struct{})
+	p := NewProbes(func(context.Context, string) (string, error) {
+		dials.Add(1)
+		<-release
+		return consts.OriginScheme, nil
+	})
+	started(t, p)
+
+	a := types.NamespacedName{Namespace: "default", Name: "a"}
+	b := types.NamespacedName{Namespace: "default", Name: "b"}
+	p.Lookup("shared.default.svc:80", a)
+	p.Lookup("shared.default.svc:80", b)
+	close(release)
+
+	got := map[types.NamespacedName]bool{woken(t, p): true, woken(t, p): true}
+	if !got[a] || !got[b] {
+		t.Errorf("woke %v, want both %v and %v", got, a, b)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("dialled %d times, want 1 for one address", n)
+	}
+}
+
+// TestProbesServesAStaleAnswerWhileRevalidating: an expired answer is still
+// an answer, so the reconcile is not held up, and the Service is woken again
+// only if the fresh one differs.
+func TestProbesServesAStaleAnswerWhileRevalidating(t *testing.T) {
+	var scheme atomic.Value
+	scheme.Store(consts.OriginScheme)
+	p := NewProbes(func(context.Context, string) (string, error) {
+		return scheme.Load().(string), nil
+	})
+	started(t, p)
+
+	const address = "web.default.svc:8080"
+	p.Lookup(address, testKey)
+	woken(t, p)
+
+	expire := func() {
+		p.mu.Lock()
+		res := p.results[address]
+		res.expires = time.Now().Add(-time.Second)
+		p.results[address] = res
+		p.mu.Unlock()
+	}
+
+	// Unchanged: the stale answer is served and nobody is woken.
+	expire()
+	if origin, ok := p.Lookup(address, testKey); !ok || origin.Scheme != consts.OriginScheme {
+		t.Fatalf("Lookup() = %+v, %v, want the stale answer", origin, ok)
+	}
+	quiet(t, p)
+
+	// Changed: the Service is woken to pick it up.
+	scheme.Store(consts.OriginSchemeTLS)
+	expire()
+	p.Lookup(address, testKey)
+	if got := woken(t, p); got != testKey {
+		t.Errorf("woke %v, want %v", got, testKey)
+	}
+	if origin, _ := p.Lookup(address, testKey); origin.Scheme != consts.OriginSchemeTLS {
+		t.Errorf("Lookup() = %+v, want %q after revalidating", origin, consts.OriginSchemeTLS)
+	}
+}
+
+// TestProbesRetriesAFailureSooner: a failed probe stands only until the
+// reconcile that saw it comes back, not for the full TTL.
+func TestProbesRetriesAFailureSooner(t *testing.T) {
+	p := NewProbes(func(context.Context, string) (string, error) {
+		return "", errors.New("connection refused")
+	})
+	started(t, p)
+
+	p.Lookup("web.default.svc:8080", testKey)
+	woken(t, p)
+
+	origin, ok := p.Lookup("web.default.svc:8080", testKey)
+	if !ok || origin.Err == nil {
+		t.Fatalf("Lookup() = %+v, %v, want the cached failure", origin, ok)
+	}
+	p.mu.Lock()
+	left := time.Until(p.results["web.default.svc:8080"].expires)
+	p.mu.Unlock()
+	if left > consts.TunnelRetryInterval {
+		t.Errorf("failure cached for %v, want at most %v", left, consts.TunnelRetryInterval)
+	}
+}
+
+// TestProbesKeepsAnOriginThatIsNotHTTP: finding Redis behind a port is an
+// answer, and stands as long as any other.
+func TestProbesKeepsAnOriginThatIsNotHTTP(t *testing.T) {
+	p := NewProbes(func(context.Context, string) (string, error) {
+		return "", fmt.Errorf("%w: not HTTP", consts.ErrUnsupported)
+	})
+	started(t, p)
+
+	p.Lookup("redis.default.svc:6379", testKey)
+	woken(t, p)
+
+	p.mu.Lock()
+	left := time.Until(p.results["redis.default.svc:6379"].expires)
+	p.mu.Unlock()
+	if left <= consts.TunnelRetryInterval {
+		t.Errorf("answer cached for %v, want the full %v", left, probeTTL)
+	}
+}
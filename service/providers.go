@@ -21,10 +21,16 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/endpoints"
+	"github.com/scaffoldly/tunnel/expiry"
+	"github.com/scaffoldly/tunnel/tunnels"
 )
 
 // The name halves of the annotations read here. The prefix is the provider, so
@@ -34,8 +40,17 @@ import (
 const (
 	annotationTunnel = "tunnel"
 	labelProtocol    = consts.ProtocolLabel
+	labelHostname    = consts.HostnameLabel
+	labelPolicy      = consts.PolicyLabel
+	labelPort        = consts.PortLabel
+	labelPorts       = consts.PortsLabel
 )
 
+// portsAll is the one value {provider}/ports takes: a tunnel for every TCP
+// port. A list of names was considered and left out until someone needs it;
+// a port that should not be public is better not exposed by the Service.
+const portsAll = "all"
+
 // What {provider}/tunnel may say. One annotation carrying one enumeration
 // rather than a boolean plus a second annotation to pick the API: "give me a
 // tunnel" and "through which API" were never independent questions, and
@@ -94,6 +109,26 @@ type resolved struct {
 	// default. Only an undeclared one is worth probing for, and only an
 	// undeclared one may be overridden by what the probe finds.
 	declared bool
+	// hostname is what {provider}/hostname asked the tunnel to be minted on,
+	// or empty. Checked against tunnels.Reserve here, where a refusal lands
+	// on the Service the user labelled rather than on a child made only to be
+	// refused, and carried onto the child for a provider that can.
+	hostname string
+	// policy is the access policy ConfigMap {provider}/policy names, or empty.
+	// Carried for the same reason: the child's half is what enforces it.
+	policy string
+	// expires is when {provider}/ttl or expires-at retires this tunnel, or the
+	// zero time. Resolved to an instant here, against the Service's own
+	// creation, and written onto the child as one.
+	expires time.Time
+	// each is set when {provider}/ports asked for a tunnel per port, which
+	// puts the port in the child's name. Unset, the name is the one a
+	// single-port Service has always had.
+	each bool
+	// inherited is set when the tunnel comes from the Namespace's label
+	// rather than anything on the Service. Such a Service never asked, so
+	// finding it cannot be served is not worth a warning on it.
+	inherited bool
 }
 
 // servicePort is the one port of a Service a tunnel fronts. Both spellings are
@@ -120,6 +155,17 @@ type request struct {
 	// protocol is empty unless {provider}/protocol said so, which is what lets
 	// the Service's own appProtocol supply the default.
 	protocol string
+	// hostname is {provider}/hostname, or empty.
+	hostname string
+	// policy is {provider}/policy, or empty.
+	policy string
+	// port is {provider}/port, or empty.
+	port string
+	// ports is {provider}/ports, or empty.
+	ports string
+	// inherited is set when the only thing asking is the Namespace's tunnel
+	// label. See providers.
+	inherited bool
 }
 
 // providers resolves a Service to the tunnels it asks for, deduplicated on
@@ -140,8 +186,18 @@ type request struct {
 // Errors are reported rather than swallowed even where the Service is
 // unambiguously not ours to serve, because a user who mistypes an annotation
 // and sees nothing happen cannot tell that from the controller being down.
-func providers(svc *corev1.Service, known []string) ([]resolved, error) {
-	requests, err := requested(svc, known)
+//
+// namespace is the labels of the Service's Namespace, whose consts.TunnelLabel
+// is the default for a Service that has none of its own; nil where there is
+// no default to apply. A Service that only inherited its tunnel did not ask
+// for one, so the one thing the default cannot settle — which port, on a
+// Service with several and none named http — skips it rather than reporting.
+// A preview namespace is full of Services like that, a database or a metrics
+// endpoint beside the app, and a warning on each would bury the one that
+// matters. A {provider}/port or ports label on it is the Service speaking
+// again, and is reported as usual.
+func providers(svc *corev1.Service, namespace map[string]string, known []string) ([]resolved, error) {
+	requests, err := requested(svc, namespace, known)
 	if err != nil {
 		return nil, err
 	}
@@ -168,21 +224,42 @@ func providers(svc *corev1.Service, known []string) ([]resolved, error) {
 	// an unstable order there orphans a child per reconcile.
 	slices.Sort(wanted)
 
-	port, err := frontedPort(svc)
-	if err != nil {
-		return nil, err
-	}
-
 	out := make([]resolved, 0, len(wanted))
 	for _, provider := range wanted {
-		scheme, declared := protocol(requests[provider].protocol, port.appProtocol)
-		out = append(out, resolved{
-			provider: provider,
-			api:      requests[provider].api,
-			port:     port,
-			protocol: scheme,
-			declared: declared,
-		})
+		r := requests[provider]
+		ports, err := frontedPorts(svc, provider, r)
+		if err != nil && r.inherited && r.port == "" && r.ports == "" {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.hostname != "" {
+			if err := tunnels.Reserve(provider, r.hostname); err != nil {
+				return nil, err
+			}
+		}
+		expires, err := expiry.At(svc, provider)
+		if err != nil {
+			return nil, err
+		}
+		// In spec order within a provider, which the API server preserves, so
+		// the children come out in the same order on every pass.
+		for _, port := range ports {
+			scheme, declared := protocol(r.protocol, port.appProtocol)
+			out = append(out, resolved{
+				provider:  provider,
+				api:       r.api,
+				port:      port,
+				protocol:  scheme,
+				declared:  declared,
+				hostname:  r.hostname,
+				policy:    r.policy,
+				expires:   expires,
+				each:      r.ports == portsAll,
+				inherited: r.inherited,
+			})
+		}
 	}
 	return out, nil
 }
@@ -238,6 +315,15 @@ func Requested(labels map[string]string) ([]string, error) {
 	return wanted, nil
 }
 
+// Wants reports whether svc asks for a tunnel this controller would build,
+// through either trigger or its Namespace's labels. Exported for the
+// public-URL webhook, which points a Pod only at a mirror that can come to
+// exist.
+func Wants(svc *corev1.Service, namespace map[string]string, known []string) bool {
+	wanted, err := providers(svc, namespace, known)
+	return err == nil && len(wanted) > 0
+}
+
 // API reports which branch a label value asks for, for a caller that has
 // already established the object asks for anything. Used by the Pod half to
 // write the resolved branch onto the child rather than the sugar it was given:
@@ -277,12 +363,69 @@ func protocols(labels map[string]string, known []string, requests map[string]*re
 	return nil
 }
 
+// carried reads the labels whose value is a name the child or the port
+// selection acts on — {provider}/hostname, {provider}/policy, {provider}/port,
+// {provider}/ports — the same way protocols reads its own: per provider, and
+// only for a provider this controller knows. field picks which of the
+// request's fields label fills.
+//
+// Every value is checked as a DNS subdomain here, where the user can be told
+// about a typo on the object they edited. For a hostname and a ConfigMap's
+// name that is the whole rule. For the other two it is only a floor, and a
+// safe one: a port name is a DNS label and a port number is digits, both of
+// which pass, and so does "all". What else a value must be — a port that
+// exists, "all" and nothing else for ports — is checked by the caller or left
+// to the child's half, which is what will hold the tunnel.
+func carried(labels map[string]string, known []string, label string, get func(string) *request, field func(*request) *string) error {
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		provider, name, ok := strings.Cut(key, "/")
+		if !ok || name != label {
+			continue
+		}
+		if !slices.Contains(known, provider) {
+			return fmt.Errorf("%w: label %q names unknown provider %q; known providers are %s",
+				consts.ErrUnsupported, key, provider, strings.Join(known, ", "))
+		}
+		if errs := validation.IsDNS1123Subdomain(labels[key]); len(errs) > 0 {
+			return fmt.Errorf("%w: label %s=%q: %s", consts.ErrUnsupported, key, labels[key], strings.Join(errs, "; "))
+		}
+		*field(get(provider)) = labels[key]
+	}
+	return nil
+}
+
+// inherits reports whether svc takes its Namespace's tunnel label when it has
+// none of its own.
+//
+// Not default/kubernetes: labelling default would otherwise publish the API
+// server, and nobody labelling a namespace for its apps means that. Nor a
+// Service another object controls, an operator's or a Knative revision's: its
+// owner decides what it carries. A label on either is still honoured; only
+// the blanket default passes them by.
+func inherits(svc *corev1.Service) bool {
+	if svc.Namespace == metav1.NamespaceDefault && svc.Name == "kubernetes" {
+		return false
+	}
+	return metav1.GetControllerOf(svc) == nil
+}
+
 // requested reads both triggers into one map, keyed by provider.
-func requested(svc *corev1.Service, known []string) (map[string]*request, error) {
+func requested(svc *corev1.Service, namespace map[string]string, known []string) (map[string]*request, error) {
 	requests, err := fromLabels(svc.Labels)
 	if err != nil {
 		return nil, err
 	}
+	if _, own := svc.Labels[consts.TunnelLabel]; !own && inherits(svc) {
+		// The Service's own label wins outright, none included, so this is
+		// only for one that has none. A value the Namespace got wrong is the
+		// Namespace's to report; see (*Reconciler).defaults.
+		if inherited, err := fromLabels(namespace); err == nil {
+			for _, r := range inherited {
+				r.inherited = r.on
+			}
+			requests = inherited
+		}
+	}
 	get := func(provider string) *request {
 		r, ok := requests[provider]
 		if !ok {
@@ -317,6 +460,23 @@ func requested(svc *corev1.Service, known []string) (map[string]*request, error)
 	if err := protocols(svc.Labels, known, requests, get); err != nil {
 		return nil, err
 	}
+	if err := carried(svc.Labels, known, labelHostname, get, func(r *request) *string { return &r.hostname }); err != nil {
+		return nil, err
+	}
+	if err := carried(svc.Labels, known, labelPolicy, get, func(r *request) *string { return &r.policy }); err != nil {
+		return nil, err
+	}
+	if err := carried(svc.Labels, known, labelPort, get, func(r *request) *string { return &r.port }); err != nil {
+		return nil, err
+	}
+	if err := carried(svc.Labels, known, labelPorts, get, func(r *request) *string { return &r.ports }); err != nil {
+		return nil, err
+	}
+	for _, provider := range slices.Sorted(maps.Keys(requests)) {
+		if v := requests[provider].ports; v != "" && v != portsAll {
+			return nil, fmt.Errorf("%w: label %s/%s=%q: must be %q", consts.ErrUnsupported, provider, labelPorts, v, portsAll)
+		}
+	}
 
 	// A protocol naming a provider that no trigger asked for is config that
 	// will never be read. Almost always a half-finished edit, so it is worth a
@@ -332,6 +492,14 @@ func requested(svc *corev1.Service, known []string) (map[string]*request, error)
 			return nil, fmt.Errorf("%w: label %s/%s names no tunnel; add label %s: %q",
 				consts.ErrUnsupported, provider, labelProtocol, consts.TunnelLabel, apiIngress)
 		}
+		for _, c := range []struct{ label, value string }{
+			{labelHostname, r.hostname}, {labelPolicy, r.policy}, {labelPort, r.port}, {labelPorts, r.ports},
+		} {
+			if c.value != "" {
+				return nil, fmt.Errorf("%w: label %s/%s names no tunnel; add label %s: %q",
+					consts.ErrUnsupported, provider, c.label, consts.TunnelLabel, apiIngress)
+			}
+		}
 	}
 
 	return requests, nil
@@ -343,7 +511,7 @@ func requested(svc *corev1.Service, known []string) (map[string]*request, error)
 //
 // An appProtocol this controller does not recognise is ignored rather than
 // refused. It is a core field with an open vocabulary — "mysql", "kafka",
-// "kubernetes.io/h2c" are all legitimate — and it belongs to the Service's
+// "kubernetes.io/ws" are all legitimate — and it belongs to the Service's
 // author, who may have set it for a consumer that has nothing to do with us.
 // The annotation is ours, so an unrecognised value there is an error.
 // The second return says whether the answer was declared or merely defaulted.
@@ -365,12 +533,14 @@ func parseProtocol(value string) (string, error) {
 		return consts.OriginScheme, nil
 	case consts.OriginSchemeTLS:
 		return consts.OriginSchemeTLS, nil
+	case consts.OriginSchemeH2C, consts.AppProtocolH2C:
+		return consts.OriginSchemeH2C, nil
 	default:
 		// grpc is the one people will reach for next. It is not simply a
-		// scheme — it is HTTP/2, cleartext or TLS — so it needs the engine's
-		// http2 knob rather than this one, and claiming support by mapping it
-		// onto https would produce a tunnel that connects and fails every RPC.
-		return "", fmt.Errorf("must be %q or %q", consts.OriginScheme, consts.OriginSchemeTLS)
+		// scheme — it is HTTP/2, cleartext or TLS — so it is spelled as the
+		// transport: h2c for cleartext, https for TLS, where ALPN picks
+		// HTTP/2. Mapping it onto either here would be a guess.
+		return "", fmt.Errorf("must be %q, %q or %q", consts.OriginScheme, consts.OriginSchemeTLS, consts.OriginSchemeH2C)
 	}
 }
 
@@ -403,32 +573,19 @@ func parseTunnel(value string) (childAPI, bool, error) {
 // the same L4/L7 mismatch the rest of the controller already refuses rather
 // than guesses at: a tunnel pointed at a port nothing can carry comes up
 // healthy and fails every request. Exactly one candidate, use it; otherwise the
-// conventional names; otherwise refuse and name what was found.
+// conventional names; otherwise refuse and name what was found, and the labels
+// that settle it.
 //
 // Only TCP ports are candidates. A tunnel carries HTTP, so a UDP or SCTP port
 // is not a worse choice than another, it is not a choice — which means a
 // Service exposing one HTTP port beside a UDP one resolves cleanly instead of
 // being refused for ambiguity that does not exist.
 func frontedPort(svc *corev1.Service) (servicePort, error) {
-	var candidates []corev1.ServicePort
-	var skipped []string
-	for _, p := range svc.Spec.Ports {
-		// An empty protocol means TCP, per the API's default.
-		if p.Protocol == "" || p.Protocol == corev1.ProtocolTCP {
-			candidates = append(candidates, p)
-			continue
-		}
-		skipped = append(skipped, fmt.Sprintf("%s/%s", describePort(p), p.Protocol))
+	candidates, err := tcpPorts(svc)
+	if err != nil {
+		return servicePort{}, err
 	}
-
-	switch len(candidates) {
-	case 0:
-		if len(skipped) > 0 {
-			return servicePort{}, fmt.Errorf("%w: no TCP port to front; a tunnel carries HTTP over TCP and this service exposes only %s",
-				consts.ErrUnsupported, strings.Join(skipped, ", "))
-		}
-		return servicePort{}, fmt.Errorf("%w: service exposes no ports", consts.ErrUnsupported)
-	case 1:
+	if len(candidates) == 1 {
 		return newServicePort(candidates[0]), nil
 	}
 
@@ -444,8 +601,134 @@ func frontedPort(svc *corev1.Service) (servicePort, error) {
 	for _, p := range candidates {
 		found = append(found, describePort(p))
 	}
-	return servicePort{}, fmt.Errorf("%w: %d TCP ports (%s), none named %s; a tunnel fronts a single origin",
-		consts.ErrUnsupported, len(candidates), strings.Join(found, ", "), strings.Join(quoted(preferredPortNames), " or "))
+	return servicePort{}, fmt.Errorf("%w: %d TCP ports (%s), none named %s; a tunnel fronts a single origin, "+
+		"so name one with label {provider}/%s, or give each its own with {provider}/%s: %q",
+		consts.ErrUnsupported, len(candidates), strings.Join(found, ", "), strings.Join(quoted(preferredPortNames), " or "),
+		labelPort, labelPorts, portsAll)
+}
+
+// frontedPorts picks the ports one provider's tunnels front: every TCP port
+// under {provider}/ports: all, the one {provider}/port names, otherwise the
+// one frontedPort chooses.
+//
+// A requested hostname names one tunnel, so it cannot go with several. Refused
+// rather than given to the first port, which would make the others' hostnames
+// differ from it for no reason the Service shows. Naming one port beside
+// asking for all of them is refused for the same reason.
+func frontedPorts(svc *corev1.Service, provider string, r *request) ([]servicePort, error) {
+	if r.port != "" && r.ports == portsAll {
+		return nil, fmt.Errorf("%w: labels %s/%s and %s/%s: %q disagree; keep one",
+			consts.ErrUnsupported, provider, labelPort, provider, labelPorts, portsAll)
+	}
+	if r.port != "" {
+		port, err := namedPort(svc, provider, r.port)
+		if err != nil {
+			return nil, err
+		}
+		return []servicePort{port}, nil
+	}
+	if r.ports != portsAll {
+		port, err := frontedPort(svc)
+		if err != nil {
+			return nil, err
+		}
+		return []servicePort{port}, nil
+	}
+	candidates, err := tcpPorts(svc)
+	if err != nil {
+		return nil, err
+	}
+	if r.hostname != "" && len(candidates) > 1 {
+		return nil, fmt.Errorf("%w: label %s names one hostname, and %s: %q asks for %d tunnels; "+
+			"a requested hostname needs a single port",
+			consts.ErrUnsupported, labelHostname, labelPorts, portsAll, len(candidates))
+	}
+	out := make([]servicePort, 0, len(candidates))
+	for _, p := range candidates {
+		out = append(out, newServicePort(p))
+	}
+	return out, nil
+}
+
+// namedPort is the TCP port {provider}/port names, by its name or its number.
+// Ahead of the http/https preference, which only decides what nobody said.
+func namedPort(svc *corev1.Service, provider, value string) (servicePort, error) {
+	name, number, err := ParsePort(value)
+	if err != nil {
+		return servicePort{}, fmt.Errorf("%w: label %s/%s=%q: %v", consts.ErrUnsupported, provider, labelPort, value, err)
+	}
+	if port, ok := endpoints.ExternalPort(svc, number); ok {
+		// Listed or not, an ExternalName's port is whatever the label says;
+		// a listed one only adds its name and appProtocol.
+		for _, p := range svc.Spec.Ports {
+			if p.Port == number {
+				port = p
+			}
+		}
+		return newServicePort(port), nil
+	}
+	candidates, err := tcpPorts(svc)
+	if err != nil {
+		return servicePort{}, err
+	}
+	found := make([]string, 0, len(candidates))
+	for _, p := range candidates {
+		if (name != "" && p.Name == name) || (name == "" && p.Port == number) {
+			return newServicePort(p), nil
+		}
+		found = append(found, describePort(p))
+	}
+	return servicePort{}, fmt.Errorf("%w: label %s/%s=%q matches no TCP port; this service exposes %s",
+		consts.ErrUnsupported, provider, labelPort, value, strings.Join(found, ", "))
+}
+
+// ParsePort reads a {provider}/port value: a port number, or a port's name.
+// Exactly one of the two returns is set.
+//
+// Exported for the Pod half, which reads the same label against container
+// ports. Checked the way the API server checks the fields it will be compared
+// against, so a value that could never match says so here rather than as "no
+// such port".
+func ParsePort(value string) (string, int32, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		if errs := validation.IsValidPortNum(n); len(errs) > 0 {
+			return "", 0, fmt.Errorf("%s", strings.Join(errs, "; "))
+		}
+		return "", int32(n), nil
+	}
+	if errs := validation.IsValidPortName(value); len(errs) > 0 {
+		return "", 0, fmt.Errorf("must be a port number or a port name: %s", strings.Join(errs, "; "))
+	}
+	return value, 0, nil
+}
+
+// tcpPorts lists the ports of a Service a tunnel could front, refusing one
+// with none. See frontedPort for why only TCP.
+func tcpPorts(svc *corev1.Service) ([]corev1.ServicePort, error) {
+	var candidates []corev1.ServicePort
+	var skipped []string
+	for _, p := range svc.Spec.Ports {
+		// An empty protocol means TCP, per the API's default.
+		if p.Protocol == "" || p.Protocol == corev1.ProtocolTCP {
+			candidates = append(candidates, p)
+			continue
+		}
+		skipped = append(skipped, fmt.Sprintf("%s/%s", describePort(p), p.Protocol))
+	}
+	if len(candidates) > 0 {
+		return candidates, nil
+	}
+	if len(skipped) > 0 {
+		return nil, fmt.Errorf("%w: no TCP port to front; a tunnel carries HTTP over TCP and this service exposes only %s",
+			consts.ErrUnsupported, strings.Join(skipped, ", "))
+	}
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		// Legitimately portless: nothing proxies an ExternalName, so the port
+		// is the caller's to name.
+		return nil, fmt.Errorf("%w: ExternalName service lists no port; name the one to dial with label {provider}/%s",
+			consts.ErrUnsupported, labelPort)
+	}
+	return nil, fmt.Errorf("%w: service exposes no ports", consts.ErrUnsupported)
 }
 
 func newServicePort(p corev1.ServicePort) servicePort {
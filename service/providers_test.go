@@ -5,12 +5,15 @@ import (
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/utils/ptr"
 
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/expiry"
 )
 
 // known is the vocabulary the controller installs classes for. Written out
@@ -34,6 +37,13 @@ func loadBalancer(class string, s *corev1.Service) *corev1.Service {
 	return s
 }
 
+// externalName turns a Service into a type: ExternalName one.
+func externalName(s *corev1.Service) *corev1.Service {
+	s.Spec.Type = corev1.ServiceTypeExternalName
+	s.Spec.ExternalName = "api.example.com"
+	return s
+}
+
 func tcp(name string, port int32) corev1.ServicePort {
 	return corev1.ServicePort{Name: name, Port: port, Protocol: corev1.ProtocolTCP}
 }
@@ -70,15 +80,68 @@ func TestProviders(t *testing.T) {
 			svc:  svc(nil, tcp("one", 8080), tcp("two", 9090)),
 		},
 		{
-			name: "annotations that are not ours are ignored, including the hostname we mirror back",
+			name: "annotations that are not ours are ignored",
 			svc: svc(map[string]string{
 				"kubectl.kubernetes.io/last-applied-configuration": "{}",
 				"meta.helm.sh/release-name":                        "web",
-				"tunnel.pizza/hostname":                            "lonely-ostrich.tunneled.pizza",
 				"tunnel.pizza/tunnelled":                           "true",
 				"api.trycloudflare.com/tunnel-port":                "8080",
 			}, httpPort),
 		},
+		{
+			// Refused on the Service, which is what was labelled, rather
+			// than on a child made only to be refused.
+			name: "a requested hostname the provider cannot mint on is refused",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel":   "gateway",
+				"tunnel.pizza/hostname": "app.tunneled.pizza",
+			}, httpPort),
+			wantErr: "cannot reserve hostname app.tunneled.pizza",
+		},
+		{
+			name: "an access policy is carried to the child",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/policy": "web-policy",
+			}, httpPort),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "http", number: 80}, protocol: consts.OriginScheme, policy: "web-policy"}},
+		},
+		{
+			name:    "an access policy without a tunnel is reported rather than ignored",
+			svc:     svc(map[string]string{"tunnel.pizza/policy": "web-policy"}, httpPort),
+			wantErr: "tunnel.pizza/policy names no tunnel",
+		},
+		{
+			name: "a requested hostname that is not a DNS name is refused",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel":   "ingress",
+				"tunnel.pizza/hostname": "App_Tunneled",
+			}, httpPort),
+			wantErr: "tunnel.pizza/hostname",
+		},
+		{
+			name: "a ttl that is not a duration is refused",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/ttl":    "2d",
+			}, httpPort),
+			wantErr: `label tunnel.pizza/ttl="2d"`,
+		},
+		{
+			name: "a requested hostname for an unknown provider is refused",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel":  "ingress",
+				"example.com/hostname": "app.example.com",
+			}, httpPort),
+			wantErr: `unknown provider "example.com"`,
+		},
+		{
+			name: "a requested hostname without a tunnel is reported rather than ignored",
+			svc: svc(map[string]string{
+				"tunnel.pizza/hostname": "app.tunneled.pizza",
+			}, httpPort),
+			wantErr: "tunnel.pizza/hostname names no tunnel",
+		},
 		{
 			name: "one annotation is one tunnel, through the Ingress API by default",
 			svc:  svc(map[string]string{"tunnel.pizza/tunnel": "ingress"}, httpPort),
@@ -268,7 +331,7 @@ func TestProviders(t *testing.T) {
 				"tunnel.pizza/tunnel":   "ingress",
 				"tunnel.pizza/protocol": "grpc",
 			}, httpPort),
-			wantErr: `label tunnel.pizza/protocol="grpc": must be "http" or "https"`,
+			wantErr: `label tunnel.pizza/protocol="grpc": must be "http", "https" or "h2c"`,
 		},
 		{
 			name: "protocol is per provider",
@@ -313,9 +376,19 @@ func TestProviders(t *testing.T) {
 			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "db", number: 5432, appProtocol: "mysql"}, protocol: consts.OriginScheme}},
 		},
 		{
-			name: "kubernetes.io/h2c is a legitimate appProtocol and means plaintext here",
+			name: "kubernetes.io/h2c declares cleartext HTTP/2",
 			svc:  svc(map[string]string{"tunnel.pizza/tunnel": "ingress"}, appProto(tcp("grpc", 9090), "kubernetes.io/h2c")),
-			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "grpc", number: 9090, appProtocol: "kubernetes.io/h2c"}, protocol: consts.OriginScheme}},
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "grpc", number: 9090, appProtocol: "kubernetes.io/h2c"}, protocol: consts.OriginSchemeH2C, declared: true}},
+		},
+		{
+			name: "the protocol label can say h2c",
+			svc:  svc(map[string]string{"tunnel.pizza/tunnel": "ingress", "tunnel.pizza/protocol": "h2c"}, tcp("grpc", 9090)),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "grpc", number: 9090}, protocol: consts.OriginSchemeH2C, declared: true}},
+		},
+		{
+			name: "kubernetes.io/ws is HTTP to us, and left to the probe",
+			svc:  svc(map[string]string{"tunnel.pizza/tunnel": "ingress"}, appProto(tcp("ws", 8080), "kubernetes.io/ws")),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "ws", number: 8080, appProtocol: "kubernetes.io/ws"}, protocol: consts.OriginScheme}},
 		},
 
 		// Precedence between the two kinds of failure.
@@ -324,6 +397,145 @@ func TestProviders(t *testing.T) {
 			svc:     svc(map[string]string{"tunnel.pizza/tunnel": "maybe"}, tcp("grpc", 9090), tcp("", 5432)),
 			wantErr: `label tunnel.pizza/tunnel="maybe"`,
 		},
+		{
+			name: "ports: all fronts every TCP port, in spec order",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/ports":  "all",
+			}, tcp("web", 8080), udp("dns", 53), tcp("admin", 9090)),
+			want: []resolved{
+				{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "web", number: 8080}, protocol: consts.OriginScheme, each: true},
+				{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "admin", number: 9090}, protocol: consts.OriginScheme, each: true},
+			},
+		},
+		{
+			// The name still changes, so switching a one-port Service over
+			// replaces its child. Harmless, and the rule stays simple.
+			name: "ports: all on a single port is one tunnel",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/ports":  "all",
+			}, httpPort),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "http", number: 80}, protocol: consts.OriginScheme, each: true}},
+		},
+		{
+			name: "ports takes only all",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/ports":  "web",
+			}, tcp("web", 8080), tcp("admin", 9090)),
+			wantErr: `label tunnel.pizza/ports="web": must be "all"`,
+		},
+		{
+			name: "one requested hostname cannot name several tunnels",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel":   "ingress",
+				"tunnel.pizza/ports":    "all",
+				"tunnel.pizza/hostname": "app.tunneled.pizza",
+			}, tcp("web", 8080), tcp("admin", 9090)),
+			wantErr: "a requested hostname needs a single port",
+		},
+		{
+			name:    "ports without a tunnel is reported rather than ignored",
+			svc:     svc(map[string]string{"tunnel.pizza/ports": "all"}, tcp("web", 8080), tcp("admin", 9090)),
+			wantErr: "tunnel.pizza/ports names no tunnel",
+		},
+		{
+			name:    "ambiguous ports name the label that takes them all",
+			svc:     svc(map[string]string{"tunnel.pizza/tunnel": "ingress"}, tcp("web", 8080), tcp("admin", 9090)),
+			wantErr: `name one with label {provider}/port, or give each its own with {provider}/ports: "all"`,
+		},
+		{
+			name: "port picks one out of several by name",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "admin",
+			}, tcp("web", 8080), tcp("admin", 9090)),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "admin", number: 9090}, protocol: consts.OriginScheme}},
+		},
+		{
+			name: "port picks one by number",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "9090",
+			}, tcp("web", 8080), tcp("admin", 9090)),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "admin", number: 9090}, protocol: consts.OriginScheme}},
+		},
+		{
+			// Said is said: the preference only decides what nobody did.
+			name: "port beats the http name",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "metrics",
+			}, tcp("http", 8080), tcp("metrics", 9090)),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "metrics", number: 9090}, protocol: consts.OriginScheme}},
+		},
+		{
+			name: "a port nothing exposes is refused, naming what is",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "grpc",
+			}, tcp("web", 8080), tcp("admin", 9090)),
+			wantErr: `label tunnel.pizza/port="grpc" matches no TCP port; this service exposes web:8080, admin:9090`,
+		},
+		{
+			// Nothing proxies an ExternalName, so its port list is the
+			// author's notes, and the label is where the port comes from.
+			name: "an ExternalName takes its port from the label",
+			svc: externalName(svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "8443",
+			})),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{number: 8443}, protocol: consts.OriginScheme}},
+		},
+		{
+			name: "a listed ExternalName port lends its name and appProtocol",
+			svc: externalName(svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "443",
+			}, appProto(tcp("https", 443), "https"))),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "https", number: 443, appProtocol: "https"}, protocol: consts.OriginSchemeTLS, declared: true}},
+		},
+		{
+			name: "an ExternalName listing its one port needs no label",
+			svc:  externalName(svc(map[string]string{"tunnel.pizza/tunnel": "ingress"}, httpPort)),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "http", number: 80}, protocol: consts.OriginScheme}},
+		},
+		{
+			name:    "an ExternalName with no port says where to name one",
+			svc:     externalName(svc(map[string]string{"tunnel.pizza/tunnel": "ingress"})),
+			wantErr: "ExternalName service lists no port; name the one to dial with label {provider}/port",
+		},
+		{
+			name: "a UDP port cannot be named",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "dns",
+			}, tcp("web", 8080), udp("dns", 53)),
+			wantErr: `label tunnel.pizza/port="dns" matches no TCP port`,
+		},
+		{
+			name: "a port number out of range is refused",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "70000",
+			}, httpPort),
+			wantErr: `label tunnel.pizza/port="70000"`,
+		},
+		{
+			name: "port and ports: all disagree",
+			svc: svc(map[string]string{
+				"tunnel.pizza/tunnel": "ingress",
+				"tunnel.pizza/port":   "web",
+				"tunnel.pizza/ports":  "all",
+			}, tcp("web", 8080), tcp("admin", 9090)),
+			wantErr: "disagree",
+		},
+		{
+			name:    "port without a tunnel is reported rather than ignored",
+			svc:     svc(map[string]string{"tunnel.pizza/port": "web"}, tcp("web", 8080)),
+			wantErr: "tunnel.pizza/port names no tunnel",
+		},
 		{
 			name:    "ambiguous ports are not reported for a service that asked for nothing",
 			svc:     svc(map[string]string{"tunnel.pizza/tunnel": "none"}, tcp("grpc", 9090), tcp("", 5432)),
@@ -333,7 +545,7 @@ func TestProviders(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got, err := providers(tc.svc, known)
+			got, err := providers(tc.svc, nil, known)
 
 			if tc.wantErr == "" {
 				if err != nil {
@@ -364,6 +576,140 @@ func TestProviders(t *testing.T) {
 	}
 }
 
+// TestProvidersNamespaceDefault: a Namespace's tunnel label stands in for a
+// Service's own, which wins whenever it is there — none included.
+func TestProvidersNamespaceDefault(t *testing.T) {
+	preview := map[string]string{"tunnel.pizza/tunnel": "true"}
+	inherited := resolved{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "http", number: 80},
+		protocol: consts.OriginScheme, inherited: true}
+
+	tests := []struct {
+		name      string
+		namespace map[string]string
+		svc       *corev1.Service
+		want      []resolved
+		wantErr   string
+	}{
+		{
+			name:      "a Service with no label of its own inherits",
+			namespace: preview,
+			svc:       svc(nil, httpPort),
+			want:      []resolved{inherited},
+		},
+		{
+			name:      "the Namespace can ask for the Gateway branch",
+			namespace: map[string]string{"tunnel.pizza/tunnel": "gateway"},
+			svc:       svc(nil, httpPort),
+			want: []resolved{{provider: "tunnel.pizza", api: apiGateway, port: servicePort{name: "http", number: 80},
+				protocol: consts.OriginScheme, inherited: true}},
+		},
+		{
+			name:      "none on the Service opts it out",
+			namespace: preview,
+			svc:       svc(map[string]string{"tunnel.pizza/tunnel": "none"}, httpPort),
+		},
+		{
+			name:      "the Service's own value wins",
+			namespace: preview,
+			svc:       svc(map[string]string{"tunnel.pizza/tunnel": "gateway"}, httpPort),
+			want:      []resolved{{provider: "tunnel.pizza", api: apiGateway, port: servicePort{name: "http", number: 80}, protocol: consts.OriginScheme}},
+		},
+		{
+			name:      "none on the Namespace is no default",
+			namespace: map[string]string{"tunnel.pizza/tunnel": "none"},
+			svc:       svc(nil, httpPort),
+		},
+		{
+			// A database beside the app, in every preview namespace.
+			name:      "a Service whose port the default cannot settle is skipped, not refused",
+			namespace: preview,
+			svc:       svc(nil, tcp("postgres", 5432), tcp("metrics", 9187)),
+		},
+		{
+			name:      "so is one with no TCP port at all",
+			namespace: preview,
+			svc:       svc(nil, udp("dns", 53)),
+		},
+		{
+			name:      "a port label needs no tunnel label of its own beside the default",
+			namespace: preview,
+			svc:       svc(map[string]string{"tunnel.pizza/port": "admin"}, tcp("web", 8080), tcp("admin", 9090)),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "admin", number: 9090},
+				protocol: consts.OriginScheme, inherited: true}},
+		},
+		{
+			// The Service said something, so it hears back.
+			name:      "a port label that matches nothing is still reported",
+			namespace: preview,
+			svc:       svc(map[string]string{"tunnel.pizza/port": "grpc"}, tcp("web", 8080), tcp("admin", 9090)),
+			wantErr:   `label tunnel.pizza/port="grpc" matches no TCP port`,
+		},
+		{
+			// Reported on the Namespace by the caller; see defaults.
+			name:      "a Namespace value that does not parse is no default",
+			namespace: map[string]string{"tunnel.pizza/tunnel": "True"},
+			svc:       svc(nil, httpPort),
+		},
+		{
+			// Labelling default is not asking to publish the API server.
+			name:      "default/kubernetes never inherits",
+			namespace: preview,
+			svc: func() *corev1.Service {
+				s := svc(nil, tcp("https", 443))
+				s.Name = "kubernetes"
+				return s
+			}(),
+		},
+		{
+			name:      "nor does a Service another object controls",
+			namespace: preview,
+			svc: func() *corev1.Service {
+				s := svc(nil, httpPort)
+				s.OwnerReferences = []metav1.OwnerReference{{
+					APIVersion: "serving.knative.dev/v1", Kind: "Revision", Name: "web-00001", UID: "1", Controller: ptr.To(true),
+				}}
+				return s
+			}(),
+		},
+		{
+			name:      "which still honours a label of its own",
+			namespace: preview,
+			svc: func() *corev1.Service {
+				s := svc(map[string]string{"tunnel.pizza/tunnel": "true"}, httpPort)
+				s.OwnerReferences = []metav1.OwnerReference{{
+					APIVersion: "serving.knative.dev/v1", Kind: "Revision", Name: "web-00001", UID: "1", Controller: ptr.To(true),
+				}}
+				return s
+			}(),
+			want: []resolved{{provider: "tunnel.pizza", api: apiIngress, port: servicePort{name: "http", number: 80}, protocol: consts.OriginScheme}},
+		},
+		{
+			name:      "the class path is not inherited, and keeps its own port errors",
+			namespace: preview,
+			svc:       loadBalancer("api.trycloudflare.com", svc(nil, tcp("one", 8080), tcp("two", 9090))),
+			wantErr:   "2 TCP ports",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := providers(tc.svc, tc.namespace, known)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("providers() = %v, %v; want error containing %q", got, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("providers() error = %v", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("providers() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
 // TestProvidersOrderIsStable pins the order against Go's randomised map
 // iteration. The table above would only flake if the sort were dropped; this
 // fails.
@@ -382,7 +728,7 @@ func TestProvidersOrderIsStable(t *testing.T) {
 	}
 
 	for i := range 100 {
-		got, err := providers(s, known)
+		got, err := providers(s, nil, known)
 		if err != nil {
 			t.Fatalf("iteration %d: unexpected error: %v", i, err)
 		}
@@ -403,7 +749,7 @@ func TestProvidersReportsTheSameErrorEveryTime(t *testing.T) {
 
 	const want = `label tunnel.pizza/tunnel="nope": must be "true", "ingress", "gateway" or "none"`
 	for i := range 100 {
-		_, err := providers(s, known)
+		_, err := providers(s, nil, known)
 		if err == nil {
 			t.Fatalf("iteration %d: want an error", i)
 		}
@@ -422,7 +768,7 @@ func TestProvidersDoesNotMutateTheService(t *testing.T) {
 	}, tcp("grpc", 9090), tcp("http", 80)))
 	before := s.DeepCopy()
 
-	if _, err := providers(s, known); err != nil {
+	if _, err := providers(s, nil, known); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
@@ -459,11 +805,11 @@ func TestKnownProvidersAreTheInstalledOnes(t *testing.T) {
 // guesses works, which it only does if it takes exactly the same path. A suite
 // that only ever exercised "ingress" would not notice the two diverging.
 func TestTrueIsAGenuineAliasForIngress(t *testing.T) {
-	fromTrue, err := providers(svc(map[string]string{"tunnel.pizza/tunnel": "true"}, httpPort), known)
+	fromTrue, err := providers(svc(map[string]string{"tunnel.pizza/tunnel": "true"}, httpPort), nil, known)
 	if err != nil {
 		t.Fatalf("true: %v", err)
 	}
-	fromIngress, err := providers(svc(map[string]string{"tunnel.pizza/tunnel": "ingress"}, httpPort), known)
+	fromIngress, err := providers(svc(map[string]string{"tunnel.pizza/tunnel": "ingress"}, httpPort), nil, known)
 	if err != nil {
 		t.Fatalf("ingress: %v", err)
 	}
@@ -484,7 +830,8 @@ func TestTrueIsAGenuineAliasForIngress(t *testing.T) {
 func TestWrittenValuesAreValidLabels(t *testing.T) {
 	written := []string{
 		string(apiIngress), string(apiGateway), tunnelNone, tunnelTrue, tunnelFalse,
-		consts.OriginScheme, consts.OriginSchemeTLS, consts.ManagedBy,
+		consts.OriginScheme, consts.OriginSchemeTLS, consts.OriginSchemeH2C, consts.ManagedBy,
+		expiry.Value(time.Now()),
 	}
 	for _, value := range written {
 		if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
@@ -494,7 +841,8 @@ func TestWrittenValuesAreValidLabels(t *testing.T) {
 
 	keys := []string{consts.TunnelLabel, consts.LabelManagedBy,
 		consts.ProviderTunnelPizza + "/" + consts.ProtocolLabel,
-		consts.ProviderCloudflare + "/" + consts.ProtocolLabel}
+		consts.ProviderCloudflare + "/" + consts.ProtocolLabel,
+		consts.ProviderTunnelPizza + "/" + consts.ExpiresAtLabel}
 	for _, key := range keys {
 		if errs := validation.IsQualifiedName(key); len(errs) != 0 {
 			t.Errorf("key %q is used as a label key but is not qualified: %v", key, errs)
@@ -538,7 +886,7 @@ func TestProtocolPrecedence(t *testing.T) {
 				port = appProto(port, tc.appProtocol)
 			}
 
-			got, err := providers(svc(labels, port), known)
+			got, err := providers(svc(labels, port), nil, known)
 			if err != nil {
 				t.Fatalf("providers() error = %v", err)
 			}
@@ -12,16 +12,23 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/events"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 
 	"github.com/scaffoldly/tunnel/config"
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/expiry"
 	"github.com/scaffoldly/tunnel/gateway"
+	"github.com/scaffoldly/tunnel/optin"
 )
 
 // ControllerName is this package's import path, read from the type system for
@@ -50,7 +57,9 @@ type Reconciler struct {
 	// full Service through the cached client would start a second, structured
 	// informer over every Service in the cluster — exactly the cost the
 	// metadata watch exists to avoid, and controller-runtime warns that the
-	// two caches then race.
+	// two caches then race. Also where a hostname mirror the label-selected
+	// ConfigMap cache has not seen is looked for before one is written: see
+	// mirror.
 	Services client.Reader
 	Recorder events.EventRecorder
 	// GatewayAPI is whether this cluster serves the Gateway API. False makes
@@ -58,18 +67,28 @@ type Reconciler struct {
 	// will ever reconcile: the Gateway controllers do not register on such a
 	// cluster either.
 	GatewayAPI bool
-	// Probe reports how an origin speaks when the Service did not say. Best
-	// effort and injectable: the production one opens a socket, which no unit
-	// test should.
-	Probe Prober
+	// Origins reports how an origin speaks when the Service did not say, from
+	// what has already been probed. Never the dial itself: that happens in
+	// Probes, off this path, and an answer arriving wakes the Service through
+	// the controller's channel source. Injectable so no unit test opens a
+	// socket.
+	Origins Origins
 	// Providers is the vocabulary a trigger may name. Injected rather than
 	// read from consts here so the resolution stays testable against a fixed
 	// set, and so widening it later is a change at one call site.
 	Providers []string
+	// Namespaces decides which namespaces may have tunnels at all.
+	Namespaces *optin.Gate
+	// Defaults reads a Namespace's metadata for its consts.TunnelLabel, the
+	// default for every Service in it that has none of its own. The manager's
+	// cached client, like Namespaces. Nil where a Namespace cannot be read —
+	// a scoped install, whose Role grants none — which turns the default
+	// off.
+	Defaults client.Reader
 }
 
 // New registers the Service controller with mgr.
-func New(mgr ctrl.Manager, _ config.Config) error {
+func New(mgr ctrl.Manager, cfg config.Config) error {
 	// The same probe the Gateway half runs, and after it: registration order in
 	// main.go puts gateway first, so --install-gateway-api has already
 	// installed the CRDs and waited for them to be established by the time this
@@ -80,13 +99,24 @@ func New(mgr ctrl.Manager, _ config.Config) error {
 		return fmt.Errorf("detect gateway api: %w", err)
 	}
 
+	// A Runnable of the manager's, so the workers start with it and stop with
+	// it.
+	probes := NewProbes(Probe)
+	if err := mgr.Add(probes); err != nil {
+		return fmt.Errorf("add origin prober: %w", err)
+	}
+
 	r := &Reconciler{
 		Client:     mgr.GetClient(),
 		Services:   mgr.GetAPIReader(),
 		Recorder:   mgr.GetEventRecorder(ReporterName),
 		GatewayAPI: gatewayAPI,
-		Probe:      Probe,
+		Origins:    probes,
 		Providers:  consts.InstalledProviders,
+		Namespaces: &optin.Gate{Reader: mgr.GetClient(), Required: cfg.NamespaceOptIn},
+	}
+	if !cfg.Scoped() {
+		r.Defaults = mgr.GetClient()
 	}
 
 	builder := ctrl.NewControllerManagedBy(mgr).
@@ -106,7 +136,29 @@ func New(mgr ctrl.Manager, _ config.Config) error {
 		Watches(&networkingv1.Ingress{},
 			handler.EnqueueRequestForOwner(mgr.GetScheme(), mgr.GetRESTMapper(), &corev1.Service{},
 				handler.OnlyControllerOwner())).
+		// The mirror, so one deleted or edited by hand is put back. Only
+		// ConfigMaps labelled as ours are cached; see cacheOptions in main.go.
+		Watches(&corev1.ConfigMap{},
+			handler.EnqueueRequestForOwner(mgr.GetScheme(), mgr.GetRESTMapper(), &corev1.Service{},
+				handler.OnlyControllerOwner())).
+		// A probe answering is not an event on any object, so the prober
+		// says so itself, naming the Services that asked.
+		WatchesRawSource(source.Channel(probes.Source(), &handler.EnqueueRequestForObject{})).
 		Named(consts.ControllerService)
+	// Listed from the metadata cache the watch above already fills.
+	services := func() client.ObjectList {
+		list := &metav1.PartialObjectMetadataList{}
+		list.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ServiceList"))
+		return list
+	}
+	builder = r.Namespaces.Watch(builder, services)
+	if r.Defaults != nil {
+		// Labelling a Namespace is the whole of asking for its Services'
+		// tunnels, and removing the label the whole of giving them back, so
+		// nothing else would bring them here.
+		builder = optin.Follow(builder, mgr.GetClient(), consts.TunnelLabel, services).
+			WatchesMetadata(&corev1.Namespace{}, r.misread())
+	}
 
 	if gatewayAPI {
 		// Behind the capability check for the same reason every other Gateway
@@ -158,15 +210,28 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 		return ctrl.Result{}, nil
 	}
 
-	wanted, err := providers(&svc, r.Providers)
+	namespace, err := r.defaults(ctx, svc.Namespace)
 	if err != nil {
-		// Unsupported by construction — providers reads one object and reaches
-		// nothing else, so there is no version of this that succeeds on retry.
-		//
-		// The children go with it. A Service whose triggers no longer resolve
-		// is not asking for the tunnels it used to, and leaving a child
-		// running would publish a hostname that nothing on the Service asks
-		// for any more. The event says why.
+		return ctrl.Result{}, err
+	}
+	wanted, err := providers(&svc, namespace, r.Providers)
+	if err == nil && len(wanted) > 0 {
+		// Only a Service that asks: every Service in the cluster arrives
+		// here, and one asking for nothing has nothing to refuse.
+		err = r.Namespaces.Admit(ctx, svc.Namespace)
+	}
+	if err != nil {
+		// Only a failed namespace read is worth a retry. providers reads one
+		// object and reaches nothing else, so everything it returns is
+		// unsupported by construction, and so is a namespace that has not
+		// opted in — labelling it is an event the namespace watch delivers.
+		if !errors.Is(err, consts.ErrUnsupported) {
+			return ctrl.Result{}, err
+		}
+		// The children go with it. A Service whose triggers no longer
+		// resolve, or that may not have a tunnel here, is not getting the ones
+		// it used to, and leaving a child running would publish a hostname
+		// nothing should. The event says why.
 		logger.Info("service not serviceable", "reason", err)
 		if err := r.prune(ctx, &svc, nil); err != nil {
 			return ctrl.Result{}, err
@@ -188,34 +253,42 @@ func (r *Reconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resu
 	// Service is left exactly as the user wrote it — no status, no
 	// annotations — which is both the decision and the only thing the API
 	// server would accept: a status.loadBalancer write on a Service that is
-	// not type LoadBalancer is rejected outright.
+	// not type LoadBalancer is rejected outright. Its hostnames are in the
+	// mirror ConfigMap instead; see mirror.
 	provider, ok := statusProvider(&svc, r.Providers)
 	if !ok {
 		return ctrl.Result{RequeueAfter: retry}, nil
 	}
-	changed, err := r.publish(ctx, &svc, hostnames[provider])
+	changed, err := r.publish(ctx, &svc, hostnames[provider]...)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
-	if changed && hostnames[provider] != "" {
+	if changed && len(hostnames[provider]) > 0 {
 		logger.Info("published tunnel hostname to service status",
-			"provider", provider, "hostname", hostnames[provider])
+			"provider", provider, "hostnames", hostnames[provider])
 	}
 	return ctrl.Result{RequeueAfter: retry}, nil
 }
 
-// reconcileChildren ensures one child per wanted provider, removes the rest,
-// and reports the hostname each child currently publishes.
+// reconcileChildren ensures one child per wanted tunnel, removes the rest,
+// and reports the hostnames each provider's children currently publish, in
+// the order wanted lists them.
 //
 // The second return is how long to wait before trying again, and is non-zero
 // only when an origin could not be reached to determine how it speaks. Nothing
 // else would bring us back: a backend becoming ready is not an event on the
 // Service or on its child.
-func (r *Reconciler) reconcileChildren(ctx context.Context, svc *corev1.Service, wanted []resolved) (map[string]string, time.Duration, error) {
+func (r *Reconciler) reconcileChildren(ctx context.Context, svc *corev1.Service, wanted []resolved) (map[string][]string, time.Duration, error) {
 	logger := log.FromContext(ctx)
-	hostnames := make(map[string]string, len(wanted))
+	hostnames := make(map[string][]string, len(wanted))
 	keep := make(map[childKey]struct{}, len(wanted))
 	var retry time.Duration
+	// next is the soonest deadline among the tunnels still served.
+	var next time.Time
+	announced, err := r.published(ctx, svc)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	for _, want := range wanted {
 		if want.api == apiGateway && !r.GatewayAPI {
@@ -232,12 +305,63 @@ func (r *Reconciler) reconcileChildren(ctx context.Context, svc *corev1.Service,
 			continue
 		}
 
+		if expiry.Elapsed(want.expires) {
+			// Not kept, so the prune below takes its children, and no
+			// hostname, so the status goes too. Said when there are children
+			// to take: the Service stays as it is after its deadline, and
+			// every pass after the first finds nothing left to retire.
+			expired, err := r.hold(ctx, svc, children(svc, want))
+			if err != nil {
+				return nil, 0, err
+			}
+			expiry.Retired(ctx, r.Recorder, svc, want.provider, want.expires, len(expired) > 0)
+			continue
+		}
+		if !want.expires.IsZero() && (next.IsZero() || want.expires.Before(next)) {
+			next = want.expires
+		}
+
 		// Only when the Service did not say. An explicit annotation or
 		// appProtocol is a statement of intent, and probing past it would let
 		// a momentarily-wrong backend override its own author.
 		if !want.declared {
-			address := originAddress(svc.Namespace, svc.Name, want.port.number)
-			switch scheme, err := r.Probe(ctx, address); {
+			address, err := r.originAddress(ctx, svc, want.port)
+			if errors.Is(err, consts.ErrUnsupported) {
+				// Nowhere to dial, so no child: it would be refused for the
+				// same reason, and the Service is what the user can fix.
+				r.unsupported(ctx, svc, want, err)
+				continue
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			origin, ok := r.Origins.Lookup(address, client.ObjectKeyFromObject(svc))
+			if !ok {
+				// Asked, not answered. Whatever is already serving stays as it
+				// is, and the answer brings this Service back.
+				logger.Info("probing origin protocol", "address", address)
+				held, err := r.hold(ctx, svc, children(svc, want))
+				if err != nil {
+					return nil, 0, err
+				}
+				for _, live := range held {
+					keep[keyOf(live)] = struct{}{}
+				}
+				if len(held) > 0 {
+					if hostname := hostnameOf(held[0]); hostname != "" {
+						hostnames[want.provider] = append(hostnames[want.provider], hostname)
+					}
+				}
+				continue
+			}
+			switch scheme, err := origin.Scheme, origin.Err; {
+			case errors.Is(err, consts.ErrUnsupported):
+				// Not kept, so the prune takes any child an earlier answer
+				// built: a tunnel to Redis fails every request it carries.
+				// Not retried either — this is an answer, and Probes asks
+				// again once it expires.
+				r.unsupported(ctx, svc, want, err)
+				continue
 			case err != nil:
 				logger.Info("could not determine origin protocol", "address", address, "error", err)
 				r.Recorder.Eventf(svc, nil, consts.EventTypeWarning, consts.ReasonProtocol,
@@ -281,18 +405,102 @@ func (r *Reconciler) reconcileChildren(ctx context.Context, svc *corev1.Service,
 			continue
 		}
 
-		hostnames[want.provider] = hostnameOf(primary)
-
-		if hostnames[want.provider] != "" {
+		if hostname := hostnameOf(primary); hostname != "" {
+			hostnames[want.provider] = append(hostnames[want.provider], hostname)
+			// Once per hostname, when it first appears or changes: the mirror
+			// holds what an earlier pass said. Every pass finds the child, and
+			// a deadline restated each time is noise that buries the one
+			// event that matters.
+			if slices.Contains(announced[want.provider], hostname) {
+				continue
+			}
 			r.Recorder.Eventf(svc, nil, consts.EventTypeNormal, consts.ReasonTunnelReady,
-				consts.ActionProvision, consts.MsgTunnelReadyFmt, hostnames[want.provider], want.provider)
+				consts.ActionProvision, consts.MsgTunnelReadyFmt, hostname, want.provider)
+			expiry.Announce(ctx, r.Recorder, svc, want.expires)
 		}
 	}
 
+	mirrored, err := r.mirror(ctx, svc, hostnames)
+	if err != nil {
+		return nil, 0, err
+	}
+	if mirrored != nil {
+		keep[keyOf(mirrored)] = struct{}{}
+	}
+
 	if err := r.prune(ctx, svc, keep); err != nil {
 		return nil, 0, err
 	}
-	return hostnames, retry, nil
+	// Back by the deadline to prune, whatever the child's half does first.
+	return hostnames, expiry.Sooner(retry, next), nil
+}
+
+// unsupported reports why want gets no tunnel: an event on svc, unless the
+// tunnel was only inherited from its Namespace. A preview namespace holds a
+// database beside every app, and the Service that never asked hears nothing;
+// the log still says.
+func (r *Reconciler) unsupported(ctx context.Context, svc *corev1.Service, want resolved, err error) {
+	log.FromContext(ctx).Info("origin cannot be tunnelled", "port", want.port.number, "inherited", want.inherited, "error", err)
+	if want.inherited {
+		return
+	}
+	r.Recorder.Eventf(svc, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
+		consts.ActionProvision, consts.MsgUnsupportedFmt, err)
+}
+
+// defaults returns the labels of namespace that providers reads the
+// namespace-wide tunnel label from, or nil where there is none to apply.
+//
+// A value there that does not parse is refused for the whole Namespace. Only
+// read here: misread says so on the Namespace, once, rather than on every
+// reconcile of every Service in it.
+func (r *Reconciler) defaults(ctx context.Context, namespace string) (map[string]string, error) {
+	if r.Defaults == nil {
+		return nil, nil
+	}
+	ns := &metav1.PartialObjectMetadata{}
+	ns.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Namespace"))
+	if err := r.Defaults.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		if apierrors.IsNotFound(err) {
+			// Going, and its Services with it.
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get namespace %s: %w", namespace, err)
+	}
+	if _, err := Requested(ns.Labels); err != nil {
+		return nil, nil
+	}
+	return ns.Labels, nil
+}
+
+// misread reports a namespace-wide tunnel label that does not parse, on the
+// Namespace: none of its Services asked for anything, and a warning on each
+// would repeat one mistake once per Service. Said when the cache first sees
+// the Namespace and again only when the label changes, which is when there is
+// something new to say. It enqueues nothing; optin.Follow brings the Services.
+func (r *Reconciler) misread() handler.EventHandler {
+	report := func(obj client.Object) {
+		_, err := Requested(obj.GetLabels())
+		if err == nil {
+			return
+		}
+		// The watch's copy need not carry its kind, and the event's
+		// reference is built from it.
+		ns := &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: obj.GetName(), UID: obj.GetUID()}}
+		ns.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Namespace"))
+		r.Recorder.Eventf(ns, nil, consts.EventTypeWarning, consts.ReasonUnsupported,
+			consts.ActionProvision, consts.MsgUnsupportedFmt, err)
+	}
+	return handler.Funcs{
+		CreateFunc: func(_ context.Context, e event.CreateEvent, _ workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			report(e.Object)
+		},
+		UpdateFunc: func(_ context.Context, e event.UpdateEvent, _ workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			if e.ObjectOld.GetLabels()[consts.TunnelLabel] != e.ObjectNew.GetLabels()[consts.TunnelLabel] {
+				report(e.ObjectNew)
+			}
+		},
+	}
 }
 
 // statusProvider reports which provider's hostname belongs in this Service's
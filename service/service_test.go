@@ -3,10 +3,15 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/meta"
@@ -20,9 +25,11 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 
 	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/optin"
 )
 
 var testKey = types.NamespacedName{Namespace: "default", Name: "web"}
@@ -65,10 +72,28 @@ func reconcilerWithProbe(t *testing.T, probe Prober, objs ...client.Object) (*Re
 		// CRDs are nearly always there. The Ingress-only case has its own
 		// constructor above.
 		GatewayAPI: true,
-		Probe:      probe, Providers: known,
+		Origins:    answered(probe), Providers: known,
 	}, c, recorder
 }
 
+// answered is an Origins that probes on the spot and always has an answer:
+// the cache and its wake-up are Probes' concern and tested there, so the
+// reconcile tests see only what the probe said.
+type answered Prober
+
+func (a answered) Lookup(address string, _ types.NamespacedName) (Origin, bool) {
+	scheme, err := a(context.Background(), address)
+	return Origin{Scheme: scheme, Err: err}, true
+}
+
+// pending is an Origins still waiting on every probe.
+type pending struct{ asked []types.NamespacedName }
+
+func (p *pending) Lookup(_ string, key types.NamespacedName) (Origin, bool) {
+	p.asked = append(p.asked, key)
+	return Origin{}, false
+}
+
 // annotated is a ClusterIP Service asking for a tunnel the ordinary way.
 func annotated(labels map[string]string, ports ...corev1.ServicePort) *corev1.Service {
 	if ports == nil {
@@ -631,13 +656,13 @@ func TestReconcileAnnotationBeatsLoadBalancerClassOnAPI(t *testing.T) {
 // opportunity to rewrite on every pass, and a rewritten child re-mints its
 // tunnel through the Gateway half.
 func TestReconcileGatewayBranchIsIdempotent(t *testing.T) {
-	r, c, _ := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "gateway"}))
+	r, c, recorder := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "gateway"}))
 
 	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
 		t.Fatalf("Reconcile() error = %v", err)
 	}
-	gwVersion := getGateway(t, c, "web-tunnel-pizza").ResourceVersion
-	routeVersion := getRoute(t, c, "web-tunnel-pizza").ResourceVersion
+	gw := settled(getGateway(t, c, "web-tunnel-pizza"))
+	route := settled(getRoute(t, c, "web-tunnel-pizza"))
 
 	for range 3 {
 		if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
@@ -645,12 +670,13 @@ func TestReconcileGatewayBranchIsIdempotent(t *testing.T) {
 		}
 	}
 
-	if got := getGateway(t, c, "web-tunnel-pizza").ResourceVersion; got != gwVersion {
-		t.Errorf("gateway was rewritten: %s -> %s", gwVersion, got)
+	if got := settled(getGateway(t, c, "web-tunnel-pizza")); !apiequality.Semantic.DeepEqual(got, gw) {
+		t.Errorf("gateway was rewritten:\n%+v\nthen\n%+v", gw, got)
 	}
-	if got := getRoute(t, c, "web-tunnel-pizza").ResourceVersion; got != routeVersion {
-		t.Errorf("httproute was rewritten: %s -> %s", routeVersion, got)
+	if got := settled(getRoute(t, c, "web-tunnel-pizza")); !apiequality.Semantic.DeepEqual(got, route) {
+		t.Errorf("httproute was rewritten:\n%+v\nthen\n%+v", route, got)
 	}
+	assertNoEvent(t, recorder, consts.ReasonFieldConflict)
 }
 
 // TestReconcileConvergesAfterAPartialFailure: the Gateway lands, the route does
@@ -698,12 +724,12 @@ func TestReconcileEmitsTunnelReady(t *testing.T) {
 // update-on-every-reconcile would churn the child and, through the Ingress
 // half, re-mint its tunnel.
 func TestReconcileIsIdempotent(t *testing.T) {
-	r, c, _ := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"}))
+	r, c, recorder := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"}))
 
 	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
 		t.Fatalf("Reconcile() error = %v", err)
 	}
-	first := getIngress(t, c, "web-tunnel-pizza").ResourceVersion
+	first := settled(getIngress(t, c, "web-tunnel-pizza"))
 
 	for range 3 {
 		if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
@@ -711,9 +737,23 @@ func TestReconcileIsIdempotent(t *testing.T) {
 		}
 	}
 
-	if got := getIngress(t, c, "web-tunnel-pizza").ResourceVersion; got != first {
-		t.Errorf("child was rewritten: resourceVersion %s -> %s", first, got)
+	if got := settled(getIngress(t, c, "web-tunnel-pizza")); !apiequality.Semantic.DeepEqual(got, first) {
+		t.Errorf("child was rewritten:\n%+v\nthen\n%+v", first, got)
 	}
+	// Its own fields, every pass: a conflict here would be the controller
+	// fighting itself.
+	assertNoEvent(t, recorder, consts.ReasonFieldConflict)
+}
+
+// settled is obj without what every write stamps on it. The fake client bumps
+// resourceVersion on every apply, one that changes nothing included, where an
+// API server leaves a no-op apply alone; everything else is what a second pass
+// must not change.
+func settled[T client.Object](obj T) T {
+	out := obj.DeepCopyObject().(T)
+	out.SetResourceVersion("")
+	out.SetManagedFields(nil)
+	return out
 }
 
 // TestReconcileFollowsThePort: the child must point at the port selection
@@ -894,6 +934,229 @@ func TestReconcileWarnsWhenTheOriginCannotBeReached(t *testing.T) {
 	assertEvent(t, recorder, consts.ReasonProtocol)
 }
 
+// TestReconcileRefusesAnOriginThatIsNotHTTP: a Service fronting Redis asked
+// for a tunnel that would fail every request. It gets none — and loses one an
+// earlier answer built — with the reason on the Service, and is not polled:
+// the probe's answer stands until it expires.
+func TestReconcileRefusesAnOriginThatIsNotHTTP(t *testing.T) {
+	svc := annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"})
+	built := ingressChildFor(svc, resolved{
+		provider: "tunnel.pizza", api: apiIngress,
+		port: servicePort{name: "http", number: 8080}, protocol: consts.OriginScheme,
+	})
+	r, c, recorder := reconcilerWithProbe(t, func(_ context.Context, address string) (string, error) {
+		return "", fmt.Errorf("%w: origin at %s does not speak HTTP", consts.ErrUnsupported, address)
+	}, svc, built)
+
+	result, err := r.Reconcile(context.Background(), reconcileRequest())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none in front of an origin that is not HTTP", names)
+	}
+	if result.RequeueAfter != 0 {
+		t.Errorf("RequeueAfter = %v, want none: this is an answer, not a failure to get one", result.RequeueAfter)
+	}
+	assertEvent(t, recorder, consts.ReasonUnsupported)
+}
+
+// TestReconcileProbesWhereTheTunnelWillDial: an ExternalName on its external
+// name and the label's port, a headless Service on a ready endpoint — the
+// places the child's half will send traffic, not a cluster DNS name that maps
+// no port.
+func TestReconcileProbesWhereTheTunnelWillDial(t *testing.T) {
+	external := annotated(map[string]string{"tunnel.pizza/tunnel": "ingress", "tunnel.pizza/port": "8443"})
+	external.Spec.Type = corev1.ServiceTypeExternalName
+	external.Spec.ExternalName = "api.example.com"
+	external.Spec.Ports = nil
+
+	headless := annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"},
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	headless.Spec.ClusterIP = corev1.ClusterIPNone
+	headless.Spec.Selector = map[string]string{"app": "web"}
+	port, number := "http", int32(8080)
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testKey.Namespace, Name: "web-a",
+			Labels: map[string]string{discoveryv1.LabelServiceName: testKey.Name},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Name: &port, Port: &number}},
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.7"}}},
+	}
+
+	for _, tc := range []struct {
+		name string
+		objs []client.Object
+		want string
+	}{
+		{"an ExternalName", []client.Object{external}, "api.example.com:8443"},
+		{"a headless Service", []client.Object{headless, slice}, "10.0.0.7:8080"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var dialed []string
+			r, c, _ := reconcilerWithProbe(t, func(_ context.Context, address string) (string, error) {
+				dialed = append(dialed, address)
+				return consts.OriginScheme, nil
+			}, tc.objs...)
+
+			if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+				t.Fatalf("Reconcile() error = %v", err)
+			}
+			if !slices.Equal(dialed, []string{tc.want}) {
+				t.Errorf("probed %v, want %s", dialed, tc.want)
+			}
+			if names := ingressNames(t, c); len(names) != 1 {
+				t.Errorf("ingresses = %v, want the one child", names)
+			}
+		})
+	}
+}
+
+// TestReconcileRefusesAHeadlessServiceWithNothingToDial: no selector and no
+// slices means no endpoint will ever appear unless someone writes one, so
+// there is no child, and the Service says why.
+func TestReconcileRefusesAHeadlessServiceWithNothingToDial(t *testing.T) {
+	svc := annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"})
+	svc.Spec.ClusterIP = corev1.ClusterIPNone
+	r, c, recorder := reconciler(t, svc)
+
+	result, err := r.Reconcile(context.Background(), reconcileRequest())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none", names)
+	}
+	if result.RequeueAfter != 0 {
+		t.Errorf("RequeueAfter = %v, want none: editing the Service is the fix", result.RequeueAfter)
+	}
+	assertEvent(t, recorder, consts.ReasonUnsupported)
+}
+
+// preview is a Namespace whose labels are the default for its Services.
+func preview(labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testKey.Namespace, Labels: labels}}
+}
+
+// TestReconcileFollowsTheNamespaceLabel: labelling the Namespace is the whole
+// of asking, and unlabelling it the whole of giving the tunnel back.
+func TestReconcileFollowsTheNamespaceLabel(t *testing.T) {
+	ns := preview(map[string]string{"tunnel.pizza/tunnel": "true"})
+	r, c, _ := reconciler(t, annotated(nil), ns)
+	r.Defaults = c
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); !slices.Equal(names, []string{"web-tunnel-pizza"}) {
+		t.Fatalf("ingresses = %v, want the inherited child", names)
+	}
+
+	ns.Labels = nil
+	if err := c.Update(context.Background(), ns); err != nil {
+		t.Fatalf("unlabel namespace: %v", err)
+	}
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none once the namespace stops asking", names)
+	}
+}
+
+// TestReconcileIgnoresTheNamespaceLabelWhenScoped: a scoped install cannot
+// read a Namespace, so it has no default to apply.
+func TestReconcileIgnoresTheNamespaceLabelWhenScoped(t *testing.T) {
+	r, c, _ := reconciler(t, annotated(nil), preview(map[string]string{"tunnel.pizza/tunnel": "true"}))
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none without Defaults", names)
+	}
+}
+
+// TestReconcileKeepsQuietAboutInheritedOrigins: the database in a preview
+// namespace never asked for a tunnel, so finding that it speaks no HTTP is not
+// a warning on it. The same Service asking for itself hears about it.
+func TestReconcileKeepsQuietAboutInheritedOrigins(t *testing.T) {
+	notHTTP := func(_ context.Context, address string) (string, error) {
+		return "", fmt.Errorf("%w: origin at %s does not speak HTTP", consts.ErrUnsupported, address)
+	}
+	ns := preview(map[string]string{"tunnel.pizza/tunnel": "true"})
+
+	r, c, recorder := reconcilerWithProbe(t, notHTTP, annotated(nil), ns)
+	r.Defaults = c
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none", names)
+	}
+	assertNoEvent(t, recorder, consts.ReasonUnsupported)
+
+	r, c, recorder = reconcilerWithProbe(t, notHTTP, annotated(map[string]string{"tunnel.pizza/tunnel": "true"}), ns)
+	r.Defaults = c
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertEvent(t, recorder, consts.ReasonUnsupported)
+}
+
+// TestReconcileRefusesABadNamespaceLabelQuietly: no Service in the Namespace
+// gets a tunnel from a label that does not parse, and none of them hears about
+// it either. Saying so is misread's, on the Namespace.
+func TestReconcileRefusesABadNamespaceLabelQuietly(t *testing.T) {
+	r, c, recorder := reconciler(t, annotated(nil), preview(map[string]string{"tunnel.pizza/tunnel": "True"}))
+	r.Defaults = c
+
+	for range 2 {
+		if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none", names)
+	}
+	assertNoEvent(t, recorder, consts.ReasonUnsupported)
+}
+
+// TestMisreadReportsABadNamespaceLabelOnce: said on the Namespace when it is
+// first seen and when the label changes to another bad value, and not on an
+// update that leaves the label alone, however many Services that update
+// re-reconciles.
+func TestMisreadReportsABadNamespaceLabelOnce(t *testing.T) {
+	r, _, fake := reconciler(t)
+	recorder := &regarding{FakeRecorder: fake}
+	r.Recorder = recorder
+	h := r.misread()
+	ctx := context.Background()
+	bad := preview(map[string]string{"tunnel.pizza/tunnel": "True"})
+	relabelled := bad.DeepCopy()
+	relabelled.Labels["team"] = "web"
+	worse := preview(map[string]string{"tunnel.pizza/tunnel": "yes"})
+	good := preview(map[string]string{"tunnel.pizza/tunnel": "true"})
+
+	h.Create(ctx, event.CreateEvent{Object: bad}, nil)
+	assertEvent(t, fake, `tunnel.pizza/tunnel="True"`)
+	h.Update(ctx, event.UpdateEvent{ObjectOld: bad, ObjectNew: relabelled}, nil)
+	assertNoEvent(t, fake, consts.ReasonUnsupported)
+	h.Update(ctx, event.UpdateEvent{ObjectOld: relabelled, ObjectNew: worse}, nil)
+	assertEvent(t, fake, `tunnel.pizza/tunnel="yes"`)
+	h.Update(ctx, event.UpdateEvent{ObjectOld: worse, ObjectNew: good}, nil)
+	h.Create(ctx, event.CreateEvent{Object: good}, nil)
+	assertNoEvent(t, fake, consts.ReasonUnsupported)
+
+	for _, obj := range recorder.objects {
+		if kind := obj.GetObjectKind().GroupVersionKind().Kind; kind != "Namespace" {
+			t.Errorf("event regarding a %q, want the Namespace", kind)
+		}
+	}
+}
+
 // TestReconcileDoesNotRequeueWhenEverythingIsKnown guards the other side: a
 // requeue on every reconcile would poll every Service in the cluster forever.
 func TestReconcileDoesNotRequeueWhenEverythingIsKnown(t *testing.T) {
@@ -934,6 +1197,46 @@ func TestReconcileUpdatesAChildWhoseProtocolChanged(t *testing.T) {
 	}
 }
 
+// TestReconcileHoldsWhileTheProbeIsPending: an origin nobody has probed yet
+// gets no child — building one would mean guessing the scheme — and a child
+// already serving is neither rewritten nor pruned while the answer is on its
+// way. The Service asked for it, so the answer brings it back.
+func TestReconcileHoldsWhileTheProbeIsPending(t *testing.T) {
+	t.Run("nothing is built before the answer", func(t *testing.T) {
+		r, c, _ := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"}))
+		origins := &pending{}
+		r.Origins = origins
+
+		if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+		if names := ingressNames(t, c); len(names) != 0 {
+			t.Errorf("ingresses = %v, want none until the probe answers", names)
+		}
+		if !slices.Contains(origins.asked, testKey) {
+			t.Errorf("asked for %v, want the Service named so the answer wakes it", origins.asked)
+		}
+	})
+
+	t.Run("what is serving stays", func(t *testing.T) {
+		svc := annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"})
+		serving := ingressChildFor(svc, resolved{
+			provider: "tunnel.pizza", api: apiIngress,
+			port: servicePort{name: "http", number: 8080}, protocol: consts.OriginSchemeTLS,
+		})
+		r, c, _ := reconciler(t, svc, serving)
+		withHostname(t, c, "web-tunnel-pizza", "abc.tunnel.pizza")
+		r.Origins = &pending{}
+
+		if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+		if got := getIngress(t, c, "web-tunnel-pizza").Labels["tunnel.pizza/protocol"]; got != consts.OriginSchemeTLS {
+			t.Errorf("child protocol = %q, want %q left alone until the probe answers", got, consts.OriginSchemeTLS)
+		}
+	})
+}
+
 func getGateway(t *testing.T, c client.Client, name string) *gatewayv1.Gateway {
 	t.Helper()
 	var gw gatewayv1.Gateway
@@ -1032,8 +1335,10 @@ func TestReconcileDoesNotListGatewayKindsWithoutTheCRDs(t *testing.T) {
 	r := &Reconciler{
 		Client: c, Services: c, Recorder: events.NewFakeRecorder(32),
 		GatewayAPI: false,
-		Probe:      func(context.Context, string) (string, error) { return consts.OriginScheme, nil },
-		Providers:  known,
+		Origins: answered(func(context.Context, string) (string, error) {
+			return consts.OriginScheme, nil
+		}),
+		Providers: known,
 	}
 
 	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
@@ -1070,3 +1375,229 @@ func TestTrueAndIngressProduceIdenticalChildren(t *testing.T) {
 		t.Errorf("labels differ:\n true    %v\n ingress %v", fromTrue.Labels, fromIngress.Labels)
 	}
 }
+
+// TestReconcileExpires walks a Service with a deadline through its life: the
+// child is stamped with the instant rather than the ttl, the reconcile comes
+// back by it, and once it passes the child goes and the status with it.
+func TestReconcileExpires(t *testing.T) {
+	svc := classed("tunnel.pizza")
+	svc.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Minute).Truncate(time.Second))
+	svc.Labels = map[string]string{"tunnel.pizza/ttl": "1h"}
+	r, c, recorder := reconciler(t, svc)
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	withHostname(t, c, "web-tunnel-pizza", "lonely-ostrich.tunneled.pizza")
+	res, err := r.Reconcile(context.Background(), reconcileRequest())
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	deadline := svc.CreationTimestamp.Add(time.Hour)
+	if got := getIngress(t, c, "web-tunnel-pizza").Labels["tunnel.pizza/expires-at"]; got != strconv.FormatInt(deadline.Unix(), 10) {
+		t.Errorf("child expires-at = %q, want %d", got, deadline.Unix())
+	}
+	if res.RequeueAfter <= 58*time.Minute || res.RequeueAfter > time.Hour {
+		t.Errorf("RequeueAfter = %v, want the time left until the deadline", res.RequeueAfter)
+	}
+	assertEvent(t, recorder, consts.ReasonTunnelExpiry)
+	// Said once. A resync finds the same hostname and the same deadline.
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder, consts.ReasonTunnelExpiry)
+
+	live := getService(t, c)
+	live.Labels["tunnel.pizza/ttl"] = "30s"
+	if err := c.Update(context.Background(), live); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none once the deadline passed", names)
+	}
+	if got := getService(t, c).Status.LoadBalancer.Ingress; len(got) != 0 {
+		t.Errorf("status.loadBalancer.ingress = %+v, want cleared", got)
+	}
+	assertEvent(t, recorder, consts.ReasonTunnelExpired)
+	// The Service is still there past its deadline, and there is nothing
+	// left to retire.
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder, consts.ReasonTunnelExpired)
+}
+
+// TestReconcileDropsALiftedDeadline: the child's labels are otherwise only
+// ever added to, and a deadline left on it would retire a tunnel its Service
+// no longer limits.
+func TestReconcileDropsALiftedDeadline(t *testing.T) {
+	svc := annotated(map[string]string{
+		"tunnel.pizza/tunnel":     "ingress",
+		"tunnel.pizza/expires-at": strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+	})
+	r, c, _ := reconciler(t, svc)
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	live := getService(t, c)
+	delete(live.Labels, "tunnel.pizza/expires-at")
+	if err := c.Update(context.Background(), live); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got, ok := getIngress(t, c, "web-tunnel-pizza").Labels["tunnel.pizza/expires-at"]; ok {
+		t.Errorf("child expires-at = %q, want it gone with the Service's", got)
+	}
+}
+
+// TestReconcileSetsBackAHandEdit: the child is rebuilt from the Service, so an
+// edit to a field the controller writes is taken back and the Service says
+// so. A label somebody else added is not one of those, and stays.
+func TestReconcileSetsBackAHandEdit(t *testing.T) {
+	r, c, recorder := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"}))
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	edited := getIngress(t, c, "web-tunnel-pizza")
+	edited.Labels["tunnel.pizza/protocol"] = consts.OriginSchemeTLS
+	edited.Labels["team"] = "checkout"
+	if err := c.Update(context.Background(), edited, client.FieldOwner("kubectl-edit")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	labels := getIngress(t, c, "web-tunnel-pizza").Labels
+	if got := labels["tunnel.pizza/protocol"]; got != consts.OriginScheme {
+		t.Errorf("child protocol = %q, want the edit set back to %q", got, consts.OriginScheme)
+	}
+	if got := labels["team"]; got != "checkout" {
+		t.Errorf("team label = %q, want somebody else's label left alone", got)
+	}
+	assertEvent(t, recorder, consts.ReasonFieldConflict)
+}
+
+// regarding records what each event is about, which events.FakeRecorder does
+// not say.
+type regarding struct {
+	*events.FakeRecorder
+	objects []runtime.Object
+}
+
+func (r *regarding) Eventf(obj, related runtime.Object, eventtype, reason, action, note string, args ...any) {
+	r.objects = append(r.objects, obj)
+	r.FakeRecorder.Eventf(obj, related, eventtype, reason, action, note, args...)
+}
+
+// TestReconcileRefusesARequestedHostname: neither provider can mint on a name
+// it is given, so {provider}/hostname is refused where it was written — on
+// the Service — and no child is made only to be refused there instead.
+func TestReconcileRefusesARequestedHostname(t *testing.T) {
+	r, c, fake := reconciler(t, annotated(map[string]string{
+		"tunnel.pizza/tunnel":   "ingress",
+		"tunnel.pizza/hostname": "app.tunneled.pizza",
+	}))
+	recorder := &regarding{FakeRecorder: fake}
+	r.Recorder = recorder
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none for a hostname that cannot be minted on", names)
+	}
+	assertEvent(t, fake, "cannot reserve hostname app.tunneled.pizza")
+	for _, obj := range recorder.objects {
+		if _, ok := obj.(*corev1.Service); !ok {
+			t.Errorf("event regarding %T, want the Service", obj)
+		}
+	}
+}
+
+// TestReconcileRefusesANamespaceThatHasNotOptedIn: under --namespace-opt-in a
+// Service asking for a tunnel loses its child and is told why, while one
+// asking for nothing is not told anything.
+func TestReconcileRefusesANamespaceThatHasNotOptedIn(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	r, c, recorder := reconciler(t, annotated(map[string]string{"tunnel.pizza/tunnel": "ingress"}), ns)
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 1 {
+		t.Fatalf("ingresses = %v, want the child before the policy applies", names)
+	}
+
+	r.Namespaces = &optin.Gate{Reader: c, Required: true}
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("ingresses = %v, want none in a namespace that has not opted in", names)
+	}
+	assertEvent(t, recorder, consts.AllowedLabel)
+
+	live := getService(t, c)
+	live.Labels = nil
+	if err := c.Update(context.Background(), live); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	assertNoEvent(t, recorder, consts.ReasonUnsupported)
+}
+
+// TestReconcileOneChildPerPort: under ports: all each TCP port gets its own
+// child, named for the port, and the class path publishes every hostname.
+func TestReconcileOneChildPerPort(t *testing.T) {
+	s := classed("tunnel.pizza",
+		corev1.ServicePort{Name: "web", Port: 8080, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "admin", Port: 9090, Protocol: corev1.ProtocolTCP})
+	s.Labels = map[string]string{"tunnel.pizza/ports": "all"}
+	r, c, _ := reconciler(t, s)
+
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if got, want := ingressNames(t, c), []string{"web-admin-tunnel-pizza", "web-web-tunnel-pizza"}; !slices.Equal(got, want) {
+		t.Fatalf("children = %v, want %v", got, want)
+	}
+	for name, port := range map[string]int32{"web-web-tunnel-pizza": 8080, "web-admin-tunnel-pizza": 9090} {
+		if got := getIngress(t, c, name).Spec.DefaultBackend.Service.Port.Number; got != port {
+			t.Errorf("%s fronts port %d, want %d", name, got, port)
+		}
+	}
+
+	withHostname(t, c, "web-web-tunnel-pizza", "brave-tuna.tunneled.pizza")
+	withHostname(t, c, "web-admin-tunnel-pizza", "lonely-ostrich.tunneled.pizza")
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	// In port order, whatever order the names sort in.
+	got := getService(t, c).Status.LoadBalancer.Ingress
+	if len(got) != 2 || got[0].Hostname != "brave-tuna.tunneled.pizza" || got[1].Hostname != "lonely-ostrich.tunneled.pizza" {
+		t.Errorf("status.loadBalancer.ingress = %+v, want both hostnames in port order", got)
+	}
+
+	// Dropping the label leaves one port to choose from, which is ambiguous:
+	// both children go.
+	svc := getService(t, c)
+	svc.Labels = nil
+	if err := c.Update(context.Background(), svc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), reconcileRequest()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if names := ingressNames(t, c); len(names) != 0 {
+		t.Errorf("children = %v after the label went, want none", names)
+	}
+}
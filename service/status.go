@@ -9,8 +9,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// publish writes the tunnel hostname to the Service's status, and reports
-// whether it had to. An empty hostname clears it.
+// publish writes the tunnel hostnames to the Service's status, and reports
+// whether it had to. One per port under {provider}/ports: all, in port order;
+// empty ones are skipped, so none at all, or "", clears it.
 //
 // Only ever called for a Service reached through spec.loadBalancerClass. That
 // is not a preference: the API server rejects a status.loadBalancer write on a
@@ -23,10 +24,13 @@ import (
 // anycast addresses, which route on SNI and are useless on their own. Setting
 // ip would also make ipMode mandatory, forcing a VIP/Proxy claim about an
 // address this controller does not own.
-func (r *Reconciler) publish(ctx context.Context, svc *corev1.Service, hostname string) (bool, error) {
+func (r *Reconciler) publish(ctx context.Context, svc *corev1.Service, hostnames ...string) (bool, error) {
 	var want []corev1.LoadBalancerIngress
-	if hostname != "" {
-		want = []corev1.LoadBalancerIngress{{
+	for _, hostname := range hostnames {
+		if hostname == "" {
+			continue
+		}
+		want = append(want, corev1.LoadBalancerIngress{
 			Hostname: hostname,
 			// Both ports, matching what the Ingress half publishes: the edge
 			// answers plaintext on 80 as well as TLS on 443, deliberately, so
@@ -43,7 +47,7 @@ func (r *Reconciler) publish(ctx context.Context, svc *corev1.Service, hostname
 				{Port: 80, Protocol: corev1.ProtocolTCP},
 				{Port: 443, Protocol: corev1.ProtocolTCP},
 			},
-		}}
+		})
 	}
 
 	// DeepEqual over the whole slice rather than a field-by-field comparison.
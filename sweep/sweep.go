@@ -0,0 +1,379 @@
+// Package sweep collects the objects this controller generated whose owner no
+// longer asks for them.
+//
+// prune already does this, and is what normally does: every reconcile of a
+// Service or a Pod deletes the children it did not keep. But prune runs only
+// when a reconcile reaches the owner, and two things can leave a child that no
+// reconcile will. A reconcile can be missed — the trigger removed while the
+// controller was down, with nothing about the owner changing afterwards to
+// bring it back. And a release can change how children are named, after which
+// prune, which lists by kind and keeps by name, does collect the old ones — but
+// only for owners it is asked to reconcile, which a quiet Service is not.
+// Either way a child goes on serving a tunnel nothing asks for, and
+// owner-reference GC does not help: the owner is still there.
+//
+// So the leader periodically lists every object labelled
+// app.kubernetes.io/managed-by=tunnel, of every kind the halves generate,
+// reads the Service or Pod controlling each, and asks the same question prune
+// would: is this among the children that owner asks for? One that is not is
+// deleted, or only reported under --sweep-dry-run. The answer comes from the
+// owner's labels — service.Children and pod.Children — and not from probes or
+// readiness: an origin that does not speak HTTP, or a Pod with no address, is
+// the reconcile's to handle, and it does.
+//
+// An object carrying the label with no Service or Pod controlling it is
+// reported and never deleted. The label is easily copied onto something else;
+// the controller reference is what says an object is this controller's, and
+// without one the sweep cannot tell.
+package sweep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+
+	"github.com/scaffoldly/tunnel/config"
+	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/gateway"
+	"github.com/scaffoldly/tunnel/optin"
+	"github.com/scaffoldly/tunnel/pod"
+	"github.com/scaffoldly/tunnel/service"
+)
+
+// ControllerName is this package's import path, from which ReporterName is
+// derived the same way the halves derive theirs.
+var ControllerName = reflect.TypeFor[Sweeper]().PkgPath()
+
+// Name is the short label for this component, used in logs.
+var Name = path.Base(ControllerName)
+
+// ReporterName is the identity the sweep's events are attributed to.
+var ReporterName = consts.Reporter(ControllerName)
+
+// Sweeper is the manager Runnable that sweeps. See the package doc.
+type Sweeper struct {
+	// Client deletes strays.
+	client.Client
+	// Reader lists the generated objects and reads their owners. The
+	// manager's *uncached* reader: the sweep exists for what the informers
+	// and the reconciles they drive missed, so it asks the API server. A
+	// handful of label-selected LISTs every few minutes is cheap.
+	Reader   client.Reader
+	Recorder events.EventRecorder
+	// Providers is the vocabulary a trigger may name, as the halves have it.
+	Providers []string
+	// Namespaces decides which namespaces may have tunnels at all. A child in
+	// one that may not is not asked for, whatever its owner says.
+	Namespaces *optin.Gate
+	// Defaults reads a Namespace's metadata for its consts.TunnelLabel, as the
+	// Service half does. Nil on a scoped install, which turns the default off
+	// there too.
+	Defaults client.Reader
+	// GatewayAPI is whether Gateways and HTTPRoutes are served here to list.
+	GatewayAPI bool
+	// Watched is the namespaces to sweep, one LIST each; empty sweeps them
+	// all with one. A scoped install's Role cannot list cluster-wide.
+	Watched []string
+	// Interval is the time between sweeps, and DryRun reports strays without
+	// deleting them.
+	Interval time.Duration
+	DryRun   bool
+
+	// reported is the objects already warned about and left in place, by
+	// UID: one that stays unowned, or stray under dry run, is found again on
+	// every sweep, and a warning each time would bury everything else on it.
+	// Said once per process, and carried only from one sweep to the next, so
+	// an object that goes is forgotten with it.
+	reported, seen map[types.UID]struct{}
+}
+
+// New registers the sweep with mgr. A zero interval turns it off.
+func New(mgr ctrl.Manager, cfg config.Config) error {
+	if cfg.SweepInterval <= 0 {
+		return nil
+	}
+	gatewayAPI, err := gateway.Installed(mgr)
+	if err != nil {
+		return fmt.Errorf("detect gateway api: %w", err)
+	}
+	s := &Sweeper{
+		Client:     mgr.GetClient(),
+		Reader:     mgr.GetAPIReader(),
+		Recorder:   mgr.GetEventRecorder(ReporterName),
+		Providers:  consts.InstalledProviders,
+		Namespaces: &optin.Gate{Reader: mgr.GetClient(), Required: cfg.NamespaceOptIn},
+		GatewayAPI: gatewayAPI,
+		Watched:    cfg.WatchNamespaces,
+		Interval:   cfg.SweepInterval,
+		DryRun:     cfg.SweepDryRun,
+	}
+	if !cfg.Scoped() {
+		s.Defaults = mgr.GetClient()
+	}
+	if err := mgr.Add(s); err != nil {
+		return fmt.Errorf("add sweep: %w", err)
+	}
+	mgr.GetLogger().Info("sweep registered", "interval", cfg.SweepInterval, "dryRun", cfg.SweepDryRun)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. One replica
+// sweeps: two would race each other to the same deletes, and a replica that is
+// not the leader is not reconciling either, so its view of what is asked for
+// is no better.
+func (s *Sweeper) NeedLeaderElection() bool { return true }
+
+// Start implements manager.Runnable: a sweep as soon as this replica leads,
+// then one every Interval until the manager stops. A startup is exactly when
+// a child left behind by a previous version or a missed reconcile is worth
+// finding. A failed sweep is logged and tried again next time; nothing about
+// it is worth stopping the manager for.
+func (s *Sweeper) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName(Name)
+	ctx = log.IntoContext(ctx, logger)
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Sweep(ctx); err != nil {
+			logger.Error(err, "sweep failed")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep runs one pass over every generated kind.
+func (s *Sweeper) Sweep(ctx context.Context) error {
+	lists := []func() client.ObjectList{
+		func() client.ObjectList { return &networkingv1.IngressList{} },
+		func() client.ObjectList { return &corev1.ConfigMapList{} },
+		func() client.ObjectList { return &corev1.ServiceList{} },
+		func() client.ObjectList { return &discoveryv1.EndpointSliceList{} },
+	}
+	if s.GatewayAPI {
+		lists = append(lists,
+			func() client.ObjectList { return &gatewayv1.GatewayList{} },
+			func() client.ObjectList { return &gatewayv1.HTTPRouteList{} },
+		)
+	}
+	namespaces := s.Watched
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	// One kind failing does not stop the rest: a cluster that refuses one
+	// LIST still has its other strays found.
+	s.seen = map[types.UID]struct{}{}
+	var errs []error
+	for _, newList := range lists {
+		for _, ns := range namespaces {
+			list := newList()
+			if err := s.Reader.List(ctx, list, client.InNamespace(ns),
+				client.MatchingLabels{consts.LabelManagedBy: consts.ManagedBy}); err != nil {
+				errs = append(errs, fmt.Errorf("list %T: %w", list, err))
+				continue
+			}
+			items, err := meta.ExtractList(list)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			for _, item := range items {
+				if err := s.sweep(ctx, item.(client.Object)); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	s.reported, s.seen = s.seen, nil
+	return errors.Join(errs...)
+}
+
+// once reports whether obj has not been warned about yet, and notes that it
+// has now.
+func (s *Sweeper) once(obj client.Object) bool {
+	s.seen[obj.GetUID()] = struct{}{}
+	_, said := s.reported[obj.GetUID()]
+	return !said
+}
+
+// stray is what the sweep found wrong with one object.
+type stray struct {
+	// owner is the Service or Pod controlling it, where there still is one.
+	// The events go there.
+	owner client.Object
+	// why completes "was generated by this controller and ...".
+	why string
+	// unowned is an object nothing controls, which is never deleted.
+	unowned bool
+}
+
+// sweep checks one object and deletes or reports it.
+func (s *Sweeper) sweep(ctx context.Context, obj client.Object) error {
+	found, err := s.examine(ctx, obj)
+	if err != nil || found == nil {
+		return err
+	}
+
+	kind := s.kindOf(obj)
+	logger := log.FromContext(ctx).WithValues("kind", kind, "namespace", obj.GetNamespace(), "name", obj.GetName())
+	on := found.owner
+	if on == nil {
+		on = obj
+	}
+	switch {
+	case found.unowned:
+		logger.Info("generated-looking object has no owner; leaving it")
+		if s.once(obj) {
+			s.Recorder.Eventf(obj, nil, consts.EventTypeWarning, consts.ReasonStrayChild,
+				consts.ActionSweep, consts.MsgStrayUnownedFmt, kind, obj.GetName())
+		}
+	case s.DryRun:
+		logger.Info("stray child; not deleting under dry run", "reason", found.why)
+		if s.once(obj) {
+			s.Recorder.Eventf(on, nil, consts.EventTypeWarning, consts.ReasonStrayChild,
+				consts.ActionSweep, consts.MsgStrayKeptFmt, kind, obj.GetName(), found.why)
+		}
+	default:
+		// Only the object that was examined. A reconcile may have deleted it
+		// and built a new one by the same name since the list, and that one
+		// is asked for; the precondition turns the delete into a conflict.
+		err := s.Delete(ctx, obj, client.Preconditions{UID: ptr.To(obj.GetUID())})
+		if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("delete %s %s: %w", kind, client.ObjectKeyFromObject(obj), err)
+		}
+		logger.Info("deleted stray child", "reason", found.why)
+		s.Recorder.Eventf(on, nil, consts.EventTypeNormal, consts.ReasonStrayChild,
+			consts.ActionSweep, consts.MsgStrayDeletedFmt, kind, obj.GetName(), found.why)
+	}
+	return nil
+}
+
+// examine decides whether obj is still asked for. Nil means it is, or that it
+// is not the sweep's to decide — an owner being deleted takes its children
+// with it.
+func (s *Sweeper) examine(ctx context.Context, obj client.Object) (*stray, error) {
+	ref := metav1.GetControllerOf(obj)
+	if ref == nil || ref.APIVersion != corev1.SchemeGroupVersion.String() {
+		return &stray{unowned: true}, nil
+	}
+
+	var owner client.Object
+	switch ref.Kind {
+	case "Service":
+		owner = &corev1.Service{}
+	case "Pod":
+		owner = &corev1.Pod{}
+	default:
+		return &stray{unowned: true}, nil
+	}
+	err := s.Reader.Get(ctx, client.ObjectKey{Namespace: obj.GetNamespace(), Name: ref.Name}, owner)
+	switch {
+	case apierrors.IsNotFound(err):
+		// GC's to collect, and it has not: behind, or blocked. Taken here
+		// rather than waited on.
+		return &stray{why: fmt.Sprintf("its %s %s no longer exists", ref.Kind, ref.Name)}, nil
+	case err != nil:
+		return nil, fmt.Errorf("get %s %s/%s: %w", ref.Kind, obj.GetNamespace(), ref.Name, err)
+	case owner.GetUID() != ref.UID:
+		// Same name, a different object: the one that owned this is gone.
+		return &stray{why: fmt.Sprintf("the %s %s it belonged to was deleted and replaced", ref.Kind, ref.Name)}, nil
+	case owner.GetDeletionTimestamp() != nil:
+		return nil, nil
+	}
+
+	wanted, err := s.children(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	gk := s.groupKind(obj)
+	for _, w := range wanted {
+		if w.GetName() == obj.GetName() && s.groupKind(w) == gk {
+			return nil, nil
+		}
+	}
+	return &stray{owner: owner, why: fmt.Sprintf("%s %s no longer asks for it", ref.Kind, ref.Name)}, nil
+}
+
+// children is what owner asks for, as its own half would resolve it.
+func (s *Sweeper) children(ctx context.Context, owner client.Object) ([]client.Object, error) {
+	if err := s.Namespaces.Admit(ctx, owner.GetNamespace()); err != nil {
+		if errors.Is(err, consts.ErrUnsupported) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	switch o := owner.(type) {
+	case *corev1.Pod:
+		return pod.Children(o), nil
+	case *corev1.Service:
+		namespace, err := s.defaults(ctx, o.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		return service.Children(o, namespace, s.Providers), nil
+	}
+	return nil, nil
+}
+
+// defaults returns the labels of namespace, for its consts.TunnelLabel. The
+// Service half reports a value there that does not parse; here it is only
+// read, and service.Children ignores what does not parse the same way the
+// reconcile does.
+func (s *Sweeper) defaults(ctx context.Context, namespace string) (map[string]string, error) {
+	if s.Defaults == nil {
+		return nil, nil
+	}
+	ns := &metav1.PartialObjectMetadata{}
+	ns.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Namespace"))
+	if err := s.Defaults.Get(ctx, client.ObjectKey{Name: namespace}, ns); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get namespace %s: %w", namespace, err)
+	}
+	if _, err := service.Requested(ns.Labels); err != nil {
+		return nil, nil
+	}
+	return ns.Labels, nil
+}
+
+// groupKind identifies an object's kind for comparing a listed object with a
+// wanted one. Listed items carry no TypeMeta, so the scheme says.
+func (s *Sweeper) groupKind(obj client.Object) schema.GroupKind {
+	gvk, err := apiutil.GVKForObject(obj, s.Scheme())
+	if err != nil {
+		return schema.GroupKind{}
+	}
+	return gvk.GroupKind()
+}
+
+func (s *Sweeper) kindOf(obj client.Object) string {
+	return s.groupKind(obj).Kind
+}
@@ -0,0 +1,353 @@
+package sweep
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+
+	"github.com/scaffoldly/tunnel/consts"
+	"github.com/scaffoldly/tunnel/optin"
+	"github.com/scaffoldly/tunnel/pod"
+	"github.com/scaffoldly/tunnel/service"
+)
+
+var known = []string{"tunnel.pizza", "api.trycloudflare.com"}
+
+func sweeper(t *testing.T, objs ...client.Object) (*Sweeper, client.Client, *events.FakeRecorder) {
+	t.Helper()
+	s := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(s))
+	utilruntime.Must(gatewayv1.Install(s))
+	c := fake.NewClientBuilder().WithScheme(s).WithObjects(objs...).Build()
+	recorder := events.NewFakeRecorder(32)
+	return &Sweeper{
+		Client: c, Reader: c, Defaults: c, Recorder: recorder,
+		Providers: known, GatewayAPI: true,
+	}, c, recorder
+}
+
+// asking is a Service whose label asks for a tunnel.
+func asking(labels map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "svc-uid", Labels: labels},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeClusterIP,
+			Ports: []corev1.ServicePort{{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+}
+
+// generated is an object as a half writes it: labelled, and controlled by
+// owner.
+func generated[T client.Object](obj T, name string, owner client.Object, kind string) T {
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetUID(types.UID(fmt.Sprintf("%T/%s", obj, name)))
+	obj.SetLabels(map[string]string{consts.LabelManagedBy: consts.ManagedBy})
+	if owner != nil {
+		obj.SetOwnerReferences([]metav1.OwnerReference{
+			*metav1.NewControllerRef(owner, corev1.SchemeGroupVersion.WithKind(kind)),
+		})
+	}
+	return obj
+}
+
+// wantedIngress is the name of the Ingress svc asks for, as the Service half
+// names it.
+func wantedIngress(t *testing.T, svc *corev1.Service) string {
+	t.Helper()
+	for _, obj := range service.Children(svc, nil, known) {
+		if _, ok := obj.(*networkingv1.Ingress); ok {
+			return obj.GetName()
+		}
+	}
+	t.Fatal("service.Children() asks for no Ingress")
+	return ""
+}
+
+func exists(t *testing.T, c client.Client, obj client.Object) bool {
+	t.Helper()
+	err := c.Get(context.Background(), client.ObjectKeyFromObject(obj), obj)
+	if apierrors.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		t.Fatalf("get %s: %v", obj.GetName(), err)
+	}
+	return true
+}
+
+func assertEvent(t *testing.T, recorder *events.FakeRecorder, substr string) {
+	t.Helper()
+	for {
+		select {
+		case e := <-recorder.Events:
+			if strings.Contains(e, substr) {
+				return
+			}
+		default:
+			t.Fatalf("no event containing %q", substr)
+		}
+	}
+}
+
+func assertNoEvents(t *testing.T, recorder *events.FakeRecorder) {
+	t.Helper()
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("unexpected event %q", e)
+	default:
+	}
+}
+
+func sweep(t *testing.T, s *Sweeper) {
+	t.Helper()
+	if err := s.Sweep(context.Background()); err != nil {
+		t.Fatalf("Sweep() error = %v", err)
+	}
+}
+
+// TestSweepKeepsWhatIsAskedFor: the ordinary case, which is nearly every
+// object on every pass, changes nothing and says nothing.
+func TestSweepKeepsWhatIsAskedFor(t *testing.T) {
+	svc := asking(map[string]string{consts.TunnelLabel: "true"})
+	ing := generated(&networkingv1.Ingress{}, wantedIngress(t, svc), svc, "Service")
+	mirror := generated(&corev1.ConfigMap{}, service.MirrorName(svc.Name), svc, "Service")
+	s, c, recorder := sweeper(t, svc, ing, mirror)
+
+	sweep(t, s)
+
+	if !exists(t, c, ing) || !exists(t, c, mirror) {
+		t.Error("an object its Service asks for was deleted")
+	}
+	assertNoEvents(t, recorder)
+}
+
+// TestSweepDeletesWhatTheOwnerNoLongerAsksFor is the missed reconcile: the
+// label went while nothing was watching, and the Ingress stayed.
+func TestSweepDeletesWhatTheOwnerNoLongerAsksFor(t *testing.T) {
+	svc := asking(map[string]string{consts.TunnelLabel: "true"})
+	name := wantedIngress(t, svc)
+	svc.Labels = nil
+	ing := generated(&networkingv1.Ingress{}, name, svc, "Service")
+	s, c, recorder := sweeper(t, svc, ing)
+
+	sweep(t, s)
+
+	if exists(t, c, ing) {
+		t.Error("Ingress kept, want it deleted: its Service asks for nothing")
+	}
+	assertEvent(t, recorder, "Service web no longer asks for it; deleted")
+}
+
+// TestSweepDeletesARenamedChild is a release that names children differently:
+// the Service is still asking, but not for this one.
+func TestSweepDeletesARenamedChild(t *testing.T) {
+	svc := asking(map[string]string{consts.TunnelLabel: "true"})
+	current := generated(&networkingv1.Ingress{}, wantedIngress(t, svc), svc, "Service")
+	old := generated(&networkingv1.Ingress{}, "web-old-scheme", svc, "Service")
+	s, c, _ := sweeper(t, svc, current, old)
+
+	sweep(t, s)
+
+	if exists(t, c, old) {
+		t.Error("Ingress under the old name kept, want it deleted")
+	}
+	if !exists(t, c, current) {
+		t.Error("Ingress under the current name deleted")
+	}
+}
+
+// TestSweepDeletesWhatOutlivedItsOwner: GC's to collect, and taken here when
+// it has not.
+func TestSweepDeletesWhatOutlivedItsOwner(t *testing.T) {
+	svc := asking(map[string]string{consts.TunnelLabel: "true"})
+	ing := generated(&networkingv1.Ingress{}, wantedIngress(t, svc), svc, "Service")
+	s, c, recorder := sweeper(t, ing)
+
+	sweep(t, s)
+
+	if exists(t, c, ing) {
+		t.Error("Ingress kept, want it deleted: its Service is gone")
+	}
+	assertEvent(t, recorder, "its Service web no longer exists")
+}
+
+// TestSweepTellsAReplacedOwnerApart: a Service deleted and created again by
+// the same name is not the one the child belonged to, however alike they are.
+func TestSweepTellsAReplacedOwnerApart(t *testing.T) {
+	svc := asking(map[string]string{consts.TunnelLabel: "true"})
+	ing := generated(&networkingv1.Ingress{}, wantedIngress(t, svc), svc, "Service")
+	replacement := svc.DeepCopy()
+	replacement.UID = "another-uid"
+	s, c, recorder := sweeper(t, replacement, ing)
+
+	sweep(t, s)
+
+	if exists(t, c, ing) {
+		t.Error("Ingress kept, want it deleted: the Service it belonged to was replaced")
+	}
+	assertEvent(t, recorder, "deleted and replaced")
+}
+
+// TestSweepDryRunOnlyReports: the flag for trying the sweep on a cluster
+// before trusting it.
+func TestSweepDryRunOnlyReports(t *testing.T) {
+	svc := asking(nil)
+	ing := generated(&networkingv1.Ingress{}, "web-tunnel-pizza", svc, "Service")
+	s, c, recorder := sweeper(t, svc, ing)
+	s.DryRun = true
+
+	sweep(t, s)
+
+	if !exists(t, c, ing) {
+		t.Error("Ingress deleted under dry run")
+	}
+	assertEvent(t, recorder, "--"+consts.FlagSweepDryRun)
+	// Found again on the next sweep, and already said.
+	sweep(t, s)
+	assertNoEvents(t, recorder)
+}
+
+// TestSweepLeavesAnUnownedObjectAlone: the label alone does not make an
+// object this controller's.
+func TestSweepLeavesAnUnownedObjectAlone(t *testing.T) {
+	cm := generated(&corev1.ConfigMap{}, "copied", nil, "")
+	s, c, recorder := sweeper(t, cm)
+
+	sweep(t, s)
+
+	if !exists(t, c, cm) {
+		t.Error("ConfigMap with no owner deleted")
+	}
+	assertEvent(t, recorder, "no Service or Pod controls it")
+	// Nothing will change its mind about it, so it is said once rather than
+	// on every sweep for as long as it stays.
+	sweep(t, s)
+	assertNoEvents(t, recorder)
+}
+
+// TestSweepWaitsOutAnOwnerBeingDeleted: its children go with it, and racing
+// the collector only produces conflicts.
+func TestSweepWaitsOutAnOwnerBeingDeleted(t *testing.T) {
+	svc := asking(nil)
+	svc.Finalizers = []string{"example.com/hold"}
+	svc.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	ing := generated(&networkingv1.Ingress{}, "web-tunnel-pizza", svc, "Service")
+	s, c, recorder := sweeper(t, svc, ing)
+
+	sweep(t, s)
+
+	if !exists(t, c, ing) {
+		t.Error("Ingress deleted while its Service was being deleted")
+	}
+	assertNoEvents(t, recorder)
+}
+
+// TestSweepFollowsTheNamespaceDefault: a Service that asks only through its
+// Namespace's label is still asking.
+func TestSweepFollowsTheNamespaceDefault(t *testing.T) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name: "default", Labels: map[string]string{consts.TunnelLabel: "true"},
+	}}
+	svc := asking(nil)
+	ing := generated(&networkingv1.Ingress{}, wantedIngress(t, asking(map[string]string{consts.TunnelLabel: "true"})), svc, "Service")
+	s, c, _ := sweeper(t, ns, svc, ing)
+
+	sweep(t, s)
+
+	if !exists(t, c, ing) {
+		t.Error("Ingress deleted, want it kept: the Namespace asks for it")
+	}
+}
+
+// TestSweepRespectsTheOptIn: in a namespace that may not have tunnels, nothing
+// is asked for.
+func TestSweepRespectsTheOptIn(t *testing.T) {
+	svc := asking(map[string]string{consts.TunnelLabel: "true"})
+	ing := generated(&networkingv1.Ingress{}, wantedIngress(t, svc), svc, "Service")
+	s, c, _ := sweeper(t, svc, ing, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	s.Namespaces = &optin.Gate{Reader: c, Required: true}
+
+	sweep(t, s)
+
+	if exists(t, c, ing) {
+		t.Error("Ingress kept in a namespace that has not opted in")
+	}
+}
+
+// TestSweepJudgesAPodsChildrenByThePod: the Pod half's Service and
+// EndpointSlice, one Pod still asking and one not.
+func TestSweepJudgesAPodsChildrenByThePod(t *testing.T) {
+	asked := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "nginx", UID: "pod-uid",
+			Labels: map[string]string{consts.TunnelLabel: "true"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name: "nginx", Ports: []corev1.ContainerPort{{ContainerPort: 80}},
+		}}},
+	}
+	children := pod.Children(asked)
+	if len(children) != 2 {
+		t.Fatalf("pod.Children() = %d objects, want a Service and an EndpointSlice", len(children))
+	}
+	name := children[0].GetName()
+	keptSvc := generated(&corev1.Service{}, name, asked, "Pod")
+	keptSlice := generated(&discoveryv1.EndpointSlice{AddressType: discoveryv1.AddressTypeIPv4}, name, asked, "Pod")
+
+	quiet := asked.DeepCopy()
+	quiet.Name, quiet.UID, quiet.Labels = "idle", "idle-uid", nil
+	stray := generated(&corev1.Service{}, "idle-tunnel", quiet, "Pod")
+
+	s, c, recorder := sweeper(t, asked, quiet, keptSvc, keptSlice, stray)
+
+	sweep(t, s)
+
+	if !exists(t, c, keptSvc) || !exists(t, c, keptSlice) {
+		t.Error("a child its Pod asks for was deleted")
+	}
+	if exists(t, c, stray) {
+		t.Error("Service kept, want it deleted: its Pod asks for nothing")
+	}
+	assertEvent(t, recorder, "Pod idle no longer asks for it")
+}
+
+// TestSweepScopedListsEachNamespace: a scoped install's Role cannot list
+// cluster-wide, so each watched namespace is listed on its own and nothing
+// outside them is looked at.
+func TestSweepScopedListsEachNamespace(t *testing.T) {
+	svc := asking(nil)
+	ing := generated(&networkingv1.Ingress{}, "web-tunnel-pizza", svc, "Service")
+	s, c, _ := sweeper(t, svc, ing)
+	s.Watched = []string{"elsewhere"}
+
+	sweep(t, s)
+
+	if !exists(t, c, ing) {
+		t.Error("Ingress in an unwatched namespace deleted")
+	}
+
+	s.Watched = []string{"elsewhere", "default"}
+	sweep(t, s)
+
+	if exists(t, c, ing) {
+		t.Error("Ingress in a watched namespace kept")
+	}
+}
@@ -0,0 +1,89 @@
+package tunnels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// checkTimeout bounds one health check, resolution and request together.
+const checkTimeout = 10 * time.Second
+
+// Checker checks hostname from outside the cluster, the way a client reaches
+// it, requesting path. Injected so the Store can be tested without a network.
+type Checker func(ctx context.Context, hostname, path string) error
+
+// Health is the end-to-end check of Ready tunnels.
+type Health struct {
+	// Interval is how often each Ready hostname is checked. Zero turns the
+	// check off.
+	Interval time.Duration
+	// Path is the path requested. Whatever the origin answers is a pass;
+	// see Check.
+	Path string
+	// Failures is how many failed checks in a row replace the Tunnel. Below
+	// one is one.
+	Failures int
+	// Check runs one check. Nil turns the check off.
+	Check Checker
+}
+
+// Threshold is Failures, at least one.
+func (h Health) Threshold() int { return max(h.Failures, 1) }
+
+// checkClient does not follow redirects: a redirect is the origin answering,
+// which is all a check needs to see.
+var checkClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// Check returns the production Checker, which marks its requests with token
+// in consts.HealthCheckHeader: hostname must resolve, and a request for path
+// through the edge must come back with something other than an edge error.
+//
+// An edge error is 520 to 530, the range Cloudflare keeps for "the edge could
+// not get an answer from the origin" — 530 is what a hostname whose tunnel is
+// gone serves. Origins do not send these. Every other status is a pass,
+// including a 500 or 503: that is the origin answering, which means the
+// tunnel works, and replacing a tunnel cannot fix an application. So is a
+// refusal by a policy in front of the origin.
+//
+// token is the front's proxy.HealthToken. The request goes to the origin like
+// any other, but the listener in front of it knows it by the token, and does
+// not count it as traffic, against a limit, or as the activity that keeps a
+// scale-to-zero backend awake. A backend asleep is not woken for it.
+func Check(token string) Checker {
+	return func(ctx context.Context, hostname, path string) error {
+		if _, err := net.DefaultResolver.LookupHost(ctx, hostname); err != nil {
+			return fmt.Errorf("%s does not resolve: %w", hostname, err)
+		}
+
+		u, err := url.Parse("https://" + hostname + path)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(consts.HealthCheckHeader, token)
+		resp, err := checkClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("GET %s: %w", u, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 520 && resp.StatusCode <= 530 {
+			return fmt.Errorf("GET %s: %w: %s", u, errEdge, resp.Status)
+		}
+		return nil
+	}
+}
+
+// errEdge marks a status the edge sent in place of the origin's.
+var errEdge = errors.New("the edge answered for the origin")
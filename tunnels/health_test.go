@@ -0,0 +1,120 @@
+package tunnels
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// checked is a Store whose health checks answer with whatever the test sends,
+// one per check, and whose one Tunnel's context is kept so the test can see it
+// torn down.
+func checked(t *testing.T, failures int) (*Store, *fakeTunnel, chan<- error, func() context.Context) {
+	t.Helper()
+	tun := newFakeTunnel("brave-tuna.trycloudflare.com")
+	var dialed context.Context
+	s := NewStore(log.Log, func(ctx context.Context, _ metav1.Object, _ *url.URL, _ *slog.Logger) Tunnel {
+		dialed = ctx
+		return tun
+	}, time.Minute)
+	t.Cleanup(s.Close)
+
+	results := make(chan error)
+	s.Health = Health{
+		Interval: time.Millisecond,
+		Path:     "/healthz",
+		Failures: failures,
+		Check: func(ctx context.Context, hostname, path string) error {
+			if hostname != tun.hostname || path != "/healthz" {
+				t.Errorf("checked %s%s, want %s/healthz", hostname, path, tun.hostname)
+			}
+			select {
+			case err := <-results:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+	return s, tun, results, func() context.Context { return dialed }
+}
+
+// A tunnel whose hostname stops answering goes Degraded, keeps its hostname,
+// and comes back to Ready when the check passes again.
+func TestStoreDegradedAndRecovered(t *testing.T) {
+	s, tun, results, _ := checked(t, 3)
+	origin := testOrigin(t, "http://web.default.svc:8080")
+	s.Ensure(testKey, testClass("tunnel.pizza"), origin)
+	tun.connect()
+	drain(t, s)
+
+	results <- errors.New("530 Origin Unreachable")
+	drain(t, s)
+	got := s.Ensure(testKey, testClass("tunnel.pizza"), origin)
+	if got.State != Degraded || got.Hostname != tun.hostname || got.Err == nil || !got.Changed {
+		t.Fatalf("ensure() = %+v, want a change to Degraded with the hostname kept and the check's error", got)
+	}
+	if got := s.Ensure(testKey, testClass("tunnel.pizza"), origin); got.State != Degraded || got.Changed {
+		t.Errorf("ensure() = %+v again, want Degraded and already reported", got)
+	}
+
+	results <- nil
+	drain(t, s)
+	if got := s.Ensure(testKey, testClass("tunnel.pizza"), origin); got.State != Ready || got.Hostname != tun.hostname || !got.Changed {
+		t.Errorf("ensure() = %+v after a passing check, want a change back to Ready", got)
+	}
+}
+
+// Enough failures in a row end the tunnel, as though libtunnel had: Failed,
+// connection torn down, and a replacement after the cooldown.
+func TestStoreReplacesATunnelThatKeepsFailing(t *testing.T) {
+	s, tun, results, dialed := checked(t, 3)
+	origin := testOrigin(t, "http://web.default.svc:8080")
+	s.Ensure(testKey, testClass("tunnel.pizza"), origin)
+	tun.connect()
+	drain(t, s)
+
+	results <- errors.New("no such host")
+	drain(t, s)
+	// Already Degraded: the second miss wakes nobody.
+	results <- errors.New("no such host")
+	results <- errors.New("no such host")
+	drain(t, s)
+
+	got := s.Ensure(testKey, testClass("tunnel.pizza"), origin)
+	if got.State != Failed || got.Hostname != "" {
+		t.Fatalf("ensure() = %+v, want Failed with no hostname", got)
+	}
+	if got.Err == nil || !strings.Contains(got.Err.Error(), "3 times in a row") {
+		t.Errorf("ensure() error = %v, want one counting the failures", got.Err)
+	}
+	if dialed().Err() == nil {
+		t.Error("the failing tunnel was left connected")
+	}
+}
+
+// The zero Health checks nothing, so a Ready tunnel stays Ready.
+func TestStoreWithoutHealthStaysReady(t *testing.T) {
+	tun := newFakeTunnel("brave-tuna.trycloudflare.com")
+	s := testStore(t, time.Minute, func(_ string, _ *url.URL) Tunnel { return tun })
+	origin := testOrigin(t, "http://web.default.svc:8080")
+	s.Ensure(testKey, testClass("tunnel.pizza"), origin)
+	tun.connect()
+	drain(t, s)
+
+	select {
+	case <-s.Source():
+		t.Fatal("Store reported a change with nothing checking")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if got := s.Ensure(testKey, testClass("tunnel.pizza"), origin); got.State != Ready {
+		t.Errorf("ensure() state = %v, want Ready", got.State)
+	}
+}
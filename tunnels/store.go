@@ -8,6 +8,7 @@ package tunnels
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/url"
 	"sync"
@@ -18,6 +19,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/scaffoldly/tunnel/consts"
 )
 
 // now is the clock the retry cooldown reads. A variable so tests can move time
@@ -83,17 +86,28 @@ const (
 	// Failed means the Tunnel ended. A replacement is minted no earlier
 	// than retryAt.
 	Failed
+	// Degraded means a Ready Tunnel's hostname failed its last health check.
+	// Still connected as far as libtunnel knows, and still published: it
+	// becomes Ready again on the next pass, or Failed after enough misses in
+	// a row. See Health.
+	Degraded
 )
 
 // Status is the snapshot Reconcile acts on.
 type Status struct {
 	State State
-	// Hostname is set once the tunnel is Ready, and empty otherwise.
+	// Hostname is set once the tunnel is Ready, and kept while Degraded.
 	Hostname string
-	// Err is why the tunnel ended, set when Failed.
+	// Err is why the tunnel ended, set when Failed, or why its last health
+	// check failed, set when Degraded.
 	Err error
 	// RetryAt is when a Failed tunnel may be re-minted.
 	RetryAt time.Time
+	// Changed is whether this is the first Ensure to report State since the
+	// tunnel moved to it. A reconcile runs on every resync and every backend
+	// change, so an event about a state — a degraded tunnel's warning — is
+	// said when this is set and not on the passes after.
+	Changed bool
 }
 
 // Store owns the live tunnels, one per Ingress, keyed by namespace/name.
@@ -108,7 +122,11 @@ type Status struct {
 // is leader-election gated by default — two replicas both minting for one
 // Ingress would leak a Tunnel per reconcile.
 type Store struct {
-	Dial  Dialer
+	Dial Dialer
+	// Health is the check every Ready Tunnel gets. Set before Start; the zero
+	// value checks nothing.
+	Health Health
+
 	log   logr.Logger
 	retry time.Duration
 
@@ -137,6 +155,8 @@ type entry struct {
 
 	mu     sync.Mutex
 	status Status
+	// reported is whether Ensure has returned status.State since it was set.
+	reported bool
 }
 
 func NewStore(log logr.Logger, d Dialer, retry time.Duration) *Store {
@@ -183,7 +203,7 @@ func (s *Store) Ensure(key types.NamespacedName, class metav1.Object, origin *ur
 				"provider", provider, "origin", target)
 			s.retire(key, e)
 		default:
-			st := e.snapshot()
+			st := e.report()
 			// A failed Tunnel is left in place until its cooldown expires, so
 			// a permanently broken origin cannot turn into a mint loop against
 			// the provider.
@@ -207,7 +227,7 @@ func (s *Store) Ensure(key types.NamespacedName, class metav1.Object, origin *ur
 	s.entries[key] = e
 
 	go s.watch(key, e)
-	return e.snapshot()
+	return e.report()
 }
 
 // Forget retires the Tunnel for key and reports whether there was one. Called
@@ -257,6 +277,11 @@ func (s *Store) retire(key types.NamespacedName, e *entry) {
 // watch follows one Tunnel's lifecycle and wakes the controller on each
 // transition. It runs until the Tunnel ends, the entry is retired, or the
 // Store shuts down.
+//
+// Done is the only failure libtunnel reports, and it reports only what it can
+// see: its connection to the edge. A hostname that stopped resolving, or an
+// edge that answers 530 for it, looks fine from here. So once Ready, the
+// hostname is also checked from outside, the way a client would reach it.
 func (s *Store) watch(key types.NamespacedName, e *entry) {
 	select {
 	case <-e.tun.TunnelReady():
@@ -275,12 +300,57 @@ func (s *Store) watch(key types.NamespacedName, e *entry) {
 	// Ready is not terminal: an established Tunnel can still drop, and the
 	// object's status has to stop advertising a hostname that no longer
 	// serves.
-	select {
-	case <-e.tun.Done():
-		e.set(Status{State: Failed, Err: e.tun.Err(), RetryAt: now().Add(s.retry)})
+	var tick <-chan time.Time
+	if s.Health.Interval > 0 && s.Health.Check != nil {
+		t := time.NewTicker(s.Health.Interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	hostname := e.tun.Hostname()
+	failures := 0
+	for {
+		select {
+		case <-e.tun.Done():
+			e.set(Status{State: Failed, Err: e.tun.Err(), RetryAt: now().Add(s.retry)})
+			s.notify(key, e)
+			return
+		case <-e.gone:
+			return
+		case <-s.base.Done():
+			return
+		case <-tick:
+		}
+
+		ctx, cancel := context.WithTimeout(s.base, checkTimeout)
+		err := s.Health.Check(ctx, hostname, s.Health.Path)
+		cancel()
+		switch {
+		case err == nil && failures == 0:
+			continue
+		case err == nil:
+			s.log.Info("tunnel passed its health check again", "object", key, "hostname", hostname)
+			failures = 0
+			e.set(Status{State: Ready, Hostname: hostname})
+		case failures+1 >= s.Health.Threshold():
+			// Torn down here rather than left for Ensure, so the replacement
+			// is not held up by a connection that is no use to anyone.
+			s.log.Info("tunnel failed its health check; replacing", "object", key,
+				"hostname", hostname, "failures", failures+1, "error", err)
+			e.cancel()
+			e.set(Status{State: Failed, RetryAt: now().Add(s.retry),
+				Err: fmt.Errorf("%s failed its health check %d times in a row: %w", hostname, failures+1, err)})
+			s.notify(key, e)
+			return
+		default:
+			failures++
+			e.set(Status{State: Degraded, Hostname: hostname, Err: err})
+			if failures > 1 {
+				// Already Degraded, and already said so.
+				continue
+			}
+			s.log.Info("tunnel failed its health check", "object", key, "hostname", hostname, "error", err)
+		}
 		s.notify(key, e)
-	case <-e.gone:
-	case <-s.base.Done():
 	}
 }
 
@@ -305,8 +375,42 @@ func (e *entry) snapshot() Status {
 	return e.status
 }
 
+// report is snapshot for Ensure, which marks the state as reported.
+func (e *entry) report() Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := e.status
+	st.Changed = !e.reported
+	e.reported = true
+	return st
+}
+
+// set records st. A new error in the same state is not a transition: a
+// Degraded tunnel's later misses update Err without repeating the warning.
 func (e *entry) set(st Status) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	if st.State != e.status.State {
+		e.reported = false
+	}
 	e.status = st
 }
+
+// Reserve checks that provider can mint a tunnel on hostname — one the caller
+// chose, rather than the one the provider hands back.
+//
+// None can. libtunnel's only engine asks the provider for a tunnel and takes
+// whatever name comes back, and neither installed provider accepts a name to
+// mint on. So this refuses every request, and exists so every half refuses the
+// same way and in the same words — not as a switch waiting to be flipped. A
+// provider that can will need the hostname keyed into the Store alongside
+// provider and origin, and passed through Dial; that is where it goes, and
+// this is what it replaces.
+//
+// Refusing is the point of the request, not a gap in it. Minting anyway and
+// publishing a random name where a specific one was asked for is the failure
+// users could not see.
+func Reserve(provider, hostname string) error {
+	return fmt.Errorf("%w: %s", consts.ErrUnsupported,
+		fmt.Sprintf(consts.MsgHostnameNotReservableFmt, provider, hostname))
+}
@@ -0,0 +1,126 @@
+// Package wake scales a Service's workload between zero and one replica, for
+// the scale-to-zero policy key.
+//
+// The workload is found the way the Service finds its Pods: by its selector,
+// matched against each Deployment's and StatefulSet's Pod template. That is
+// the only link there is — a Service names no owner — and it is the one the
+// user already wrote. Exactly one must match. Two would leave which to wake a
+// guess, and waking the wrong one leaves the request held for nothing.
+//
+// Scaled through the scale subresource, not by editing the workload: that is
+// the one write an autoscaler makes too, it needs no more than the scale
+// grant, and it cannot touch anything else in the spec. Whoever else manages
+// the replica count still owns it whenever the controller has not just
+// changed it.
+package wake
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+// errUnsupported marks a Service whose workload cannot be scaled as written.
+// See consts.ErrUnsupported.
+var errUnsupported = consts.ErrUnsupported
+
+// Workload is the one Deployment or StatefulSet whose Pods svc selects.
+//
+// r should be the uncached reader: this runs once per wake or sleep, and a
+// cache would be an informer over every Deployment in the cluster for it.
+func Workload(ctx context.Context, r client.Reader, svc *corev1.Service) (client.Object, error) {
+	if len(svc.Spec.Selector) == 0 {
+		return nil, fmt.Errorf("%w: service %s/%s has no selector, so no workload to scale", errUnsupported, svc.Namespace, svc.Name)
+	}
+	selector := labels.SelectorFromSet(svc.Spec.Selector)
+
+	var found []client.Object
+	var deployments appsv1.DeploymentList
+	if err := r.List(ctx, &deployments, client.InNamespace(svc.Namespace)); err != nil {
+		return nil, fmt.Errorf("list deployments: %w", err)
+	}
+	for i := range deployments.Items {
+		if selector.Matches(labels.Set(deployments.Items[i].Spec.Template.Labels)) {
+			found = append(found, &deployments.Items[i])
+		}
+	}
+	var sets appsv1.StatefulSetList
+	if err := r.List(ctx, &sets, client.InNamespace(svc.Namespace)); err != nil {
+		return nil, fmt.Errorf("list statefulsets: %w", err)
+	}
+	for i := range sets.Items {
+		if selector.Matches(labels.Set(sets.Items[i].Spec.Template.Labels)) {
+			found = append(found, &sets.Items[i])
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%w: no Deployment or StatefulSet runs the pods service %s/%s selects", errUnsupported, svc.Namespace, svc.Name)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %d workloads run the pods service %s/%s selects; which to scale is ambiguous",
+			errUnsupported, len(found), svc.Namespace, svc.Name)
+	}
+}
+
+// Scale sets obj's replicas, and reports whether it had to. Already there is
+// not a write.
+func Scale(ctx context.Context, c client.SubResourceClientConstructor, obj client.Object, replicas int32) (bool, error) {
+	var scale autoscalingv1.Scale
+	if err := c.SubResource("scale").Get(ctx, obj, &scale); err != nil {
+		return false, fmt.Errorf("get scale of %s %s: %w", Kind(obj), client.ObjectKeyFromObject(obj), err)
+	}
+	if scale.Spec.Replicas == replicas {
+		return false, nil
+	}
+	scale.Spec.Replicas = replicas
+	if err := c.SubResource("scale").Update(ctx, obj, client.WithSubResourceBody(&scale)); err != nil {
+		return false, fmt.Errorf("scale %s %s to %d: %w", Kind(obj), client.ObjectKeyFromObject(obj), replicas, err)
+	}
+	return true, nil
+}
+
+// ScaleFor sets the replicas of the workload behind svc, on owner's behalf:
+// the Ingress or Gateway whose policy asked. When that was a change it says
+// so on owner with msg, which takes the workload's kind and name and then
+// args. The workload is found through r, the uncached reader Workload wants,
+// and scaled through c.
+func ScaleFor(ctx context.Context, c client.Client, r client.Reader, rec events.EventRecorder, owner client.Object,
+	svc *corev1.Service, replicas int32, msg string, args ...any) error {
+	workload, err := Workload(ctx, r, svc)
+	if err != nil {
+		return err
+	}
+	changed, err := Scale(ctx, c, workload, replicas)
+	if err != nil || !changed {
+		return err
+	}
+	log.FromContext(ctx).Info("scaled backend", "kind", Kind(workload), "name", workload.GetName(),
+		"replicas", replicas)
+	rec.Eventf(owner, workload, consts.EventTypeNormal, consts.ReasonBackendScaled, consts.ActionScale,
+		msg, append([]any{Kind(workload), workload.GetName()}, args...)...)
+	return nil
+}
+
+// Kind names the workload, for messages. Objects from a typed list carry no
+// TypeMeta.
+func Kind(obj client.Object) string {
+	switch obj.(type) {
+	case *appsv1.Deployment:
+		return "Deployment"
+	case *appsv1.StatefulSet:
+		return "StatefulSet"
+	}
+	return fmt.Sprintf("%T", obj)
+}
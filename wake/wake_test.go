@@ -0,0 +1,158 @@
+package wake
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/events"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/scaffoldly/tunnel/consts"
+)
+
+func service(selector map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       corev1.ServiceSpec{Selector: selector},
+	}
+}
+
+func template(labels map[string]string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels}}
+}
+
+func deployment(name string, replicas int32, labels map[string]string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       appsv1.DeploymentSpec{Replicas: ptr.To(replicas), Template: template(labels)},
+	}
+}
+
+func statefulSet(name string, labels map[string]string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       appsv1.StatefulSetSpec{Replicas: ptr.To[int32](1), Template: template(labels)},
+	}
+}
+
+func TestWorkload(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	// A template carrying more labels than the selector asks for still
+	// matches, as its Pods would.
+	webV2 := map[string]string{"app": "web", "version": "v2"}
+	for _, tc := range []struct {
+		name            string
+		svc             *corev1.Service
+		objs            []client.Object
+		want            string
+		wantUnsupported bool
+	}{
+		{
+			name: "a deployment",
+			svc:  service(web),
+			objs: []client.Object{deployment("web", 1, webV2), deployment("api", 1, map[string]string{"app": "api"})},
+			want: "Deployment web",
+		},
+		{
+			name: "a statefulset",
+			svc:  service(web),
+			objs: []client.Object{statefulSet("db", web)},
+			want: "StatefulSet db",
+		},
+		{
+			name:            "no selector",
+			svc:             service(nil),
+			objs:            []client.Object{deployment("web", 1, web)},
+			wantUnsupported: true,
+		},
+		{
+			name:            "nothing matches",
+			svc:             service(web),
+			objs:            []client.Object{deployment("api", 1, map[string]string{"app": "api"})},
+			wantUnsupported: true,
+		},
+		{
+			name:            "two match",
+			svc:             service(web),
+			objs:            []client.Object{deployment("web", 1, web), statefulSet("web-cache", web)},
+			wantUnsupported: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(tc.objs...).Build()
+			got, err := Workload(context.Background(), c, tc.svc)
+			if tc.wantUnsupported {
+				if !errors.Is(err, consts.ErrUnsupported) {
+					t.Errorf("Workload() error = %v, want unsupported", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Workload() error = %v", err)
+			}
+			if name := Kind(got) + " " + got.GetName(); name != tc.want {
+				t.Errorf("Workload() = %s, want %s", name, tc.want)
+			}
+		})
+	}
+}
+
+func TestScale(t *testing.T) {
+	d := deployment("web", 0, map[string]string{"app": "web"})
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(d).Build()
+
+	changed, err := Scale(context.Background(), c, d, 1)
+	if err != nil || !changed {
+		t.Fatalf("Scale(1) = %v, %v; want a change", changed, err)
+	}
+	var got appsv1.Deployment
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(d), &got); err != nil {
+		t.Fatal(err)
+	}
+	if ptr.Deref(got.Spec.Replicas, 0) != 1 {
+		t.Errorf("replicas = %d after Scale(1), want 1", ptr.Deref(got.Spec.Replicas, 0))
+	}
+
+	// Already there is not a write: a scale every resync would fight any
+	// autoscaler that owns the count in between.
+	if changed, err := Scale(context.Background(), c, &got, 1); err != nil || changed {
+		t.Errorf("Scale(1) again = %v, %v; want no change", changed, err)
+	}
+}
+
+// TestScaleForSaysSoOnce: the event goes on the object whose policy asked,
+// naming the workload, and only when the scale was a change.
+func TestScaleForSaysSoOnce(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	d := deployment("web", 1, web)
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(d).Build()
+	recorder := events.NewFakeRecorder(10)
+	owner := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "owner"}}
+
+	for range 2 {
+		if err := ScaleFor(context.Background(), c, c, recorder, owner, service(web), 0, consts.MsgBackendSleptFmt, "10m0s"); err != nil {
+			t.Fatalf("ScaleFor(0) error = %v", err)
+		}
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, consts.ReasonBackendScaled) || !strings.Contains(e, "Deployment web") {
+			t.Errorf("event %q, want %s naming the Deployment", e, consts.ReasonBackendScaled)
+		}
+	default:
+		t.Fatal("no event for a scale that changed the replicas")
+	}
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("scale that changed nothing: unexpected event %q", e)
+	default:
+	}
+}